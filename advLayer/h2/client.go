@@ -0,0 +1,200 @@
+package h2
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// implements advLayer.MuxClient
+type Client struct {
+	Creator
+	Config
+
+	requestHeader  map[string][]string
+	responseHeader map[string][]string
+
+	mutex      sync.Mutex
+	cachedConn *http2.ClientConn //一个 ClientConn 对应 一个提供的 dial好的 tls 连接，正好作为CommonConn。
+}
+
+func (c *Client) GetPath() string {
+	return c.Path
+}
+
+func (c *Client) IsEarly() bool {
+	return false
+}
+
+// 不用 http2.Transport 的 连接池, 因为 其 按 Host 区分 连接, 而 我们 的 Host 是 随机选择的,
+// 会导致 在 同一个 underlay 上 建立 多个 h2 连接
+func (c *Client) GetCommonConn(underlay net.Conn) (any, error) {
+	if underlay == nil {
+		c.mutex.Lock()
+		cc := c.cachedConn
+		c.mutex.Unlock()
+
+		if cc != nil && cc.CanTakeNewRequest() {
+			return cc, nil
+		} else {
+			return nil, errors.New("h2.GetCommonConn: underlay==nil and no usable cachedConn")
+		}
+	} else {
+		return underlay, nil
+	}
+}
+
+func (c *Client) DialSubConn(underlay any) (net.Conn, error) {
+
+	if underlay == nil {
+		return nil, utils.ErrNilParameter
+	}
+
+	var cc *http2.ClientConn
+
+	switch u := underlay.(type) {
+	case *http2.ClientConn:
+		cc = u
+	case net.Conn:
+		var err error
+		cc, err = (&http2.Transport{DisableCompression: true}).NewClientConn(u)
+		if err != nil {
+			return nil, err
+		}
+		c.mutex.Lock()
+		c.cachedConn = cc
+		c.mutex.Unlock()
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "h2.DialSubConn: underlay type wrong", Data: underlay}
+	}
+
+	reader, writer := io.Pipe()
+
+	request := &http.Request{
+		Method: c.Method,
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   c.Hosts[rand.Intn(len(c.Hosts))],
+			Path:   c.Path,
+		},
+		Proto:         "HTTP/2",
+		ProtoMajor:    2,
+		Header:        make(http.Header),
+		Body:          reader,
+		ContentLength: -1,
+	}
+	for k, vs := range httpLayer.TrimHeaders(c.requestHeader) {
+		request.Header.Set(k, vs[0])
+	}
+
+	conn := &ClientConn{
+		client:  c,
+		request: request,
+		cc:      cc,
+		writer:  writer,
+	}
+	conn.InitEasyDeadline()
+
+	go conn.handshakeOnce.Do(conn.handshake) //handshake 要等到 服务端 响应 才返回, 所以 用 goroutine
+
+	return conn, nil
+}
+
+// implements net.Conn
+type ClientConn struct {
+	netLayer.EasyDeadline
+
+	client *Client
+
+	request *http.Request
+	cc      *http2.ClientConn
+	writer  *io.PipeWriter
+
+	handshakeOnce sync.Once
+	response      *http.Response
+	err           error
+
+	closeOnce sync.Once
+}
+
+func (c *ClientConn) LocalAddr() net.Addr  { return nil }
+func (c *ClientConn) RemoteAddr() net.Addr { return nil }
+
+func (c *ClientConn) handshake() {
+	response, err := c.cc.RoundTrip(c.request)
+	if err != nil {
+		c.err = err
+		c.writer.CloseWithError(err)
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		c.err = utils.ErrInErr{ErrDesc: "h2 Client got wrong status", Data: response.Status}
+
+	} else if len(c.client.responseHeader) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(c.client.responseHeader, response.Header); !ok {
+			if ce := utils.CanLogWarn("h2 Client configured custom header, but the server response doesn't have all of them"); ce != nil {
+				ce.Write(zap.String("firstNotMatchKey", firstNotMatchKey))
+			}
+			c.err = utils.ErrInErr{ErrDesc: "h2 response header not match", Data: firstNotMatchKey}
+		}
+	}
+
+	if c.err != nil {
+		response.Body.Close()
+		c.writer.CloseWithError(c.err)
+		return
+	}
+	c.response = response
+}
+
+func (c *ClientConn) Read(b []byte) (n int, err error) {
+	c.handshakeOnce.Do(c.handshake)
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	select {
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return c.response.Body.Read(b)
+	}
+}
+
+func (c *ClientConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		//握手 失败 时 pipe 会被 CloseWithError, 这里 会 得到 该错误
+		return c.writer.Write(b)
+	}
+}
+
+func (c *ClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writer.Close()
+
+		//还没 得到 响应 时 关闭, 让 handshake 中的 RoundTrip 结束 后 关闭 响应
+		go func() {
+			c.handshakeOnce.Do(c.handshake)
+			if c.response != nil {
+				c.response.Body.Close()
+			}
+		}()
+	})
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+Package h2 implements plain http/2 transport for advLayer, compatible with v2ray's "http" transport.
+
+每一条 子连接 是 一个 h2 请求: 请求体 为 客户端 发出的 原始数据流, 响应体 为 服务端 发出的 原始数据流.
+与 grpc 不同, 数据 不经过 任何 分帧 包装. 所有 子连接 都在 同一个 tls 连接 上 多路复用.
+
+# Config
+
+path 为 请求路径, 默认为 "/".
+
+Extra:
+
+	hosts: 字符串数组, 客户端 每次 随机选择 一个 作为 请求的 Host; 服务端 只接受 Host 在 其中的 请求.
+	不给出时 客户端 使用 host 项, 服务端 不检查 Host.
+
+	method: 请求方法, 默认为 "PUT", 与 v2ray 相同.
+
+自定义 header 通过 HeaderPreset 配置, 服务端 检查 请求头, 客户端 检查 响应头.
+
+# Fallback
+
+与 grpcSimple 一样, 不是 h2c 的 连接 按 http1.1 回落; Host/path/method/header 不符合 的 h2 请求 以 FallbackMeta.IsH2 回落.
+*/
+package h2
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+)
+
+func init() {
+	advLayer.ProtocolsMap["h2"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) PackageID() string {
+	return "h2"
+}
+
+func (Creator) ProtocolName() string {
+	return "h2"
+}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return "h2", true
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
+
+func (Creator) IsMux() bool {
+	return true
+}
+
+type Config struct {
+	Path   string
+	Hosts  []string
+	Method string
+}
+
+func getConfig(conf *advLayer.Conf) (c Config) {
+	c.Path = conf.Path
+	if c.Path == "" {
+		c.Path = "/"
+	} else if !strings.HasPrefix(c.Path, "/") {
+		c.Path = "/" + c.Path
+	}
+
+	c.Method = http.MethodPut
+
+	if len(conf.Extra) == 0 {
+		return
+	}
+
+	switch hosts := conf.Extra["hosts"].(type) {
+	case string:
+		for _, h := range strings.Split(hosts, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				c.Hosts = append(c.Hosts, h)
+			}
+		}
+	case []string:
+		c.Hosts = hosts
+	case []any:
+		for _, h := range hosts {
+			if str, ok := h.(string); ok && str != "" {
+				c.Hosts = append(c.Hosts, str)
+			}
+		}
+	}
+
+	if m, ok := conf.Extra["method"].(string); ok && m != "" {
+		c.Method = strings.ToUpper(m)
+	}
+	return
+}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	c := &Client{
+		Config: getConfig(conf),
+	}
+	if len(c.Hosts) == 0 {
+		c.Hosts = []string{conf.Host}
+	}
+
+	if conf.Headers != nil && conf.Headers.Request != nil && len(conf.Headers.Request.Headers) > 0 {
+		c.requestHeader = conf.Headers.Request.Headers
+	}
+	if conf.Headers != nil && conf.Headers.Response != nil && len(conf.Headers.Response.Headers) > 0 {
+		c.responseHeader = conf.Headers.Response.Headers
+	}
+	return c, nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return &Server{
+		Config:  getConfig(conf),
+		Headers: conf.Headers,
+	}, nil
+}
@@ -0,0 +1,133 @@
+package h2_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/advLayer/h2"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"golang.org/x/net/http2"
+)
+
+func TestH2(t *testing.T) {
+	listenAddr := netLayer.GetRandLocalAddr(true, false)
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	headers := &httpLayer.HeaderPreset{
+		Request:  &httpLayer.RequestHeader{Headers: map[string][]string{"X-Req": {"a", "b"}}},
+		Response: &httpLayer.ResponseHeader{Headers: map[string][]string{"X-Resp": {"c"}}},
+	}
+	conf := &advLayer.Conf{
+		Path:    "/h2path",
+		Headers: headers,
+		Extra:   map[string]any{"hosts": []any{"a.example.com", "b.example.com"}},
+	}
+
+	as, err := h2.Creator{}.NewServerFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := as.(*h2.Server)
+	defer server.Stop()
+
+	fallbackGot := make(chan httpLayer.FallbackMeta, 1)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.StartHandle(conn, func(sc net.Conn) {
+				io.Copy(sc, sc)
+				sc.Close()
+			}, func(fm httpLayer.FallbackMeta) {
+				if fm.IsH2 {
+					fm.H2RW.WriteHeader(http.StatusTeapot)
+				}
+				fallbackGot <- fm
+			})
+		}
+	}()
+
+	ac, err := h2.Creator{}.NewClientFromConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ac.(advLayer.MuxClient)
+
+	tcpConn, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	commonConn, err := client.GetCommonConn(tcpConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		sub, err := client.DialSubConn(commonConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commonConn, _ = client.GetCommonConn(nil)
+
+		go func() {
+			defer sub.Close()
+
+			data := make([]byte, 200*1024)
+			rand.Read(data)
+			go sub.Write(data)
+
+			got := make([]byte, len(data))
+			sub.SetReadDeadline(time.Now().Add(time.Second * 10))
+			if _, err := io.ReadFull(sub, got); err != nil {
+				done <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				done <- io.ErrUnexpectedEOF
+				return
+			}
+			done <- nil
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//host, method, header 不对 时 回落
+	cc := commonConn.(*http2.ClientConn)
+	for _, rq := range []*http.Request{
+		{Method: http.MethodPut, Host: "c.example.com", Header: http.Header{"X-Req": {"a"}}},
+		{Method: http.MethodPost, Host: "a.example.com", Header: http.Header{"X-Req": {"a"}}},
+		{Method: http.MethodPut, Host: "a.example.com", Header: http.Header{"X-Req": {"d"}}},
+	} {
+		rq.URL = &url.URL{Scheme: "https", Host: rq.Host, Path: "/h2path"}
+		resp, err := cc.RoundTrip(rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if fm := <-fallbackGot; resp.StatusCode != http.StatusTeapot || !fm.IsH2 {
+			t.Fatal("h2 fallback failed", rq.Method, rq.Host, resp.StatusCode)
+		}
+	}
+}
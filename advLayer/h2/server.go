@@ -0,0 +1,306 @@
+package h2
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+var clientPreface = []byte(http2.ClientPreface)
+
+// implements advLayer.MuxServer
+type Server struct {
+	Creator
+	Config
+	http2.Server
+	netLayer.ConnList
+
+	Headers *httpLayer.HeaderPreset
+
+	closed atomic.Bool
+}
+
+func (s *Server) GetPath() string {
+	return s.Path
+}
+
+func (s *Server) Stop() {
+	if s.closed.Swap(true) {
+		return
+	}
+	s.CloseDeleteAll()
+}
+
+func (s *Server) isValidHost(host string) bool {
+	if len(s.Hosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range s.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// 阻塞
+func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	s.closed.Store(false)
+
+	oldUnderlay := underlay
+
+	s.Insert(oldUnderlay)
+
+	//先过滤一下h2c 的 preface. 因为不是h2c的话，依然可以试图回落到 h1.
+
+	bs := utils.GetPacket()
+	netLayer.SetCommonReadTimeout(underlay)
+
+	var notH2c bool
+	n, err := underlay.Read(bs)
+	if err != nil {
+		if ce := utils.CanLogDebug("h2 try read preface failed"); ce != nil {
+			ce.Write()
+		}
+		s.CloseDelete(oldUnderlay)
+		return
+
+	} else if n < len(clientPreface) || !bytes.Equal(bs[:len(clientPreface)], clientPreface) {
+		notH2c = true
+	}
+
+	netLayer.PersistConn(underlay)
+
+	firstBuf := bytes.NewBuffer(bs[:n])
+
+	if notH2c {
+		if ce := utils.CanLogInfo("h2 got not h2c request"); ce != nil {
+			ce.Write()
+		}
+		s.Delete(oldUnderlay)
+
+		if fallbackFunc != nil {
+			_, method, path, _, failreason := httpLayer.ParseH1Request(bs, false)
+			if failreason != 0 {
+				go fallbackFunc(httpLayer.FallbackMeta{
+					Conn:         underlay,
+					H1RequestBuf: firstBuf,
+				})
+			} else {
+				go fallbackFunc(httpLayer.FallbackMeta{
+					Path:         path,
+					Method:       method,
+					Conn:         underlay,
+					H1RequestBuf: firstBuf,
+				})
+			}
+		} else {
+			underlay.Write([]byte(httpLayer.Err403response))
+			underlay.Close()
+		}
+		return
+	}
+
+	underlay = &netLayer.ReadWrapper{
+		Conn:              underlay,
+		OptionalReader:    io.MultiReader(firstBuf, underlay),
+		RemainFirstBufLen: n,
+	}
+
+	//阻塞
+	s.Server.ServeConn(underlay, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			if s.closed.Load() {
+				return
+			}
+			s.handle(rw, rq, newSubConnFunc, fallbackFunc)
+		}),
+	})
+
+	s.CloseDelete(oldUnderlay)
+}
+
+func (s *Server) handle(rw http.ResponseWriter, rq *http.Request, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	p := rq.URL.Path
+
+	shouldFallback := false
+
+	if p != s.Path || rq.Method != s.Method || !s.isValidHost(rq.Host) {
+		if ce := utils.CanLogWarn("h2 Server got wrong path, method or host"); ce != nil {
+			ce.Write(zap.String("path", p), zap.String("method", rq.Method), zap.String("host", rq.Host))
+		}
+		shouldFallback = true
+
+	} else if s.Headers != nil && s.Headers.Request != nil && len(s.Headers.Request.Headers) > 0 {
+		if ok, fnmk := httpLayer.AllHeadersIn(s.Headers.Request.Headers, rq.Header); !ok {
+			if ce := utils.CanLogWarn("h2 Server has custom header configured, but the client request have notMatched Header(s)"); ce != nil {
+				ce.Write(zap.String("firstNotMatchKey", fnmk))
+			}
+			shouldFallback = true
+		}
+	}
+
+	if shouldFallback {
+		if fallbackFunc == nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if ce := utils.CanLogInfo("h2 will fallback"); ce != nil {
+			ce.Write(
+				zap.String("path", p),
+				zap.String("method", rq.Method),
+				zap.String("raddr", rq.RemoteAddr))
+		}
+
+		fallbackFunc(httpLayer.FallbackMeta{
+			Path:   p,
+			Method: rq.Method,
+			Conn: &netLayer.IOWrapper{
+				Reader:   rq.Body,
+				Writer:   rw,
+				Rejecter: httpLayer.RejectConn{ResponseWriter: rw},
+			},
+			IsH2:      true,
+			H2Request: rq,
+			H2RW:      rw,
+		})
+		return
+	}
+
+	headerMap := rw.Header()
+	headerMap.Set("Cache-Control", "no-store") //同 v2ray
+	if s.Headers != nil && s.Headers.Response != nil && len(s.Headers.Response.Headers) > 0 {
+		for k, vs := range httpLayer.TrimHeaders(s.Headers.Response.Headers) {
+			headerMap.Add(k, vs[0])
+		}
+	}
+	rw.WriteHeader(http.StatusOK)
+	if flusher, ok := rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	sc := &ServerConn{
+		Reader: rq.Body,
+		Closer: rq.Body,
+		rw:     rw,
+		ra:     getRemoteAddr(rq),
+		done:   make(chan struct{}),
+	}
+	sc.InitEasyDeadline()
+
+	if s.closed.Load() {
+		sc.Close()
+		return
+	}
+
+	newSubConnFunc(sc)
+
+	//handler 返回后 rw 不可再用, 所以 要等到 子连接 关闭
+	select {
+	case <-sc.done:
+	case <-rq.Context().Done():
+		sc.Close()
+	}
+}
+
+func getRemoteAddr(rq *http.Request) net.Addr {
+	if xffs := rq.Header.Values(httpLayer.XForwardStr); len(xffs) > 0 {
+		xff := strings.TrimSpace(strings.SplitN(xffs[0], ",", 2)[0])
+		ta, e := net.ResolveIPAddr("ip", xff)
+		if e == nil {
+			return ta
+		}
+		if ce := utils.CanLogWarn("Failed in h2 parse X-Forwarded-For"); ce != nil {
+			ce.Write(zap.Error(e), zap.Any(httpLayer.XForwardStr, xffs))
+		}
+	}
+	ta, e := net.ResolveTCPAddr("tcp", rq.RemoteAddr)
+	if e == nil {
+		return ta
+	}
+	return nil
+}
+
+// implements net.Conn
+type ServerConn struct {
+	netLayer.EasyDeadline
+	io.Reader
+	io.Closer
+
+	rw http.ResponseWriter
+	ra net.Addr
+
+	writeMutex sync.Mutex
+	closed     bool
+	closeOnce  sync.Once
+	done       chan struct{}
+}
+
+// implements netLayer.RejectConn, return true
+func (*ServerConn) HasOwnDefaultRejectBehavior() bool {
+	return true
+}
+
+// implements netLayer.RejectConn, 模仿nginx响应，参考 httpLayer.SetNginx400Response
+func (sc *ServerConn) Reject() {
+	httpLayer.SetNginx400Response(sc.rw)
+}
+
+func (sc *ServerConn) LocalAddr() net.Addr  { return nil }
+func (sc *ServerConn) RemoteAddr() net.Addr { return sc.ra }
+
+func (sc *ServerConn) Read(p []byte) (int, error) {
+	select {
+	case <-sc.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return sc.Reader.Read(p)
+	}
+}
+
+func (sc *ServerConn) Write(p []byte) (n int, err error) {
+	select {
+	case <-sc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+
+	//handler 返回后 调用 rw 会 panic
+	if sc.closed {
+		return 0, net.ErrClosed
+	}
+	n, err = sc.rw.Write(p)
+	if err == nil {
+		sc.rw.(http.Flusher).Flush()
+	}
+	return
+}
+
+func (sc *ServerConn) Close() error {
+	sc.closeOnce.Do(func() {
+		sc.writeMutex.Lock()
+		sc.closed = true
+		sc.writeMutex.Unlock()
+
+		sc.Closer.Close()
+		close(sc.done)
+	})
+	return nil
+}
@@ -0,0 +1,201 @@
+package httpupgrade
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// implements advLayer.SingleClient
+type Client struct {
+	Creator
+	host         string
+	path         string
+	UseEarlyData bool
+
+	headers *httpLayer.HeaderPreset
+}
+
+// 这里默认，传入的path必须 以 "/" 为前缀. 若path为空，本函数 将自动使用 "/"
+func NewClient(hostAddr, path string, headers *httpLayer.HeaderPreset, isEarly bool) (*Client, error) {
+	if path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, utils.ErrInErr{ErrDesc: "httpupgrade path must start with /", Data: path}
+	}
+	return &Client{
+		host:         hostAddr,
+		path:         path,
+		headers:      headers,
+		UseEarlyData: isEarly,
+	}, nil
+}
+
+func (*Client) GetCreator() advLayer.Creator {
+	return Creator{}
+}
+
+func (c *Client) GetPath() string {
+	return c.path
+}
+
+func (c *Client) IsEarly() bool {
+	return c.UseEarlyData
+}
+
+// 与服务端进行 http upgrade 握手，并返回 可直接读写 原始数据 的 net.Conn
+func (c *Client) Handshake(underlay net.Conn, firstPayloadLen int) (net.Conn, error) {
+	if c.IsEarly() && firstPayloadLen > 0 && firstPayloadLen <= MaxEarlyDataLen {
+		// 同 ws, 等到 内层协议 写入 包头 时 再 握手
+		return &EarlyDataConn{
+			Conn:         underlay,
+			client:       c,
+			firstWritten: make(chan struct{}),
+		}, nil
+	}
+
+	if err := c.writeRequest(underlay, nil); err != nil {
+		return nil, err
+	}
+	return c.readResponse(underlay)
+}
+
+func (c *Client) writeRequest(underlay net.Conn, earlyData []byte) error {
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	buf.WriteString("GET ")
+	buf.WriteString(c.path)
+	buf.WriteString(" HTTP/1.1\r\nHost: ")
+	buf.WriteString(c.host)
+	buf.WriteString("\r\nConnection: Upgrade\r\nUpgrade: ")
+	buf.WriteString(upgradeValue)
+	buf.WriteString("\r\n")
+
+	if c.headers != nil && c.headers.Request != nil && len(c.headers.Request.Headers) > 0 {
+		for k, vs := range httpLayer.TrimHeaders(c.headers.Request.Headers) {
+			switch http.CanonicalHeaderKey(k) {
+			case "Host", "Connection", "Upgrade", earlyDataHeader:
+				continue
+			}
+			buf.WriteString(k)
+			buf.WriteString(": ")
+			buf.WriteString(vs[0])
+			buf.WriteString("\r\n")
+		}
+	}
+
+	if len(earlyData) > 0 {
+		buf.WriteString(earlyDataHeader)
+		buf.WriteString(": ")
+		buf.WriteString(base64.RawURLEncoding.EncodeToString(earlyData))
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	_, err := underlay.Write(buf.Bytes())
+	return err
+}
+
+func (c *Client) readResponse(underlay net.Conn) (net.Conn, error) {
+	br := bufio.NewReader(underlay)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade read response", ErrDetail: err}
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), upgradeValue) {
+		return nil, utils.ErrInErr{ErrDesc: "httpupgrade got wrong response", Data: resp.Status}
+	}
+
+	if c.headers != nil && c.headers.Response != nil && len(c.headers.Response.Headers) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(c.headers.Response.Headers, resp.Header); !ok {
+			if ce := utils.CanLogWarn("httpupgrade Client configured custom header, but the server response doesn't have all of them"); ce != nil {
+				ce.Write(zap.String("firstNotMatchKey", firstNotMatchKey))
+			}
+			return nil, utils.ErrInErr{ErrDesc: "httpupgrade response header not match", Data: firstNotMatchKey}
+		}
+	}
+
+	//服务器 可能 紧接着 发送了 数据, 从 bufio.Reader 中 取出
+	var rest []byte
+	if n := br.Buffered(); n > 0 {
+		bs, _ := br.Peek(n)
+		rest = append([]byte(nil), bs...)
+	}
+	return wrapConn(underlay, rest, nil), nil
+}
+
+type EarlyDataConn struct {
+	net.Conn
+	client *Client
+
+	firstWriteOnce sync.Once
+	firstWritten   chan struct{}
+	handshakeErr   error
+
+	realConn net.Conn //只在 Read 中 使用
+}
+
+// 第一次 Write 会 把 内层协议 的 包头 作为 earlydata 放在 握手请求 中
+func (edc *EarlyDataConn) Write(p []byte) (n int, err error) {
+	first := false
+	edc.firstWriteOnce.Do(func() {
+		first = true
+
+		if len(p) <= MaxEarlyDataLen {
+			err = edc.client.writeRequest(edc.Conn, p)
+		} else {
+			err = edc.client.writeRequest(edc.Conn, nil)
+			if err == nil {
+				_, err = edc.Conn.Write(p)
+			}
+		}
+		edc.handshakeErr = err
+		close(edc.firstWritten)
+	})
+	if first {
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	return edc.Conn.Write(p)
+}
+
+func (edc *EarlyDataConn) Read(p []byte) (int, error) {
+	if edc.realConn == nil {
+		<-edc.firstWritten
+		if edc.handshakeErr != nil {
+			return 0, errors.New("failed in httpupgrade EarlyDataConn read because handshake failed")
+		}
+		rc, err := edc.client.readResponse(edc.Conn)
+		if err != nil {
+			return 0, err
+		}
+		edc.realConn = rc
+	}
+	return edc.realConn.Read(p)
+}
+
+// 让 firstWritten 之前 被关闭 的 Read 能够 返回
+func (edc *EarlyDataConn) Close() error {
+	edc.firstWriteOnce.Do(func() {
+		edc.handshakeErr = io.ErrClosedPipe
+		close(edc.firstWritten)
+	})
+	return edc.Conn.Close()
+}
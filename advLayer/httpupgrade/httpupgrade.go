@@ -0,0 +1,127 @@
+/*
+Package httpupgrade implements http upgrade for advLayer.
+
+httpupgrade 与 ws 的握手 一样, 是 http1.1 的 Upgrade 请求, 服务端 返回 101 后, 连接 直接 作为 原始的 数据流 使用,
+不再 有 websocket 的 分帧 与 掩码. 与 xray 的 httpupgrade 兼容.
+
+一些 cdn 会 解析/改写 websocket 的帧, 或者 限制 ws, 而 只要求 Upgrade 握手 的 话 一般 都能通过.
+没有 分帧 还 可以 节省 一些 性能, 且 可以 使用 splice.
+
+Below is a handshake:
+
+Request
+
+	GET /path HTTP/1.1
+	Host: server.example.com
+	Connection: Upgrade
+	Upgrade: websocket
+
+Response
+
+	HTTP/1.1 101 Switching Protocols
+	Connection: Upgrade
+	Upgrade: websocket
+
+# Early Data
+
+与 ws 一样, 用 Sec-WebSocket-Protocol 传输 base64 RawURLEncoding 编码 的 earlydata.
+
+# Fallback
+
+不符合 的 http1.1 请求 会 返回 httpLayer.FallbackMeta 和 httpLayer.ErrShouldFallback.
+*/
+package httpupgrade
+
+import (
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+)
+
+const MaxEarlyDataLen = 2048
+
+const MaxEarlyDataLen_Base64 = 2732
+
+const (
+	earlyDataHeader = "Sec-WebSocket-Protocol"
+	upgradeValue    = "websocket"
+)
+
+func init() {
+	advLayer.ProtocolsMap["httpupgrade"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	hn := conf.Host
+	if conf.Addr.Network == "unix" {
+		hn = ""
+	}
+	return NewClient(hn, conf.Path, conf.Headers, conf.IsEarly)
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return NewServer(conf.Path, conf.Headers, conf.IsEarly), nil
+}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return
+}
+
+func (Creator) PackageID() string {
+	return "httpupgrade"
+}
+
+func (Creator) ProtocolName() string {
+	return "httpupgrade"
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsMux() bool {
+	return false
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
+
+// 握手后 直接读写 原始流. 握手时 多读到的数据 以及 earlydata 会 先被读出;
+// 服务端 可从 X-Forwarded-For 读取 用户真实ip
+type Conn struct {
+	net.Conn
+
+	firstBuf  []byte
+	realRaddr net.Addr
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.firstBuf) > 0 {
+		n := copy(p, c.firstBuf)
+		c.firstBuf = c.firstBuf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.realRaddr != nil {
+		return c.realRaddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// 没有 需要 额外处理的 东西 时 直接返回 underlay
+func wrapConn(underlay net.Conn, firstBuf []byte, realRaddr net.Addr) net.Conn {
+	if len(firstBuf) == 0 && realRaddr == nil {
+		return underlay
+	}
+	return &Conn{
+		Conn:      underlay,
+		firstBuf:  firstBuf,
+		realRaddr: realRaddr,
+	}
+}
@@ -0,0 +1,119 @@
+package httpupgrade_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer/httpupgrade"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+func TestHttpUpgrade(t *testing.T) {
+	testHttpUpgrade(t, false)
+}
+
+func TestHttpUpgradeEarlyData(t *testing.T) {
+	testHttpUpgrade(t, true)
+}
+
+func testHttpUpgrade(t *testing.T, early bool) {
+	listenAddr := netLayer.GetRandLocalAddr(true, false)
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	thePath := "/thepath"
+	headers := &httpLayer.HeaderPreset{
+		Request:  &httpLayer.RequestHeader{Headers: map[string][]string{"X-Test": {"1"}}},
+		Response: &httpLayer.ResponseHeader{Headers: map[string][]string{"X-Resp": {"2"}}},
+	}
+
+	bigBytes := make([]byte, 10240)
+	rand.Reader.Read(bigBytes)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		s := httpupgrade.NewServer(thePath, headers, early)
+
+		huConn, err := s.Handshake(conn)
+		if err != nil {
+			t.Log(err)
+			t.Fail()
+			return
+		}
+		bs := make([]byte, 5)
+		if _, err = io.ReadFull(huConn, bs); err != nil || string(bs) != "hello" {
+			t.Log("server got", string(bs), err)
+			t.Fail()
+			return
+		}
+		huConn.Write(bigBytes)
+	}()
+
+	cli, err := httpupgrade.NewClient(listenAddr, thePath, headers, early)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpConn, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	firstLen := 0
+	if early {
+		firstLen = 5
+	}
+	huConn, err := cli.Handshake(tcpConn, firstLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := huConn.(*httpupgrade.EarlyDataConn); ok != early {
+		t.Fatal("early data conn expected", early)
+	}
+	if _, err = huConn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	bs := make([]byte, len(bigBytes))
+	if _, err = io.ReadFull(huConn, bs); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, bigBytes) {
+		t.Fatal("not equal")
+	}
+}
+
+func TestHttpUpgradeFallback(t *testing.T) {
+	s := httpupgrade.NewServer("/thepath", nil, false)
+
+	for _, req := range []string{
+		"GET /wrong HTTP/1.1\r\nHost: a.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+		"POST /thepath HTTP/1.1\r\nHost: a.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+		"GET /thepath HTTP/1.1\r\nHost: a.com\r\n\r\n",
+	} {
+		c1, c2 := net.Pipe()
+		go c1.Write([]byte(req))
+
+		result, err := s.Handshake(c2)
+		if !errors.Is(err, httpLayer.ErrShouldFallback) {
+			t.Fatal("should fallback", req, err)
+		}
+		meta := result.(httpLayer.FallbackMeta)
+		if meta.H1RequestBuf.String() != req {
+			t.Fatal("fallback buffer should be the whole request", meta.H1RequestBuf.String())
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,178 @@
+package httpupgrade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// implements advLayer.SingleServer
+type Server struct {
+	Creator
+	UseEarlyData bool
+	Thepath      string
+
+	requestHeaders map[string][]string
+	responseHeader map[string][]string
+}
+
+// 这里默认: 传入的path必须 以 "/" 为前缀. 若path为空，本函数 将自动使用 "/"
+func NewServer(path string, headers *httpLayer.HeaderPreset, UseEarlyData bool) *Server {
+	if path == "" {
+		path = "/"
+	}
+	s := &Server{
+		Thepath:      path,
+		UseEarlyData: UseEarlyData,
+	}
+	if headers != nil {
+		if headers.Request != nil && len(headers.Request.Headers) > 0 {
+			s.requestHeaders = make(map[string][]string)
+			for k, vs := range headers.Request.Headers {
+				switch http.CanonicalHeaderKey(k) {
+				case "Host", "Connection", "Upgrade", earlyDataHeader:
+					continue
+				}
+				s.requestHeaders[k] = vs
+			}
+		}
+		if headers.Response != nil && len(headers.Response.Headers) > 0 {
+			s.responseHeader = headers.Response.Headers
+		}
+	}
+	return s
+}
+
+func (*Server) GetCreator() advLayer.Creator {
+	return Creator{}
+}
+
+func (s *Server) GetPath() string {
+	return s.Thepath
+}
+
+func (*Server) Stop() {}
+
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handshake 检查 http1.1 的 Upgrade 请求, 返回 101 后 连接 直接作为 原始数据流.
+//
+// 如果遇到不符合的http1.1请求，会返回 httpLayer.FallbackMeta 和 httpLayer.ErrShouldFallback
+func (s *Server) Handshake(underlay net.Conn) (net.Conn, error) {
+
+	var rp httpLayer.H1RequestParser
+	re := rp.ReadAndParse_2(underlay)
+	if re != nil {
+		if errors.Is(re, httpLayer.ErrNotHTTP_Request) {
+			return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade check parse http", ErrDetail: re, ExtraIs: []error{httpLayer.ErrNotHTTP_Request}, Data: rp.Failreason}
+		}
+		return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade check handshake read", ErrDetail: re}
+	}
+
+	var realAddr net.Addr
+
+	fallback := func(reason string) (net.Conn, error) {
+		return httpLayer.FallbackMeta{
+			Conn:         underlay,
+			H1RequestBuf: rp.WholeRequestBuf,
+			Path:         rp.Path,
+			Method:       rp.Method,
+			Reason:       reason,
+			XFF:          realAddr,
+		}, httpLayer.ErrShouldFallback
+	}
+
+	if rp.Method != "GET" || rp.Path != s.Thepath {
+		return fallback(`rp.Method != "GET" || s.Thepath != rp.Path`)
+	}
+
+	// ReadAndParse_2 已经确认 读到了 完整的 头部, 所以 这里 不会 再从 underlay 读取
+	whole := rp.WholeRequestBuf.Bytes()
+	br := bufio.NewReaderSize(bytes.NewReader(whole), len(whole))
+	rq, err := http.ReadRequest(br)
+	if err != nil {
+		return fallback(err.Error())
+	}
+
+	if xffs := rq.Header.Get(httpLayer.XForwardStr); xffs != "" {
+		xff := strings.TrimSpace(strings.SplitN(xffs, ",", 2)[0])
+		ta, e := net.ResolveIPAddr("ip", xff)
+		if e == nil {
+			realAddr = ta
+		} else if ce := utils.CanLogWarn("Failed in httpupgrade parse X-Forwarded-For"); ce != nil {
+			ce.Write(zap.Error(e), zap.String(httpLayer.XForwardStr, xffs))
+		}
+	}
+
+	if !headerHasToken(rq.Header, "Connection", "upgrade") || rq.Header.Get("Upgrade") == "" {
+		return fallback("has no upgrade field")
+	}
+
+	if len(s.requestHeaders) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(s.requestHeaders, rq.Header); !ok {
+			if ce := utils.CanLogWarn("httpupgrade headers not match"); ce != nil {
+				ce.Write(zap.String("firstNotMatchKey", firstNotMatchKey))
+			}
+			return fallback("headers not match")
+		}
+	}
+
+	var firstBuf []byte
+
+	if s.UseEarlyData {
+		if ed := rq.Header.Get(earlyDataHeader); ed != "" {
+			if len(ed) > MaxEarlyDataLen_Base64 {
+				return fallback("early data too long")
+			}
+			firstBuf, err = base64.RawURLEncoding.DecodeString(ed)
+			if err != nil {
+				return fallback("early data not base64")
+			}
+		}
+	}
+
+	// 客户端 可能 在 请求头 后 紧接着 发送了 数据
+	rest, _ := io.ReadAll(br)
+	firstBuf = append(firstBuf, rest...)
+
+	resp := utils.GetBuf()
+	defer utils.PutBuf(resp)
+
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: ")
+	resp.WriteString(rq.Header.Get("Upgrade"))
+	resp.WriteString("\r\n")
+	if len(s.responseHeader) > 0 {
+		for k, vs := range httpLayer.TrimHeaders(s.responseHeader) {
+			resp.WriteString(k)
+			resp.WriteString(": ")
+			resp.WriteString(vs[0])
+			resp.WriteString("\r\n")
+		}
+	}
+	resp.WriteString("\r\n")
+
+	if _, err = underlay.Write(resp.Bytes()); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "Failed in httpupgrade write response", ErrDetail: err}
+	}
+
+	return wrapConn(underlay, firstBuf, realAddr), nil
+}
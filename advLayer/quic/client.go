@@ -45,6 +45,34 @@ func NewClient(addr *netLayer.Addr, tConf tls.Config, args arguments) *Client {
 	}
 }
 
+// NewProxyClient 返回 一个 供 代理协议 自己拨号 使用的 Client, 通过 GetCommonConn 和 DialSubConn 复用 其 连接池.
+//
+// 每个 新拨号的 连接 都会 经过 newConnFunc (可为nil), 代理协议 可在其中 认证 或 包装 该连接;
+// 返回 错误 时 该连接 会被 关闭. 包装后的 连接 可 通过 UnderlayConn 取出.
+func NewProxyClient(addr *netLayer.Addr, tConf *tls.Config, pc ProxyConf, newConnFunc func(quic.Connection) (quic.Connection, error)) *Client {
+	args := pc.toArguments()
+	args.newConnFunc = newConnFunc
+	return NewClient(addr, *tConf, args)
+}
+
+// UnderlayConn 返回 GetCommonConn 所返回的 值 中的 quic.Connection, 供 需要 datagram 或 单向流 的 代理协议 使用.
+func UnderlayConn(thing any) quic.Connection {
+	if theState, ok := thing.(*connState); ok && theState != nil {
+		return theState.Connection
+	}
+	return nil
+}
+
+// 关闭 所有 已拨号的 连接
+func (c *Client) CloseConns() {
+	c.connMapMutex.Lock()
+	for id, thisState := range c.clientconns {
+		thisState.CloseWithError(0, "")
+		delete(c.clientconns, id)
+	}
+	c.connMapMutex.Unlock()
+}
+
 //trimBadConns removes non-Active sessions, and try to pick and return the best session for a new stream
 func (c *Client) trimBadConns() (bestConn *connState) {
 
@@ -134,21 +162,24 @@ func (c *Client) getCommonConn(_ net.Conn) (*connState, error) {
 		return nil, err
 	}
 
+	thisConfig := common_DialConfig
+	thisConfig.EnableDatagrams = c.enableDatagrams
+
 	if c.early {
 		utils.Debug("quic Dialing Early")
 		//conn, err = quic.DialAddrEarly(c.serverAddrStr, &c.tlsConf, &common_DialConfig)
-		conn, err = quic.DialEarly(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &common_DialConfig)
+		conn, err = quic.DialEarly(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &thisConfig)
 
 	} else {
 
 		utils.Debug("quic Dialing Connection")
 		//conn, err = quic.DialAddr(c.serverAddrStr, &c.tlsConf, &common_DialConfig)
-		conn, err = quic.Dial(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &common_DialConfig)
+		conn, err = quic.Dial(udpConn, rudpAddr, c.serverAddrStr, &c.tlsConf, &thisConfig)
 
 	}
 
 	if err != nil {
-
+		udpConn.Close()
 		return nil, err
 	}
 
@@ -165,6 +196,15 @@ func (c *Client) getCommonConn(_ net.Conn) (*connState, error) {
 		}
 	}
 
+	if c.newConnFunc != nil {
+		wrapped, err := c.newConnFunc(conn)
+		if err != nil {
+			conn.CloseWithError(0, "")
+			return nil, err
+		}
+		conn = wrapped
+	}
+
 	id := utils.GenerateUUID()
 
 	var result = &connState{Connection: conn, id: id}
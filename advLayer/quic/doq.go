@@ -0,0 +1,123 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/miekg/dns"
+)
+
+// DNS over QUIC, rfc9250. 每个 dns请求 使用 一个新的 双向stream, 消息前 有2字节长度, 且 id 必须为0.
+func init() {
+	netLayer.NewDoQExchanger = newDoQExchanger
+}
+
+// DoQ 的 alpn, 见 rfc9250 4.1.1
+const DoQAlpn = "doq"
+
+type doqExchanger struct {
+	addr    string
+	tlsConf *tls.Config
+
+	mutex sync.Mutex
+	conn  quic.Connection
+}
+
+func newDoQExchanger(addr *netLayer.Addr, serverName string) (netLayer.DnsExchanger, error) {
+	return &doqExchanger{
+		addr: addr.String(),
+		tlsConf: &tls.Config{
+			ServerName: serverName,
+			NextProtos: []string{DoQAlpn},
+		},
+	}, nil
+}
+
+// 返回 一个活跃的 Connection, 若没有 则 重新拨号
+func (d *doqExchanger) getConn() (quic.Connection, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.conn != nil && isActive(d.conn) {
+		return d.conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), netLayer.DnsTimeout)
+	defer cancel()
+
+	conn, err := quic.DialAddrContext(ctx, d.addr, d.tlsConf, &common_DialConfig)
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+func (d *doqExchanger) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	id := m.Id
+	m.Id = 0
+	bs, err := m.Pack()
+	m.Id = id
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), netLayer.DnsTimeout)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream.SetDeadline(time.Now().Add(netLayer.DnsTimeout))
+
+	buf := make([]byte, 2+len(bs))
+	binary.BigEndian.PutUint16(buf, uint16(len(bs)))
+	copy(buf[2:], bs)
+
+	if _, err = stream.Write(buf); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+
+	//rfc9250 4.2: 客户端 发送完请求后 必须 关闭 stream 的 发送方向
+	stream.Close()
+
+	var lenbs [2]byte
+	if _, err = io.ReadFull(stream, lenbs[:]); err != nil {
+		return nil, err
+	}
+	respbs := make([]byte, binary.BigEndian.Uint16(lenbs[:]))
+	if _, err = io.ReadFull(stream, respbs); err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err = r.Unpack(respbs); err != nil {
+		return nil, err
+	}
+	r.Id = id
+	return r, nil
+}
+
+func (d *doqExchanger) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.conn != nil {
+		d.conn.CloseWithError(0, "")
+		d.conn = nil
+	}
+	return nil
+}
@@ -45,6 +45,8 @@ const (
 	Default_hysteriaMaxByteCount           = 1024 * 1024 / 8 * 100
 	Default_Server_maxStreamCountInOneConn = 4 //一个 Connection 中 stream越多, 性能越低, 因此我们这里限制为4
 
+	Default_Proxy_maxUniStreamCountInOneConn = 1024 //用于 ListenForProxy, 如 tuic 的 quic 模式 udp 每个包 都是 一个 单向流
+
 	common_maxidletimeout       = time.Second * 45
 	common_HandshakeIdleTimeout = time.Second * 8
 	common_ConnectionIDLength   = 12
@@ -96,6 +98,30 @@ type arguments struct {
 	useHysteria, hysteria_manual, early bool
 	customMaxStreamsInOneConn           int64
 	hysteriaMaxByteCount                int
+
+	enableDatagrams bool
+
+	//以下 两项 只用于 ProxyConf, 见 NewProxyClient 和 ListenForProxy
+	newConnFunc  func(quic.Connection) (quic.Connection, error)
+	dealConnFunc func(quic.Connection)
+}
+
+// ProxyConf 供 自己拨号/监听 quic 的 代理协议 (如 tuic) 使用, 以 复用 本包的 连接池 与 监听 逻辑.
+type ProxyConf struct {
+	Early           bool
+	EnableDatagrams bool
+	Extra           map[string]any //与 quic 高级层 的 extra 相同, 如 congestion_control = "hy", maxStreamsInOneConn
+}
+
+func (pc ProxyConf) toArguments() arguments {
+	args := arguments{
+		early:           pc.Early,
+		enableDatagrams: pc.EnableDatagrams,
+	}
+	if pc.Extra != nil {
+		args.useHysteria, args.hysteria_manual, args.hysteriaMaxByteCount, args.customMaxStreamsInOneConn = getExtra(pc.Extra)
+	}
+	return args
 }
 
 type Creator struct{}
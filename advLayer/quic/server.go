@@ -53,6 +53,14 @@ func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), _
 	dealNewConn(underlay.(quic.Connection), newSubConnFunc)
 }
 
+// ListenForProxy 供 自己监听 quic 的 代理协议 使用, 每个 新连接 都会 在 新的 goroutine 中 交给 dealConnFunc 处理.
+// non-blocking
+func ListenForProxy(addr string, tlsConf *tls.Config, pc ProxyConf, dealConnFunc func(quic.Connection)) io.Closer {
+	args := pc.toArguments()
+	args.dealConnFunc = dealConnFunc
+	return ListenInitialLayers(addr, *tlsConf, args, nil)
+}
+
 // non-blocking
 func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubConnFunc func(net.Conn)) (returnCloser io.Closer) {
 
@@ -60,6 +68,17 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 	if arg.customMaxStreamsInOneConn > 0 {
 		thisConfig.MaxIncomingStreams = arg.customMaxStreamsInOneConn
 	}
+	thisConfig.EnableDatagrams = arg.enableDatagrams
+
+	dealConn := arg.dealConnFunc
+	if dealConn == nil {
+		dealConn = func(conn quic.Connection) {
+			dealNewConn(conn, newSubConnFunc)
+		}
+	} else {
+		//代理协议 可能会 使用 单向流
+		thisConfig.MaxIncomingUniStreams = Default_Proxy_maxUniStreamCountInOneConn
+	}
 
 	var listener quic.Listener
 	var elistener quic.EarlyListener
@@ -105,10 +124,10 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 	}
 
 	if arg.early {
-		go loopAcceptEarly(elistener, newSubConnFunc, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount)
+		go loopAcceptEarly(elistener, dealConn, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount)
 		returnCloser = elistener
 	} else {
-		go loopAccept(listener, newSubConnFunc, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount)
+		go loopAccept(listener, dealConn, arg.useHysteria, arg.hysteria_manual, arg.hysteriaMaxByteCount)
 
 		returnCloser = listener
 	}
@@ -117,7 +136,7 @@ func ListenInitialLayers(addr string, tlsConf tls.Config, arg arguments, newSubC
 }
 
 // 阻塞
-func loopAccept(l quic.Listener, newSubConnFunc func(net.Conn), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int) {
+func loopAccept(l quic.Listener, dealConn func(quic.Connection), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int) {
 	for {
 
 		conn, err := l.Accept(context.Background())
@@ -133,13 +152,13 @@ func loopAccept(l quic.Listener, newSubConnFunc func(net.Conn), useHysteria bool
 			configHyForConn(conn, hysteria_manual, hysteriaMaxByteCount)
 		}
 
-		go dealNewConn(conn, newSubConnFunc)
+		go dealConn(conn)
 
 	}
 }
 
 // 阻塞
-func loopAcceptEarly(el quic.EarlyListener, newSubConnFunc func(net.Conn), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int) {
+func loopAcceptEarly(el quic.EarlyListener, dealConn func(quic.Connection), useHysteria bool, hysteria_manual bool, hysteriaMaxByteCount int) {
 
 	for {
 
@@ -155,7 +174,7 @@ func loopAcceptEarly(el quic.EarlyListener, newSubConnFunc func(net.Conn), useHy
 			configHyForConn(conn, hysteria_manual, hysteriaMaxByteCount)
 		}
 
-		go dealNewConn(conn, newSubConnFunc)
+		go dealConn(conn)
 
 	}
 }
@@ -30,7 +30,16 @@ var (
 	}
 )
 
-//来自v2ray, 实际上就是先嗅探quic，之后再嗅探tls层。也就是说quic握手包是套在tls握手包外面的。
+func init() {
+	tlsLayer.SniffQUIC = func(b []byte) string {
+		//SniffQUIC 会 原地解密, 所以要 复制一份
+		return SniffQUIC(append([]byte(nil), b...))
+	}
+}
+
+// 来自v2ray, 实际上就是先嗅探quic，之后再嗅探tls层。也就是说quic握手包是套在tls握手包外面的。
+//
+// 注意 b 会被 原地修改.
 func SniffQUIC(b []byte) (sni string) {
 	buffer := bytes.NewBuffer(b)
 	typeByte, err := buffer.ReadByte()
@@ -42,8 +51,9 @@ func SniffQUIC(b []byte) (sni string) {
 		return
 	}
 
-	vb, err := buffer.ReadBytes(4)
-	if err != nil {
+	//注意 bytes.Buffer 的 ReadBytes 的参数 是 分隔符 而不是 长度
+	vb := buffer.Next(4)
+	if len(vb) != 4 {
 		return
 	}
 
@@ -89,6 +99,10 @@ func SniffQUIC(b []byte) (sni string) {
 
 	hdrLen := len(b) - int(buffer.Len())
 
+	if hdrLen+4+16 > len(b) || packetLen > uint64(len(b)-hdrLen) || packetLen < 4+16 {
+		return
+	}
+
 	origPNBytes := make([]byte, 4)
 	copy(origPNBytes, b[hdrLen:hdrLen+4])
 
@@ -148,9 +162,15 @@ func SniffQUIC(b []byte) (sni string) {
 		return
 	}
 	buffer = bytes.NewBuffer(decrypted)
-	frameType, err := buffer.ReadByte()
-	if err != nil {
-		return
+	var frameType byte
+	for {
+		if frameType, err = buffer.ReadByte(); err != nil {
+			return
+		}
+		//跳过 crypto 之前的 PADDING 和 PING 帧, chrome 会 随机插入 这些帧
+		if frameType != 0x0 && frameType != 0x1 {
+			break
+		}
 	}
 	if frameType != 0x6 {
 		// not crypto frame
@@ -171,8 +191,16 @@ func SniffQUIC(b []byte) (sni string) {
 		return
 	}
 
+	//crypto 帧 中 是 不带 record 头 的 握手消息, 而 CommonDetect 需要 完整的 tls record, 所以 补上 record 头
+	record := make([]byte, 5+len(frameData))
+	record[0] = 22
+	record[1] = 3
+	record[2] = 1
+	binary.BigEndian.PutUint16(record[3:], uint16(len(frameData)))
+	copy(record[5:], frameData)
+
 	cs := tlsLayer.ComSniff{Isclient: true}
-	cs.CommonDetect(frameData, true, true)
+	cs.CommonDetect(record, true, true)
 
 	return cs.SniffedServerName
 }
@@ -0,0 +1,104 @@
+package quic
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 用 crypto/tls 生成一个 带 sni 的 ClientHello 握手消息 (不含 record 头)
+func genClientHello(t *testing.T, sni string) []byte {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go tls.Client(c1, &tls.Config{ServerName: sni, MinVersion: tls.VersionTLS13}).Handshake()
+
+	c2.SetReadDeadline(time.Now().Add(time.Second * 3))
+	var hdr [5]byte
+	if _, err := c2.Read(hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(hdr[3:]))
+	for n := 0; n < len(msg); {
+		m, err := c2.Read(msg[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	return msg
+}
+
+// 按 rfc9001 5 构造 一个 QUIC v1 的 Initial 包, 包号 长度为1, 并在 crypto 帧 前 插入 padding
+func genQUICInitial(clientHello []byte) []byte {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var payload bytes.Buffer
+	payload.Write([]byte{0, 0, 0}) //padding
+	payload.WriteByte(0x6)
+	payload.Write(quicvarint.Append(nil, 0))
+	payload.Write(quicvarint.Append(nil, uint64(len(clientHello))))
+	payload.Write(clientHello)
+	payload.Write(make([]byte, 32))
+
+	const pnLen = 1
+	const tagLen = 16
+
+	var hdr bytes.Buffer
+	hdr.WriteByte(0xc0) //long header, Initial, 包号长度 1
+	hdr.Write([]byte{0, 0, 0, 1})
+	hdr.WriteByte(byte(len(dcid)))
+	hdr.Write(dcid)
+	hdr.WriteByte(0) //scid
+	hdr.WriteByte(0) //token
+	length := pnLen + payload.Len() + tagLen
+	hdr.Write([]byte{0x40 | byte(length>>8), byte(length)}) //2字节的 varint
+	pnOffset := hdr.Len()
+	hdr.WriteByte(0) //包号
+
+	initialSecret := hkdf.Extract(crypto.SHA256.New, dcid, quicSalt)
+	secret := hkdfExpandLabel(crypto.SHA256, initialSecret, []byte{}, "client in", crypto.SHA256.Size())
+	key := hkdfExpandLabel(crypto.SHA256, secret, []byte{}, "quic key", 16)
+	iv := hkdfExpandLabel(crypto.SHA256, secret, []byte{}, "quic iv", 12)
+	hpKey := hkdfExpandLabel(crypto.SHA256, secret, []byte{}, "quic hp", 16)
+
+	aead := initialSuite.AEAD(key, iv)
+	nonce := make([]byte, aead.NonceSize())
+	packet := aead.Seal(hdr.Bytes(), nonce, payload.Bytes(), hdr.Bytes())
+
+	block, _ := aes.NewCipher(hpKey)
+	mask := make([]byte, block.BlockSize())
+	block.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	packet[0] ^= mask[0] & 0xf
+	packet[pnOffset] ^= mask[1]
+	return packet
+}
+
+func TestSniffQUIC(t *testing.T) {
+	packet := genQUICInitial(genClientHello(t, "www.example.com"))
+	orig := append([]byte(nil), packet...)
+
+	if sni := tlsLayer.SniffQUIC(packet); sni != "www.example.com" {
+		t.Fatal("sniff wrong", sni)
+	}
+	if !bytes.Equal(packet, orig) {
+		t.Fatal("packet should not be modified")
+	}
+
+	//截断的包 不能 panic
+	for _, n := range []int{1, 20, 40, 60, len(packet) / 2} {
+		if sni := tlsLayer.SniffQUIC(packet[:n]); sni != "" {
+			t.Fatal("truncated packet should fail", n, sni)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package splithttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// implements advLayer.MuxClient
+type Client struct {
+	Creator
+
+	host string
+	path string
+
+	requestHeader  map[string][]string
+	responseHeader map[string][]string
+
+	cachedTransport *http2.Transport //一个 transport 对应 一个提供的 dial好的 tls 连接，正好作为CommonConn。
+}
+
+func (c *Client) GetPath() string {
+	return c.path
+}
+
+func (c *Client) IsEarly() bool {
+	return false
+}
+
+func (c *Client) dealErr(err error) {
+	if errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed") {
+		c.cachedTransport = nil
+	}
+}
+
+func (c *Client) GetCommonConn(underlay net.Conn) (any, error) {
+	if underlay == nil {
+		if c.cachedTransport != nil {
+			return c.cachedTransport, nil
+		} else {
+			return nil, errors.New("splithttp.GetCommonConn: underlay==nil and no cachedTranspot")
+		}
+	} else {
+		return underlay, nil
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader, contentLength int64) *http.Request {
+	rq := &http.Request{
+		Method: method,
+		URL: &url.URL{
+			Scheme: "https",
+			Host:   c.host,
+			Path:   path,
+		},
+		Proto:         "HTTP/2",
+		ProtoMajor:    2,
+		Header:        make(http.Header),
+		ContentLength: contentLength,
+	}
+	if body != nil {
+		rq.Body = io.NopCloser(body)
+	}
+	for k, vs := range httpLayer.TrimHeaders(c.requestHeader) {
+		rq.Header.Set(k, vs[0])
+	}
+	return rq.WithContext(ctx)
+}
+
+func (c *Client) DialSubConn(underlay any) (net.Conn, error) {
+
+	if underlay == nil {
+		return nil, utils.ErrNilParameter
+	}
+
+	var transport *http2.Transport
+
+	if t, ok := underlay.(*http2.Transport); ok && t != nil {
+		transport = t
+	} else {
+		transport = &http2.Transport{
+			DialTLS: func(_, _ string, cfg *tls.Config) (net.Conn, error) {
+				return underlay.(net.Conn), nil
+			},
+			AllowHTTP:          false,
+			DisableCompression: true,
+		}
+		c.cachedTransport = transport
+	}
+
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn := &ClientConn{
+		client:     c,
+		transport:  transport,
+		sessionID:  utils.GenerateUUIDStr(),
+		ctx:        ctx,
+		cancel:     cancel,
+		uploadW:    pw,
+		uploadDone: make(chan struct{}),
+	}
+	conn.InitEasyDeadline()
+
+	go conn.downloadOnce.Do(conn.startDownload)
+	go conn.upload(pr)
+
+	return conn, nil
+}
+
+// Close 时 等待 上传完毕 的 最长时间
+const closeWaitTimeout = time.Second * 5
+
+// implements net.Conn
+type ClientConn struct {
+	netLayer.EasyDeadline
+
+	client    *Client
+	transport *http2.Transport
+	sessionID string
+
+	ctx    context.Context //用于 取消 下载
+	cancel context.CancelFunc
+
+	downloadOnce sync.Once
+	download     io.ReadCloser
+	err          error
+
+	uploadW    *io.PipeWriter
+	uploadDone chan struct{}
+
+	closeOnce sync.Once
+}
+
+func (c *ClientConn) LocalAddr() net.Addr  { return nil }
+func (c *ClientConn) RemoteAddr() net.Addr { return nil }
+
+func (c *ClientConn) startDownload() {
+	rq := c.client.newRequest(c.ctx, http.MethodGet, c.client.path+c.sessionID, nil, 0)
+
+	resp, err := c.transport.RoundTrip(rq)
+	if err != nil {
+		c.err = err
+		c.client.dealErr(err)
+		c.uploadW.CloseWithError(err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		c.err = utils.ErrInErr{ErrDesc: "splithttp download got wrong status", Data: resp.Status}
+
+	} else if len(c.client.responseHeader) > 0 {
+		if ok, firstNotMatchKey := httpLayer.AllHeadersIn(c.client.responseHeader, resp.Header); !ok {
+			if ce := utils.CanLogWarn("splithttp Client configured custom header, but the server response doesn't have all of them"); ce != nil {
+				ce.Write(zap.String("firstNotMatchKey", firstNotMatchKey))
+			}
+			c.err = utils.ErrInErr{ErrDesc: "splithttp response header not match", Data: firstNotMatchKey}
+		}
+	}
+
+	if c.err != nil {
+		resp.Body.Close()
+		c.uploadW.CloseWithError(c.err)
+		return
+	}
+	c.download = resp.Body
+}
+
+// 把 Write 写入的 数据 分块 用 POST 发出, 最多 同时 发出 maxConcurrentPosts 个
+func (c *ClientConn) upload(pr *io.PipeReader) {
+	defer close(c.uploadDone)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentPosts)
+
+	bs := utils.GetPacket()
+	defer utils.PutPacket(bs)
+
+	var seq uint64
+	for {
+		n, err := pr.Read(bs[:MaxPostSize])
+		if n > 0 {
+			data := append([]byte(nil), bs[:n]...)
+			sem <- struct{}{}
+			wg.Add(1)
+
+			go func(seq uint64) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				if e := c.post(seq, data); e != nil {
+					if ce := utils.CanLogDebug("splithttp post failed"); ce != nil {
+						ce.Write(zap.Uint64("seq", seq), zap.Error(e))
+					}
+					pr.CloseWithError(e)
+					c.cancel()
+				}
+			}(seq)
+
+			seq++
+		}
+		if err != nil {
+			break
+		}
+	}
+	wg.Wait()
+}
+
+func (c *ClientConn) post(seq uint64, data []byte) error {
+	path := c.client.path + c.sessionID + "/" + strconv.FormatUint(seq, 10)
+	rq := c.client.newRequest(context.Background(), http.MethodPost, path, bytes.NewReader(data), int64(len(data)))
+
+	resp, err := c.transport.RoundTrip(rq)
+	if err != nil {
+		c.client.dealErr(err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return utils.ErrInErr{ErrDesc: "splithttp upload got wrong status", Data: resp.Status}
+	}
+	return nil
+}
+
+func (c *ClientConn) Read(b []byte) (n int, err error) {
+	c.downloadOnce.Do(c.startDownload)
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.download == nil {
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return c.download.Read(b)
+	}
+}
+
+func (c *ClientConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		//下载 或 上传 失败时 pipe 会被 CloseWithError, 这里 会 得到 该错误
+		return c.uploadW.Write(b)
+	}
+}
+
+// 等待 已经写入的 数据 上传完毕, 然后 断开 下载
+func (c *ClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.uploadW.Close()
+		select {
+		case <-c.uploadDone:
+		case <-time.After(closeWaitTimeout):
+		}
+		c.cancel()
+	})
+	return nil
+}
@@ -0,0 +1,535 @@
+package splithttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// 只收到 POST 而 迟迟 没有 GET 的 session 会在 此时间 后 被 删除
+const sessionWaitTimeout = time.Second * 30
+
+var (
+	clientPreface = []byte(http2.ClientPreface)
+
+	errSessionClosed = errors.New("splithttp session closed")
+	errTooManyChunks = errors.New("splithttp too many pending chunks")
+)
+
+// implements advLayer.MuxServer
+type Server struct {
+	Creator
+	http2.Server
+	netLayer.ConnList
+
+	Headers *httpLayer.HeaderPreset
+
+	path string
+
+	closed atomic.Bool
+
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+func NewServer(path string, headers *httpLayer.HeaderPreset) *Server {
+	return &Server{
+		path:     getBasePath(path),
+		Headers:  headers,
+		sessions: make(map[string]*session),
+	}
+}
+
+func (s *Server) GetPath() string {
+	return s.path
+}
+
+func (s *Server) Stop() {
+	if s.closed.Swap(true) {
+		return
+	}
+
+	s.CloseDeleteAll()
+
+	s.mutex.Lock()
+	for _, sess := range s.sessions {
+		sess.close()
+	}
+	s.mutex.Unlock()
+}
+
+// 获取 session, 没有 则 新建
+func (s *Server) getSession(sid string) *session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess := s.sessions[sid]
+	if sess == nil {
+		sess = newSession()
+		s.sessions[sid] = sess
+
+		sess.timer = time.AfterFunc(sessionWaitTimeout, func() {
+			sess.close()
+		})
+		go func() {
+			<-sess.done
+			s.mutex.Lock()
+			if s.sessions[sid] == sess {
+				delete(s.sessions, sid)
+			}
+			s.mutex.Unlock()
+		}()
+	}
+	return sess
+}
+
+// 阻塞
+func (s *Server) StartHandle(underlay net.Conn, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	s.closed.Store(false)
+
+	oldUnderlay := underlay
+
+	s.Insert(oldUnderlay)
+
+	//先过滤一下h2c 的 preface. 因为不是h2c的话，依然可以试图回落到 h1.
+
+	bs := utils.GetPacket()
+	netLayer.SetCommonReadTimeout(underlay)
+
+	var notH2c bool
+	n, err := underlay.Read(bs)
+	if err != nil {
+		if ce := utils.CanLogDebug("splithttp try read preface failed"); ce != nil {
+			ce.Write()
+		}
+		s.CloseDelete(oldUnderlay)
+		return
+
+	} else if n < len(clientPreface) || !bytes.Equal(bs[:len(clientPreface)], clientPreface) {
+		notH2c = true
+	}
+
+	netLayer.PersistConn(underlay)
+
+	firstBuf := bytes.NewBuffer(bs[:n])
+
+	if notH2c {
+		if ce := utils.CanLogInfo("splithttp got not h2c request"); ce != nil {
+			ce.Write()
+		}
+		s.Delete(oldUnderlay)
+
+		if fallbackFunc != nil {
+			_, method, path, _, failreason := httpLayer.ParseH1Request(bs, false)
+			if failreason != 0 {
+				go fallbackFunc(httpLayer.FallbackMeta{
+					Conn:         underlay,
+					H1RequestBuf: firstBuf,
+				})
+			} else {
+				go fallbackFunc(httpLayer.FallbackMeta{
+					Path:         path,
+					Method:       method,
+					Conn:         underlay,
+					H1RequestBuf: firstBuf,
+				})
+			}
+		} else {
+			underlay.Write([]byte(httpLayer.Err403response))
+			underlay.Close()
+		}
+		return
+	}
+
+	underlay = &netLayer.ReadWrapper{
+		Conn:              underlay,
+		OptionalReader:    io.MultiReader(firstBuf, underlay),
+		RemainFirstBufLen: n,
+	}
+
+	//阻塞
+	s.Server.ServeConn(underlay, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, rq *http.Request) {
+			if s.closed.Load() {
+				return
+			}
+			s.handle(rw, rq, newSubConnFunc, fallbackFunc)
+		}),
+	})
+
+	s.CloseDelete(oldUnderlay)
+}
+
+func (s *Server) handle(rw http.ResponseWriter, rq *http.Request, newSubConnFunc func(net.Conn), fallbackFunc func(httpLayer.FallbackMeta)) {
+	p := rq.URL.Path
+
+	var sid string
+	var seq uint64
+	var isUpload, ok bool
+
+	if strings.HasPrefix(p, s.path) {
+		sid, seq, isUpload, ok = parseSubPath(p[len(s.path):])
+		if ok && !(isUpload && rq.Method == http.MethodPost || !isUpload && rq.Method == http.MethodGet) {
+			ok = false
+		}
+	}
+
+	if !ok {
+		if ce := utils.CanLogWarn("splithttp Server got wrong path or method"); ce != nil {
+			ce.Write(zap.String("path", p), zap.String("method", rq.Method))
+		}
+	} else if s.Headers != nil && s.Headers.Request != nil && len(s.Headers.Request.Headers) > 0 {
+		if match, fnmk := httpLayer.AllHeadersIn(s.Headers.Request.Headers, rq.Header); !match {
+			if ce := utils.CanLogWarn("splithttp Server has custom header configured, but the client request have notMatched Header(s)"); ce != nil {
+				ce.Write(zap.String("firstNotMatchKey", fnmk))
+			}
+			ok = false
+		}
+	}
+
+	if !ok {
+		if fallbackFunc == nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if ce := utils.CanLogInfo("splithttp will fallback"); ce != nil {
+			ce.Write(
+				zap.String("path", p),
+				zap.String("method", rq.Method),
+				zap.String("raddr", rq.RemoteAddr))
+		}
+
+		fallbackFunc(httpLayer.FallbackMeta{
+			Path:   p,
+			Method: rq.Method,
+			Conn: &netLayer.IOWrapper{
+				Reader:   rq.Body,
+				Writer:   rw,
+				Rejecter: httpLayer.RejectConn{ResponseWriter: rw},
+			},
+			IsH2:      true,
+			H2Request: rq,
+			H2RW:      rw,
+		})
+		return
+	}
+
+	if isUpload {
+		s.handleUpload(rw, rq, sid, seq)
+	} else {
+		s.handleDownload(rw, rq, sid, newSubConnFunc)
+	}
+}
+
+func (s *Server) handleUpload(rw http.ResponseWriter, rq *http.Request, sid string, seq uint64) {
+	data, err := io.ReadAll(io.LimitReader(rq.Body, MaxPostSize+1))
+	if err != nil {
+		return
+	}
+	if len(data) > MaxPostSize {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	//阻塞 直到 该块 被 读出, 这样 客户端 的 并发 POST 就 起到了 背压 的作用
+	if err = s.getSession(sid).push(rq.Context(), seq, data); err != nil {
+		if ce := utils.CanLogDebug("splithttp push chunk failed"); ce != nil {
+			ce.Write(zap.String("session", sid), zap.Uint64("seq", seq), zap.Error(err))
+		}
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleDownload(rw http.ResponseWriter, rq *http.Request, sid string, newSubConnFunc func(net.Conn)) {
+	sess := s.getSession(sid)
+	if !sess.startDownload() {
+		rw.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	headerMap := rw.Header()
+	headerMap.Set("Content-Type", "text/event-stream") //不让 cdn 缓存 响应
+	headerMap.Set("Cache-Control", "no-store")
+	if s.Headers != nil && s.Headers.Response != nil && len(s.Headers.Response.Headers) > 0 {
+		for k, vs := range httpLayer.TrimHeaders(s.Headers.Response.Headers) {
+			headerMap.Add(k, vs[0])
+		}
+	}
+	rw.WriteHeader(http.StatusOK)
+	if flusher, ok := rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	sc := &ServerConn{
+		sess: sess,
+		rw:   rw,
+		ra:   getRemoteAddr(rq),
+	}
+	sc.InitEasyDeadline()
+
+	if s.closed.Load() {
+		sc.Close()
+		return
+	}
+
+	newSubConnFunc(sc)
+
+	//handler 返回后 rw 不可再用, 所以 要等到 子连接 关闭, 并 在返回前 将 sc 标记为 关闭
+	select {
+	case <-sess.done:
+	case <-rq.Context().Done():
+	}
+	sc.Close()
+}
+
+func getRemoteAddr(rq *http.Request) net.Addr {
+	if xffs := rq.Header.Values(httpLayer.XForwardStr); len(xffs) > 0 {
+		xff := strings.TrimSpace(strings.SplitN(xffs[0], ",", 2)[0])
+		ta, e := net.ResolveIPAddr("ip", xff)
+		if e == nil {
+			return ta
+		}
+		if ce := utils.CanLogWarn("Failed in splithttp parse X-Forwarded-For"); ce != nil {
+			ce.Write(zap.Error(e), zap.Any(httpLayer.XForwardStr, xffs))
+		}
+	}
+	ta, e := net.ResolveTCPAddr("tcp", rq.RemoteAddr)
+	if e == nil {
+		return ta
+	}
+	return nil
+}
+
+// 一个 子连接 的 上传 数据, 按 seq 排序 后 读出
+type session struct {
+	mutex   sync.Mutex
+	next    uint64
+	cur     []byte
+	pending map[uint64][]byte
+
+	drained chan struct{} //每当 一块 被 完全读出 时 关闭 并 替换, 用于 唤醒 等待的 push
+
+	downloading bool
+	timer       *time.Timer
+
+	notify    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSession() *session {
+	return &session{
+		pending: make(map[uint64][]byte),
+		drained: make(chan struct{}),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+func (sess *session) close() {
+	sess.closeOnce.Do(func() {
+		close(sess.done)
+	})
+}
+
+// 一个 session 只能 有 一个 下载
+func (sess *session) startDownload() bool {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+	if sess.downloading {
+		return false
+	}
+	sess.downloading = true
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+	return true
+}
+
+// 乱序 的 块, 即 在等待 之前的块 的 块 的 数量. 调用前须持有mutex
+func (sess *session) outOfOrderCount_nolock() int {
+	n := len(sess.pending)
+	if _, ok := sess.pending[sess.next]; ok {
+		n--
+	}
+	return n
+}
+
+// seq 所对应的块 是否 已被 完全读出. 调用前须持有mutex
+func (sess *session) isDrained_nolock(seq uint64) bool {
+	return seq < sess.next && !(seq+1 == sess.next && len(sess.cur) > 0)
+}
+
+// 唤醒 等待的 push. 调用前须持有mutex
+func (sess *session) signalDrained_nolock() {
+	close(sess.drained)
+	sess.drained = make(chan struct{})
+}
+
+// 放入 一块 数据, 并 阻塞 直到 它 被 完全读出, 或 session 关闭, 或 ctx 结束.
+// 只有 乱序的块 计入 maxPendingPosts, 超过 时 关闭 session.
+func (sess *session) push(ctx context.Context, seq uint64, data []byte) error {
+	select {
+	case <-sess.done:
+		return errSessionClosed
+	default:
+	}
+
+	sess.mutex.Lock()
+	if _, ok := sess.pending[seq]; ok || seq < sess.next {
+		sess.mutex.Unlock()
+		return utils.ErrInErr{ErrDesc: "splithttp got duplicated chunk", Data: seq}
+	}
+	if seq > sess.next && sess.outOfOrderCount_nolock() >= maxPendingPosts {
+		sess.mutex.Unlock()
+		sess.close()
+		return errTooManyChunks
+	}
+	sess.pending[seq] = data
+
+	select {
+	case sess.notify <- struct{}{}:
+	default:
+	}
+
+	for !sess.isDrained_nolock(seq) {
+		drained := sess.drained
+		sess.mutex.Unlock()
+
+		select {
+		case <-drained:
+		case <-sess.done:
+			return errSessionClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		sess.mutex.Lock()
+	}
+	sess.mutex.Unlock()
+	return nil
+}
+
+// 读取 数据, 没有 下一块 时 等待
+func (sess *session) read(p []byte, timeoutChan chan struct{}) (int, error) {
+	for {
+		sess.mutex.Lock()
+		for len(sess.cur) == 0 {
+			data, ok := sess.pending[sess.next]
+			if !ok {
+				break
+			}
+			delete(sess.pending, sess.next)
+			sess.next++
+			sess.cur = data
+			if len(data) == 0 {
+				sess.signalDrained_nolock()
+			}
+		}
+		if len(sess.cur) > 0 {
+			n := copy(p, sess.cur)
+			sess.cur = sess.cur[n:]
+			if len(sess.cur) == 0 {
+				sess.signalDrained_nolock()
+			}
+			sess.mutex.Unlock()
+			return n, nil
+		}
+		sess.mutex.Unlock()
+
+		//关闭 前 已经 收到的 数据 仍然 可以 读出
+		select {
+		case <-sess.done:
+			return 0, io.EOF
+		default:
+		}
+
+		select {
+		case <-sess.notify:
+		case <-sess.done:
+		case <-timeoutChan:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// implements net.Conn
+type ServerConn struct {
+	netLayer.EasyDeadline
+
+	sess *session
+	rw   http.ResponseWriter
+	ra   net.Addr
+
+	writeMutex sync.Mutex
+	closed     bool
+}
+
+// implements netLayer.RejectConn, return true
+func (*ServerConn) HasOwnDefaultRejectBehavior() bool {
+	return true
+}
+
+// implements netLayer.RejectConn, 模仿nginx响应，参考 httpLayer.SetNginx400Response
+func (sc *ServerConn) Reject() {
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+
+	//handler 返回后 调用 rw 会 panic
+	if sc.closed {
+		return
+	}
+	httpLayer.SetNginx400Response(sc.rw)
+}
+
+func (sc *ServerConn) LocalAddr() net.Addr  { return nil }
+func (sc *ServerConn) RemoteAddr() net.Addr { return sc.ra }
+
+func (sc *ServerConn) Read(p []byte) (int, error) {
+	return sc.sess.read(p, sc.ReadTimeoutChan())
+}
+
+func (sc *ServerConn) Write(p []byte) (n int, err error) {
+	select {
+	case <-sc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+
+	//handler 返回后 调用 rw 会 panic
+	if sc.closed {
+		return 0, net.ErrClosed
+	}
+	n, err = sc.rw.Write(p)
+	if err == nil {
+		sc.rw.(http.Flusher).Flush()
+	}
+	return
+}
+
+func (sc *ServerConn) Close() error {
+	sc.writeMutex.Lock()
+	sc.closed = true
+	sc.writeMutex.Unlock()
+
+	sc.sess.close()
+	return nil
+}
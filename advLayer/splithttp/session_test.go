@@ -0,0 +1,86 @@
+package splithttp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionPushBlocksUntilRead(t *testing.T) {
+	sess := newSession()
+	defer sess.close()
+
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- sess.push(context.Background(), 0, []byte("abcd"))
+	}()
+
+	select {
+	case err := <-pushed:
+		t.Fatal("push returned before read", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	p := make([]byte, 2)
+	if _, err := sess.read(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-pushed:
+		t.Fatal("push returned before chunk drained", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	if _, err := sess.read(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push not released after chunk drained")
+	}
+}
+
+func TestSessionOutOfOrderLimit(t *testing.T) {
+	sess := newSession()
+	defer sess.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, maxPendingPosts+1)
+	for i := 1; i <= maxPendingPosts; i++ {
+		go func(seq uint64) {
+			errs <- sess.push(ctx, seq, []byte{byte(seq)})
+		}(uint64(i))
+	}
+
+	//等 乱序块 都放入
+	for i := 0; i < 100; i++ {
+		sess.mutex.Lock()
+		n := len(sess.pending)
+		sess.mutex.Unlock()
+		if n == maxPendingPosts {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	//按序块 不计入 上限
+	go func() {
+		errs <- sess.push(ctx, 0, []byte{0})
+	}()
+	time.Sleep(time.Millisecond * 50)
+	select {
+	case <-sess.done:
+		t.Fatal("in-order chunk should not exceed the limit")
+	default:
+	}
+
+	if err := sess.push(ctx, maxPendingPosts+1, []byte{1}); err != errTooManyChunks {
+		t.Fatal("expect errTooManyChunks, got", err)
+	}
+}
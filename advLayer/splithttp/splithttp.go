@@ -0,0 +1,117 @@
+/*
+Package splithttp implements splithttp for advLayer, carrying upload and download in separate http requests.
+
+一些 cdn 不支持 websocket, 也 不支持 grpc 那样 双向流式 的 请求体, 但 基本 都支持 普通的 http 请求 和 流式的 响应.
+splithttp 把 一条 子连接 拆成 多个 普通 http 请求:
+
+	GET  /path/<session id>          下载, 响应体 为 流式 的 服务端 数据
+	POST /path/<session id>/<seq>    上传, 每个 请求体 为 一块 客户端 数据, seq 从0开始 递增
+
+上传 可以 同时 发出 多个 POST, 服务端 按照 seq 重新排序. session id 由 客户端 随机生成.
+
+所有 请求 都在 同一个 h2 连接 上 多路复用, 所以 与 grpc 一样 是 MuxClient, 要求 alpn 为 h2.
+
+# Fallback
+
+与 grpcSimple 一样, 不是 h2c 的 连接 按 http1.1 回落; 不符合的 h2 请求 以 FallbackMeta.IsH2 回落.
+*/
+package splithttp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+)
+
+const (
+	// 每个 POST 携带 的 最大 数据量
+	MaxPostSize = 64 * 1024
+
+	// 客户端 同时 发出 的 最大 POST 数
+	maxConcurrentPosts = 8
+
+	// 服务端 为 一个 session 缓存 的 最多 乱序 块 数. 按序的块 不计入, 它们的 POST 会 阻塞 直到 被读出
+	maxPendingPosts = 32
+
+	maxSessionIDLen = 64
+)
+
+func init() {
+	advLayer.ProtocolsMap["splithttp"] = Creator{}
+}
+
+type Creator struct{}
+
+func (Creator) PackageID() string {
+	return "splithttp"
+}
+
+func (Creator) ProtocolName() string {
+	return "splithttp"
+}
+
+func (Creator) GetDefaultAlpn() (alpn string, mustUse bool) {
+	return "h2", true
+}
+
+func (Creator) CanHandleHeaders() bool {
+	return true
+}
+
+func (Creator) IsSuper() bool {
+	return false
+}
+
+func (Creator) IsMux() bool {
+	return true
+}
+
+// 返回 以 "/" 结尾 的 path
+func getBasePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return path
+}
+
+// 解析 basePath 之后 的 部分, 为 "<session id>" 或 "<session id>/<seq>"
+func parseSubPath(rest string) (sid string, seq uint64, hasSeq bool, ok bool) {
+	sid = rest
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		sid = rest[:i]
+		var err error
+		seq, err = strconv.ParseUint(rest[i+1:], 10, 64)
+		if err != nil {
+			return
+		}
+		hasSeq = true
+	}
+	if sid == "" || len(sid) > maxSessionIDLen {
+		return
+	}
+	ok = true
+	return
+}
+
+func (Creator) NewClientFromConf(conf *advLayer.Conf) (advLayer.Client, error) {
+	c := &Client{
+		host: conf.Host,
+		path: getBasePath(conf.Path),
+	}
+
+	if conf.Headers != nil && conf.Headers.Request != nil && len(conf.Headers.Request.Headers) > 0 {
+		c.requestHeader = conf.Headers.Request.Headers
+	}
+	if conf.Headers != nil && conf.Headers.Response != nil && len(conf.Headers.Response.Headers) > 0 {
+		c.responseHeader = conf.Headers.Response.Headers
+	}
+	return c, nil
+}
+
+func (Creator) NewServerFromConf(conf *advLayer.Conf) (advLayer.Server, error) {
+	return NewServer(conf.Path, conf.Headers), nil
+}
@@ -0,0 +1,128 @@
+package splithttp_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/advLayer"
+	"github.com/e1732a364fed/v2ray_simple/advLayer/splithttp"
+	"github.com/e1732a364fed/v2ray_simple/httpLayer"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"golang.org/x/net/http2"
+)
+
+func TestSplitHttp(t *testing.T) {
+	listenAddr := netLayer.GetRandLocalAddr(true, false)
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conf := &advLayer.Conf{Host: "example.com", Path: "/sp"}
+	server := splithttp.NewServer(conf.Path, nil)
+	defer server.Stop()
+
+	fallbackGot := make(chan httpLayer.FallbackMeta, 1)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.StartHandle(conn, func(sc net.Conn) {
+				io.Copy(sc, sc)
+				sc.Close()
+			}, func(fm httpLayer.FallbackMeta) {
+				if fm.IsH2 {
+					fm.H2RW.WriteHeader(http.StatusTeapot)
+				} else {
+					fm.Conn.Close()
+				}
+				fallbackGot <- fm
+			})
+		}
+	}()
+
+	ac, _ := splithttp.Creator{}.NewClientFromConf(conf)
+	client := ac.(advLayer.MuxClient)
+
+	tcpConn, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpConn.Close()
+
+	commonConn, err := client.GetCommonConn(tcpConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//两个 子连接 同时 传输, 数据 大于 MaxPostSize 以 产生 多个 并发的 POST
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		sub, err := client.DialSubConn(commonConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//之后的 子连接 使用 缓存的 transport, 同 main.go
+		commonConn, _ = client.GetCommonConn(nil)
+		go func() {
+			defer sub.Close()
+
+			data := make([]byte, splithttp.MaxPostSize*5+123)
+			rand.Read(data)
+			go sub.Write(data)
+
+			got := make([]byte, len(data))
+			sub.SetReadDeadline(time.Now().Add(time.Second * 10))
+			if _, err := io.ReadFull(sub, got); err != nil {
+				done <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				done <- io.ErrUnexpectedEOF
+				return
+			}
+			done <- nil
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//h2 回落
+	cc, _ := client.GetCommonConn(nil)
+	resp, err := cc.(*http2.Transport).RoundTrip(&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/other"},
+		Header: http.Header{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if fm := <-fallbackGot; resp.StatusCode != http.StatusTeapot || !fm.IsH2 || fm.Path != "/other" {
+		t.Fatal("h2 fallback failed", resp.StatusCode, fm.Path)
+	}
+
+	//http1.1 回落
+	h1Conn, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1Conn.Close()
+	h1Conn.Write([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if fm := <-fallbackGot; fm.IsH2 || fm.Path != "/index.html" || fm.Method != "GET" {
+		t.Fatal("h1 fallback failed", fm.Path, fm.Method)
+	}
+}
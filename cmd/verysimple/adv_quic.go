@@ -2,6 +2,10 @@
 
 package main
 
-import _ "github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+import (
+	_ "github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/hysteria2" //hysteria2 基于 quic
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/tuic"      //tuic 基于 quic
+)
 
 // 如果不引用 quic，go build 编译出的可执行文件 的大小 可以减小 2MB 。
@@ -76,6 +76,8 @@ func init() {
 		"【热加载】新配置文件", func() { interactively_hotLoadConfigFile(mainM) },
 	}, &CliCmd{
 		"【热加载】新配置url", func() { interactively_hotLoadUrlConfig(mainM) },
+	}, &CliCmd{
+		"【用户管理】查看/添加/删除/更换 某个listen的用户", func() { interactively_manageUsers(mainM) },
 	}, &CliCmd{
 		"调节日志等级", interactively_adjust_loglevel,
 	})
@@ -510,6 +512,108 @@ func interactively_hotLoadConfigFile(m *machine.M) {
 	m.PrintAllState(os.Stdout, false)
 }
 
+// 在运行时 管理 某个 listen 的用户, 不影响 其它用户的连接
+func interactively_manageUsers(m *machine.M) {
+	tags := m.UserManagedServerTags()
+	if len(tags) == 0 {
+		utils.PrintStr("没有 可管理用户 且 有tag 的 listen\n")
+		return
+	}
+
+	Select := promptui.Select{
+		Label: "请选择 listen 的 tag",
+		Items: tags,
+	}
+	_, tag, err := Select.Run()
+	if err != nil {
+		fmt.Printf("Prompt failed %v\n", err)
+		return
+	}
+
+	us, err := m.ListUsers(tag)
+	if err != nil {
+		fmt.Printf("list users failed %v\n", err)
+		return
+	}
+	utils.PrintStr("【当前所有用户】为：\n")
+	utils.PrintStr(delimiter)
+	for _, u := range us {
+		utils.PrintStr(u.IdentityStr() + "\n")
+	}
+	utils.PrintStr(delimiter)
+
+	Select = promptui.Select{
+		Label: "请选择操作",
+		Items: []string{
+			"添加用户",
+			"删除用户",
+			"更换用户(uuid/密码)",
+			"返回",
+		},
+	}
+	i, result, err := Select.Run()
+	if err != nil {
+		fmt.Printf("Prompt failed %v\n", err)
+		return
+	}
+	fmt.Printf("你选择了 %s\n", result)
+
+	var id string
+	if i == 1 || i == 2 {
+		ids := make([]string, len(us))
+		for j, u := range us {
+			ids[j] = u.IdentityStr()
+		}
+		Select = promptui.Select{
+			Label: "请选择用户",
+			Items: ids,
+		}
+		_, id, err = Select.Run()
+		if err != nil {
+			fmt.Printf("Prompt failed %v\n", err)
+			return
+		}
+	}
+
+	var uc utils.UserConf
+	if i == 0 || i == 2 {
+		utils.PrintStr("vless/vmess 的 user 为 uuid, trojan 的 user 为 密码, socks5/http/hysteria2/tuic 还需要 pass\n")
+
+		promptUser := promptui.Prompt{
+			Label: "user",
+		}
+		uc.User, err = promptUser.Run()
+		if err != nil {
+			fmt.Printf("Prompt failed %v\n", err)
+			return
+		}
+		promptPass := promptui.Prompt{
+			Label: "pass (可为空)",
+		}
+		uc.Pass, err = promptPass.Run()
+		if err != nil {
+			fmt.Printf("Prompt failed %v\n", err)
+			return
+		}
+	}
+
+	switch i {
+	case 0:
+		err = m.AddUser(tag, uc)
+	case 1:
+		err = m.RemoveUser(tag, id)
+	case 2:
+		err = m.RotateUser(tag, id, uc)
+	default:
+		return
+	}
+	if err != nil {
+		fmt.Printf("失败: %v\n", err)
+		return
+	}
+	utils.PrintStr("成功！\n")
+}
+
 func interactively_adjust_loglevel() {
 	fmt.Println("当前日志等级为：", utils.LogLevelStr(utils.LogLevel))
 
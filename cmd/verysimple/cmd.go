@@ -108,6 +108,34 @@ func generateAndPrintUUID() {
 	utils.PrintStr("\n")
 }
 
+func generateRealityKeyPair() {
+	priv, pub, err := tlsLayer.GenerateRealityKeyPair()
+	if err != nil {
+		utils.PrintStr(err.Error())
+		utils.PrintStr("\n")
+		return
+	}
+	utils.PrintStr("reality_private_key : ")
+	utils.PrintStr(priv)
+	utils.PrintStr("\nreality_public_key : ")
+	utils.PrintStr(pub)
+	utils.PrintStr("\n")
+}
+
+func generateECHKey(publicName string) {
+	configList, key, err := tlsLayer.GenerateECHKey(publicName)
+	if err != nil {
+		utils.PrintStr(err.Error())
+		utils.PrintStr("\n")
+		return
+	}
+	utils.PrintStr("ech_config : ")
+	utils.PrintStr(configList)
+	utils.PrintStr("\nech_key : ")
+	utils.PrintStr(key)
+	utils.PrintStr("\n")
+}
+
 func generateRandomSSlCert() {
 	const certFn = "cert.pem"
 	const keyFn = "cert.key"
@@ -20,6 +20,8 @@ func init() {
 	extraExitCmds := []exitCmd{
 		{name: "gu", desc: "automatically generate a uuid for you", f: generateAndPrintUUID},
 		{name: "gc", desc: "automatically generate random certificate for you", f: generateRandomSSlCert},
+		{name: "grk", desc: "automatically generate x25519 key pair for reality", f: generateRealityKeyPair},
+		{name: "gech", isStr: true, desc: "if given, generate ech config and key for the given public name", fs: generateECHKey},
 
 		{name: "cvqxtvs", isStr: true, desc: "if given, convert qx server config string to vs toml config", fs: convertQxToVs},
 		{name: "eqxrs", isStr: true, desc: "if given, automatically extract remote servers from quantumultX config for you", fs: extractQxRemoteServers},
@@ -187,7 +187,7 @@ func addConfControls(sc proxy.StandardConf, vb *ui.Box, isDial bool) {
 
 	allAdvs := append([]string{""}, utils.GetMapSortedKeySlice(advLayer.ProtocolsMap)...)
 
-	tlsTypes := []string{"tls", "utls", "shadowtls_v2"}
+	tlsTypes := []string{"tls", "utls", "shadowtls_v2", "reality"}
 	if !isDial {
 		utils.Splice(&tlsTypes, 1, 1)
 	}
@@ -9,7 +9,7 @@ Package main 读取配置文件，然后进行代理转发, 并选择性运行 c
 
 提供 noquic,notun,noutils, gui 这几个 build tag。
 
-若 noquic给出，则不引用 advLayer/quic，否则 默认引用 advLayer/quic。
+若 noquic给出，则不引用 advLayer/quic, proxy/hysteria2 和 proxy/tuic，否则 默认引用 它们。
 quic大概占用 2MB 大小。
 
 若 notun给出，则不引用 proxy/tun, 否则 默认引用 proxy/tun
@@ -28,11 +28,16 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 
 	_ "github.com/e1732a364fed/v2ray_simple/advLayer/grpcSimple"
+	_ "github.com/e1732a364fed/v2ray_simple/advLayer/h2"
+	_ "github.com/e1732a364fed/v2ray_simple/advLayer/httpupgrade"
+	_ "github.com/e1732a364fed/v2ray_simple/advLayer/splithttp"
 	_ "github.com/e1732a364fed/v2ray_simple/advLayer/ws"
 
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/dokodemo"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/muxcool"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/shadowsocks"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/simplesocks"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/singmux"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/socks5http" //该包自动引用 socks5 和 http
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/trojan"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/vless"
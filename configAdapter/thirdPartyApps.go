@@ -440,6 +440,16 @@ func ToClash(dc *proxy.DialConf) string {
 				sb.WriteString("\n    grpc-opts:")
 				sb.WriteString("\n      grpc-service-name: ")
 				sb.WriteString(dc.Path)
+			case "h2":
+				sb.WriteString("\n    h2-opts:")
+				if dc.Host != "" {
+					sb.WriteString("\n      host:\n        - ")
+					sb.WriteString(dc.Host)
+				}
+				if dc.Path != "" {
+					sb.WriteString("\n      path: ")
+					sb.WriteString(dc.Path)
+				}
 
 			}
 
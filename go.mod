@@ -9,6 +9,7 @@ require (
 	github.com/dustin/go-humanize v1.0.0
 	github.com/e1732a364fed/ui v0.0.1-alpha.13
 	github.com/gobwas/ws v1.1.0
+	github.com/hashicorp/yamux v0.1.2
 	github.com/lucas-clemente/quic-go v0.0.0-00010101000000-000000000000
 	github.com/manifoldco/promptui v0.9.0
 	github.com/marten-seemann/qtls v0.10.0
@@ -31,8 +32,8 @@ require (
 	golang.zx2c4.com/wireguard v0.0.0-20220920152132-bb719d3a6e2c
 	gonum.org/v1/gonum v0.11.0
 	gvisor.dev/gvisor v0.0.0-20221214043228-7501cb5e258d
+	lukechampine.com/blake3 v1.2.1
 	rsc.io/qr v0.2.0
-
 )
 
 require (
@@ -41,6 +42,8 @@ require (
 	github.com/google/btree v1.0.1 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/klauspost/compress v1.15.12 // indirect
+	github.com/klauspost/cpuid/v2 v2.1.1 // indirect
+	github.com/marten-seemann/qpack v0.3.0 // indirect
 	github.com/marten-seemann/qtls-go1-19 v0.1.1 // indirect
 	github.com/onsi/ginkgo/v2 v2.2.0 // indirect
 	github.com/riobard/go-bloom v0.0.0-20200614022211-cdc8013cb5b3 // indirect
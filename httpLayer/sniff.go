@@ -0,0 +1,64 @@
+package httpLayer
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+var sniffMethods = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE"}
+
+// SniffHost 从 http/1.x 请求的首包 中 读取 Host 头 的 主机名 (不含端口, 小写).
+// 不是 http请求, 没有 Host 头, 或者 Host 为 ip 时 返回 "". 不要求 首包 包含 完整的头部.
+func SniffHost(first []byte) string {
+	lineEnd := bytes.Index(first, []byte(CRLF))
+	if lineEnd < 0 {
+		return ""
+	}
+	firstLine := first[:lineEnd]
+
+	//请求行 形如 GET /path HTTP/1.1
+	sp := bytes.IndexByte(firstLine, ' ')
+	if sp < 0 || !bytes.HasPrefix(firstLine[bytes.LastIndexByte(firstLine, ' ')+1:], []byte("HTTP/1.")) {
+		return ""
+	}
+	method := string(firstLine[:sp])
+	ok := false
+	for _, m := range sniffMethods {
+		if m == method {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return ""
+	}
+
+	rest := first[lineEnd+2:]
+	for len(rest) > 0 {
+		i := bytes.Index(rest, []byte(CRLF))
+		if i == 0 { //头部结束
+			return ""
+		}
+		if i < 0 { //不完整的行
+			return ""
+		}
+		line := rest[:i]
+		rest = rest[i+2:]
+
+		colon := bytes.IndexByte(line, ':')
+		if colon < 0 || !strings.EqualFold(string(bytes.TrimSpace(line[:colon])), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(line[colon+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if host == "" || net.ParseIP(strings.Trim(host, "[]")) != nil {
+			return ""
+		}
+		return host
+	}
+	return ""
+}
@@ -0,0 +1,20 @@
+package httpLayer
+
+import "testing"
+
+func TestSniffHost(t *testing.T) {
+	for req, want := range map[string]string{
+		"GET / HTTP/1.1\r\nHost: www.Example.com\r\n\r\n":                   "www.example.com",
+		"POST /a HTTP/1.1\r\nUser-Agent: x\r\nhost:example.com:8080\r\n":    "example.com",
+		"GET / HTTP/1.1\r\nUser-Agent: x\r\nHost: 1.2.3.4\r\n\r\n":          "",
+		"GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n":                          "",
+		"GET / HTTP/1.1\r\nUser-Agent: x\r\n\r\nHost: example.com\r\n":      "",
+		"GET / HTTP/1.1\r\nHost: exam":                                      "",
+		"SSH-2.0-OpenSSH_8.9\r\n":                                           "",
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n": "",
+	} {
+		if got := SniffHost([]byte(req)); got != want {
+			t.Fatalf("%q want %q, got %q", req, want, got)
+		}
+	}
+}
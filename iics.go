@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
@@ -68,8 +69,8 @@ type incomingInserverConnState struct {
 
 	isInner bool
 
-	inTag       string //在inServer为nil时，可用此项确定 inTag。比如tproxy就属于这种情况
-	useSniffing bool   //在inServer为nil时，可用此项确定 是否使用sniffing
+	inTag     string           //在inServer为nil时，可用此项确定 inTag。比如tproxy就属于这种情况
+	sniffConf *proxy.SniffConf //在inServer为nil时，可用此项确定 是否使用sniffing 以及 如何嗅探
 
 	cachedRemoteAddr string
 
@@ -95,6 +96,8 @@ type incomingInserverConnState struct {
 
 	routingEnv *proxy.RoutingEnv //used in passToOutClient
 
+	viaChain []proxy.Client //链式代理 中 已经 在 拨号的 client, 用于 检测 循环
+
 	heapObj *heapObj
 }
 
@@ -306,3 +309,96 @@ func (iics *incomingInserverConnState) getRealRAddr() (raddr string) {
 	}
 	return
 }
+
+// 返回 客户端的ip, 无法得知时 (比如 unix domain socket) 返回 nil
+func (iics *incomingInserverConnState) getRealRIP() net.IP {
+	raddr := iics.getRealRAddr()
+	if raddr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		host = raddr
+	}
+	return net.ParseIP(host)
+}
+
+// 在实际转发开始前调用, 返回 此次转发 所要更新的 TrafficCounter (全局统计, inTag/outTag 统计 以及 用户统计), 可能为nil.
+// userID 为 inServer 握手所得的用户的 IdentityStr, 可为空. 返回的 end 必须在转发结束后调用.
+func (iics *incomingInserverConnState) startTrafficStat(client proxy.Client, userID string) (tc netLayer.TrafficCounter, end func()) {
+	var mtc netLayer.MultiTrafficCounter
+
+	gi := iics.GlobalInfo
+	if gi != nil {
+		atomic.AddInt32(&gi.ActiveConnectionCount, 1)
+		mtc = append(mtc, gi)
+
+		if iics.inServer != nil {
+			mtc = append(mtc, gi.InTagTraffic.GetOrCreate(statTagOf(iics.inServer)))
+		} else if iics.inTag != "" {
+			mtc = append(mtc, gi.InTagTraffic.GetOrCreate(iics.inTag))
+		}
+		if client != nil {
+			mtc = append(mtc, gi.OutTagTraffic.GetOrCreate(statTagOf(client)))
+		}
+	}
+
+	var endUserConn func()
+
+	if userID != "" {
+		us := utils.UserTraffic.GetOrCreate(userID)
+		endUserConn = us.StartConnection()
+		mtc = append(mtc, us)
+	}
+
+	if len(mtc) > 0 {
+		tc = mtc
+	}
+
+	end = func() {
+		if gi != nil {
+			atomic.AddInt32(&gi.ActiveConnectionCount, -1)
+		}
+		if endUserConn != nil {
+			endUserConn()
+		}
+	}
+	return
+}
+
+// 返回此次转发 在上行/下行 方向上 所受的限速, 即 inServer, client 以及 用户 三者限速的叠加. 没有限速的方向 返回nil.
+func (iics *incomingInserverConnState) getRateLimiters(client proxy.Client, userID string) (up, down netLayer.RateLimiter) {
+	var ups, downs utils.MultiRateLimiter
+
+	add := func(rp *utils.RateLimitPair) {
+		if rp == nil {
+			return
+		}
+		if rp.Up != nil {
+			ups = append(ups, rp.Up)
+		}
+		if rp.Down != nil {
+			downs = append(downs, rp.Down)
+		}
+	}
+
+	if iics.inServer != nil {
+		add(iics.inServer.GetBase().RateLimit)
+	}
+	if client != nil {
+		if b := client.GetBase(); b != nil {
+			add(b.RateLimit)
+		}
+	}
+	if userID != "" {
+		add(utils.UserRateLimits.Get(userID))
+	}
+
+	if len(ups) > 0 {
+		up = ups
+	}
+	if len(downs) > 0 {
+		down = downs
+	}
+	return
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
@@ -130,6 +131,91 @@ func (m *M) runApiServer() {
 	ser.addServerHandle(mux, "allstate", func(w http.ResponseWriter, r *http.Request) {
 		m.PrintAllState(w, false)
 	})
+	//以json格式 返回所有用户的流量统计. 若给出 id 参数, 则只返回该用户的统计
+	ser.addServerHandle(mux, "userTraffic", func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+
+		var v any
+		if id == "" {
+			v = utils.UserTraffic.Records()
+		} else {
+			us := utils.UserTraffic.Get(id)
+			if us == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			v = us.Record(id)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+
+	//以json格式 返回所有负载均衡组 各成员的状态
+	ser.addServerHandle(mux, "balancers", func(w http.ResponseWriter, r *http.Request) {
+		v := make(map[string][]proxy.BalancerMemberState, len(m.routingEnv.Balancers))
+		for tag, b := range m.routingEnv.Balancers {
+			v[tag] = b.State()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+
+	//以 Prometheus 文本格式 返回各项统计指标
+	ser.addServerHandle(mux, "metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		m.WriteMetrics(w)
+	})
+
+	//管理 某个 listen 的用户. tag 参数 指定 listen; action 为 list(默认), add, remove 或 rotate.
+	//add 和 rotate 读取 user, pass, daily_quota, monthly_quota 参数, remove 和 rotate 读取 id 参数 (即 旧用户的 IdentityStr).
+	//list 以json格式 返回 所有用户的 id
+	ser.addServerHandle(mux, "users", func(w http.ResponseWriter, r *http.Request) {
+		if e := r.ParseForm(); e != nil {
+			failBadRequest(e, "api server ParseForm failed", w)
+			return
+		}
+		f := r.Form
+		tag := f.Get("tag")
+		uc := utils.UserConf{
+			User:         f.Get("user"),
+			Pass:         f.Get("pass"),
+			DailyQuota:   f.Get("daily_quota"),
+			MonthlyQuota: f.Get("monthly_quota"),
+		}
+
+		var err error
+		switch action := f.Get("action"); action {
+		case "", "list":
+			var us []utils.User
+			us, err = m.ListUsers(tag)
+			if err != nil {
+				break
+			}
+			ids := make([]string, len(us))
+			for i, u := range us {
+				ids[i] = u.IdentityStr()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ids)
+			return
+		case "add":
+			err = m.AddUser(tag, uc)
+		case "remove":
+			err = m.RemoveUser(tag, f.Get("id"))
+		case "rotate":
+			err = m.RotateUser(tag, f.Get("id"), uc)
+		default:
+			err = utils.ErrInErr{ErrDesc: "unknown action", ErrDetail: utils.ErrInvalidData, Data: action}
+		}
+		if err != nil {
+			failBadRequest(err, "api server manage users failed", w)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
 	ser.addServerHandle(mux, "hotDelete", func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
 
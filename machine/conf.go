@@ -35,10 +35,15 @@ type AppConf struct {
 	DialTimeoutSeconds *int `toml:"dial_timeout"` //秒
 	ReadTimeoutSeconds *int `toml:"read_timeout"` //秒
 
-	GeoipFile     *string `toml:"geoip_file"`
-	GeositeFolder *string `toml:"geosite_folder"`
+	GeoipFile     *string `toml:"geoip_file"`     //maxmind 的 mmdb, 或 以 .dat 结尾 的 v2ray geoip.dat
+	GeositeFolder *string `toml:"geosite_folder"` //v2fly domain-list-community 的 data 文件夹
+	GeositeFile   *string `toml:"geosite_file"`   //v2ray 的 geosite.dat, 给出时 不再 读取 geosite_folder
+
+	RuleSetFiles map[string]string `toml:"rule_set"` //sing-box 的 二进制 rule-set (.srs) 文件, tag -> 文件路径, 在 route 的 rule_set 中 引用
 
 	EnablePeriodicallyReportState bool `toml:"enable_periodically_report_state"`
+
+	UserTrafficFile *string `toml:"user_traffic_file"` //可选, 用户流量统计的持久化文件(json格式). 给出后 统计数据会在重启后恢复
 }
 
 func LoadVSConfFromBs(bs []byte) (vsConf VSConf, err error) {
@@ -129,6 +134,12 @@ func (ac *AppConf) Setup() {
 	if ac.GeositeFolder != nil {
 		netLayer.GeositeFolder = *ac.GeositeFolder
 	}
+	if ac.GeositeFile != nil {
+		netLayer.GeositeFileName = *ac.GeositeFile
+	}
+	if ac.RuleSetFiles != nil {
+		netLayer.SetRuleSetFiles(ac.RuleSetFiles)
+	}
 }
 
 func (m *M) LoadConfigByTomlBytes(bs []byte) (err error) {
@@ -148,6 +159,7 @@ func (m *M) LoadConfigByTomlBytes(bs []byte) (err error) {
 		if m.AppConf.EnablePeriodicallyReportState {
 			m.enablePeriodicallyReportState = true
 		}
+		m.loadUserTraffic()
 	}
 	if vsConf.ApiServerConf != nil {
 		m.tomlApiServerConf = *vsConf.ApiServerConf
@@ -28,7 +28,7 @@ func (m *M) LoadDialConf(conf []*proxy.DialConf) (ok bool) {
 			continue
 		}
 
-		m.allClients = append(m.allClients, outClient)
+		m.addClient(outClient)
 		if tag := outClient.GetTag(); tag != "" {
 			m.tryInitEnv()
 			m.routingEnv.SetClient(tag, outClient)
@@ -200,10 +200,18 @@ func (m *M) loadUrlClient(urlConf proxy.UrlConf) (result int, client proxy.Clien
 		return
 	}
 
-	m.allClients = append(m.allClients, client)
+	m.addClient(client)
 	return
 }
 
+// 所有 新建的 client 都要 通过 这里 加入 m, 无论 是 启动前 加载, 还是 运行中 通过 热加载 或 api 加入.
+func (m *M) addClient(c proxy.Client) {
+	if tc := c.GetTLS_Client(); tc != nil {
+		tc.SetECHQuerier(m.queryECHConfig)
+	}
+	m.allClients = append(m.allClients, c)
+}
+
 // 从当前内存中的配置 导出 VSConf
 func (m *M) DumpVSConf() (vc VSConf) {
 	vc.StandardConf = m.DumpStandardConf()
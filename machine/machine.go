@@ -8,7 +8,9 @@ package machine
 import (
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -51,6 +53,8 @@ type M struct {
 
 	enablePeriodicallyReportState bool
 	stateReportTicker             *time.Ticker
+
+	userTrafficSaveTicker *time.Ticker
 }
 
 func New() *M {
@@ -96,6 +100,11 @@ func (m *M) Start() {
 		m.Lock()
 		m.running = true
 		m.callToggleFallback(1)
+
+		if dm := m.routingEnv.DnsMachine; dm != nil {
+			dm.SetOutboundDialFunc(m.dialDnsOutbound)
+		}
+
 		for _, inServer := range m.allServers {
 			lis := v2ray_simple.ListenSer(inServer, m.DefaultOutClient, &m.routingEnv, &m.GlobalInfo)
 
@@ -108,6 +117,12 @@ func (m *M) Start() {
 			dm.StartListen()
 		}
 
+		m.startSavingUserTraffic()
+
+		for _, b := range m.routingEnv.Balancers {
+			b.StartProbing(&m.routingEnv, v2ray_simple.DialThroughClient)
+		}
+
 		if m.enablePeriodicallyReportState {
 			if m.stateReportTicker == nil {
 				m.stateReportTicker = time.NewTicker(time.Minute * 5) //每隔五分钟输出一次目前状态
@@ -162,14 +177,44 @@ func (m *M) Stop() {
 	}
 	if dm := m.routingEnv.DnsMachine; dm != nil {
 		dm.Stop()
+		dm.CloseExchangers()
 	}
 	if m.stateReportTicker != nil {
 		m.stateReportTicker.Stop()
 		m.stateReportTicker = nil
 	}
+	m.stopSavingUserTraffic()
+	for _, b := range m.routingEnv.Balancers {
+		b.StopProbing()
+	}
 	m.Unlock()
 }
 
+// 通过 tag 为 outbound 的 dial 拨号到 target, 用于 DNSMachine 通过代理 发送 dns请求
+func (m *M) dialDnsOutbound(outbound string, target netLayer.Addr) (net.Conn, error) {
+	c := m.routingEnv.GetClient(outbound)
+	if c == nil {
+		return nil, utils.ErrInErr{ErrDesc: "dns outbound not found", ErrDetail: utils.ErrInvalidData, Data: outbound}
+	}
+	rwc, err := v2ray_simple.DialThroughClient(c, target)
+	if err != nil {
+		return nil, err
+	}
+	if conn, ok := rwc.(net.Conn); ok {
+		return conn, nil
+	}
+	return &netLayer.IOWrapper{Reader: rwc, Writer: rwc, Closer: rwc}, nil
+}
+
+// 用 当前的 DnsMachine 查询 ECHConfigList; 在查询时 才取 DnsMachine, 因为 client 可能 先于 dns 加载.
+func (m *M) queryECHConfig(domain string) ([]byte, error) {
+	dm := m.routingEnv.DnsMachine
+	if dm == nil {
+		return nil, utils.ErrInErr{ErrDesc: "ech dns query needs dns config", ErrDetail: utils.ErrInvalidData, Data: domain}
+	}
+	return dm.QueryECHConfig(domain)
+}
+
 func (m *M) setDefaultDirectClient() {
 	m.allClients = append(m.allClients, v2ray_simple.DirectClient)
 	m.DefaultOutClient = v2ray_simple.DirectClient
@@ -213,6 +258,27 @@ func (m *M) printState_proxy(w io.Writer) {
 	}
 }
 
+func (m *M) printState_balancers(w io.Writer) {
+	tags := make([]string, 0, len(m.routingEnv.Balancers))
+	for tag := range m.routingEnv.Balancers {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		b := m.routingEnv.Balancers[tag]
+		fmt.Fprintln(w, "balancer", tag, "strategy", b.Strategy)
+		for _, s := range b.State() {
+			fmt.Fprintln(w, "balancerMember", tag, s.Tag,
+				"alive", s.Alive,
+				"latency", s.Latency,
+				"activeConnectionCount", s.ActiveConns,
+				"lastError", s.LastError,
+			)
+		}
+	}
+}
+
 func (m *M) printState_routePolicy(w io.Writer) {
 	if rp := m.routingEnv.RoutePolicy; rp != nil {
 		for i, v := range rp.List {
@@ -235,6 +301,8 @@ func (m *M) PrintAllState(w io.Writer, printRouteEnv bool) {
 	fmt.Fprintln(w, "allUploadBytesSinceStart", m.AllUploadBytesSinceStart)
 
 	m.printState_proxy(w)
+	m.printState_balancers(w)
+	m.printState_users(w, false)
 	if printRouteEnv {
 		m.printState_routePolicy(w)
 
@@ -251,6 +319,8 @@ func (m *M) PrintAllStateForHuman(w io.Writer, printRouteEnv bool) {
 	fmt.Fprintln(w, "allUploadBytesSinceStart", humanize.Bytes(m.AllUploadBytesSinceStart))
 
 	m.printState_proxy(w)
+	m.printState_balancers(w)
+	m.printState_users(w, true)
 	if printRouteEnv {
 		m.printState_routePolicy(w)
 
@@ -0,0 +1,114 @@
+package machine
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// Prometheus 文本格式 (text/plain; version=0.0.4) 的 Content-Type
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// 写入一个指标的 HELP 与 TYPE 行
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labels 按 key, value, key, value ... 的顺序给出
+func writeMetric(w io.Writer, name string, value uint64, labels ...string) {
+	if len(labels) == 0 {
+		fmt.Fprintf(w, "%s %d\n", name, value)
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(metricsLabelReplacer.Replace(labels[i+1]))
+		sb.WriteByte('"')
+	}
+	sb.WriteString("} ")
+	sb.WriteString(strconv.FormatUint(value, 10))
+	sb.WriteByte('\n')
+	io.WriteString(w, sb.String())
+}
+
+// 按key排序写入 一组计数器
+func writeNamedCounters(w io.Writer, name, labelName string, counters map[string]uint64, extraLabels ...string) {
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeMetric(w, name, counters[k], append(extraLabels, labelName, k)...)
+	}
+}
+
+// 以 Prometheus 文本格式 写入 各项统计指标, 供 /metrics 使用.
+func (m *M) WriteMetrics(w io.Writer) {
+	gi := &m.GlobalInfo
+
+	writeMetricHeader(w, "vs_active_connections", "gauge", "Number of connections being relayed.")
+	writeMetric(w, "vs_active_connections", uint64(atomic.LoadInt32(&gi.ActiveConnectionCount)))
+
+	writeMetricHeader(w, "vs_bytes_total", "counter", "Total bytes relayed since start.")
+	writeMetric(w, "vs_bytes_total", atomic.LoadUint64(&gi.AllDownloadBytesSinceStart), "direction", "download")
+	writeMetric(w, "vs_bytes_total", atomic.LoadUint64(&gi.AllUploadBytesSinceStart), "direction", "upload")
+
+	writeMetricHeader(w, "vs_inbound_bytes_total", "counter", "Bytes relayed per inbound tag.")
+	tags, stats := gi.InTagTraffic.Snapshot()
+	for i, tag := range tags {
+		writeMetric(w, "vs_inbound_bytes_total", stats[i].Download, "tag", tag, "direction", "download")
+		writeMetric(w, "vs_inbound_bytes_total", stats[i].Upload, "tag", tag, "direction", "upload")
+	}
+
+	writeMetricHeader(w, "vs_outbound_bytes_total", "counter", "Bytes relayed per outbound tag.")
+	tags, stats = gi.OutTagTraffic.Snapshot()
+	for i, tag := range tags {
+		writeMetric(w, "vs_outbound_bytes_total", stats[i].Download, "tag", tag, "direction", "download")
+		writeMetric(w, "vs_outbound_bytes_total", stats[i].Upload, "tag", tag, "direction", "upload")
+	}
+
+	writeMetricHeader(w, "vs_handshake_failures_total", "counter", "Failed proxy handshakes per side and protocol.")
+	writeNamedCounters(w, "vs_handshake_failures_total", "protocol", gi.InHandshakeFailures.Snapshot(), "side", "in")
+	writeNamedCounters(w, "vs_handshake_failures_total", "protocol", gi.OutHandshakeFailures.Snapshot(), "side", "out")
+
+	writeMetricHeader(w, "vs_fallback_total", "counter", "Connections that hit a fallback.")
+	writeMetric(w, "vs_fallback_total", atomic.LoadUint64(&gi.FallbackCount))
+
+	writeMetricHeader(w, "vs_route_decisions_total", "counter", "Routing decisions per outbound tag.")
+	writeNamedCounters(w, "vs_route_decisions_total", "outtag", gi.RouteCount.Snapshot())
+
+	if dm := m.routingEnv.DnsMachine; dm != nil {
+		hit, miss := dm.CacheStat()
+		writeMetricHeader(w, "vs_dns_cache_total", "counter", "DNS queries answered from cache or not.")
+		writeMetric(w, "vs_dns_cache_total", hit, "result", "hit")
+		writeMetric(w, "vs_dns_cache_total", miss, "result", "miss")
+	}
+
+	if rs := utils.UserTraffic.Records(); len(rs) > 0 {
+		writeMetricHeader(w, "vs_user_bytes_total", "counter", "Bytes relayed per user.")
+		for _, r := range rs {
+			writeMetric(w, "vs_user_bytes_total", r.Download, "user", r.ID, "direction", "download")
+			writeMetric(w, "vs_user_bytes_total", r.Upload, "user", r.ID, "direction", "upload")
+		}
+
+		writeMetricHeader(w, "vs_user_active_connections", "gauge", "Number of connections being relayed per user.")
+		for _, r := range rs {
+			writeMetric(w, "vs_user_active_connections", uint64(r.ActiveConnectionCount), "user", r.ID)
+		}
+	}
+}
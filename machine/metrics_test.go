@@ -0,0 +1,68 @@
+package machine
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	m := New()
+
+	gi := &m.GlobalInfo
+	gi.ActiveConnectionCount = 2
+	gi.AddDownload(100)
+	gi.AddUpload(20)
+	gi.InTagTraffic.GetOrCreate("in").AddDownload(30)
+	gi.OutTagTraffic.GetOrCreate(`out"1`).AddUpload(40)
+	gi.InHandshakeFailures.Add("vmess", 3)
+	gi.OutHandshakeFailures.Add("trojan", 1)
+	gi.FallbackCount = 5
+	gi.RouteCount.Add("direct", 6)
+
+	//SpecialIPPollicy 的回答 也计为 命中缓存
+	dm := &netLayer.DNSMachine{SpecialIPPollicy: map[string][]netip.Addr{"a.example.com": {netip.MustParseAddr("1.2.3.4")}}}
+	m.routingEnv.DnsMachine = dm
+	for _, name := range []string{"a.example.com.", "a.example.com.", "b.example.com."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		dm.Exchange(q)
+	}
+
+	//使用 独立的 UserTraffic, 不影响 其它测试
+	prevUserTraffic := utils.UserTraffic
+	utils.UserTraffic = utils.NewUserTrafficMap()
+	t.Cleanup(func() { utils.UserTraffic = prevUserTraffic })
+
+	const userID = "u\\\"\n"
+	utils.UserTraffic.GetOrCreate(userID).AddDownload(7)
+
+	var sb strings.Builder
+	m.WriteMetrics(&sb)
+	got := sb.String()
+
+	for _, line := range []string{
+		"# TYPE vs_active_connections gauge",
+		"vs_active_connections 2",
+		`vs_bytes_total{direction="download"} 100`,
+		`vs_bytes_total{direction="upload"} 20`,
+		`vs_inbound_bytes_total{tag="in",direction="download"} 30`,
+		`vs_outbound_bytes_total{tag="out\"1",direction="upload"} 40`,
+		`vs_handshake_failures_total{side="in",protocol="vmess"} 3`,
+		`vs_handshake_failures_total{side="out",protocol="trojan"} 1`,
+		"vs_fallback_total 5",
+		`vs_route_decisions_total{outtag="direct"} 6`,
+		`vs_dns_cache_total{result="hit"} 2`,
+		`vs_dns_cache_total{result="miss"} 1`,
+		`vs_user_bytes_total{user="u\\\"\n",direction="download"} 7`,
+		`vs_user_active_connections{user="u\\\"\n"} 0`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Fatal("missing", line, "in", got)
+		}
+	}
+}
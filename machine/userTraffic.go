@@ -0,0 +1,95 @@
+package machine
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// 用户流量统计 持久化到文件的间隔. Stop 时 也会 保存一次
+const userTrafficSaveInterval = time.Second * 10
+
+func (m *M) userTrafficFile() string {
+	if m.UserTrafficFile == nil {
+		return ""
+	}
+	return *m.UserTrafficFile
+}
+
+// 从 AppConf.UserTrafficFile 恢复 用户流量统计
+func (m *M) loadUserTraffic() {
+	fn := m.userTrafficFile()
+	if fn == "" {
+		return
+	}
+	if err := utils.UserTraffic.LoadFile(fn); err != nil {
+		if ce := utils.CanLogErr("load user traffic file failed"); ce != nil {
+			ce.Write(zap.String("file", fn), zap.Error(err))
+		}
+	}
+}
+
+func (m *M) saveUserTraffic() {
+	fn := m.userTrafficFile()
+	if fn == "" {
+		return
+	}
+	if err := utils.UserTraffic.SaveFile(fn); err != nil {
+		if ce := utils.CanLogErr("save user traffic file failed"); ce != nil {
+			ce.Write(zap.String("file", fn), zap.Error(err))
+		}
+	}
+}
+
+// 若给出了 AppConf.UserTrafficFile, 则定期保存 用户流量统计. 调用前须持有 m 的锁
+func (m *M) startSavingUserTraffic() {
+	if m.userTrafficFile() == "" || m.userTrafficSaveTicker != nil {
+		return
+	}
+	m.userTrafficSaveTicker = time.NewTicker(userTrafficSaveInterval)
+	ticker := m.userTrafficSaveTicker
+	go func() {
+		for range ticker.C {
+			m.saveUserTraffic()
+		}
+	}()
+}
+
+// 停止定期保存, 并立即保存一次. 调用前须持有 m 的锁
+func (m *M) stopSavingUserTraffic() {
+	if m.userTrafficSaveTicker == nil {
+		return
+	}
+	m.userTrafficSaveTicker.Stop()
+	m.userTrafficSaveTicker = nil
+
+	m.saveUserTraffic()
+}
+
+func (m *M) printState_users(w io.Writer, forHuman bool) {
+	for _, r := range utils.UserTraffic.Records() {
+		if forHuman {
+			fmt.Fprintln(w, "user", r.ID,
+				"download", humanize.Bytes(r.Download),
+				"upload", humanize.Bytes(r.Upload),
+				"activeConnectionCount", r.ActiveConnectionCount,
+				"totalConnectionCount", r.TotalConnectionCount,
+				"today", humanize.Bytes(r.DailyBytes),
+				"thisMonth", humanize.Bytes(r.MonthlyBytes),
+			)
+		} else {
+			fmt.Fprintln(w, "user", r.ID,
+				"download", r.Download,
+				"upload", r.Upload,
+				"activeConnectionCount", r.ActiveConnectionCount,
+				"totalConnectionCount", r.TotalConnectionCount,
+				"today", r.DailyBytes,
+				"thisMonth", r.MonthlyBytes,
+			)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package machine
+
+import (
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// 按 tag 找到 可在运行时增删用户的 listen
+func (m *M) getUserManagedServer(tag string) (proxy.UserManagedServer, error) {
+	for _, s := range m.allServers {
+		if s.GetTag() != tag {
+			continue
+		}
+		if ums, ok := s.(proxy.UserManagedServer); ok {
+			return ums, nil
+		}
+		return nil, utils.ErrInErr{ErrDesc: "listen doesn't support user management", ErrDetail: utils.ErrUnImplemented, Data: tag}
+	}
+	return nil, utils.ErrInErr{ErrDesc: "no listen with tag", ErrDetail: utils.ErrNoMatch, Data: tag}
+}
+
+// 返回 所有 可在运行时增删用户 且 有 tag 的 listen 的 tag
+func (m *M) UserManagedServerTags() (tags []string) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, s := range m.allServers {
+		if _, ok := s.(proxy.UserManagedServer); ok && s.GetTag() != "" {
+			tags = append(tags, s.GetTag())
+		}
+	}
+	return
+}
+
+func findUser(s proxy.UserManagedServer, id string) utils.User {
+	for _, u := range s.AllUsers() {
+		if u.IdentityStr() == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// 返回 tag 所对应的 listen 的 所有用户
+func (m *M) ListUsers(tag string) ([]utils.User, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	s, err := m.getUserManagedServer(tag)
+	if err != nil {
+		return nil, err
+	}
+	return s.AllUsers(), nil
+}
+
+// 向 tag 所对应的 listen 添加用户, 并设置 uc 中给出的 配额 与 限速. 已有的连接 不受影响.
+func (m *M) AddUser(tag string, uc utils.UserConf) error {
+	m.Lock()
+	defer m.Unlock()
+
+	s, err := m.getUserManagedServer(tag)
+	if err != nil {
+		return err
+	}
+	return addUser(s, uc)
+}
+
+// 从 tag 所对应的 listen 删除 IdentityStr 为 id 的用户. 该用户 已有的连接 不会被断开, 但无法再 进行新的握手.
+//
+// 不能删除 最后一个用户, 因为 socks5/http 等 协议 在没有用户时 会 变为 不需要认证.
+func (m *M) RemoveUser(tag string, id string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	s, err := m.getUserManagedServer(tag)
+	if err != nil {
+		return err
+	}
+	return removeUser(s, id)
+}
+
+// 将 IdentityStr 为 id 的用户 替换为 uc 所给出的 新用户; 用于 更换 uuid/密码. 先添加 后删除, 所以 不会有 无法认证的 间隙; 其它用户的连接 不受影响.
+func (m *M) RotateUser(tag string, id string, uc utils.UserConf) error {
+	m.Lock()
+	defer m.Unlock()
+
+	s, err := m.getUserManagedServer(tag)
+	if err != nil {
+		return err
+	}
+	old := findUser(s, id)
+	if old == nil {
+		return utils.ErrInErr{ErrDesc: "no such user", ErrDetail: utils.ErrNoMatch, Data: id}
+	}
+	u, err := s.NewUserByConf(uc)
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "invalid user conf", ErrDetail: err, Data: uc.User}
+	}
+	if u.AuthStr() == old.AuthStr() {
+		return utils.ErrInErr{ErrDesc: "new user is the same as the old one", ErrDetail: utils.ErrInvalidData, Data: id}
+	}
+	if u.IdentityStr() != id && findUser(s, u.IdentityStr()) != nil {
+		return utils.ErrInErr{ErrDesc: "user already exists", ErrDetail: utils.ErrInvalidData, Data: u.IdentityStr()}
+	}
+
+	if err = setUserLimits(uc); err != nil {
+		return err
+	}
+	if err = s.AddUser(u); err != nil {
+		return err
+	}
+	if err = s.DelUser(old); err != nil {
+		return err
+	}
+	if u.IdentityStr() != id {
+		utils.UserRateLimits.Set(id, nil)
+	}
+
+	removeUserConf(s, id)
+	appendUserConf(s, uc)
+
+	if ce := utils.CanLogInfo("user rotated"); ce != nil {
+		ce.Write(zap.String("listen", s.GetTag()), zap.String("old", id), zap.String("new", u.IdentityStr()))
+	}
+	return nil
+}
+
+// 设置 uc 中给出的 配额 与 限速
+func setUserLimits(uc utils.UserConf) error {
+	ucs := []utils.UserConf{uc}
+	if err := utils.UserTraffic.LoadQuotas(ucs); err != nil {
+		return err
+	}
+	return utils.UserRateLimits.LoadUserConfs(ucs)
+}
+
+func addUser(s proxy.UserManagedServer, uc utils.UserConf) error {
+	u, err := s.NewUserByConf(uc)
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "invalid user conf", ErrDetail: err, Data: uc.User}
+	}
+	if findUser(s, u.IdentityStr()) != nil {
+		return utils.ErrInErr{ErrDesc: "user already exists", ErrDetail: utils.ErrInvalidData, Data: u.IdentityStr()}
+	}
+
+	if err = setUserLimits(uc); err != nil {
+		return err
+	}
+	if err = s.AddUser(u); err != nil {
+		return err
+	}
+	appendUserConf(s, uc)
+
+	if ce := utils.CanLogInfo("user added"); ce != nil {
+		ce.Write(zap.String("listen", s.GetTag()), zap.String("user", u.IdentityStr()))
+	}
+	return nil
+}
+
+func removeUser(s proxy.UserManagedServer, id string) error {
+	u := findUser(s, id)
+	if u == nil {
+		return utils.ErrInErr{ErrDesc: "no such user", ErrDetail: utils.ErrNoMatch, Data: id}
+	}
+	if len(s.AllUsers()) <= 1 {
+		return utils.ErrInErr{ErrDesc: "can't remove the last user", ErrDetail: utils.ErrInvalidData, Data: id}
+	}
+	if err := s.DelUser(u); err != nil {
+		return err
+	}
+	removeUserConf(s, id)
+	utils.UserRateLimits.Set(id, nil)
+
+	if ce := utils.CanLogInfo("user removed"); ce != nil {
+		ce.Write(zap.String("listen", s.GetTag()), zap.String("user", id))
+	}
+	return nil
+}
+
+// 生成新的切片, 以免影响 之前 dump 出的 ListenConf
+func appendUserConf(s proxy.UserManagedServer, uc utils.UserConf) {
+	lc := s.GetBase().ListenConf
+	lc.Users = append(append([]utils.UserConf{}, lc.Users...), uc)
+}
+
+// 从 ListenConf 中 删去 id 所对应的 UserConf; 若 Users 中没有, 则该用户 来自 UUID 项, 清空之.
+func removeUserConf(s proxy.UserManagedServer, id string) {
+	lc := s.GetBase().ListenConf
+
+	ucs := make([]utils.UserConf, 0, len(lc.Users))
+	found := false
+	for _, uc := range lc.Users {
+		if u, err := s.NewUserByConf(uc); err == nil && u.IdentityStr() == id {
+			found = true
+			continue
+		}
+		ucs = append(ucs, uc)
+	}
+	if found {
+		lc.Users = ucs
+	} else {
+		lc.UUID = ""
+	}
+}
@@ -0,0 +1,107 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/socks5"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/vmess"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const (
+	testUUID1 = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+	testUUID2 = "a684455c-b14f-11ea-bf0d-42010aaa0004"
+	testUUID3 = "a684455c-b14f-11ea-bf0d-42010aaa0005"
+)
+
+func newTestServer(t *testing.T, m *M, lc *proxy.ListenConf) {
+	s, err := proxy.NewServer(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.allServers = append(m.allServers, s)
+}
+
+func userIDs(t *testing.T, m *M, tag string) (ids []string) {
+	us, err := m.ListUsers(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range us {
+		ids = append(ids, u.IdentityStr())
+	}
+	return
+}
+
+func TestManageUsers(t *testing.T) {
+	m := New()
+
+	lc := &proxy.ListenConf{}
+	lc.Protocol = "vmess"
+	lc.Tag = "in"
+	lc.UUID = testUUID1
+	lc.IP = "127.0.0.1"
+	lc.Port = 1
+	newTestServer(t, m, lc)
+
+	if err := m.AddUser("in", utils.UserConf{User: testUUID2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddUser("in", utils.UserConf{User: testUUID2}); err == nil {
+		t.Fatal("should not add an existing user")
+	}
+	if err := m.AddUser("nope", utils.UserConf{User: testUUID3}); err == nil {
+		t.Fatal("should fail with unknown tag")
+	}
+	if ids := userIDs(t, m, "in"); len(ids) != 2 {
+		t.Fatal("add failed", ids)
+	}
+
+	if err := m.RotateUser("in", testUUID1, utils.UserConf{User: testUUID3}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := userIDs(t, m, "in"); len(ids) != 2 || ids[0] != testUUID2 || ids[1] != testUUID3 {
+		t.Fatal("rotate failed", ids)
+	}
+	if lc.UUID != "" || len(lc.Users) != 2 {
+		t.Fatal("listen conf not updated", lc.UUID, lc.Users)
+	}
+
+	if err := m.RemoveUser("in", testUUID2); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RemoveUser("in", testUUID3); err == nil {
+		t.Fatal("should not remove the last user")
+	}
+	if ids := userIDs(t, m, "in"); len(ids) != 1 || ids[0] != testUUID3 {
+		t.Fatal("remove failed", ids)
+	}
+	if len(lc.Users) != 1 || lc.Users[0].User != testUUID3 {
+		t.Fatal("listen conf not updated", lc.Users)
+	}
+}
+
+func TestRotateUserPassword(t *testing.T) {
+	m := New()
+
+	lc := &proxy.ListenConf{}
+	lc.Protocol = "socks5"
+	lc.Tag = "socks"
+	lc.IP = "127.0.0.1"
+	lc.Port = 1
+	lc.Users = []utils.UserConf{{User: "a", Pass: "1"}}
+	newTestServer(t, m, lc)
+
+	if err := m.RotateUser("socks", "a", utils.UserConf{User: "a", Pass: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := m.getUserManagedServer("socks")
+	us := s.(proxy.UserServer)
+	if us.AuthUserByStr("a\n1") != nil || us.AuthUserByStr("a\n2") == nil {
+		t.Fatal("password not rotated")
+	}
+	if len(lc.Users) != 1 || lc.Users[0].Pass != "2" {
+		t.Fatal("listen conf not updated", lc.Users)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"net/url"
 	"os"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -19,15 +18,44 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
 	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
-// statistics
+// statistics. 实现 netLayer.TrafficCounter
 type GlobalInfo struct {
 	ActiveConnectionCount      int32
 	AllDownloadBytesSinceStart uint64
 	AllUploadBytesSinceStart   uint64
+
+	FallbackCount uint64 //回落 命中次数
+
+	InTagTraffic  TagTrafficMap //按 inServer 的tag 统计的流量
+	OutTagTraffic TagTrafficMap //按 outClient 的tag 统计的流量
+
+	InHandshakeFailures  NamedCounters //按协议名 统计的 inServer 握手失败次数
+	OutHandshakeFailures NamedCounters //按协议名 统计的 outClient 握手失败次数
+
+	RouteCount NamedCounters //按 outtag 统计的 分流结果, 未分流的 计入 DefaultRouteStatKey
+}
+
+func (gi *GlobalInfo) AddDownload(n uint64) {
+	utils.AtomicAddUint64(&gi.AllDownloadBytesSinceStart, n)
+}
+
+func (gi *GlobalInfo) AddUpload(n uint64) {
+	utils.AtomicAddUint64(&gi.AllUploadBytesSinceStart, n)
+}
+
+// 从 wlc 或 udp_wlc 中 取出 inServer 握手所得的 User 的 IdentityStr; 若没有, 返回空字符串
+func getUserIdentityStr(wlc net.Conn, udp_wlc netLayer.MsgConn) string {
+	if uc, ok := wlc.(utils.User); ok {
+		return uc.IdentityStr()
+	} else if uc, ok := udp_wlc.(utils.User); ok {
+		return uc.IdentityStr()
+	}
+	return ""
 }
 
 var (
@@ -89,7 +117,7 @@ func ListenSer(inServer proxy.Server, defaultOutClient proxy.Client, env *proxy.
 			tcpFunc = func(tcpInfo netLayer.TCPRequestInfo) {
 				passToOutClient(incomingInserverConnState{
 					inTag:         inServer.GetTag(),
-					useSniffing:   inServer.Sniffing(),
+					sniffConf:     inServer.GetSniffConf(),
 					wrappedConn:   tcpInfo.Conn,
 					defaultClient: defaultOutClient,
 					routingEnv:    env,
@@ -101,13 +129,17 @@ func ListenSer(inServer proxy.Server, defaultOutClient proxy.Client, env *proxy.
 		if udp == 1 {
 
 			udpFunc = func(udpInfo netLayer.UDPRequestInfo) {
-				passToOutClient(incomingInserverConnState{
+				iics := incomingInserverConnState{
 					inTag:         inServer.GetTag(),
-					useSniffing:   inServer.Sniffing(),
+					sniffConf:     inServer.GetSniffConf(),
 					defaultClient: defaultOutClient,
 					routingEnv:    env,
 					GlobalInfo:    gi,
-				}, false, nil, udpInfo.MsgConn, udpInfo.Target)
+				}
+				if udpInfo.Source != nil {
+					iics.cachedRemoteAddr = udpInfo.Source.String()
+				}
+				passToOutClient(iics, false, nil, udpInfo.MsgConn, udpInfo.Target)
 			}
 		}
 		closer = inServer.(proxy.ListenerServer).StartListen(tcpFunc, udpFunc)
@@ -489,6 +521,7 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 	wlc, udp_wlc, targetAddr, err = inServer.Handshake(iics.wrappedConn)
 
 	if err != nil {
+		iics.GlobalInfo.addInHandshakeFailure(inServer.Name())
 
 		if ce := iics.CanLogWarn("Failed handshakeInserver"); ce != nil {
 			ce.Write(
@@ -523,7 +556,30 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 
 	////////////////////////////// 内层mux阶段 /////////////////////////////////////
 
-	if muxInt, innerProxyName := inServer.HasInnerMux(); muxInt > 0 {
+	var session innerMux.Session
+	var innerProxyName string
+
+	if wlc != nil && innerMux.IsSingMuxAddr(targetAddr) {
+		//sing-mux 不依赖 mux 命令, 任何 代理协议 都可以 使用
+		innerProxyName = "singmux"
+
+		var err2 error
+		session, err2 = innerMux.NewSingMuxServerSession(wlc)
+		if err2 != nil {
+			if ce := iics.CanLogWarn("Failed in sing-mux server session creation"); ce != nil {
+				ce.Write(zap.Error(err2))
+			}
+			err = err2
+			return
+		}
+
+	} else if wlc != nil && innerMux.IsMuxCoolAddr(targetAddr) {
+		//vmess 与 vless v0 的 mux 命令, 以及 其它 代理协议 的 v1.mux.cool 目标, 都 开启 Mux.Cool
+		innerProxyName = innerMux.MuxCool
+
+		session = innerMux.NewMuxCoolServerSession(wlc)
+
+	} else if muxInt, name := inServer.HasInnerMux(); muxInt > 0 {
 		mm, ok := wlc.(proxy.MuxMarker)
 		if !ok {
 			return
@@ -531,6 +587,17 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 		if !mm.IsMux() {
 			return
 		}
+		innerProxyName = name
+
+		session = inServer.GetServerInnerMuxSession(mm)
+
+		if session == nil {
+			err = utils.ErrFailed
+			return
+		}
+	}
+
+	if session != nil {
 
 		innerSerConf := proxy.ListenConf{
 			CommonConf: proxy.CommonConf{
@@ -541,25 +608,19 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 		innerSer, err2 := proxy.NewServer(&innerSerConf)
 		if err2 != nil {
 			if ce := iics.CanLogDebug("Failed mux inner proxy server creation"); ce != nil {
-				ce.Write(zap.Error(err))
+				ce.Write(zap.Error(err2))
 			}
+			session.Close()
 			err = err2
 			return
 		}
 
-		session := inServer.GetServerInnerMuxSession(mm)
-
-		if session == nil {
-			err = utils.ErrFailed
-			return
-		}
-
 		//内层mux要对每一个子连接单独进行 子代理协议握手 以及 outClient的拨号。
 
 		go func() {
 
 			for {
-				if ce := iics.CanLogDebug("Try inServer accept smux stream "); ce != nil {
+				if ce := iics.CanLogDebug("Try inServer accept inner mux stream "); ce != nil {
 					ce.Write()
 				}
 
@@ -581,6 +642,8 @@ func handshakeInserver(iics *incomingInserverConnState) (wlc net.Conn, udp_wlc n
 					wlc1, udp_wlc1, targetAddr1, err1 := innerSer.Handshake(stream)
 
 					if err1 != nil {
+						iics.GlobalInfo.addInHandshakeFailure(innerSer.Name())
+
 						if ce := iics.CanLogDebug("Failed inServer mux inner proxy handshake"); ce != nil {
 							ce.Write(zap.Error(err1))
 						}
@@ -694,6 +757,8 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 		fallbackTargetAddr, fbResult := iics.checkfallback()
 		if fbResult >= 0 {
+			iics.GlobalInfo.addFallbackHit()
+
 			targetAddr = fallbackTargetAddr
 			wlc = iics.wrappedConn
 
@@ -966,23 +1031,28 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 	////////////////////////////// Sniff阶段 /////////////////////////////////////
 
-	//tls请求和纯http请求是可以嗅探 host的，嗅探可以帮助我们使用 geosite 精准分流，所以是很有用的
+	//tls请求和纯http请求是可以嗅探 host的，udp 的 quic 请求 可以嗅探 sni, 嗅探可以帮助我们使用 geosite 精准分流，所以是很有用的
 
 	if len(iics.firstPayload) > 0 {
 
-		inserverMarkedSniffing := false
+		var sniffConf *proxy.SniffConf
 
 		if inServer == nil {
-			inserverMarkedSniffing = iics.useSniffing
+			sniffConf = iics.sniffConf
 		} else {
-			inserverMarkedSniffing = inServer.Sniffing()
+			sniffConf = inServer.GetSniffConf()
 		}
+		inserverMarkedSniffing := sniffConf != nil && sniffConf.Enable
 
 		dialIslazy := iics.defaultClient.IsLazyTls()
 
 		shouldSniff := inserverMarkedSniffing || dialIslazy
 
-		if shouldSniff {
+		isudp := targetAddr.IsUDP()
+
+		var sniffedName, sniffedBy string
+
+		if shouldSniff && !isudp {
 			tlsSniff = new(tlsLayer.ComSniff)
 
 			if !iics.isTlsLazyServerEnd {
@@ -991,17 +1061,77 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 			tlsSniff.CommonDetect(iics.firstPayload, true, inserverMarkedSniffing && !(iics.isTlsLazyServerEnd || dialIslazy))
 
-			if sni := tlsSniff.SniffedServerName; sni != "" {
-				if ce := iics.CanLogDebug("Sniffed Sni"); ce != nil {
-					ce.Write(zap.String("sni", sni))
+			//lazy 需要 tls的嗅探结果, 但 只有 开启了 tls嗅探器 时 才将 sni 用于 分流
+			if sni := tlsSniff.SniffedServerName; sni != "" && (!inserverMarkedSniffing || sniffConf.IsSnifferEnabled(netLayer.ProtocolTLS)) {
+				sniffedName, sniffedBy = sni, netLayer.ProtocolTLS
+			}
+		}
+
+		if sniffedName == "" && inserverMarkedSniffing {
+			if isudp {
+				if tlsLayer.SniffQUIC != nil && sniffConf.IsSnifferEnabled(netLayer.ProtocolQUIC) {
+					sniffedName, sniffedBy = tlsLayer.SniffQUIC(iics.firstPayload), netLayer.ProtocolQUIC
+				}
+			} else if sniffConf.IsSnifferEnabled(netLayer.ProtocolHTTP) {
+				sniffedName, sniffedBy = httpLayer.SniffHost(iics.firstPayload), netLayer.ProtocolHTTP
+			}
+		}
+
+		if sniffedName != "" {
+			if ce := iics.CanLogDebug("Sniffed host"); ce != nil {
+				ce.Write(zap.String("host", sniffedName), zap.String("by", sniffedBy))
+			}
+
+			override := sniffConf != nil && sniffConf.OverrideDest
+
+			//udp 的首包 一般 就是发往 targetAddr 的, 此时 一并修改
+			if isudp && iics.udpFirstTarget.Port == targetAddr.Port && iics.udpFirstTarget.IP.Equal(targetAddr.IP) {
+				iics.udpFirstTarget.Name = sniffedName
+				if override {
+					iics.udpFirstTarget.IP = nil
 				}
+			}
 
-				targetAddr.Name = sni
+			targetAddr.Name = sniffedName
+
+			//不覆盖时 保留原ip, 因为 Addr 拨号时 优先使用 ip, 所以 域名 只用于分流
+			if override {
+				targetAddr.IP = nil
 			}
 		}
 
 	}
 
+	////////////////////////////// FakeIP 还原阶段 /////////////////////////////////////
+
+	//tun 和 tproxy 拿到的目标 可能是 我们的dns 分配的 假ip, 要在 dns解析 和 分流 之前 还原为 域名,
+	// 这样 即使 嗅探失败, 也可以 按域名分流.
+	//对于 udp, 后续的 消息 由 FakeIPMsgConn 还原, 回写时 再换回 假ip.
+
+	if re := iics.routingEnv; re != nil && re.DnsMachine != nil && re.DnsMachine.FakeIP != nil {
+		fakeAddr := targetAddr
+		restored := false
+
+		if udp_wlc != nil && targetAddr.IsUDP() {
+			fc := netLayer.NewFakeIPMsgConn(udp_wlc, re.DnsMachine)
+			restored = fc.Restore(&targetAddr)
+			if len(iics.firstPayload) > 0 && fc.Restore(&iics.udpFirstTarget) {
+				restored = true
+			}
+			if restored {
+				udp_wlc = fc
+			}
+		} else {
+			restored = re.DnsMachine.RestoreFakeIP(&targetAddr)
+		}
+
+		if restored {
+			if ce := iics.CanLogDebug("FakeIP restored"); ce != nil {
+				ce.Write(zap.String("fakeip", fakeAddr.String()), zap.String("domain", targetAddr.Name))
+			}
+		}
+	}
+
 	////////////////////////////// DNS解析阶段 /////////////////////////////////////
 
 	//dns解析会试图解析域名并将ip放入 targetAddr中
@@ -1031,6 +1161,7 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 	var client proxy.Client = iics.defaultClient
 	routed := false
+	routedTag := proxy.DirectName //分流到direct时 不会再被赋值
 
 	//尝试分流, 获取到真正要发向 的 outClient
 	if re := iics.routingEnv; re != nil && re.RoutePolicy != nil && !(inServer != nil && inServer.CantRoute()) {
@@ -1043,10 +1174,11 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 		} else {
 			desc.InTag = iics.inTag
 		}
-		if uc, ok := wlc.(utils.User); ok {
-			desc.UserIdentityStr = uc.IdentityStr()
-		} else if uc, ok := udp_wlc.(utils.User); ok {
-			desc.UserIdentityStr = uc.IdentityStr()
+		desc.UserIdentityStr = getUserIdentityStr(wlc, udp_wlc)
+		desc.SourceIP = iics.getRealRIP()
+
+		if len(iics.firstPayload) > 0 {
+			desc.Protocol = netLayer.SniffProtocol(iics.firstPayload, targetAddr.IsUDP())
 		}
 
 		if ce := iics.CanLogDebug("Try routing"); ce != nil {
@@ -1055,10 +1187,26 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 		outtag := re.RoutePolicy.CalcuOutTag(desc)
 
-		if len(re.ClientsTagMap) > 0 {
+		if balancedC, done := re.GetBalancedClient(outtag); balancedC != nil {
+			defer done()
+
+			client = balancedC
+			routed = true
+			routedTag = outtag
+			if ce := iics.CanLogInfo("Route to balancer"); ce != nil {
+				ce.Write(
+					zap.String("balancer", outtag),
+					zap.String("picked", client.GetTag()),
+					zap.String("with addr", client.AddrStr()),
+					zap.String("and protocol", proxy.GetFullName(client)),
+					zap.Any("for source", desc),
+				)
+			}
+		} else if len(re.ClientsTagMap) > 0 {
 			if tagC := re.GetClient(outtag); tagC != nil {
 				client = tagC
 				routed = true
+				routedTag = outtag
 				if ce := iics.CanLogInfo("Route"); ce != nil {
 					ce.Write(
 						zap.String("to outtag", outtag),
@@ -1083,7 +1231,11 @@ func passToOutClient(iics incomingInserverConnState, isfallback bool, wlc net.Co
 
 	}
 
-	if !routed {
+	if routed {
+		iics.GlobalInfo.addRoute(routedTag)
+	} else {
+		iics.GlobalInfo.addRoute(DefaultRouteStatKey)
+
 		if ce := iics.CanLogDebug("Default Route"); ce != nil {
 			ce.Write(
 				zap.Any("source", targetAddr.String()),
@@ -1205,7 +1357,8 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 
 			client.Lock()
 
-			if client.InnerMuxEstablished() {
+			//只取一次, 否则 判断时 与 使用时 得到的 可能 不是 同一个 会话
+			if muxSession := client.GetClientInnerMuxSession(nil); muxSession != nil {
 				client.Unlock()
 
 				if ce := iics.CanLogInfo("Mux Request"); ce != nil {
@@ -1217,7 +1370,7 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 					)
 				}
 
-				wrc1, realudp_wrc, result1 := dialInnerProxy(iics, client, wlc, nil, innerProxyName, targetAddr, isudp)
+				wrc1, realudp_wrc, result1 := dialInnerProxy(iics, client, wlc, muxSession, innerProxyName, targetAddr, isudp)
 
 				if result1 == 0 {
 					if wrc1 != nil {
@@ -1307,10 +1460,10 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 		realTargetAddr.Network = targetAddr.Network
 	}
 
-	dialhere := !(client.Name() == proxy.DirectName)
+	dialhere := !(client.Name() == proxy.DirectName || client.SelfDial())
 
 	/*
-		direct的udp是自己拨号的，因为它用到了udp的fullcone
+		direct的udp是自己拨号的，因为它用到了udp的fullcone; hysteria2 则是自己拨号quic
 
 		不是的话，也要分情况:
 		如果是单路的, 则我们在此dial, 如果是多路复用, 则不行, 因为要复用同一个连接
@@ -1360,7 +1513,11 @@ func dialClient(iics incomingInserverConnState, targetAddr netLayer.Addr,
 			na = client.LocalUDPAddr()
 		}
 
-		clientConn, err = realTargetAddr.Dial(client.GetSockopt(), na)
+		if via := client.GetBase().GetVia(); via != "" {
+			clientConn, err = dialVia(iics, client, via, realTargetAddr)
+		} else {
+			clientConn, err = realTargetAddr.Dial(client.GetSockopt(), na)
+		}
 
 		if err != nil {
 			if err == netLayer.ErrMachineCantConnectToIpv6 {
@@ -1576,8 +1733,17 @@ shakeStep:
 			}
 		}
 
-		wrc, err = client.Handshake(clientConn, ed, targetAddr)
+		handshakeTarget := targetAddr
+		if hasInnerMux && client.GetBase().UseSingMux() {
+			handshakeTarget = innerMux.SingMuxAddr()
+		} else if hasInnerMux && client.GetBase().UseMuxCool() {
+			handshakeTarget = innerMux.MuxCoolAddr()
+		}
+
+		wrc, err = client.Handshake(clientConn, ed, handshakeTarget)
 		if err != nil {
+			iics.GlobalInfo.addOutHandshakeFailure(client.Name())
+
 			if ce := iics.CanLogErr("Failed in Handshake client"); ce != nil {
 				ce.Write(
 					zap.String("target", targetAddr.String()),
@@ -1597,6 +1763,8 @@ shakeStep:
 
 		udp_wrc, err = client.EstablishUDPChannel(clientConn, iics.firstPayload, theAddr)
 		if err != nil {
+			iics.GlobalInfo.addOutHandshakeFailure(client.Name())
+
 			if ce := iics.CanLogErr("Failed in EstablishUDPChannel"); ce != nil {
 				ce.Write(
 					zap.String("target", targetAddr.String()),
@@ -1610,29 +1778,80 @@ shakeStep:
 
 	////////////////////////////// 建立内层 mux 阶段 /////////////////////////////////////
 	if hasInnerMux {
-		//我们目前的实现中，mux统一使用smux v1, 即 smux.DefaultConfig返回的值。这可以兼容trojan-go的实现。
+		//传统模式 使用 smux v1, 即 smux.DefaultConfig返回的值, 这可以兼容trojan-go的实现; 配置了 mux_conf.protocol 时 使用 sing-mux。
 
-		wrc, udp_wrc, result = dialInnerProxy(iics, client, wlc, wrc, innerProxyName, targetAddr, isudp)
+		wrc, udp_wrc, result = dialInnerProxy(iics, client, wlc, client.GetClientInnerMuxSession(wrc), innerProxyName, targetAddr, isudp)
 	}
 
 	return
 } //dialClient
 
+// 在 dialClient 中调用, 通过 tag 为 via 的 client 拨号 到 addr (即 client 的 地址), 所得连接 作为 client 的 底层连接.
+// via 的 client 自己 也可以 有 via, 由此 形成 任意长度的 链, 如 socks5 -> trojan -> vless.
+//
+// addr 为 udp 时 (client 的 传输层 为 udp), 使用 via 的 EstablishUDPChannel, 需要 via 的 协议 支持 udp.
+func dialVia(iics incomingInserverConnState, client proxy.Client, via string, addr netLayer.Addr) (net.Conn, error) {
+	if iics.routingEnv == nil {
+		return nil, utils.ErrInErr{ErrDesc: "dialVia failed, no routing env to find the via client", Data: via}
+	}
+	viaClient := iics.routingEnv.GetClient(via)
+	if viaClient == nil {
+		return nil, utils.ErrInErr{ErrDesc: "dialVia failed, via client not found", Data: via}
+	}
+	if viaClient == client {
+		return nil, utils.ErrInErr{ErrDesc: "dialVia failed, client can't dial via itself", Data: via}
+	}
+	for _, c := range iics.viaChain {
+		if c == viaClient {
+			return nil, utils.ErrInErr{ErrDesc: "dialVia failed, loop in via chain", Data: via}
+		}
+	}
+
+	if ce := iics.CanLogDebug("dial via"); ce != nil {
+		ce.Write(
+			zap.String("via", via),
+			zap.String("target", addr.UrlString()),
+		)
+	}
+
+	newiics := iics
+	newiics.viaChain = append(append([]proxy.Client{}, iics.viaChain...), client)
+	newiics.firstPayload = nil
+	newiics.fallbackXver = -1
+	newiics.routedToDirect = false
+
+	wrc, udp_wrc, _, _, result := dialClient(newiics, addr, viaClient, nil, nil, false)
+	if result != 0 {
+		return nil, utils.ErrInErr{ErrDesc: "dialVia failed", Data: via}
+	}
+
+	if udp_wrc != nil {
+		return netLayer.MsgConnNetAdapter{MsgConn: udp_wrc, RA: addr.ToAddr()}, nil
+	}
+	if c, ok := wrc.(net.Conn); ok {
+		return c, nil
+	}
+	return &netLayer.IOWrapper{
+		Reader: wrc,
+		Writer: wrc,
+		Closer: wrc,
+	}, nil
+}
+
 // 在 dialClient 中调用。 如果调用不成功，则result < 0. 若成功, 则 result == 0.
-func dialInnerProxy(iics incomingInserverConnState, client proxy.Client, wlc net.Conn, wrc io.ReadWriteCloser, innerProxyName string, targetAddr netLayer.Addr, isudp bool) (realwrc io.ReadWriteCloser, realudp_wrc netLayer.MsgConn, result int) {
+func dialInnerProxy(iics incomingInserverConnState, client proxy.Client, wlc net.Conn, muxSession innerMux.Session, innerProxyName string, targetAddr netLayer.Addr, isudp bool) (realwrc io.ReadWriteCloser, realudp_wrc netLayer.MsgConn, result int) {
 
-	smuxSession := client.GetClientInnerMuxSession(wrc)
-	if smuxSession == nil {
+	if muxSession == nil {
 		result = -1
-		if ce := iics.CanLogErr("Failed dialInnerProxy, smuxSession == nil"); ce != nil {
+		if ce := iics.CanLogErr("Failed dialInnerProxy, muxSession == nil"); ce != nil {
 			ce.Write()
 		}
 		return
 	}
 
-	stream, err := smuxSession.OpenStream()
+	stream, err := muxSession.OpenStream()
 	if err != nil {
-		client.CloseInnerMuxSession() //发现就算 OpenStream 失败, session也不会自动被关闭, 需要我们手动关一下。
+		muxSession.Close() //发现就算 OpenStream 失败, session也不会自动被关闭, 需要我们手动关一下。
 
 		if ce := iics.CanLogWarn("Failed dialInnerProxy"); ce != nil {
 			ce.Write(zap.Error(err))
@@ -1704,6 +1923,11 @@ func dialClient_andRelay(iics incomingInserverConnState, targetAddr netLayer.Add
 		}
 	}
 
+	if bc, ok := wlc.(proxy.BindConn); ok {
+		relayBind(iics, targetAddr, bc, client)
+		return
+	}
+
 	wrc, udp_wrc, realTargetAddr, clientEndRemoteClientTlsRawReadRecorder, result := dialClient(iics, targetAddr, client, wlc, udp_wlc, isTlsLazy_clientEnd)
 	if result != 0 {
 		return
@@ -1740,16 +1964,13 @@ func dialClient_andRelay(iics incomingInserverConnState, targetAddr netLayer.Add
 
 		}
 
-		if gi := iics.GlobalInfo; gi != nil {
-			atomic.AddInt32(&gi.ActiveConnectionCount, 1)
+		userID := getUserIdentityStr(wlc, nil)
+		tc, endStat := iics.startTrafficStat(client, userID)
+		upLimit, downLimit := iics.getRateLimiters(client, userID)
 
-			netLayer.Relay(&realTargetAddr, wrc, wlc, iics.id, &gi.AllDownloadBytesSinceStart, &gi.AllUploadBytesSinceStart)
+		netLayer.Relay(&realTargetAddr, wrc, wlc, iics.id, tc, upLimit, downLimit)
 
-			atomic.AddInt32(&gi.ActiveConnectionCount, -1)
-		} else {
-			netLayer.Relay(&realTargetAddr, wrc, wlc, iics.id, nil, nil)
-
-		}
+		endStat()
 
 		return
 
@@ -1759,23 +1980,16 @@ func dialClient_andRelay(iics incomingInserverConnState, targetAddr netLayer.Add
 			udp_wrc.WriteMsg(ffb.Bytes(), targetAddr)
 		}
 
-		var ac *int32
-		var adc *uint64
-		var auc *uint64
-		if iics.GlobalInfo != nil {
-			ac = &iics.GlobalInfo.ActiveConnectionCount
-			adc = &iics.GlobalInfo.AllDownloadBytesSinceStart
-			auc = &iics.GlobalInfo.AllUploadBytesSinceStart
-			atomic.AddInt32(ac, 1)
-
-		}
+		userID := getUserIdentityStr(nil, udp_wlc)
+		tc, endStat := iics.startTrafficStat(client, userID)
+		upLimit, downLimit := iics.getRateLimiters(client, userID)
 
 		if client.IsUDP_MultiChannel() {
 			if ce := iics.CanLogDebug("Relaying UDP with MultiChannel"); ce != nil {
 				ce.Write()
 			}
 
-			netLayer.RelayUDP_separate(udp_wrc, udp_wlc, &targetAddr, adc, auc, func(raddr netLayer.Addr) netLayer.MsgConn {
+			netLayer.RelayUDP_separate(udp_wrc, udp_wlc, &targetAddr, tc, upLimit, downLimit, func(raddr netLayer.Addr) netLayer.MsgConn {
 				if ce := iics.CanLogDebug("Relaying UDP with MultiChannel,dialfunc called"); ce != nil {
 					ce.Write()
 				}
@@ -1794,16 +2008,129 @@ func dialClient_andRelay(iics incomingInserverConnState, targetAddr netLayer.Add
 			})
 
 		} else {
-			netLayer.RelayUDP(udp_wrc, udp_wlc, adc, auc)
+			netLayer.RelayUDP(udp_wrc, udp_wlc, tc, upLimit, downLimit)
 
 		}
 
-		if ac != nil {
-			atomic.AddInt32(ac, -1)
+		endStat()
+
+		return
+	}
+
+}
+
+// 处理 inServer 返回的 proxy.BindConn. 只有 分流到 direct 时 才会 在本机 等待 目标主机 连入,
+// 之后 与 普通连接 一样 统计流量 并 限速 地 转发.
+func relayBind(iics incomingInserverConnState, targetAddr netLayer.Addr, bc proxy.BindConn, client proxy.Client) {
+	var wrc net.Conn
+	var peerAddr netLayer.Addr
+	var err error
 
+	if client.Name() == proxy.DirectName {
+		wrc, peerAddr, err = bc.AcceptBound()
+
+	} else if bindClient, ok := client.(proxy.BindClient); ok {
+		wrc, peerAddr, err = bindThroughClient(iics, targetAddr, bc, bindClient)
+
+	} else {
+		bc.RejectBind()
+
+		if ce := iics.CanLogWarn("Bind request not routed to direct or a client supporting bind, rejected"); ce != nil {
+			ce.Write(zap.String("outClient", client.GetTag()))
 		}
+		return
+	}
 
+	if err != nil {
+		if ce := iics.CanLogWarn("Failed in bind"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
 		return
 	}
 
+	if len(iics.firstPayload) > 0 {
+		_, err = wrc.Write(iics.firstPayload)
+		if err != nil {
+			wrc.Close()
+			if ce := iics.CanLogWarn("Failed in bind, write first payload"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			return
+		}
+	}
+
+	userID := getUserIdentityStr(bc, nil)
+	tc, endStat := iics.startTrafficStat(client, userID)
+	upLimit, downLimit := iics.getRateLimiters(client, userID)
+
+	netLayer.Relay(&peerAddr, wrc, bc, iics.id, tc, upLimit, downLimit)
+
+	endStat()
+}
+
+// 通过 上游 进行 BIND, 并将 上游的 两个回复 转告 客户端. 目前 只支持 不带 tls 和 高级层 的 client.
+func bindThroughClient(iics incomingInserverConnState, targetAddr netLayer.Addr, bc proxy.BindConn, client proxy.BindClient) (net.Conn, netLayer.Addr, error) {
+	if client.IsUseTLS() || client.AdvancedLayer() != "" || client.GetBase().GetVia() != "" {
+		bc.RejectBind()
+		return nil, netLayer.Addr{}, utils.ErrInErr{ErrDesc: "bind through client with tls, advLayer or via not supported", ErrDetail: utils.ErrUnImplemented, Data: client.GetTag()}
+	}
+
+	serverAddr, err := netLayer.NewAddr(client.AddrStr())
+	if err != nil {
+		bc.ReplyBind(netLayer.Addr{}, err)
+		return nil, netLayer.Addr{}, err
+	}
+
+	if ce := iics.CanLogInfo("Bind Request"); ce != nil {
+		ce.Write(
+			zap.String("From", iics.cachedRemoteAddr),
+			zap.String("Target", targetAddr.UrlString()),
+			zap.String("through", proxy.GetVSI_url(client, "tcp")),
+		)
+	}
+
+	underlay, err := serverAddr.Dial(client.GetSockopt(), client.LocalTCPAddr())
+	if err != nil {
+		bc.ReplyBind(netLayer.Addr{}, err)
+		return nil, netLayer.Addr{}, err
+	}
+
+	bindAddr, err := client.Bind(underlay, targetAddr)
+	if err == nil {
+		err = bc.ReplyBind(bindAddr, nil)
+	} else {
+		bc.ReplyBind(netLayer.Addr{}, err)
+	}
+	if err != nil {
+		underlay.Close()
+		return nil, netLayer.Addr{}, err
+	}
+
+	peerAddr, err := client.ReadBindReply(underlay)
+	if err == nil {
+		err = bc.ReplyBind(peerAddr, nil)
+	} else {
+		bc.ReplyBind(netLayer.Addr{}, err)
+	}
+	if err != nil {
+		underlay.Close()
+		return nil, netLayer.Addr{}, err
+	}
+
+	return underlay, peerAddr, nil
+}
+
+// 通过 client 拨号到 target, 返回 已完成握手的连接. 用于 不经过 inServer 的场合, 如 proxy.Balancer 的健康检查.
+// 实现 proxy.ClientDialFunc
+func DialThroughClient(client proxy.Client, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	iics := incomingInserverConnState{
+		fallbackXver: -1,
+	}
+	iics.genID()
+
+	wrc, _, _, _, result := dialClient(iics, target, client, nil, nil, false)
+	if result != 0 {
+		return nil, utils.ErrInErr{ErrDesc: "DialThroughClient failed", ErrDetail: utils.ErrFailed, Data: result}
+	}
+	return wrc, nil
 }
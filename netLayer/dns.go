@@ -7,7 +7,7 @@ import (
 	"os"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"github.com/miekg/dns"
@@ -55,20 +55,26 @@ func Is_DNSQuery_returnType_ReadFatalErr(err error) bool {
 // 如果从conn中Read后成功返回, 则可能返回如下几种错误 os.ErrNotExist (表示查无此记录), dns.ErrRcode (表示dns返回的 Rcode 不是 dns.RcodeSuccess), ErrRecursion,
 // 如果不是这三个error, 那就是 从 该 conn 读取数据时出错了.
 func DNSQuery(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex, recursionCount int) (ip net.IP, ttl uint32, err error) {
-	m := new(dns.Msg)
-	m.SetQuestion((domain), dns_type) //为了更快，不使用 dns.Fqdn, 请调用之前先确保ok
-	c := new(dns.Client)
-
 	if theMux == nil {
 		theMux = &globalDnsQueryMutex
 	}
+	c := new(dns.Client)
 
-	theMux.Lock()
+	return dnsQuery(domain, dns_type, func(m *dns.Msg) (r *dns.Msg, err error) {
+		theMux.Lock()
+		r, _, err = c.ExchangeWithConn(m, conn)
+		theMux.Unlock()
+		return
+	}, recursionCount)
+}
 
-	var r *dns.Msg
-	r, _, err = c.ExchangeWithConn(m, conn)
+// 同 DNSQuery, 但 通过 exchange 收发 dns消息. exchange 需自行保证 并发安全.
+func dnsQuery(domain string, dns_type uint16, exchange func(m *dns.Msg) (*dns.Msg, error), recursionCount int) (ip net.IP, ttl uint32, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion((domain), dns_type) //为了更快，不使用 dns.Fqdn, 请调用之前先确保ok
 
-	theMux.Unlock()
+	var r *dns.Msg
+	r, err = exchange(m)
 
 	if r == nil {
 		if ce := utils.CanLogErr("dns query read err"); ce != nil {
@@ -121,7 +127,7 @@ func DNSQuery(domain string, dns_type uint16, conn *dns.Conn, theMux *sync.Mutex
 				err = ErrRecursion
 				return
 			}
-			return DNSQuery(dns.Fqdn(aa.Target), dns_type, conn, theMux, recursionCount+1)
+			return dnsQuery(dns.Fqdn(aa.Target), dns_type, exchange, recursionCount+1)
 		}
 	}
 
@@ -138,26 +144,55 @@ type DnsConn struct {
 	// 这样就不会造成并发时的混乱
 	mutex sync.Mutex
 
-	garbageMark bool
+	garbageMark bool //重新拨号 失败时 设置, 之后 被 DNSMachine.removeConn 移除. 在 mutex 中 写入
+
+	exchanger DnsExchanger //DoH, DoQ 时 非空, 此时 不使用 Conn
 }
 
-type IPRecord struct {
-	IP         net.IP
-	TTL        uint32 //seconds
-	RecordTime time.Time
+// 是否有 可用于查询 的 底层连接 或 exchanger
+func (c *DnsConn) usable() bool {
+	return c.Conn != nil || c.exchanger != nil
+}
+
+// 向 该服务器 发送 m 并返回响应. garbage 为 true 表示 该 DnsConn 已废, 调用者 应将其 移除.
+//
+// 如果是读取的、非timeout的错误，那么我们直接认为底层连接出故障了, 会重新dial, 但并不再次查询.
+// 因为 miekg/dns 包会设置timeout，所以确实要筛除timeout的情况. DoH 和 DoQ 自行管理底层连接, 无需重新拨号.
+// 重新dial 也在 mutex 中 进行, 这样 并发的查询 不会 同时 重新dial, 也不会 用到 正在被替换的 Conn.
+func (c *DnsConn) exchange(m *dns.Msg) (r *dns.Msg, garbage bool, err error) {
+	if c.exchanger != nil {
+		r, err = c.exchanger.Exchange(m)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r, _, err = new(dns.Client).ExchangeWithConn(m, c.Conn)
+
+	if err != nil && !c.garbageMark && Is_DNSQuery_returnType_ReadFatalErr(err) {
+		c.Conn.Close()
+		if e := c.Dial(); e != nil {
+			//再dial还是错误？那么就废了，
+			if ce := utils.CanLogErr("[DNSMachine] Re-Dial Dns Server Failed"); ce != nil {
+				ce.Write(zap.Error(e))
+			}
+			c.garbageMark = true
+		}
+	}
+	return r, c.garbageMark, err
 }
 
 // dns machine维持与多个dns服务器的连接(最好是udp这种无状态的)，并可以发起dns请求。
-// 会缓存dns记录; 该设施是一个状态机, 所以叫 DNSMachine。
+// 会缓存 完整的dns响应, 包括 任意记录类型 以及 否定响应; 该设施是一个状态机, 所以叫 DNSMachine。
 // SpecialIPPollicy 用于指定特殊的 域名-ip 映射，这样遇到这种域名时，不经过dns查询，直接返回预设ip。
-// SpecialServerPollicy 用于为特殊的 域名指定特殊的 dns服务器，这样遇到这种域名时，会通过该特定服务器查询。
+// SpecialServerPollicy 用于为特殊的 域名指定特殊的 dns服务器，这样遇到这种域名 及其子域名 时，会通过该特定服务器查询。
 type DNSMachine struct {
 	TypeStrategy int64  // 0, 4, 6, 40, 60
 	TTLStrategy  uint32 // 0, 1, arbitrary，见 DnsConf 中的定义
 
 	defaultConn DnsConn
 	conns       map[string]*DnsConn
-	cache       map[string]IPRecord //cache的key统一为 未经 Fqdn包装过的域名. 即尾部没有点号
+	cache       map[dnsCacheKey]*dnsCacheRecord
 
 	SpecialIPPollicy map[string][]netip.Addr
 
@@ -168,6 +203,18 @@ type DNSMachine struct {
 	listening bool
 	listenUrl string
 	server    *dns.Server
+
+	cacheHitCount  uint64 //原子更新
+	cacheMissCount uint64 //原子更新
+
+	outboundDial atomic.Value //DnsOutboundDialFunc
+
+	FakeIP *FakeIPPool //非空时, 对外提供的 dns服务 对 A 和 AAAA 查询 返回 假ip, 见 fakeip.go
+}
+
+// 返回 自启动以来 Exchange 命中/未命中 缓存(包括 SpecialIPPollicy) 的次数. QueryType 与 ServeDNS 都通过 Exchange 查询.
+func (dm *DNSMachine) CacheStat() (hit, miss uint64) {
+	return atomic.LoadUint64(&dm.cacheHitCount), atomic.LoadUint64(&dm.cacheMissCount)
 }
 
 // Dial通过 c 内部设置好的地址进行拨号,并将 c.Conn.Conn 设为 新建立好的连接
@@ -211,7 +258,7 @@ func DialDnsAddr(addr *Addr) (conn net.Conn, err error) {
 		conn, err = addr.Dial(nil, nil)
 
 	}
-	//todo: 以后支持DoH的话，要分离出https这个Network然后单独使用独特方法进行dial
+	//DoH 和 DoQ 不通过本函数拨号, 见 AddNewServerByURL
 
 	return
 }
@@ -225,30 +272,34 @@ func (dm *DNSMachine) SetDefaultConn(c net.Conn, addr *Addr) {
 // 添加一个 特定的DNS服务器 , name为该dns服务器的名称. 若dm.DefaultConn.Conn为空, 则会设为 dm.DefaultConn
 func (dm *DNSMachine) AddNewServer(name string, addr *Addr) error {
 
-	if dm.defaultConn.Conn == nil { //若未配置过 DefaultConn
-		dm.defaultConn = DnsConn{Conn: new(dns.Conn), raddr: addr, Name: name}
-		err := dm.defaultConn.Dial()
-		if err != nil {
-			dm.defaultConn.Conn = nil
-			return err
-		}
-	} else {
-
-		dcc := &DnsConn{Conn: new(dns.Conn), raddr: addr, Name: name}
-		err := dcc.Dial()
-		if err != nil {
-			return err
-		}
-
-		if dm.conns == nil {
-			dm.conns = make(map[string]*DnsConn)
-		}
-		dm.conns[name] = dcc
+	dcc := &DnsConn{Conn: new(dns.Conn), raddr: addr, Name: name}
+	err := dcc.Dial()
+	if err != nil {
+		return err
 	}
-
+	dm.addDnsConn(dcc)
 	return nil
 }
 
+// 若未配置过 defaultConn, 则 dcc 成为 defaultConn, 否则 加入 conns
+func (dm *DNSMachine) addDnsConn(dcc *DnsConn) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if !dm.defaultConn.usable() {
+		dm.defaultConn.Conn = dcc.Conn
+		dm.defaultConn.exchanger = dcc.exchanger
+		dm.defaultConn.raddr = dcc.raddr
+		dm.defaultConn.Name = dcc.Name
+		dm.defaultConn.garbageMark = false
+		return
+	}
+	if dm.conns == nil {
+		dm.conns = make(map[string]*DnsConn)
+	}
+	dm.conns[dcc.Name] = dcc
+}
+
 func (dm *DNSMachine) Query(domain string) (ip net.IP) {
 	switch dm.TypeStrategy {
 	default:
@@ -271,184 +322,81 @@ func (dm *DNSMachine) Query(domain string) (ip net.IP) {
 	return
 }
 
-// 传入的domain必须是不带尾缀点号的domain, 即没有包过 Fqdn
+// 传入的domain必须是不带尾缀点号的domain, 即没有包过 Fqdn.
+// 若响应中 只有 CNAME, 会继续查询 其目标, 最多递归3次.
 func (dm *DNSMachine) QueryType(domain string, dns_type uint16) (ip net.IP, ttl uint32) {
-	var generalCacheHit bool // 若读到了 cache 或 SpecialIPPollicy 的项, 则 generalCacheHit 为 true
-
-	var theDNSServerConn *DnsConn
-	// ttl  //用于cache
-
-	defer func() {
-		if theDNSServerConn != nil && theDNSServerConn.garbageMark {
-			dm.mutex.Lock()
-			delete(dm.conns, theDNSServerConn.Name)
-			if theDNSServerConn == &dm.defaultConn {
-				//如果DefaultConn都废了，那就糟糕
-				//我们选一个备用的conn，升格为defaultConn
-
-				dm.defaultConn.Conn = nil
-
-				if len(dm.conns) > 0 {
-					for name, c := range dm.conns {
-						dm.defaultConn.Conn = c.Conn
-						dm.defaultConn.garbageMark = false
-						delete(dm.conns, name)
-						break
-					}
-				}
-				//没备用的，那就只好保持 dm.defaultConn.Conn 的 nil状态, 下一次dns查询就会失败
-
-			}
-			dm.mutex.Unlock()
-		}
 
-		if generalCacheHit {
+	for recursionCount := 0; recursionCount < 3; recursionCount++ {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(domain), dns_type)
 
-			if ce := utils.CanLogDebug("[DNSMachine] hit cache"); ce != nil {
-				ce.Write(zap.String("domain", domain), zap.String("ip", ip.String()))
+		r, err := dm.Exchange(m)
+		if err != nil {
+			if ce := utils.CanLogDebug("[DNSMachine] query failed"); ce != nil {
+				ce.Write(zap.String("domain", domain), zap.Error(err))
 			}
 			return
 		}
-
-		if len(ip) > 0 {
-			domain = strings.TrimSuffix(domain, ".")
-			if ce := utils.CanLogDebug("[DNSMachine] will add to cache"); ce != nil {
-				ce.Write(zap.String("domain", domain), zap.String("ip", ip.String()))
-			}
-
-			dm.mutex.Lock()
-			if dm.cache == nil {
-
-				dm.cache = make(map[string]IPRecord)
-			}
-
-			dm.cache[domain] = IPRecord{IP: ip, TTL: ttl, RecordTime: time.Now()}
-			dm.mutex.Unlock()
-		}
-	}()
-
-	// 查找步骤:
-	//先从 cache找，有的话，若符合TTL策略，就直接返回；不符合策略或者找不到的话，进入下面步骤：
-	//
-	//查 specialIPPollicy，类似cache，有就直接返回
-	//
-	// 查不到再找 specialServerPolicy 看有没有特殊的dns服务器
-	// 如果有指定服务器，用指定服务器查dns，若没有，用默认服务器查
-
-	if dm.cache != nil {
-
-		dm.mutex.RLock()
-		ipRecord, ok := dm.cache[domain]
-		dm.mutex.RUnlock()
-
-		if ok {
-
-			switch dm.TTLStrategy {
-			case 0: // no timeout
-			case 1: //strictly follow TTL
-				now := time.Now()
-				deadline := ipRecord.RecordTime.Add(time.Second * time.Duration(ipRecord.TTL))
-				if now.After(deadline) {
-					ok = false
-				}
-			default: //customized ttl
-				now := time.Now()
-				deadline := ipRecord.RecordTime.Add(time.Second * time.Duration(dm.TTLStrategy))
-				if now.After(deadline) {
-					ok = false
-				}
-			}
-
-			if ok {
-				ip = ipRecord.IP
-				generalCacheHit = true
-
-				return
-
-			} else {
-				dm.mutex.Lock()
-				delete(dm.cache, domain)
-				dm.mutex.Unlock()
+		if r.Rcode != dns.RcodeSuccess {
+			if ce := utils.CanLogDebug("[DNSMachine] query code err"); ce != nil {
+				//dns查不到的情况是很有可能的，所以还是放在debug日志里
+				ce.Write(zap.String("domain", domain), zap.Int("rcode", r.Rcode))
 			}
+			return
 		}
-	}
-
-	dm.mutex.RLock()
-	defer dm.mutex.RUnlock()
-
-	if dm.SpecialIPPollicy != nil {
-		if na := dm.SpecialIPPollicy[domain]; len(na) > 0 {
 
-			switch dns_type {
-			case dns.TypeA:
-				for _, a := range na {
-
-					if a.Is4() || a.Is4In6() {
-						aa := a.As4()
-						generalCacheHit = true
-						return aa[:], uint32(dm.TTLStrategy)
-					}
+		var cname string
+		for _, a := range r.Answer {
+			switch aa := a.(type) {
+			case *dns.A:
+				if dns_type == dns.TypeA {
+					return aa.A, aa.Hdr.Ttl
 				}
-			case dns.TypeAAAA:
-				for _, a := range na {
-					if a.Is6() {
-						aa := a.As16()
-						generalCacheHit = true
-						return aa[:], uint32(dm.TTLStrategy)
-					}
+			case *dns.AAAA:
+				if dns_type == dns.TypeAAAA {
+					return aa.AAAA, aa.Hdr.Ttl
+				}
+			case *dns.CNAME:
+				if cname == "" {
+					cname = aa.Target
 				}
 			}
-
 		}
-	}
-
-	theDNSServerConn = &dm.defaultConn
-	if len(dm.conns) > 0 && len(dm.SpecialServerPolicy) > 0 {
-
-		if dnsServerName := dm.SpecialServerPolicy[domain]; dnsServerName != "" {
-
-			if serConn := dm.conns[dnsServerName]; serConn != nil {
-				theDNSServerConn = serConn
-			}
+		if cname == "" {
+			return
 		}
-	}
-
-	if theDNSServerConn.Conn == nil { //如果配置文件只配置了自定义映射, 而没配置dns服务器的话, 那么我们就无法进行实际的dns查询; 或者配置了，但是因为Dial失败，导致没有 实际的Conn
-		if ce := utils.CanLogDebug("[DNSMachine] no server configured, return nil."); ce != nil {
-			ce.Write()
+		if ce := utils.CanLogDebug("[DNSMachine] query got cname"); ce != nil {
+			ce.Write(zap.String("query", domain), zap.String("target", cname))
 		}
-
-		return
+		domain = strings.TrimSuffix(cname, ".")
 	}
+	return
+}
 
-	domain = dns.Fqdn(domain)
+// 查询 domain 的 HTTPS 记录(rfc9460) 中的 ech 参数, 即 ECHConfigList. 记录中没有 ech 参数时 返回 nil, nil
+func (dm *DNSMachine) QueryECHConfig(domain string) ([]byte, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), dns.TypeHTTPS)
 
-	if ce := utils.CanLogDebug("[DNSMachine] start querying"); ce != nil {
-		ce.Write(zap.String("domain", domain), zap.String("through", theDNSServerConn.Name))
+	r, err := dm.Exchange(m)
+	if err != nil {
+		return nil, err
 	}
-	var err error
-
-	ip, ttl, err = DNSQuery(domain, dns_type, theDNSServerConn.Conn, &theDNSServerConn.mutex, 0)
-
-	if Is_DNSQuery_returnType_ReadFatalErr(err) {
-		//如果是读取的、非timeout的错误，那么我们直接认为底层连接出故障了, 我们需要重新dial
-		//因为 miekg/dns 包会设置4秒的timeout，所以确实要筛除timeout的情况
-
-		theDNSServerConn.Conn.Close()
-		err = theDNSServerConn.Dial()
-		if err != nil {
-			//再dial还是错误？那么就废了，
-			if ce := utils.CanLogErr("[DNSMachine] Re-Dial Dns Server Failed"); ce != nil {
-				ce.Write(zap.Error(err))
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, utils.ErrInErr{ErrDesc: "[DNSMachine] query HTTPS record code err", Data: r.Rcode}
+	}
+	for _, a := range r.Answer {
+		h, ok := a.(*dns.HTTPS)
+		if !ok {
+			continue
+		}
+		for _, kv := range h.Value {
+			if ech, ok := kv.(*dns.SVCBECHConfig); ok && len(ech.ECH) > 0 {
+				return ech.ECH, nil
 			}
-
-			theDNSServerConn.garbageMark = true
 		}
-
-		//我们只是重新Dial，并不再次查询，否则就又递归了
-
 	}
-	return
+	return nil, nil
 }
 
 // 使用通过配置设置好的监听地址进行监听
@@ -506,44 +454,62 @@ func (dm *DNSMachine) Stop() {
 		dm.server.Shutdown()
 		dm.server = nil
 	}
+	if dm.FakeIP != nil {
+		if err := dm.FakeIP.SaveFile(); err != nil {
+			if ce := utils.CanLogErr("FakeIP save file failed"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+		}
+	}
+}
+
+// 关闭 所有 DoH, DoQ 上游 的 空闲连接. 之后 依然可以进行查询, 届时会重新建立连接.
+func (dm *DNSMachine) CloseExchangers() {
+	dm.mutex.RLock()
+	defer dm.mutex.RUnlock()
+
+	if ex := dm.defaultConn.exchanger; ex != nil {
+		ex.Close()
+	}
+	for _, c := range dm.conns {
+		if c.exchanger != nil {
+			c.exchanger.Close()
+		}
+	}
 }
 
 // 实现 miekg/dns.Handler, 用于监听。不要直接调用该方法。
-// 只查第一个question
+// 只查第一个question, 可以为任意记录类型.
 func (dm *DNSMachine) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	if r == nil || len(r.Question) == 0 {
 		return
 	}
-	name := r.Question[0].Name
-	qtype := r.Question[0].Qtype
-	noDotName := strings.TrimSuffix(name, ".")
 
 	if ce := utils.CanLogDebug("Dns got"); ce != nil {
-		ce.Write(zap.String("name", noDotName), zap.Uint16("qtype", qtype))
+		ce.Write(zap.String("name", r.Question[0].Name), zap.Uint16("qtype", r.Question[0].Qtype))
 	}
 
-	ip, ttl := dm.QueryType(noDotName, qtype)
-
-	if ce := utils.CanLogDebug("Dns ip for"); ce != nil {
-		ce.Write(zap.String("name", noDotName), zap.String("ip", ip.String()))
+	resp := dm.fakeIPAnswer(r)
+	var err error
+	if resp == nil {
+		resp, err = dm.Exchange(r)
+	}
+	if err != nil {
+		if ce := utils.CanLogDebug("Dns serve failed"); ce != nil {
+			ce.Write(zap.String("name", r.Question[0].Name), zap.Error(err))
+		}
+		resp = new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeServerFailure)
 	}
 
-	// 构建返回信息
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Authoritative = true
-
-	var dnsRR []dns.RR
-
-	rr := new(dns.A)
-
-	if dm.TTLStrategy != 1 {
-		ttl = uint32(dm.TTLStrategy)
+	//udp 的响应 不可超过 客户端 所声明的大小, 否则要截断 并设置 TC 位, 让客户端 改用tcp
+	if _, isUDP := w.LocalAddr().(*net.UDPAddr); isUDP {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
 	}
-	rr.Hdr = dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
-	rr.A = ip
-	dnsRR = append(dnsRR, rr)
 
-	m.Answer = dnsRR
-	w.WriteMsg(m)
+	w.WriteMsg(resp)
 }
@@ -0,0 +1,320 @@
+package netLayer
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	// 缓存条目 超过此数时, 会先清理过期的条目, 若依然超过, 则 随机删除一些
+	DnsMaxCacheCount = 4096 * 4
+
+	// TTLStrategy 为 0(永不过期) 时, 否定响应 依然按 SOA 所给出的时间 过期, 但不超过该值(秒)
+	DnsMaxNegativeTTL = 3600
+)
+
+var ErrNoDnsServer = errors.New("no dns server configured")
+
+// 缓存的key, name 为 小写的 不带尾缀点号的 域名
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type dnsCacheRecord struct {
+	msg        *dns.Msg
+	recordTime time.Time
+	expire     time.Time //为零值时 表示 永不过期
+	negative   bool      //NXDOMAIN 或 NODATA
+}
+
+func (r *dnsCacheRecord) expired(now time.Time) bool {
+	return !r.expire.IsZero() && now.After(r.expire)
+}
+
+func newDnsCacheKey(q dns.Question) dnsCacheKey {
+	return dnsCacheKey{name: strings.ToLower(strings.TrimSuffix(q.Name, ".")), qtype: q.Qtype}
+}
+
+// 按 rfc2308 计算 响应 可以被缓存的时间(秒). 肯定响应 取 Answer 中 最小的TTL;
+// 否定响应 取 SOA 的 TTL 与 MINIMUM 中较小者, 没有 SOA 的否定响应 不缓存. 其它Rcode 以及 被截断的响应 不缓存.
+func dnsCacheTTLOf(r *dns.Msg) (ttl uint32, negative, ok bool) {
+	if r.Truncated {
+		return
+	}
+	switch r.Rcode {
+	case dns.RcodeSuccess:
+		if len(r.Answer) > 0 {
+			ttl = r.Answer[0].Header().Ttl
+			for _, rr := range r.Answer[1:] {
+				if t := rr.Header().Ttl; t < ttl {
+					ttl = t
+				}
+			}
+			ok = true
+			return
+		}
+	case dns.RcodeNameError:
+	default:
+		return
+	}
+
+	for _, rr := range r.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl, true, true
+		}
+	}
+	return
+}
+
+// 按 TTLStrategy 将 r 存入缓存
+func (dm *DNSMachine) putCache(key dnsCacheKey, r *dns.Msg) {
+	ttl, negative, ok := dnsCacheTTLOf(r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	record := &dnsCacheRecord{msg: r.Copy(), recordTime: now, negative: negative}
+
+	switch dm.TTLStrategy {
+	case 0: // no timeout
+		if negative {
+			if ttl > DnsMaxNegativeTTL {
+				ttl = DnsMaxNegativeTTL
+			}
+			record.expire = now.Add(time.Second * time.Duration(ttl))
+		}
+	case 1: //strictly follow TTL
+		record.expire = now.Add(time.Second * time.Duration(ttl))
+	default: //customized ttl
+		record.expire = now.Add(time.Second * time.Duration(dm.TTLStrategy))
+	}
+
+	if ce := utils.CanLogDebug("[DNSMachine] will add to cache"); ce != nil {
+		ce.Write(zap.String("domain", key.name), zap.Uint16("qtype", key.qtype), zap.Bool("negative", negative))
+	}
+
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	if dm.cache == nil {
+		dm.cache = make(map[dnsCacheKey]*dnsCacheRecord)
+	}
+	if len(dm.cache) >= DnsMaxCacheCount {
+		for k, v := range dm.cache {
+			if v.expired(now) {
+				delete(dm.cache, k)
+			}
+		}
+		for k := range dm.cache {
+			if len(dm.cache) < DnsMaxCacheCount*3/4 {
+				break
+			}
+			delete(dm.cache, k)
+		}
+	}
+	dm.cache[key] = record
+}
+
+// 从缓存中 读取 未过期的响应, 返回的是 一个副本. TTLStrategy 为1时, 响应中的 TTL 会减去 已经缓存的时间.
+func (dm *DNSMachine) getCache(key dnsCacheKey) *dns.Msg {
+	dm.mutex.RLock()
+	record := dm.cache[key]
+	dm.mutex.RUnlock()
+
+	if record == nil {
+		return nil
+	}
+	now := time.Now()
+	if record.expired(now) {
+		dm.mutex.Lock()
+		if dm.cache[key] == record {
+			delete(dm.cache, key)
+		}
+		dm.mutex.Unlock()
+		return nil
+	}
+
+	r := record.msg.Copy()
+	if dm.TTLStrategy == 1 {
+		elapsed := uint32(now.Sub(record.recordTime) / time.Second)
+		for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+			for _, rr := range section {
+				h := rr.Header()
+				if h.Rrtype == dns.TypeOPT {
+					continue
+				}
+				if h.Ttl > elapsed {
+					h.Ttl -= elapsed
+				} else {
+					h.Ttl = 0
+				}
+			}
+		}
+	}
+	return r
+}
+
+// 从 SpecialIPPollicy 构建 A 或 AAAA 响应, 没有对应记录时 返回 nil. 调用者 须持有 dm.mutex 的读锁.
+func (dm *DNSMachine) hostsAnswer(q *dns.Msg, domain string) *dns.Msg {
+	question := q.Question[0]
+	if dm.SpecialIPPollicy == nil || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+	na := dm.SpecialIPPollicy[domain]
+	if len(na) == 0 {
+		return nil
+	}
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: dm.TTLStrategy}
+
+	var answer []dns.RR
+	for _, a := range na {
+		switch {
+		case question.Qtype == dns.TypeA && (a.Is4() || a.Is4In6()):
+			aa := a.As4()
+			answer = append(answer, &dns.A{Hdr: hdr, A: aa[:]})
+		case question.Qtype == dns.TypeAAAA && a.Is6() && !a.Is4In6():
+			aa := a.As16()
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: aa[:]})
+		}
+	}
+	if len(answer) == 0 {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	r.RecursionAvailable = true
+	r.Answer = answer
+	return r
+}
+
+// 返回 domain 所应使用的 dns服务器; 按 SpecialServerPolicy 匹配 domain 本身 及其 各级父域名, 都没有 则为 defaultConn.
+// 调用者 须持有 dm.mutex 的读锁.
+func (dm *DNSMachine) serverFor(domain string) *DnsConn {
+	if len(dm.conns) > 0 && len(dm.SpecialServerPolicy) > 0 {
+		for d := domain; d != ""; {
+			if dnsServerName := dm.SpecialServerPolicy[d]; dnsServerName != "" {
+				if serConn := dm.conns[dnsServerName]; serConn != nil {
+					return serConn
+				}
+			}
+			i := strings.IndexByte(d, '.')
+			if i < 0 {
+				break
+			}
+			d = d[i+1:]
+		}
+	}
+	if !dm.defaultConn.usable() {
+		return nil
+	}
+	return &dm.defaultConn
+}
+
+// 将 废掉的 dc 从 conns 中删除; 若是 defaultConn, 则 选一个备用的, 升格为 defaultConn
+func (dm *DNSMachine) removeConn(dc *DnsConn) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	//并发的查询 可能 已经 移除了 dc; 若 dc 是 defaultConn, 此时 它已被 备用的 替换, 不能 再移除
+	if !dc.garbageMark {
+		return
+	}
+
+	delete(dm.conns, dc.Name)
+	if dc != &dm.defaultConn {
+		return
+	}
+	//如果DefaultConn都废了，那就糟糕
+	dm.defaultConn.Conn = nil
+	dm.defaultConn.exchanger = nil
+
+	for name, c := range dm.conns {
+		dm.defaultConn.Conn = c.Conn
+		dm.defaultConn.exchanger = c.exchanger
+		dm.defaultConn.raddr = c.raddr
+		dm.defaultConn.Name = c.Name
+		dm.defaultConn.garbageMark = false
+		delete(dm.conns, name)
+		break
+	}
+	//没备用的，那就只好保持 dm.defaultConn 不可用的状态, 下一次dns查询就会失败
+}
+
+// 通过 domain 所对应的 dns服务器 发送 m
+func (dm *DNSMachine) forward(domain string, m *dns.Msg) (r *dns.Msg, err error) {
+	dm.mutex.RLock()
+	dc := dm.serverFor(domain)
+	if dc == nil { //如果配置文件只配置了自定义映射, 而没配置dns服务器的话, 那么我们就无法进行实际的dns查询; 或者配置了，但是因为Dial失败，导致没有 实际的Conn
+		dm.mutex.RUnlock()
+		return nil, ErrNoDnsServer
+	}
+
+	if ce := utils.CanLogDebug("[DNSMachine] start querying"); ce != nil {
+		ce.Write(zap.String("domain", domain), zap.String("through", dc.Name))
+	}
+
+	r, garbage, err := dc.exchange(m)
+	dm.mutex.RUnlock()
+
+	if garbage {
+		dm.removeConn(dc)
+	}
+	return
+}
+
+// Exchange 回答 q 中的 第一个问题, 可以为 任意记录类型, 返回的响应 的 Id 与 q 相同.
+//
+// 依次查找 SpecialIPPollicy(仅 A 和 AAAA), 缓存, 然后 通过 对应的 dns服务器 查询; 不认识的记录类型 会被原样转发.
+// 查询的结果 按 TTLStrategy 缓存, 包括 否定响应(NXDOMAIN, NODATA).
+func (dm *DNSMachine) Exchange(q *dns.Msg) (r *dns.Msg, err error) {
+	if len(q.Question) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "dns query has no question", ErrDetail: utils.ErrInvalidData}
+	}
+	question := q.Question[0]
+	key := newDnsCacheKey(question)
+
+	dm.mutex.RLock()
+	r = dm.hostsAnswer(q, key.name)
+	dm.mutex.RUnlock()
+
+	if r == nil {
+		r = dm.getCache(key)
+	}
+	if r != nil {
+		utils.AtomicAddUint64(&dm.cacheHitCount, 1)
+
+		if ce := utils.CanLogDebug("[DNSMachine] hit cache"); ce != nil {
+			ce.Write(zap.String("domain", key.name), zap.Uint16("qtype", key.qtype))
+		}
+		r.Id = q.Id
+		r.Question = []dns.Question{question}
+		return
+	}
+	utils.AtomicAddUint64(&dm.cacheMissCount, 1)
+
+	m := q.Copy()
+	m.Id = dns.Id()
+	m.Question = []dns.Question{question}
+	m.RecursionDesired = true
+
+	r, err = dm.forward(key.name, m)
+	if err != nil {
+		return
+	}
+
+	dm.putCache(key, r)
+
+	r.Id = q.Id
+	return
+}
@@ -0,0 +1,238 @@
+package netLayer
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 用于测试的 上游, 对 nx.example.com 返回 NXDOMAIN, 其它的 返回 一条 所请求类型 的记录; TXT 记录 的内容 以及 HTTPS 记录 的 ech 参数 为 上游的名称
+type testExchanger struct {
+	name  string
+	count int
+}
+
+func (e *testExchanger) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	e.count++
+	r := new(dns.Msg)
+	r.SetReply(m)
+	q := m.Question[0]
+	if q.Name == "nx.example.com." {
+		r.Rcode = dns.RcodeNameError
+		r.Ns = append(r.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns.example.com.",
+			Mbox:   "admin.example.com.",
+			Minttl: 100,
+		})
+		return r, nil
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch q.Qtype {
+	case dns.TypeA:
+		r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(5, 6, 7, 8)})
+	case dns.TypeTXT:
+		r.Answer = append(r.Answer, &dns.TXT{Hdr: hdr, Txt: []string{e.name}})
+	case dns.TypeHTTPS:
+		r.Answer = append(r.Answer, &dns.HTTPS{SVCB: dns.SVCB{Hdr: hdr, Priority: 1, Target: ".", Value: []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: []string{"h2"}}, &dns.SVCBECHConfig{ECH: []byte(e.name)},
+		}}})
+	default:
+		//其它类型 用 rfc3597 的通用格式 表示
+		r.Answer = append(r.Answer, &dns.RFC3597{Hdr: hdr, Rdata: "00"})
+	}
+	return r, nil
+}
+
+func (e *testExchanger) Close() error { return nil }
+
+func newTestQuestion(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+func TestDNSMachineExchangeCache(t *testing.T) {
+	ex := &testExchanger{name: "default"}
+	dm := &DNSMachine{TTLStrategy: 1}
+	dm.addDnsConn(&DnsConn{Name: "default", exchanger: ex})
+
+	q := newTestQuestion("Www.Example.com.", dns.TypeTXT)
+	r, err := dm.Exchange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id || len(r.Answer) != 1 || r.Answer[0].(*dns.TXT).Txt[0] != "default" {
+		t.Fatal("wrong response", r)
+	}
+
+	q = newTestQuestion("www.example.com.", dns.TypeTXT)
+	r, err = dm.Exchange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.count != 1 || r.Id != q.Id || r.Question[0].Name != "www.example.com." {
+		t.Fatal("should hit cache", ex.count, r)
+	}
+
+	//TTLStrategy 为 1 时, 返回的TTL 要减去 已缓存的时间
+	key := dnsCacheKey{name: "www.example.com", qtype: dns.TypeTXT}
+	dm.cache[key].recordTime = time.Now().Add(-time.Second * 20)
+	if r, _ = dm.Exchange(q); r.Answer[0].Header().Ttl != 40 {
+		t.Fatal("ttl should decrease", r.Answer[0].Header().Ttl)
+	}
+
+	dm.cache[key].expire = time.Now().Add(-time.Second)
+	if dm.Exchange(q); ex.count != 2 {
+		t.Fatal("expired record should be queried again", ex.count)
+	}
+
+	//否定缓存, 时间取 SOA 的 TTL 与 MINIMUM 中较小者
+	q = newTestQuestion("nx.example.com.", dns.TypeA)
+	if r, _ = dm.Exchange(q); r.Rcode != dns.RcodeNameError {
+		t.Fatal("should be NXDOMAIN", r.Rcode)
+	}
+	if r, _ = dm.Exchange(q); r.Rcode != dns.RcodeNameError || ex.count != 3 {
+		t.Fatal("NXDOMAIN should be cached", ex.count)
+	}
+	rec := dm.cache[dnsCacheKey{name: "nx.example.com", qtype: dns.TypeA}]
+	if !rec.negative || rec.expire.Sub(rec.recordTime) != time.Second*100 {
+		t.Fatal("negative ttl wrong", rec.expire.Sub(rec.recordTime))
+	}
+
+	if ip := dm.Query("nx.example.com"); ip != nil {
+		t.Fatal("should not resolve nx", ip)
+	}
+	if ip := dm.Query("a.example.com"); !ip.Equal(net.IPv4(5, 6, 7, 8)) {
+		t.Fatal("query wrong", ip)
+	}
+}
+
+func TestDNSMachineSpecialServerAndHosts(t *testing.T) {
+	def := &testExchanger{name: "default"}
+	special := &testExchanger{name: "special"}
+
+	dm := &DNSMachine{
+		SpecialServerPolicy: map[string]string{"google.com": "special"},
+		SpecialIPPollicy:    map[string][]netip.Addr{"myfake.com": {netip.MustParseAddr("11.22.33.44")}},
+	}
+	dm.addDnsConn(&DnsConn{Name: "default", exchanger: def})
+	dm.addDnsConn(&DnsConn{Name: "special", exchanger: special})
+
+	for name, want := range map[string]string{
+		"www.google.com.": "special",
+		"google.com.":     "special",
+		"notgoogle.com.":  "default",
+	} {
+		r, err := dm.Exchange(newTestQuestion(name, dns.TypeTXT))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Answer[0].(*dns.TXT).Txt[0]; got != want {
+			t.Fatal(name, "should go through", want, "but got", got)
+		}
+	}
+
+	r, err := dm.Exchange(newTestQuestion("myfake.com.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(net.IPv4(11, 22, 33, 44)) {
+		t.Fatal("hosts answer wrong", r)
+	}
+	if def.count+special.count != 3 {
+		t.Fatal("hosts should not be forwarded")
+	}
+	if hit, miss := dm.CacheStat(); hit != 1 || miss != 3 {
+		t.Fatal("cache stat wrong", hit, miss)
+	}
+}
+
+type testDnsResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *testDnsResponseWriter) LocalAddr() net.Addr { return &net.UDPAddr{} }
+
+func (w *testDnsResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestDNSMachineServeDNS(t *testing.T) {
+	dm := &DNSMachine{}
+	dm.addDnsConn(&DnsConn{Name: "default", exchanger: &testExchanger{name: "default"}})
+
+	for _, qtype := range []uint16{dns.TypeMX, dns.TypeSRV, dns.TypeHTTPS, dns.TypePTR} {
+		q := newTestQuestion("www.example.com.", qtype)
+		w := &testDnsResponseWriter{}
+		dm.ServeDNS(w, q)
+		if w.msg == nil || w.msg.Id != q.Id || len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Rrtype != qtype {
+			t.Fatal("serve wrong for", dns.TypeToString[qtype], w.msg)
+		}
+	}
+
+	ech, err := dm.QueryECHConfig("www.example.com")
+	if err != nil || string(ech) != "default" {
+		t.Fatal("query ech config wrong", ech, err)
+	}
+	if _, err = dm.QueryECHConfig("nx.example.com"); err == nil {
+		t.Fatal("query ech config should fail for NXDOMAIN")
+	}
+
+	//没有服务器时 返回 SERVFAIL
+	dm = &DNSMachine{}
+	w := &testDnsResponseWriter{}
+	dm.ServeDNS(w, newTestQuestion("www.example.com.", dns.TypeMX))
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+		t.Fatal("should be SERVFAIL", w.msg)
+	}
+}
+
+// 底层连接 出故障 时, 并发的查询 只会 重新拨号 一次, 且 不会 与 重新拨号 竞争
+func TestDNSMachineRedialConcurrent(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		r, _ := (&testExchanger{}).Exchange(m)
+		w.WriteMsg(r)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	raddr := NewAddrFromUDPAddr(pc.LocalAddr().(*net.UDPAddr))
+	dc := &DnsConn{Conn: new(dns.Conn), raddr: &raddr, Name: "udp"}
+	if err = dc.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	dc.Conn.Close() //模拟 底层连接 出故障
+	old := dc.Conn.Conn
+
+	dm := &DNSMachine{}
+	dm.addDnsConn(dc)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dm.Exchange(newTestQuestion("a"+strconv.Itoa(i)+".example.com.", dns.TypeA))
+		}(i)
+	}
+	wg.Wait()
+
+	if dm.defaultConn.Conn == nil || dm.defaultConn.Conn.Conn == old || dm.defaultConn.garbageMark {
+		t.Fatal("should have redialed")
+	}
+	if ip := dm.Query("b.example.com"); !ip.Equal(net.IPv4(5, 6, 7, 8)) {
+		t.Fatal("query after redial failed", ip)
+	}
+}
@@ -3,6 +3,7 @@ package netLayer
 import (
 	"net"
 	"net/netip"
+	"strings"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"go.uber.org/zap"
@@ -12,14 +13,32 @@ type DnsConf struct {
 	Listen string `toml:"listen"` // 格式: udp://127.0.0.1:8053 , 如果有效，则尝试监听该地址，否则不监听. 可以为 udp,tcp 或 tls
 
 	Strategy    int64          `toml:"strategy"`     //0表示默认(和4含义相同), 4表示先查ip4后查ip6, 6表示先查6后查4; 40表示只查ipv4, 60 表示只查ipv6
-	TTLStrategy uint32         `toml:"ttl_strategy"` //0表示默认(记录永不过期), 1表示严格按照dns查询到的TTL, 其他值则为自定义的秒数，然后程序会按这个时间周期性清理缓存。
+	TTLStrategy uint32         `toml:"ttl_strategy"` //0表示默认(记录永不过期, 但否定响应 依然按 SOA 过期), 1表示严格按照dns查询到的TTL, 其他值则为自定义的秒数，然后程序会按这个时间周期性清理缓存。
 	Hosts       map[string]any `toml:"hosts"`        //用于强制指定哪些域名会被解析为哪些具体的ip；可以为一个ip字符串，or a []string, 内可以是A,AAAA或CNAME
 	Servers     []any          `toml:"servers"`      //可以为一个地址url字符串，or a SpecialDnsServerConf; 如果第一个元素是url字符串形式，则此第一个元素将会被用作默认dns服务器
+
+	Outbound  string `toml:"outbound"`   //若给出, 则 https 的 dns服务器 的请求 通过 该tag的 dial 发出, 以防 dns泄露; 其它 scheme 的服务器 不受影响, 依然 直接连接.
+	DoHMethod string `toml:"doh_method"` //DoH 所用的 http方法, GET 或 POST, 默认为 POST
+
+	FakeIP *FakeIPConf `toml:"fakeip"` //若给出, 则 开启 FakeIP 模式, 一般 与 tun 或 tproxy 配合使用
 }
 
+// url 可以为 udp://, tcp://, tls:// (DoT), https:// (DoH, 如 https://1.1.1.1/dns-query), quic:// (DoQ, 如 quic://dns.adguard.com)
+//
+// 目前 只有 DoH 支持 outbound; udp, tcp, DoT 与 DoQ 都不支持 通过 outbound 发出,
+// 对它们 显式 给出 Outbound 会 导致 该服务器 加载失败.
 type SpecialDnsServerConf struct {
-	AddrUrlStr string   `toml:"addr"`   //必须为 udp://1.1.1.1:53 这种格式
-	Domains    []string `toml:"domain"` //指定哪些域名需要通过 该dns服务器进行查询
+	AddrUrlStr string   `toml:"addr"`     //url格式, 如 udp://1.1.1.1:53
+	Domains    []string `toml:"domain"`   //指定哪些域名需要通过 该dns服务器进行查询
+	Outbound   string   `toml:"outbound"` //同 DnsConf.Outbound, 仅 https 支持; 若不给出, 则 https 的服务器 使用 DnsConf.Outbound
+}
+
+// DnsConf.Outbound 只用于 https 的服务器, 其它的 不支持 outbound.
+func globalDnsOutboundFor(urlStr, outbound string) string {
+	if !strings.HasPrefix(urlStr, "https://") {
+		return ""
+	}
+	return outbound
 }
 
 func loadSpecialDnsServerConf_fromTomlUnmarshalledMap(m map[string]any) *SpecialDnsServerConf {
@@ -65,9 +84,12 @@ func loadSpecialDnsServerConf_fromTomlUnmarshalledMap(m map[string]any) *Special
 		}
 		domainsSlice = append(domainsSlice, dstr)
 	}
+	outbound, _ := m["outbound"].(string)
+
 	return &SpecialDnsServerConf{
 		Domains:    domainsSlice,
 		AddrUrlStr: addrStr,
+		Outbound:   outbound,
 	}
 
 }
@@ -86,16 +108,7 @@ func LoadDnsMachine(conf *DnsConf) *DNSMachine {
 		for _, ser := range servers {
 			switch server := ser.(type) {
 			case string:
-				ad, e := NewAddrByURL(server)
-				if e != nil {
-					if ce := utils.CanLogErr("Failed in LoadDnsMachine, parse server url "); ce != nil {
-						ce.Write(zap.Error(e))
-					}
-
-					continue
-				}
-
-				if err := dm.AddNewServer(server, &ad); err != nil {
+				if err := dm.AddNewServerByURL(server, globalDnsOutboundFor(server, conf.Outbound), conf.DoHMethod); err != nil {
 					if ce := utils.CanLogErr("Failed in LoadDnsMachine, AddNewServer by string"); ce != nil {
 						ce.Write(zap.Error(err))
 					}
@@ -118,17 +131,12 @@ func LoadDnsMachine(conf *DnsConf) *DNSMachine {
 					continue
 				}
 
-				addr, e := NewAddrByURL(realServer.AddrUrlStr)
-				if e != nil {
-
-					if ce := utils.CanLogErr("Err, LoadDnsMachine, server url invalid"); ce != nil {
-						ce.Write(zap.Error(e))
-					}
-
-					continue
+				outbound := realServer.Outbound
+				if outbound == "" {
+					outbound = globalDnsOutboundFor(realServer.AddrUrlStr, conf.Outbound)
 				}
 
-				if err := dm.AddNewServer(realServer.AddrUrlStr, &addr); err != nil {
+				if err := dm.AddNewServerByURL(realServer.AddrUrlStr, outbound, conf.DoHMethod); err != nil {
 
 					if ce := utils.CanLogErr("Err, LoadDnsMachine, AddNewServer by map "); ce != nil {
 						ce.Write(zap.Error(err))
@@ -181,6 +189,16 @@ func LoadDnsMachine(conf *DnsConf) *DNSMachine {
 	if !ok {
 		return nil
 	}
+	if conf.FakeIP != nil {
+		pool, err := NewFakeIPPool(conf.FakeIP)
+		if err != nil {
+			if ce := utils.CanLogErr("Err, LoadDnsMachine, FakeIP config"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			return nil
+		}
+		dm.FakeIP = pool
+	}
 	if conf.Listen != "" {
 		dm.listenUrl = conf.Listen
 
@@ -0,0 +1,230 @@
+package netLayer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+)
+
+/*
+DoH (rfc8484) 与 DoQ (rfc9250) 都不是 在一个 dns.Conn 上 收发 dns消息 的, 所以 无法使用 miekg/dns 的 ExchangeWithConn.
+
+我们用 DnsExchanger 表示 这类上游, DnsConn 中 若 exchanger 非空, 则 不使用 其 dns.Conn.
+
+DoH 由本包 直接实现; DoQ 依赖 quic-go, 由 advLayer/quic 包 通过 NewDoQExchanger 注册, 以免 本包 依赖 quic-go.
+*/
+
+const (
+	DnsTimeout = time.Second * 5
+
+	DoHMethodPost = "POST"
+	DoHMethodGet  = "GET"
+
+	dnsMessageContentType = "application/dns-message"
+)
+
+// 发送一个 dns请求 并 返回 响应. 必须 可以并发调用.
+type DnsExchanger interface {
+	Exchange(m *dns.Msg) (*dns.Msg, error)
+	Close() error
+}
+
+// 通过 名为 outbound 的 dial 拨号到 target. 由 machine 设置, 以使 dns请求 可以通过代理发出, 防止 dns 泄露.
+type DnsOutboundDialFunc func(outbound string, target Addr) (net.Conn, error)
+
+// 创建 DoQ 上游. addr 为 quic://host:port 所解析出的地址, serverName 用于 tls 的 SNI.
+// 在 advLayer/quic 包 被引用时 才会被设置.
+var NewDoQExchanger func(addr *Addr, serverName string) (DnsExchanger, error)
+
+type dohExchanger struct {
+	url    string
+	method string
+	client *http.Client
+}
+
+// 创建 DoH 上游. 若 dial 非空, 则 通过 dial 建立 底层连接, 否则 直接拨号.
+//
+// 底层连接 上 会进行 tls握手, 并优先协商 h2.
+func newDoHExchanger(urlStr, method string, dial func(Addr) (net.Conn, error)) (*dohExchanger, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, utils.ErrInErr{ErrDesc: "DoH url must be https", ErrDetail: utils.ErrInvalidData, Data: urlStr}
+	}
+	switch method = strings.ToUpper(method); method {
+	case "":
+		method = DoHMethodPost
+	case DoHMethodPost, DoHMethodGet:
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "DoH method must be GET or POST", ErrDetail: utils.ErrInvalidData, Data: method}
+	}
+
+	transport := &http.Transport{
+		ForceAttemptHTTP2:   true,
+		TLSClientConfig:     &tls.Config{ServerName: u.Hostname(), NextProtos: []string{"h2", "http/1.1"}},
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     time.Minute * 2,
+	}
+
+	if dial != nil {
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			target, err := NewAddr(addr)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := dial(target)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, transport.TLSClientConfig.Clone())
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
+
+	return &dohExchanger{
+		url:    u.String(),
+		method: method,
+		client: &http.Client{Transport: transport, Timeout: DnsTimeout},
+	}, nil
+}
+
+func (d *dohExchanger) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	//rfc8484 4.1: 为了 便于 http 缓存, id 应为 0
+	id := m.Id
+	m.Id = 0
+	bs, err := m.Pack()
+	m.Id = id
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if d.method == DoHMethodGet {
+		sep := "?"
+		if strings.Contains(d.url, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequest(http.MethodGet, d.url+sep+"dns="+base64.RawURLEncoding.EncodeToString(bs), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, d.url, bytes.NewReader(bs))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageContentType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, utils.ErrInErr{ErrDesc: "DoH server returned bad status", ErrDetail: utils.ErrInvalidData, Data: resp.StatusCode}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err = r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = id
+	return r, nil
+}
+
+func (d *dohExchanger) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
+
+// 设置 通过 outbound 发送 dns请求 时 所用的拨号函数.
+func (dm *DNSMachine) SetOutboundDialFunc(f DnsOutboundDialFunc) {
+	dm.outboundDial.Store(f)
+}
+
+func (dm *DNSMachine) dialOutbound(outbound string, target Addr) (net.Conn, error) {
+	f, _ := dm.outboundDial.Load().(DnsOutboundDialFunc)
+	if f == nil {
+		return nil, utils.ErrInErr{ErrDesc: "dns outbound dial func not set", ErrDetail: utils.ErrUnImplemented, Data: outbound}
+	}
+	return f(outbound, target)
+}
+
+// 按 url 的 scheme 添加 dns服务器, name 为 该url. https 为 DoH, quic 为 DoQ, 其它的 见 DialDnsAddr.
+//
+// 若 outbound 非空, 则 dns请求 会通过 该 outbound 发出; 目前 仅 DoH 支持, 其它的(包括 DoQ) 给出 outbound 会 返回错误.
+func (dm *DNSMachine) AddNewServerByURL(urlStr, outbound, dohMethod string) error {
+	switch {
+	case strings.HasPrefix(urlStr, "https://"):
+		var dial func(Addr) (net.Conn, error)
+		if outbound != "" {
+			dial = func(target Addr) (net.Conn, error) {
+				return dm.dialOutbound(outbound, target)
+			}
+		}
+		ex, err := newDoHExchanger(urlStr, dohMethod, dial)
+		if err != nil {
+			return err
+		}
+		dm.addDnsConn(&DnsConn{Name: urlStr, exchanger: ex})
+		return nil
+
+	case outbound != "":
+		return utils.ErrInErr{ErrDesc: "dns outbound only supported for https upstream", ErrDetail: utils.ErrUnImplemented, Data: urlStr}
+
+	case strings.HasPrefix(urlStr, "quic://"):
+		if NewDoQExchanger == nil {
+			return utils.ErrInErr{ErrDesc: "DoQ not supported, quic not compiled", ErrDetail: utils.ErrUnImplemented, Data: urlStr}
+		}
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			return err
+		}
+		port := u.Port()
+		if port == "" {
+			port = "853"
+		}
+		addr, err := NewAddrByHostPort(net.JoinHostPort(u.Hostname(), port))
+		if err != nil {
+			return err
+		}
+		addr.Network = "udp"
+		ex, err := NewDoQExchanger(&addr, u.Hostname())
+		if err != nil {
+			return err
+		}
+		dm.addDnsConn(&DnsConn{Name: urlStr, exchanger: ex})
+		return nil
+
+	default:
+		ad, err := NewAddrByURL(urlStr)
+		if err != nil {
+			return err
+		}
+		return dm.AddNewServer(urlStr, &ad)
+	}
+}
+
+var _ DnsExchanger = (*dohExchanger)(nil)
@@ -0,0 +1,154 @@
+package netLayer
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// 一个简单的 DoH 服务端, 对任何 A 请求 都返回 1.2.3.4
+func newTestDoHServer(t *testing.T) (*httptest.Server, *int32) {
+	var h2Count int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			atomic.AddInt32(&h2Count, 1)
+		}
+		var bs []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			bs, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dnsMessageContentType {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			bs, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		q := new(dns.Msg)
+		if err = q.Unpack(bs); err != nil || q.Id != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(1, 2, 3, 4),
+		})
+		bs, _ = m.Pack()
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(bs)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	return ts, &h2Count
+}
+
+func TestDoHExchanger(t *testing.T) {
+	ts, h2Count := newTestDoHServer(t)
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	for _, method := range []string{DoHMethodPost, DoHMethodGet} {
+
+		//模拟 通过 outbound 拨号
+		var dialCount int32
+		dial := func(target Addr) (net.Conn, error) {
+			atomic.AddInt32(&dialCount, 1)
+			return net.Dial("tcp", ts.Listener.Addr().String())
+		}
+
+		ex, err := newDoHExchanger(ts.URL+"/dns-query", method, dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConf := ex.client.Transport.(*http.Transport).TLSClientConfig
+		tlsConf.RootCAs = pool
+		tlsConf.ServerName = "example.com"
+
+		dm := &DNSMachine{}
+		dm.addDnsConn(&DnsConn{Name: "doh", exchanger: ex})
+
+		ip, ttl := dm.QueryType("www.example.com", dns.TypeA)
+		if !ip.Equal(net.IPv4(1, 2, 3, 4)) || ttl != 60 {
+			t.Fatal(method, "got wrong record", ip, ttl)
+		}
+		if atomic.LoadInt32(&dialCount) != 1 {
+			t.Fatal(method, "should dial through given func")
+		}
+		ex.Close()
+	}
+
+	if atomic.LoadInt32(h2Count) != 2 {
+		t.Fatal("should use http2", *h2Count)
+	}
+}
+
+func TestAddNewServerByURL(t *testing.T) {
+	dm := &DNSMachine{}
+	if err := dm.AddNewServerByURL("https://1.1.1.1/dns-query", "proxy", ""); err != nil {
+		t.Fatal(err)
+	}
+	if dm.defaultConn.exchanger == nil {
+		t.Fatal("https should be DoH")
+	}
+	if err := dm.AddNewServerByURL("udp://1.1.1.1:53", "proxy", ""); err == nil {
+		t.Fatal("outbound for udp should fail")
+	}
+	if err := dm.AddNewServerByURL("https://1.1.1.1/dns-query", "", "PUT"); err == nil {
+		t.Fatal("bad doh method should fail")
+	}
+
+	//未设置 outbound 的拨号函数时, 查询会失败 而不是 直接连接
+	if ip, _ := dm.QueryType("www.example.com", dns.TypeA); ip != nil {
+		t.Fatal("should not query without outbound dial func")
+	}
+}
+
+// 全局的 outbound 只作用于 https 的服务器, 不应 导致 其它服务器 加载失败
+func TestLoadDnsMachineGlobalOutbound(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tcpUrl := "tcp://" + l.Addr().String()
+
+	dm := LoadDnsMachine(&DnsConf{
+		Outbound: "proxy",
+		Servers: []any{
+			"udp://127.0.0.1:53",
+			"https://1.1.1.1/dns-query",
+			map[string]any{"addr": tcpUrl, "domain": []any{"example.com"}},
+			map[string]any{"addr": "udp://127.0.0.2:53", "domain": []any{"example.org"}, "outbound": "proxy"},
+		},
+	})
+	if dm == nil {
+		t.Fatal("LoadDnsMachine failed")
+	}
+	defer dm.Stop()
+
+	if dm.defaultConn.Name != "udp://127.0.0.1:53" {
+		t.Fatal("udp server not loaded", dm.defaultConn.Name)
+	}
+	if dm.conns["https://1.1.1.1/dns-query"] == nil || dm.conns[tcpUrl] == nil {
+		t.Fatal("https or tcp server not loaded", dm.conns)
+	}
+	if dm.conns["udp://127.0.0.2:53"] != nil {
+		t.Fatal("explicit outbound for udp should fail")
+	}
+}
@@ -0,0 +1,438 @@
+package netLayer
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+/*
+FakeIP 模式下, DNSMachine 对外提供的 dns服务 (dns.listen) 不再返回 真实ip, 而是 从 FakeIPPool 中 为每个域名 分配一个 假ip.
+
+tun 和 tproxy 收到 发往 假ip 的连接时, 我们在 分流之前 将其 还原为 域名, 这样 即使 嗅探失败 (比如 非tls 非http 的流量),
+也可以 使用 域名分流; 真实ip 则 由 后面的 DNS解析阶段 通过 DNSMachine 查询 (不经过 FakeIP).
+
+映射 按 LRU 淘汰, 可以 通过 file 持久化, 以免 重启后 客户端 缓存的 假ip 失效.
+
+要 使用 FakeIP, 需要 让 系统的dns 指向 dns.listen, 比如 listen = "udp://127.0.0.1:53", 并设 tun_dns = "127.0.0.1".
+*/
+
+const (
+	DefaultFakeIPCIDR = "198.18.0.0/15"
+	DefaultFakeIPSize = 65535
+
+	// 假ip 的 dns响应 的 TTL, 尽量短, 以免 客户端 在 映射被淘汰后 依然使用 旧的假ip
+	FakeIPTTL = 1
+)
+
+// FakeIP 的配置, 在 [dns.fakeip] 中给出
+type FakeIPConf struct {
+	CIDR    string   `toml:"cidr"`    //ipv4 的地址池, 默认为 198.18.0.0/15
+	CIDR6   string   `toml:"cidr6"`   //ipv6 的地址池, 可选, 如 fc00::/18; 不给出时, AAAA 查询 返回 空响应
+	Size    int      `toml:"size"`    //映射的最大数量, 超过后 淘汰 最久未使用的; 默认为 65535, 且不超过 cidr 与 cidr6 中 可用地址 的数量
+	File    string   `toml:"file"`    //持久化文件, 在 加载时 读取, 在 dns 停止时 写入; 不给出 则 不持久化
+	Exclude []string `toml:"exclude"` //不使用 FakeIP 的域名, 其子域名 也一并排除; 比如 一些 需要 真实ip 的 局域网域名
+}
+
+type fakeIPEntry struct {
+	domain   string
+	ip4, ip6 netip.Addr //ip6 在 第一次 AAAA 查询 时 才分配
+}
+
+// FakeIPPool 是 域名 与 假ip 之间 的 双向映射, 可以 并发使用.
+type FakeIPPool struct {
+	prefix4, prefix6 netip.Prefix
+	size             int
+	exclude          map[string]bool
+	file             string
+
+	mutex    sync.Mutex
+	lru      *list.List //元素为 *fakeIPEntry, 越靠前 越是 最近使用的
+	byDomain map[string]*list.Element
+	byIP     map[netip.Addr]*list.Element
+	next4    netip.Addr //下一个 待分配的 地址
+	next6    netip.Addr
+}
+
+func NewFakeIPPool(conf *FakeIPConf) (*FakeIPPool, error) {
+	cidr := conf.CIDR
+	if cidr == "" {
+		cidr = DefaultFakeIPCIDR
+	}
+	p := &FakeIPPool{
+		size:     conf.Size,
+		file:     conf.File,
+		exclude:  make(map[string]bool),
+		lru:      list.New(),
+		byDomain: make(map[string]*list.Element),
+		byIP:     make(map[netip.Addr]*list.Element),
+	}
+	var err error
+	if p.prefix4, err = netip.ParsePrefix(cidr); err != nil || !p.prefix4.Addr().Is4() {
+		return nil, utils.ErrInErr{ErrDesc: "fakeip cidr must be ipv4 cidr", ErrDetail: utils.ErrInvalidData, Data: cidr}
+	}
+	p.prefix4 = p.prefix4.Masked()
+
+	//去掉 网络地址 与 广播地址
+	usable := (uint64(1) << (32 - p.prefix4.Bits())) - 2
+	if usable < 1 || usable > 1<<31 {
+		return nil, utils.ErrInErr{ErrDesc: "fakeip cidr too small", ErrDetail: utils.ErrInvalidData, Data: cidr}
+	}
+	if p.size <= 0 {
+		p.size = DefaultFakeIPSize
+	}
+	if uint64(p.size) > usable {
+		p.size = int(usable)
+	}
+	p.next4 = p.prefix4.Addr().Next()
+
+	if conf.CIDR6 != "" {
+		if p.prefix6, err = netip.ParsePrefix(conf.CIDR6); err != nil || !p.prefix6.Addr().Is6() || p.prefix6.Bits() > 120 {
+			return nil, utils.ErrInErr{ErrDesc: "fakeip cidr6 must be ipv6 cidr, not longer than /120", ErrDetail: utils.ErrInvalidData, Data: conf.CIDR6}
+		}
+		p.prefix6 = p.prefix6.Masked()
+		p.next6 = p.prefix6.Addr().Next()
+
+		//每个映射 至多 占用 一个 ipv6 地址, 所以 size 也不能 超过 cidr6 中 可用地址 的数量, 否则 分配 ipv6 时 会 找不到 空闲地址
+		if hostBits := 128 - p.prefix6.Bits(); hostBits < 32 {
+			if usable6 := (uint64(1) << hostBits) - 2; uint64(p.size) > usable6 {
+				p.size = int(usable6)
+			}
+		}
+	}
+
+	for _, d := range conf.Exclude {
+		p.exclude[strings.ToLower(strings.TrimSuffix(d, "."))] = true
+	}
+
+	if p.file != "" {
+		f, err := os.Open(p.file)
+		if err == nil {
+			err = p.Load(f)
+			f.Close()
+		}
+		if err != nil && !os.IsNotExist(err) {
+			if ce := utils.CanLogWarn("FakeIP load file failed"); ce != nil {
+				ce.Write(zap.String("file", p.file), zap.Error(err))
+			}
+		}
+	}
+	return p, nil
+}
+
+func (p *FakeIPPool) Size() int { return p.size }
+
+func (p *FakeIPPool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.lru.Len()
+}
+
+// domain 本身 或 其父域名 是否在 exclude 中.
+func (p *FakeIPPool) Excluded(domain string) bool {
+	for d := domain; d != ""; {
+		if p.exclude[d] {
+			return true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return false
+}
+
+// ip 是否在 地址池 的范围内; 不一定 已经分配.
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	a = a.Unmap()
+	return p.prefix4.Contains(a) || (p.prefix6.IsValid() && p.prefix6.Contains(a))
+}
+
+// 返回 ip 所对应的 域名, 并将其 标记为 最近使用; 不是 已分配的 假ip 时 返回 "".
+func (p *FakeIPPool) DomainOf(ip net.IP) string {
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e := p.byIP[a.Unmap()]
+	if e == nil {
+		return ""
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*fakeIPEntry).domain
+}
+
+// 返回 domain 的 假ip, 没有 则 分配 一个; 地址池 满时 淘汰 最久未使用的 映射.
+// domain 为 小写的 不带尾缀点号的 域名. 若 ipv6 为 true 但 没有配置 cidr6, 返回 无效的 netip.Addr.
+func (p *FakeIPPool) Lookup(domain string, ipv6 bool) netip.Addr {
+	if ipv6 && !p.prefix6.IsValid() {
+		return netip.Addr{}
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e := p.byDomain[domain]
+	if e != nil {
+		p.lru.MoveToFront(e)
+	} else {
+		e = p.newEntry(domain)
+	}
+
+	entry := e.Value.(*fakeIPEntry)
+	if !ipv6 {
+		return entry.ip4
+	}
+	if !entry.ip6.IsValid() {
+		entry.ip6 = p.alloc(&p.next6, p.prefix6)
+		p.byIP[entry.ip6] = e
+	}
+	return entry.ip6
+}
+
+// 为 domain 新建映射, 并分配 ip4. 调用者 须持有 p.mutex.
+func (p *FakeIPPool) newEntry(domain string) *list.Element {
+	var entry *fakeIPEntry
+
+	if p.lru.Len() >= p.size {
+		//复用 被淘汰的 映射 的地址
+		entry = p.lru.Remove(p.lru.Back()).(*fakeIPEntry)
+		delete(p.byDomain, entry.domain)
+
+		if ce := utils.CanLogDebug("FakeIP evict"); ce != nil {
+			ce.Write(zap.String("domain", entry.domain), zap.String("ip", entry.ip4.String()))
+		}
+
+		entry.domain = domain
+	} else {
+		entry = &fakeIPEntry{domain: domain, ip4: p.alloc(&p.next4, p.prefix4)}
+	}
+
+	e := p.lru.PushFront(entry)
+	p.byDomain[domain] = e
+	p.byIP[entry.ip4] = e
+	if entry.ip6.IsValid() {
+		p.byIP[entry.ip6] = e
+	}
+	return e
+}
+
+// 从 next 开始 找 一个 未被占用的 地址, 跳过 网络地址 与 广播地址. 调用者 须持有 p.mutex, 且 保证 地址池 未满.
+func (p *FakeIPPool) alloc(next *netip.Addr, prefix netip.Prefix) netip.Addr {
+	for {
+		a := *next
+		*next = a.Next()
+		if !prefix.Contains(*next) || isLastOfPrefix(*next, prefix) {
+			*next = prefix.Addr().Next()
+		}
+		if _, used := p.byIP[a]; !used {
+			return a
+		}
+	}
+}
+
+func isLastOfPrefix(a netip.Addr, prefix netip.Prefix) bool {
+	return !prefix.Contains(a.Next())
+}
+
+// 按 最近使用 的顺序 将 映射 写入 w, 每行 为 "域名 ip4 [ip6]".
+func (p *FakeIPPool) Save(w io.Writer) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*fakeIPEntry)
+		if entry.ip6.IsValid() {
+			fmt.Fprintln(bw, entry.domain, entry.ip4, entry.ip6)
+		} else {
+			fmt.Fprintln(bw, entry.domain, entry.ip4)
+		}
+	}
+	return bw.Flush()
+}
+
+// 读取 Save 写入的 映射; 不在 地址池 范围内 或 重复 的行 会被忽略, 超过 Size 的部分 也会被忽略.
+func (p *FakeIPPool) Load(r io.Reader) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() && p.lru.Len() < p.size {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		entry := &fakeIPEntry{domain: fields[0]}
+		if _, has := p.byDomain[entry.domain]; has {
+			continue
+		}
+
+		var err error
+		if entry.ip4, err = netip.ParseAddr(fields[1]); err != nil || !p.prefix4.Contains(entry.ip4) {
+			continue
+		}
+		if _, used := p.byIP[entry.ip4]; used {
+			continue
+		}
+		if len(fields) > 2 && p.prefix6.IsValid() {
+			if ip6, err := netip.ParseAddr(fields[2]); err == nil && p.prefix6.Contains(ip6) {
+				if _, used := p.byIP[ip6]; !used {
+					entry.ip6 = ip6
+				}
+			}
+		}
+
+		e := p.lru.PushBack(entry)
+		p.byDomain[entry.domain] = e
+		p.byIP[entry.ip4] = e
+		if entry.ip6.IsValid() {
+			p.byIP[entry.ip6] = e
+		}
+	}
+	return sc.Err()
+}
+
+// 若 配置了 file, 则 保存到 该文件
+func (p *FakeIPPool) SaveFile() error {
+	if p.file == "" {
+		return nil
+	}
+	f, err := os.Create(p.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.Save(f)
+}
+
+// 若 q 是 可以使用 FakeIP 的 A 或 AAAA 查询, 则 返回 假ip 的响应, 否则 返回 nil.
+// hosts 中的域名 与 exclude 的域名 不使用 FakeIP.
+func (dm *DNSMachine) fakeIPAnswer(q *dns.Msg) *dns.Msg {
+	pool := dm.FakeIP
+	if pool == nil || len(q.Question) == 0 {
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qclass != dns.ClassINET || (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+	domain := newDnsCacheKey(question).name
+	if domain == "" || pool.Excluded(domain) {
+		return nil
+	}
+
+	dm.mutex.RLock()
+	_, inHosts := dm.SpecialIPPollicy[domain]
+	dm.mutex.RUnlock()
+	if inHosts {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: FakeIPTTL}
+	ip := pool.Lookup(domain, question.Qtype == dns.TypeAAAA)
+
+	switch {
+	case !ip.IsValid(): //没有 cidr6 时, 返回 空的 NOERROR 响应, 让 客户端 使用 ipv4
+	case ip.Is4():
+		a := ip.As4()
+		r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: a[:]})
+	default:
+		a := ip.As16()
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: a[:]})
+	}
+	return r
+}
+
+// 若 ip 是 已分配的 假ip, 返回 其 域名; 否则 或 未开启 FakeIP 时 返回 "".
+func (dm *DNSMachine) FakeIPToDomain(ip net.IP) string {
+	if dm == nil || dm.FakeIP == nil || len(ip) == 0 || !dm.FakeIP.Contains(ip) {
+		return ""
+	}
+	return dm.FakeIP.DomainOf(ip)
+}
+
+// 将 目标为 假ip 的 addr 还原为 域名 (保留 端口 与 网络), 返回是否 进行了还原.
+// 若 addr 已经有 Name (比如 嗅探得到的), 则 保留 该 Name.
+func (dm *DNSMachine) RestoreFakeIP(addr *Addr) bool {
+	domain := dm.FakeIPToDomain(addr.IP)
+	if domain == "" {
+		return false
+	}
+	if addr.Name == "" {
+		addr.Name = domain
+	}
+	addr.IP = nil
+	return true
+}
+
+// FakeIPMsgConn 包装 tun 或 tproxy 的 MsgConn, 将 发往 假ip 的 udp消息 的目标 还原为 域名,
+// 并在 回写时 将 源地址 换回 原来的 假ip, 以便 客户端 能够 识别.
+//
+// 回写的地址 一般是 出站 解析出的 真实ip, 无法 与 域名 对应, 所以 当 只有一个 假ip 目标 时, 回写 总是使用 该 假ip;
+// 有多个时 只能 按 域名 匹配.
+type FakeIPMsgConn struct {
+	MsgConn
+	dm *DNSMachine
+
+	mutex    sync.Mutex
+	restored map[string]Addr //域名:端口 -> 原 假ip 地址
+	last     Addr
+}
+
+func NewFakeIPMsgConn(mc MsgConn, dm *DNSMachine) *FakeIPMsgConn {
+	return &FakeIPMsgConn{MsgConn: mc, dm: dm, restored: make(map[string]Addr)}
+}
+
+// 还原 addr, 并记录 原来的 假ip; 返回是否 进行了还原.
+func (fc *FakeIPMsgConn) Restore(addr *Addr) bool {
+	fake := *addr
+	if !fc.dm.RestoreFakeIP(addr) {
+		return false
+	}
+	fc.mutex.Lock()
+	fc.restored[addr.String()] = fake
+	fc.last = fake
+	fc.mutex.Unlock()
+	return true
+}
+
+func (fc *FakeIPMsgConn) ReadMsg() ([]byte, Addr, error) {
+	bs, peer, err := fc.MsgConn.ReadMsg()
+	if err == nil {
+		fc.Restore(&peer)
+	}
+	return bs, peer, err
+}
+
+func (fc *FakeIPMsgConn) WriteMsg(p []byte, peer Addr) error {
+	fc.mutex.Lock()
+	if fake, ok := fc.restored[peer.String()]; ok {
+		peer = fake
+	} else if len(fc.restored) == 1 {
+		peer = fc.last
+	}
+	fc.mutex.Unlock()
+	return fc.MsgConn.WriteMsg(p, peer)
+}
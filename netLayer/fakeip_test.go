@@ -0,0 +1,186 @@
+package netLayer
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	//一个 /29 有 6 个可用地址, size 为 3
+	p, err := NewFakeIPPool(&FakeIPConf{CIDR: "10.0.0.0/29", Size: 3, CIDR6: "fc00::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := p.Lookup("a.com", false)
+	b := p.Lookup("b.com", false)
+	c := p.Lookup("c.com", false)
+	if a.String() != "10.0.0.1" || b.String() != "10.0.0.2" || c.String() != "10.0.0.3" {
+		t.Fatal("allocation wrong", a, b, c)
+	}
+	if p.Lookup("a.com", false) != a {
+		t.Fatal("same domain should get same ip")
+	}
+	a6 := p.Lookup("a.com", true)
+	if !a6.Is6() || p.DomainOf(a6.AsSlice()) != "a.com" {
+		t.Fatal("ipv6 allocation wrong", a6)
+	}
+
+	//a 刚被使用过, 所以 淘汰的是 b
+	d := p.Lookup("d.com", false)
+	if d != b || p.DomainOf(b.AsSlice()) != "d.com" || p.Len() != 3 {
+		t.Fatal("lru eviction wrong", d)
+	}
+	if p.DomainOf(net.IPv4(10, 0, 0, 1)) != "a.com" || p.DomainOf(net.IPv4(10, 0, 0, 5)) != "" {
+		t.Fatal("reverse lookup wrong")
+	}
+	if !p.Contains(net.IPv4(10, 0, 0, 5)) || p.Contains(net.IPv4(10, 0, 0, 8)) {
+		t.Fatal("contains wrong")
+	}
+
+	var buf bytes.Buffer
+	if err = p.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	p2, _ := NewFakeIPPool(&FakeIPConf{CIDR: "10.0.0.0/29", Size: 3, CIDR6: "fc00::/64"})
+	if err = p2.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if p2.Lookup("a.com", true) != a6 || p2.Lookup("d.com", false) != d || p2.Len() != 3 {
+		t.Fatal("load wrong")
+	}
+
+	//加载后 新分配的地址 不能与 已有的 冲突
+	p3, _ := NewFakeIPPool(&FakeIPConf{CIDR: "10.0.0.0/29"})
+	p3.Load(bytes.NewBufferString("x.com 10.0.0.1\n"))
+	if y := p3.Lookup("y.com", false); y.String() != "10.0.0.2" {
+		t.Fatal("should skip used ip", y)
+	}
+
+	if _, err = NewFakeIPPool(&FakeIPConf{CIDR: "fc00::/64"}); err == nil {
+		t.Fatal("cidr must be ipv4")
+	}
+}
+
+// cidr6 比 cidr 小 时, ipv6 地址 用完后 应 淘汰 旧映射, 而不是 一直 寻找 空闲地址
+func TestFakeIPPool_smallCIDR6(t *testing.T) {
+	p, err := NewFakeIPPool(&FakeIPConf{CIDR6: "fc00::/120"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Size() != 254 {
+		t.Fatal("size should be capped by cidr6", p.Size())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		seen := make(map[netip.Addr]bool)
+		for i := 0; i < 300; i++ {
+			ip := p.Lookup(strconv.Itoa(i)+".com", true)
+			if !ip.Is6() {
+				t.Error("ipv6 allocation wrong", ip)
+				return
+			}
+			seen[ip] = true
+		}
+		if len(seen) != 254 || p.Len() != 254 {
+			t.Error("should reuse evicted ipv6", len(seen), p.Len())
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lookup hangs when cidr6 is exhausted")
+	}
+}
+
+func TestDNSMachineFakeIP(t *testing.T) {
+	ex := &testExchanger{name: "default"}
+	pool, _ := NewFakeIPPool(&FakeIPConf{Exclude: []string{"lan"}})
+	dm := &DNSMachine{
+		FakeIP:           pool,
+		SpecialIPPollicy: map[string][]netip.Addr{"myhost.com": {netip.MustParseAddr("11.22.33.44")}},
+	}
+	dm.addDnsConn(&DnsConn{Name: "default", exchanger: ex})
+
+	serve := func(name string, qtype uint16) *dns.Msg {
+		w := &testDnsResponseWriter{}
+		dm.ServeDNS(w, newTestQuestion(name, qtype))
+		return w.msg
+	}
+
+	r := serve("www.Example.com.", dns.TypeA)
+	fake := r.Answer[0].(*dns.A).A
+	if !pool.Contains(fake) || r.Answer[0].Header().Ttl != FakeIPTTL || ex.count != 0 {
+		t.Fatal("should answer fake ip", r)
+	}
+	if r = serve("www.example.com.", dns.TypeAAAA); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatal("AAAA without cidr6 should be empty", r)
+	}
+
+	//hosts, exclude 以及 其它类型 不使用 FakeIP
+	if r = serve("myhost.com.", dns.TypeA); !r.Answer[0].(*dns.A).A.Equal(net.IPv4(11, 22, 33, 44)) {
+		t.Fatal("hosts should not be faked", r)
+	}
+	if r = serve("nas.lan.", dns.TypeA); !r.Answer[0].(*dns.A).A.Equal(net.IPv4(5, 6, 7, 8)) {
+		t.Fatal("excluded should not be faked", r)
+	}
+	if serve("www.example.com.", dns.TypeTXT); ex.count != 2 {
+		t.Fatal("other types should be forwarded", ex.count)
+	}
+
+	//用于分流的 查询 依然返回 真实ip
+	if ip := dm.Query("www.example.com"); !ip.Equal(net.IPv4(5, 6, 7, 8)) {
+		t.Fatal("Query should return real ip", ip)
+	}
+
+	addr := Addr{IP: fake, Port: 443, Network: "tcp"}
+	if !dm.RestoreFakeIP(&addr) || addr.Name != "www.example.com" || addr.IP != nil || addr.Port != 443 {
+		t.Fatal("restore wrong", addr)
+	}
+	addr = Addr{IP: net.IPv4(1, 1, 1, 1), Port: 443}
+	if dm.RestoreFakeIP(&addr) {
+		t.Fatal("real ip should not be restored")
+	}
+}
+
+type testMsgConn struct {
+	MsgConn
+	readPeer  Addr
+	writePeer Addr
+}
+
+func (mc *testMsgConn) ReadMsg() ([]byte, Addr, error) { return []byte{1}, mc.readPeer, nil }
+
+func (mc *testMsgConn) WriteMsg(p []byte, peer Addr) error {
+	mc.writePeer = peer
+	return nil
+}
+
+func TestFakeIPMsgConn(t *testing.T) {
+	pool, _ := NewFakeIPPool(&FakeIPConf{})
+	dm := &DNSMachine{FakeIP: pool}
+	fake := pool.Lookup("quic.example.com", false)
+
+	fakeAddr := Addr{IP: fake.AsSlice(), Port: 443, Network: "udp"}
+	mc := &testMsgConn{readPeer: fakeAddr}
+	fc := NewFakeIPMsgConn(mc, dm)
+
+	_, peer, _ := fc.ReadMsg()
+	if peer.Name != "quic.example.com" || peer.IP != nil {
+		t.Fatal("read peer should be restored", peer)
+	}
+
+	//出站 回写的 是 真实ip, 只有 一个 假ip 目标 时 换回 该 假ip
+	fc.WriteMsg([]byte{1}, Addr{IP: net.IPv4(5, 6, 7, 8), Port: 443, Network: "udp"})
+	if !mc.writePeer.IP.Equal(fakeAddr.IP) || mc.writePeer.Port != 443 {
+		t.Fatal("write peer should be fake ip", mc.writePeer)
+	}
+}
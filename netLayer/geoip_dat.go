@@ -0,0 +1,154 @@
+package netLayer
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/yl2chen/cidranger"
+	"go.uber.org/zap"
+)
+
+/*
+v2ray/xray 所用的 geoip.dat 是 protobuf 编码的 GeoIPList, 见 v2fly 的 app/router/routercommon/common.proto:
+
+	GeoIPList { repeated GeoIP entry = 1; }
+	GeoIP { string country_code = 1; repeated CIDR cidr = 2; bool reverse_match = 3; }
+	CIDR { bytes ip = 1; uint32 prefix = 2; }
+
+与 maxmind 的 mmdb 不同, geoip.dat 不是 由ip查国家, 而是 由 列表名 得到 一组 cidr, 且 除了 国家 之外 还有 private 等 列表.
+所以 我们 在 加载 路由规则 时 将 用到的 列表 直接 插入 RouteSet 的 NetRanger 中.
+
+geoip.dat 中 CN 等 列表 很大, 而 一般 只会 用到 其中 几个, 所以 加载时 只 记录 每个 列表 的 位置, 用到时 才 解析.
+*/
+
+// country_code (大写) -> 该 GeoIP 的 protobuf 数据
+var geoipDatMap map[string][]byte
+
+// 加载 geoip 文件; 若fn=="", 则会自动使用 GeoipFileName 的值.
+// 以 .dat 结尾 的 视为 v2ray 的 geoip.dat, 否则 视为 maxmind 的 mmdb.
+func LoadGeoipFile(fn string) {
+	if fn == "" {
+		fn = GeoipFileName
+	}
+	if strings.ToLower(filepath.Ext(fn)) != ".dat" {
+		LoadMaxmindGeoipFile(fn)
+		return
+	}
+	if err := LoadV2rayGeoipFile(fn); err != nil {
+		if ce := utils.CanLogErr("LoadV2rayGeoipFile failed"); ce != nil {
+			ce.Write(zap.String("file", fn), zap.Error(err))
+		}
+	}
+}
+
+// 读取 v2ray 格式 的 geoip.dat
+func LoadV2rayGeoipFile(fn string) error {
+	bs, err := os.ReadFile(utils.GetFilePath(fn))
+	if err != nil {
+		return err
+	}
+	m, err := parseGeoipDat(bs)
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "parse geoip.dat failed", ErrDetail: err, Data: fn}
+	}
+	geoipDatMap = m
+	return nil
+}
+
+func parseGeoipDat(bs []byte) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	err := rangeProtoFields(bs, func(num, wireType int, _ uint64, data []byte) error {
+		if num != 1 || wireType != 2 {
+			return nil
+		}
+		var code string
+		err := rangeProtoFields(data, func(num, wireType int, _ uint64, d []byte) error {
+			if num == 1 && wireType == 2 {
+				code = strings.ToUpper(string(d))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		m[code] = data
+		return nil
+	})
+	return m, err
+}
+
+// 是否 加载了 geoip.dat
+func HasGeoipDat() bool {
+	return len(geoipDatMap) > 0
+}
+
+// 返回 geoip.dat 中 名为 code 的 列表 的 所有 cidr. 未加载 geoip.dat 或 没有该列表 时 返回 false.
+//
+// 我们 不支持 reverse_match, 官方的 geoip.dat 中 也 没有 使用 它 的 列表.
+func GetGeoIPPrefixes(code string) (list []netip.Prefix, ok bool) {
+	data, ok := geoipDatMap[strings.ToUpper(code)]
+	if !ok {
+		return
+	}
+	err := rangeProtoFields(data, func(num, wireType int, _ uint64, d []byte) error {
+		if num != 2 || wireType != 2 {
+			return nil
+		}
+		var ip []byte
+		var bits uint64
+		err := rangeProtoFields(d, func(num, wireType int, varint uint64, d []byte) error {
+			switch num {
+			case 1:
+				ip = d
+			case 2:
+				bits = varint
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		addr, addrOk := netip.AddrFromSlice(ip)
+		if !addrOk || bits > uint64(addr.BitLen()) {
+			return utils.ErrInErr{ErrDesc: "geoip.dat invalid cidr", ErrDetail: utils.ErrInvalidData, Data: code}
+		}
+		list = append(list, netip.PrefixFrom(addr, int(bits)).Masked())
+		return nil
+	})
+	if err != nil {
+		if ce := utils.CanLogErr("GetGeoIPPrefixes failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+	}
+	return
+}
+
+func insertPrefixes(ranger cidranger.Ranger, list []netip.Prefix) {
+	for _, p := range list {
+		ranger.Insert(cidranger.NewBasicRangerEntry(net.IPNet{
+			IP:   p.Addr().AsSlice(),
+			Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+		}))
+	}
+}
+
+// 若 加载了 geoip.dat, 则 将 rs.Countries 中 各国家 的 cidr 插入 rs.NetRanger
+func (rs *RouteSet) loadCountriesFromGeoipDat() {
+	if !HasGeoipDat() {
+		return
+	}
+	for c := range rs.Countries {
+		list, ok := GetGeoIPPrefixes(c)
+		if !ok {
+			continue
+		}
+		if rs.NetRanger == nil {
+			rs.NetRanger = cidranger.NewPCTrieRanger()
+		}
+		insertPrefixes(rs.NetRanger, list)
+	}
+}
@@ -115,11 +115,17 @@ func IsDomainInsideGeosite(geositeName string, domain string) bool {
 		}
 	}
 
+	for _, k := range glist.Keywords {
+		if strings.Contains(domain, k) {
+			return true
+		}
+	}
+
 	return false
 }
 
 type GeositeDomain struct {
-	Type  string //domain, regexp, full
+	Type  string //domain, regexp, full, keyword
 	Value string
 	Attrs []GeositeAttr
 }
@@ -141,6 +147,7 @@ type GeositeList struct {
 	FullDomains  map[string]GeositeDomain
 	Domains      map[string]GeositeDomain
 	RegexDomains []*regexp.Regexp
+	Keywords     []string
 }
 
 type MapGeositeDomainHaser map[string]GeositeDomain
@@ -0,0 +1,125 @@
+package netLayer
+
+import (
+	"os"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+/*
+v2ray/xray 所用的 geosite.dat 是 protobuf 编码的 GeoSiteList, 见 v2fly 的 app/router/routercommon/common.proto:
+
+	GeoSiteList { repeated GeoSite entry = 1; }
+	GeoSite { string country_code = 1; repeated Domain domain = 2; }
+	Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+	Attribute { string key = 1; oneof typed_value { bool bool_value = 2; int64 int_value = 3; } }
+
+其中 Type 为 Plain(0, 即 keyword), Regex(1), RootDomain(2, 即 domain), Full(3).
+
+geosite.dat 中的 include 已经 展开 过了, 所以 可以 直接 转换为 GeositeList.
+*/
+
+// 若给出, 则 从 该 geosite.dat 文件 加载 geosite, 而不是 从 GeositeFolder 加载
+var GeositeFileName string
+
+var geositeDatDomainTypes = [...]string{"keyword", "regexp", "domain", "full"}
+
+// 若 给出了 GeositeFileName 则 调用 LoadGeositeDatFile, 否则 调用 LoadGeositeFiles
+func LoadGeosite() error {
+	if GeositeFileName != "" {
+		return LoadGeositeDatFile(GeositeFileName)
+	}
+	return LoadGeositeFiles()
+}
+
+// 读取 v2ray 格式 的 geosite.dat 并加载到 GeositeListMap 中.
+func LoadGeositeDatFile(fn string) error {
+	bs, err := os.ReadFile(utils.GetFilePath(fn))
+	if err != nil {
+		return err
+	}
+	lists, err := ParseGeositeDat(bs)
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "parse geosite.dat failed", ErrDetail: err, Data: fn}
+	}
+	for _, l := range lists {
+		GeositeListMap[l.Name] = l.ToGeositeList()
+	}
+	return nil
+}
+
+func ParseGeositeDat(bs []byte) (lists []*GeositeRawList, err error) {
+	err = rangeProtoFields(bs, func(num, wireType int, _ uint64, data []byte) error {
+		if num != 1 || wireType != 2 {
+			return nil
+		}
+		list, err := parseGeositeDatEntry(data)
+		if err != nil {
+			return err
+		}
+		lists = append(lists, list)
+		return nil
+	})
+	return
+}
+
+func parseGeositeDatEntry(bs []byte) (*GeositeRawList, error) {
+	list := &GeositeRawList{}
+	err := rangeProtoFields(bs, func(num, wireType int, _ uint64, data []byte) error {
+		if wireType != 2 {
+			return nil
+		}
+		switch num {
+		case 1:
+			list.Name = strings.ToUpper(string(data))
+		case 2:
+			d, err := parseGeositeDatDomain(data)
+			if err != nil {
+				return err
+			}
+			list.Domains = append(list.Domains, d)
+		}
+		return nil
+	})
+	return list, err
+}
+
+func parseGeositeDatDomain(bs []byte) (d GeositeDomain, err error) {
+	var domainType uint64
+	err = rangeProtoFields(bs, func(num, wireType int, varint uint64, data []byte) error {
+		switch {
+		case num == 1 && wireType == 0:
+			domainType = varint
+		case num == 2 && wireType == 2:
+			d.Value = string(data)
+		case num == 3 && wireType == 2:
+			var attr GeositeAttr
+			err := rangeProtoFields(data, func(num, wireType int, varint uint64, data []byte) error {
+				switch num {
+				case 1:
+					attr.Key = string(data)
+				case 2:
+					attr.Value = varint != 0
+				case 3:
+					attr.Value = int64(varint)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			d.Attrs = append(d.Attrs, attr)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if domainType >= uint64(len(geositeDatDomainTypes)) {
+		err = utils.ErrInErr{ErrDesc: "geosite.dat unknown domain type", ErrDetail: utils.ErrInvalidData, Data: domainType}
+		return
+	}
+	d.Type = geositeDatDomainTypes[domainType]
+	return
+}
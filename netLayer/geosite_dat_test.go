@@ -0,0 +1,126 @@
+package netLayer
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 测试用的 简易 protobuf 编码
+
+func pbVarint(num int, v uint64) []byte {
+	bs := binary.AppendUvarint(nil, uint64(num<<3))
+	return binary.AppendUvarint(bs, v)
+}
+
+func pbBytes(num int, data ...[]byte) []byte {
+	var body []byte
+	for _, d := range data {
+		body = append(body, d...)
+	}
+	bs := binary.AppendUvarint(nil, uint64(num<<3|2))
+	bs = binary.AppendUvarint(bs, uint64(len(body)))
+	return append(bs, body...)
+}
+
+func geositeDatDomain(t uint64, value string) []byte {
+	return pbBytes(2, pbVarint(1, t), pbBytes(2, []byte(value)), pbBytes(3, pbBytes(1, []byte("cn")), pbVarint(2, 1)))
+}
+
+func geoipDatCIDR(cidr string) []byte {
+	_, ipnet, _ := net.ParseCIDR(cidr)
+	ip := ipnet.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ones, _ := ipnet.Mask.Size()
+	return pbBytes(2, pbBytes(1, ip), pbVarint(2, uint64(ones)))
+}
+
+func TestGeositeDat(t *testing.T) {
+	dat := pbBytes(1,
+		pbBytes(1, []byte("test-dat")),
+		geositeDatDomain(2, "example.com"),
+		geositeDatDomain(3, "www.full.org"),
+		geositeDatDomain(1, `^ads\d+\.`),
+		geositeDatDomain(0, "tracker"),
+	)
+	dat = append(dat, pbBytes(1, pbBytes(1, []byte("other")), geositeDatDomain(3, "other.net"))...)
+
+	fn := filepath.Join(t.TempDir(), "geosite.dat")
+	if err := os.WriteFile(fn, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lists, err := ParseGeositeDat(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 2 || lists[0].Name != "TEST-DAT" || len(lists[0].Domains) != 4 {
+		t.Fatal("parse wrong", lists)
+	}
+	if attrs := lists[0].Domains[0].Attrs; len(attrs) != 1 || attrs[0].Key != "cn" || attrs[0].Value != true {
+		t.Fatal("attr wrong", attrs)
+	}
+
+	defer addTestGeosite("PLACEHOLDER", nil, nil, nil)()
+	if err := LoadGeositeDatFile(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := LoadRuleForRouteSet(&RuleConf{DialTag: "direct", Domains: []string{"geosite:test-dat"}})
+	for name, want := range map[string]bool{
+		"example.com": true, "a.example.com": true, "www.full.org": true, "full.org": false,
+		"ads1.foo.com": true, "mytracker.io": true, "other.net": false, "google.com": false,
+	} {
+		if got := rs.IsAddrIn(Addr{Name: name}); got != want {
+			t.Fatal(name, "got", got, "want", want)
+		}
+		if got := IsDomainInsideGeosite("test-dat", name); got != want {
+			t.Fatal(name, "IsDomainInsideGeosite got", got, "want", want)
+		}
+	}
+
+	if _, err := ParseGeositeDat([]byte{0x0a, 0x05, 0x01}); err == nil {
+		t.Fatal("should fail on truncated data")
+	}
+}
+
+func TestGeoipDat(t *testing.T) {
+	dat := pbBytes(1, pbBytes(1, []byte("private")), geoipDatCIDR("10.0.0.0/8"), geoipDatCIDR("fc00::/7"))
+	dat = append(dat, pbBytes(1, pbBytes(1, []byte("xx")), geoipDatCIDR("1.2.3.0/24"))...)
+
+	fn := filepath.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(fn, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := geoipDatMap
+	defer func() { geoipDatMap = old }()
+
+	LoadGeoipFile(fn)
+	if !HasGeoipDat() {
+		t.Fatal("geoip.dat not loaded")
+	}
+	if list, ok := GetGeoIPPrefixes("PRIVATE"); !ok || len(list) != 2 || list[1].String() != "fc00::/7" {
+		t.Fatal("prefixes wrong", list)
+	}
+
+	rs := LoadRuleForRouteSet(&RuleConf{DialTag: "direct", IPs: []string{"geoip:private"}, Countries: []string{"xx"}})
+	for ip, want := range map[string]bool{
+		"10.1.2.3": true, "fd00::1": true, "1.2.3.4": true, "1.2.4.1": false, "192.168.1.1": false,
+	} {
+		if got := rs.IsAddrIn(Addr{IP: net.ParseIP(ip)}); got != want {
+			t.Fatal(ip, "got", got, "want", want)
+		}
+	}
+
+	//没有 geoip.dat 时, geoip:private 使用 内置 的 范围
+	geoipDatMap = nil
+	rs = LoadRuleForRouteSet(&RuleConf{DialTag: "direct", IPs: []string{"geoip:private"}})
+	if !rs.IsAddrIn(Addr{IP: net.ParseIP("192.168.1.1")}) || rs.IsAddrIn(Addr{IP: net.ParseIP("8.8.8.8")}) {
+		t.Fatal("builtin private wrong")
+	}
+}
@@ -233,6 +233,8 @@ func (grl *GeositeRawList) ToGeositeList() (gl *GeositeList) {
 			}
 		case "full":
 			gl.FullDomains[v.Value] = v
+		case "keyword":
+			gl.Keywords = append(gl.Keywords, v.Value)
 		}
 	}
 	return
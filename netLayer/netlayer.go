@@ -160,6 +160,7 @@ type TCPRequestInfo struct {
 type UDPRequestInfo struct {
 	MsgConn
 	Target Addr
+	Source net.Addr //客户端的地址, 可为nil
 }
 
 type ChanCloseConn struct {
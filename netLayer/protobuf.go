@@ -0,0 +1,58 @@
+package netLayer
+
+import (
+	"encoding/binary"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 极简的 protobuf 解码, 仅用于 读取 v2ray 的 geosite.dat 与 geoip.dat. 与 geosite.go 中 所说的 一样, 我们 不引入 protobuf 依赖.
+//
+// 依次 对 bs 中的 每一个 字段 调用 f; wireType 为 0 时 值 在 varint 中, 为 2 时 值 在 data 中, 其它 类型 的 值 不会 给出.
+func rangeProtoFields(bs []byte, f func(num int, wireType int, varint uint64, data []byte) error) error {
+	for len(bs) > 0 {
+		key, n := binary.Uvarint(bs)
+		if n <= 0 {
+			return utils.ErrInErr{ErrDesc: "protobuf invalid key", ErrDetail: utils.ErrInvalidData}
+		}
+		bs = bs[n:]
+
+		num, wireType := int(key>>3), int(key&7)
+
+		var varint uint64
+		var data []byte
+
+		switch wireType {
+		case 0:
+			varint, n = binary.Uvarint(bs)
+			if n <= 0 {
+				return utils.ErrInErr{ErrDesc: "protobuf invalid varint", ErrDetail: utils.ErrInvalidData, Data: num}
+			}
+			bs = bs[n:]
+		case 1:
+			if len(bs) < 8 {
+				return utils.ErrInErr{ErrDesc: "protobuf short fixed64", ErrDetail: utils.ErrInvalidData, Data: num}
+			}
+			bs = bs[8:]
+		case 2:
+			l, n := binary.Uvarint(bs)
+			if n <= 0 || l > uint64(len(bs)-n) {
+				return utils.ErrInErr{ErrDesc: "protobuf invalid length", ErrDetail: utils.ErrInvalidData, Data: num}
+			}
+			data = bs[n : n+int(l)]
+			bs = bs[n+int(l):]
+		case 5:
+			if len(bs) < 4 {
+				return utils.ErrInErr{ErrDesc: "protobuf short fixed32", ErrDetail: utils.ErrInvalidData, Data: num}
+			}
+			bs = bs[4:]
+		default:
+			return utils.ErrInErr{ErrDesc: "protobuf unsupported wire type", ErrDetail: utils.ErrInvalidData, Data: wireType}
+		}
+
+		if err := f(num, wireType, varint, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package netLayer
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// 可用于分流的 应用层协议 名称, 见 RuleConf 的 protocol 项
+const (
+	ProtocolTLS        = "tls"
+	ProtocolHTTP       = "http"
+	ProtocolQUIC       = "quic"
+	ProtocolBitTorrent = "bittorrent"
+)
+
+var (
+	httpMethodPrefixes = [][]byte{
+		[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+		[]byte("OPTIONS "), []byte("CONNECT "), []byte("PATCH "), []byte("TRACE "),
+	}
+
+	bittorrentHandshake = []byte("\x13BitTorrent protocol")
+)
+
+// SniffProtocol 通过 首包 判断 应用层协议, 无法判断时 返回 "".
+// 仅做 简单的 特征判断, 不保证 准确; 用于 分流 而不是 安全用途.
+func SniffProtocol(first []byte, isudp bool) string {
+	if isudp {
+		switch {
+		case isQUICInitial(first):
+			return ProtocolQUIC
+		case isBitTorrentUDP(first):
+			return ProtocolBitTorrent
+		}
+		return ""
+	}
+
+	switch {
+	//ContentType 为 handshake(22), 版本 主号 为3, HandshakeType 为 client_hello(1)
+	case len(first) >= 6 && first[0] == 22 && first[1] == 3 && first[5] == 1:
+		return ProtocolTLS
+	case bytes.HasPrefix(first, bittorrentHandshake):
+		return ProtocolBitTorrent
+	}
+	for _, m := range httpMethodPrefixes {
+		if bytes.HasPrefix(first, m) {
+			return ProtocolHTTP
+		}
+	}
+	return ""
+}
+
+// 判断 是否为 QUIC 的 Initial 包 (rfc9000 17.2.2, rfc9369 3.2). 长包头 的 首字节 最高两位 都为1,
+// v1 与 各草案版本 的 Initial 类型 为 0, v2 的 Initial 类型 为 1.
+func isQUICInitial(p []byte) bool {
+	if len(p) < 7 || p[0]&0xc0 != 0xc0 {
+		return false
+	}
+	packetType := (p[0] & 0x30) >> 4
+	switch version := binary.BigEndian.Uint32(p[1:5]); {
+	case version == 1:
+		return packetType == 0
+	case version == 0x6b3343cf:
+		return packetType == 1
+	case version&0xffffff00 == 0xff000000: //草案版本
+		return packetType == 0
+	}
+	return false
+}
+
+// DHT (BEP 5) 的 bencode 消息 或 uTP (BEP 29) 的 SYN 包
+func isBitTorrentUDP(p []byte) bool {
+	if bytes.HasPrefix(p, []byte("d1:")) {
+		return bytes.Contains(p, []byte("1:y1:q")) || bytes.Contains(p, []byte("1:y1:r")) || bytes.Contains(p, []byte("1:y1:e"))
+	}
+
+	//uTP 包头 为20字节, 首字节 高4位 为 类型(ST_SYN 为4), 低4位 为 版本(1); 第二字节 为 extension, 目前只定义了 0,1,2
+	return len(p) >= 20 && p[0] == 0x41 && p[1] <= 2
+}
@@ -311,21 +311,142 @@ classic:
 	return int64(n), e
 }
 
+// TrafficCounter 被告知 此次转发的 上传/下载 字节数, 会被 多个goroutine 同时调用. 见 Relay, RelayUDP 和 RelayUDP_separate.
+//
+// udp 每转发一个包 告知一次; tcp 默认 在 每个方向 拷贝结束时 一次性告知, 这样 依然可以 splice/readv,
+// 除非 它 实现了 RealtimeTrafficCounter 且 需要 实时统计.
+type TrafficCounter interface {
+	AddDownload(n uint64)
+	AddUpload(n uint64)
+}
+
+// NeedRealtime 返回 true 时, Relay 会在 每次写入后 告知 字节数, 比如 有配额的用户 需要 及时计入 长连接 与 mux 连接 的流量;
+// 此时 只能使用 经典拷贝方法.
+type RealtimeTrafficCounter interface {
+	TrafficCounter
+	NeedRealtime() bool
+}
+
+func needRealtime(tc TrafficCounter) bool {
+	rtc, ok := tc.(RealtimeTrafficCounter)
+	return ok && rtc.NeedRealtime()
+}
+
+// 可同时更新多个 TrafficCounter, 比如 同时统计全局流量与 单用户流量. 其中为nil的项会被跳过. 实现 TrafficCounter
+type MultiTrafficCounter []TrafficCounter
+
+func (m MultiTrafficCounter) AddDownload(n uint64) {
+	for _, c := range m {
+		if c != nil {
+			c.AddDownload(n)
+		}
+	}
+}
+
+func (m MultiTrafficCounter) AddUpload(n uint64) {
+	for _, c := range m {
+		if c != nil {
+			c.AddUpload(n)
+		}
+	}
+}
+
+// 任意一项 需要 实时统计 时 返回 true. 实现 RealtimeTrafficCounter
+func (m MultiTrafficCounter) NeedRealtime() bool {
+	for _, c := range m {
+		if c != nil && needRealtime(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimiter 用于转发时限速. 每次写入 n 字节之前, 会调用 Wait(n), 阻塞直到允许写入.
+// 见 Relay, RelayUDP 和 RelayUDP_separate
+type RateLimiter interface {
+	Wait(n int)
+}
+
+// 类似 TryCopy, 但是 每次写入前 都会在 rl 上等待. 因为要按字节数限速, 所以只能使用 经典拷贝方法,
+// 无法 splice 或 readv; 所以只应在 确实有限速时 使用.
+func LimitedCopy(writeConn io.Writer, readConn io.Reader, rl RateLimiter, id uint32) (allnum int64, err error) {
+	return classicCopy(writeConn, readConn, rl, nil, id)
+}
+
+// 经典拷贝. 若 rl 给出, 每次写入前 在其上等待; 若 add 给出, 每次写入后 将写入的字节数 告知 add.
+func classicCopy(writeConn io.Writer, readConn io.Reader, rl RateLimiter, add func(uint64), id uint32) (allnum int64, err error) {
+	if ce := utils.CanLogDebug("copying with classic method, limiting or counting"); ce != nil {
+		ce.Write(zap.Uint32("id", id), zap.Bool("limit", rl != nil), zap.Bool("count", add != nil))
+	}
+
+	bs := utils.GetPacket()
+	defer utils.PutPacket(bs)
+
+	for {
+		var n int
+		n, err = readConn.Read(bs)
+		if n > 0 {
+			if rl != nil {
+				rl.Wait(n)
+			}
+
+			n2, err2 := writeConn.Write(bs[:n])
+			allnum += int64(n2)
+			if add != nil && n2 > 0 {
+				add(uint64(n2))
+			}
+			if err2 != nil {
+				err = err2
+				return
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+	}
+}
+
+// 若 rl 为nil 且 不需要 realtime, 调用 TryCopy, 并在 结束时 将 字节数 一次性 告知 add;
+// 否则调用 classicCopy, 每次写入后 告知 add.
+func copyAndCount(writeConn io.Writer, readConn io.Reader, rl RateLimiter, add func(uint64), realtime bool, id uint32) (int64, error) {
+	if rl == nil && (add == nil || !realtime) {
+		n, err := TryCopy(writeConn, readConn, id)
+		if add != nil && n > 0 {
+			add(uint64(n))
+		}
+		return n, err
+	}
+	return classicCopy(writeConn, readConn, rl, add, id)
+}
+
 // 从 rc 读取 写入到 lc ，并同时从 lc 读取写入 rc.
 // 阻塞. rc是指 remoteConn, lc 是指localConn; 一般lc由自己监听的Accept产生, rc 由自己拨号产生.
 // UseReadv==true 时 内部使用 TryCopy 进行拷贝,
 // 会自动优选 splice，readv，不行则使用经典拷贝.
 //
 // 拷贝完成后会主动关闭双方连接.
-// 返回从 rc读取到的总字节长度（即下载流量）. 如果 downloadByteCount, uploadByteCount 给出,
-// 则会 分别原子更新 上传和下载的总字节数. identity 用于输出日志。
-func Relay(realTargetAddr *Addr, rc, lc io.ReadWriteCloser, identity uint32, downloadByteCount, uploadByteCount *uint64) int64 {
+// 返回从 rc读取到的总字节长度（即下载流量）. 如果 tc 给出,
+// 则会 分别 将 上传和下载的字节数 告知 tc, 见 TrafficCounter. identity 用于输出日志。
+//
+// upLimit 作用于 lc->rc 方向, downLimit 作用于 rc->lc 方向.
+// 给出 限速 或 tc 需要实时统计 的方向 只能使用 经典拷贝方法, 其它情况 依然可以 splice/readv.
+func Relay(realTargetAddr *Addr, rc, lc io.ReadWriteCloser, identity uint32, tc TrafficCounter, upLimit, downLimit RateLimiter) int64 {
+
+	var addUp, addDown func(uint64)
+	var realtime bool
+	if tc != nil {
+		addUp, addDown = tc.AddUpload, tc.AddDownload
+		realtime = needRealtime(tc)
+	}
 
 	if utils.LogLevel == utils.Log_debug {
 
 		rtaddrStr := realTargetAddr.String()
 		go func() {
-			n, e := TryCopy(rc, lc, identity)
+			n, e := copyAndCount(rc, lc, upLimit, addUp, realtime, identity)
 
 			utils.CanLogDebug("Relay End").Write(zap.Uint32("id", identity),
 				zap.String("direction", "L->R"),
@@ -337,13 +458,9 @@ func Relay(realTargetAddr *Addr, rc, lc io.ReadWriteCloser, identity uint32, dow
 			lc.Close()
 			rc.Close()
 
-			if uploadByteCount != nil {
-				utils.AtomicAddUint64(uploadByteCount, uint64(n))
-			}
-
 		}()
 
-		n, e := TryCopy(lc, rc, identity)
+		n, e := copyAndCount(lc, rc, downLimit, addDown, realtime, identity)
 
 		utils.CanLogDebug("Relay End").Write(zap.Uint32("id", identity),
 			zap.String("direction", "R->L"),
@@ -355,31 +472,21 @@ func Relay(realTargetAddr *Addr, rc, lc io.ReadWriteCloser, identity uint32, dow
 		lc.Close()
 		rc.Close()
 
-		if downloadByteCount != nil {
-			utils.AtomicAddUint64(downloadByteCount, uint64(n))
-		}
 		return n
 	} else {
 		go func() {
-			n, _ := TryCopy(rc, lc, identity)
+			copyAndCount(rc, lc, upLimit, addUp, realtime, identity)
 
 			lc.Close()
 			rc.Close()
 
-			if uploadByteCount != nil {
-				utils.AtomicAddUint64(uploadByteCount, uint64(n))
-			}
-
 		}()
 
-		n, _ := TryCopy(lc, rc, identity)
+		n, _ := copyAndCount(lc, rc, downLimit, addDown, realtime, identity)
 
 		lc.Close()
 		rc.Close()
 
-		if downloadByteCount != nil {
-			utils.AtomicAddUint64(downloadByteCount, uint64(n))
-		}
 		return n
 	}
 
@@ -0,0 +1,91 @@
+package netLayer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestLimitedCopy(t *testing.T) {
+	const rate = 256 * 1024
+	const total = rate + rate/2 //桶中初始有 一秒的流量, 剩下的应耗时约 0.5秒
+
+	src := bytes.NewReader(make([]byte, total))
+	var dst bytes.Buffer
+
+	start := time.Now()
+	n, err := LimitedCopy(&dst, src, utils.NewRateLimiter(rate), 0)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != total || dst.Len() != total {
+		t.Fatal("short copy", n, dst.Len())
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatal("rate limit not working", elapsed)
+	}
+}
+
+type testTrafficCounter struct {
+	up, down uint64
+	realtime bool
+}
+
+func (c *testTrafficCounter) AddDownload(n uint64) { atomic.AddUint64(&c.down, n) }
+func (c *testTrafficCounter) AddUpload(n uint64)   { atomic.AddUint64(&c.up, n) }
+func (c *testTrafficCounter) NeedRealtime() bool   { return c.realtime }
+
+// 等待 tc 被告知 up 和 down; 写入 返回后 才会 计入, 所以 要 稍等一下
+func waitTrafficCount(tc *testTrafficCounter, up, down uint64) bool {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadUint64(&tc.up) == up && atomic.LoadUint64(&tc.down) == down {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// 需要 实时统计 时, 流量 要在 转发过程中 就计入 tc; 否则 在 连接关闭时 计入
+func TestRelayTrafficCount(t *testing.T) {
+	for _, realtime := range []bool{true, false} {
+		lc, lcPeer := net.Pipe()
+		rc, rcPeer := net.Pipe()
+
+		tc := &testTrafficCounter{realtime: realtime}
+		done := make(chan struct{})
+		go func() {
+			Relay(&Addr{Name: "test", Port: 80}, rc, lc, 0, tc, nil, nil)
+			close(done)
+		}()
+
+		buf := make([]byte, 100)
+		go lcPeer.Write(make([]byte, 100))
+		if _, err := io.ReadFull(rcPeer, buf); err != nil {
+			t.Fatal(err)
+		}
+		go rcPeer.Write(make([]byte, 30))
+		if _, err := io.ReadFull(lcPeer, buf[:30]); err != nil {
+			t.Fatal(err)
+		}
+
+		if realtime && !waitTrafficCount(tc, 100, 30) {
+			t.Fatal("traffic not counted while relaying", atomic.LoadUint64(&tc.up), atomic.LoadUint64(&tc.down))
+		}
+
+		lcPeer.Close()
+		rcPeer.Close()
+		<-done
+
+		if !waitTrafficCount(tc, 100, 30) {
+			t.Fatal("traffic not counted", realtime, atomic.LoadUint64(&tc.up), atomic.LoadUint64(&tc.down))
+		}
+	}
+}
@@ -88,7 +88,7 @@ udp是无连接的，所以需要考虑超时问题。
 
 若为fullcone，则 rc错误时，rc可以关闭，而 lc 则不可以随意关闭; 若lc错误时，则两端都可关闭
 */
-func RelayUDP(rc, lc MsgConn, downloadByteCount, uploadByteCount *uint64) uint64 {
+func RelayUDP(rc, lc MsgConn, tc TrafficCounter, upLimit, downLimit RateLimiter) uint64 {
 	isfullcone := rc.Fullcone() && lc.Fullcone()
 	go func() {
 
@@ -96,8 +96,6 @@ func RelayUDP(rc, lc MsgConn, downloadByteCount, uploadByteCount *uint64) uint64
 			ce.Write(zap.String("from", reflect.TypeOf(lc).String()), zap.String("to", reflect.TypeOf(rc).String()))
 		}
 
-		var count uint64
-
 		var lcReadErr bool
 
 		for {
@@ -111,12 +109,18 @@ func RelayUDP(rc, lc MsgConn, downloadByteCount, uploadByteCount *uint64) uint64
 				ce.Write(zap.String("src addr", raddr.String()), zap.Int("len", len(bs)))
 			}
 
+			if upLimit != nil {
+				upLimit.Wait(len(bs))
+			}
+
 			err = rc.WriteMsg(bs, raddr)
 			if err != nil {
 				break
 			}
 
-			count += uint64(len(bs))
+			if tc != nil {
+				tc.AddUpload(uint64(len(bs)))
+			}
 		}
 
 		if !isfullcone {
@@ -132,13 +136,9 @@ func RelayUDP(rc, lc MsgConn, downloadByteCount, uploadByteCount *uint64) uint64
 
 		}
 
-		if uploadByteCount != nil {
-			utils.AtomicAddUint64(uploadByteCount, count)
-		}
-
 	}()
 
-	count2, rcReadErr := relayUDP_rc_toLC(rc, lc, downloadByteCount, nil)
+	count2, rcReadErr := relayUDP_rc_toLC(rc, lc, tc, downLimit, nil)
 	rc.Close()
 
 	if isfullcone {
@@ -154,10 +154,10 @@ func RelayUDP(rc, lc MsgConn, downloadByteCount, uploadByteCount *uint64) uint64
 }
 
 /*
-循环从rc读取数据，并写入lc，直到错误发生。若 downloadByteCount 给出，会更新 下载总字节数。
+循环从rc读取数据，并写入lc，直到错误发生。若 tc 给出，每次写入后 会将 下载字节数 告知 tc。若 rl 给出, 每次写入前会在其上等待。
 返回此次所下载的字节数。如果是rc读取产生了错误导致的退出, 返回的bool为true。若mutex给出，则 内部调用 lc.WriteMsg 时会进行 锁定。
 */
-func relayUDP_rc_toLC(rc, lc MsgConn, downloadByteCount *uint64, mutex *sync.RWMutex) (uint64, bool) {
+func relayUDP_rc_toLC(rc, lc MsgConn, tc TrafficCounter, rl RateLimiter, mutex *sync.RWMutex) (uint64, bool) {
 
 	var count uint64
 	var rcwrong bool
@@ -168,6 +168,10 @@ func relayUDP_rc_toLC(rc, lc MsgConn, downloadByteCount *uint64, mutex *sync.RWM
 			break
 		}
 
+		if rl != nil {
+			rl.Wait(len(bs))
+		}
+
 		if mutex != nil {
 			mutex.Lock()
 			err = lc.WriteMsg(bs, raddr)
@@ -181,10 +185,9 @@ func relayUDP_rc_toLC(rc, lc MsgConn, downloadByteCount *uint64, mutex *sync.RWM
 			break
 		}
 		count += uint64(len(bs))
-	}
-
-	if downloadByteCount != nil {
-		utils.AtomicAddUint64(downloadByteCount, count)
+		if tc != nil {
+			tc.AddDownload(uint64(len(bs)))
+		}
 	}
 
 	return count, rcwrong
@@ -195,7 +198,7 @@ func relayUDP_rc_toLC(rc, lc MsgConn, downloadByteCount *uint64, mutex *sync.RWM
 // 分离信道法还有个好处，就是fullcone时，不必一直保留某连接, 如果超时/读取错误, 可以断开单个rc连接, 释放占用的端口资源.
 // 不过分离信道只能用于代理，不能用于 direct, 因为direct为了实现fullcone, 对所有rc连接都用的同一个udp端口。
 // 阻塞. 返回从 rc 下载的总字节数. 拷贝完成后自动关闭双端连接.
-func RelayUDP_separate(rc, lc MsgConn, firstAddr *Addr, downloadByteCount, uploadByteCount *uint64, dialfunc func(raddr Addr) MsgConn) uint64 {
+func RelayUDP_separate(rc, lc MsgConn, firstAddr *Addr, tc TrafficCounter, upLimit, downLimit RateLimiter, dialfunc func(raddr Addr) MsgConn) uint64 {
 	//一般而言，lc为 socks5 的MsgConn，rc 为 vless v1 客户端的 MsgConn
 
 	var lc_mutex sync.RWMutex
@@ -213,7 +216,6 @@ func RelayUDP_separate(rc, lc MsgConn, firstAddr *Addr, downloadByteCount, uploa
 	}
 
 	go func() {
-		var count uint64
 		//从单个lc读取, 然后随着时间推移, 会创建多个rc.
 		// 然后 对每一个rc, 创建单独goroutine 读取rc, 然后写入lc.
 		// 因为是多通道的, 所以涉及到了 对 lc 写入的 并发抢占问题, 要加锁。
@@ -246,7 +248,7 @@ func RelayUDP_separate(rc, lc MsgConn, firstAddr *Addr, downloadByteCount, uploa
 				lc_mutex.Unlock()
 
 				go func() {
-					_, rcwrong := relayUDP_rc_toLC(rc, lc, downloadByteCount, &lc_mutex)
+					_, rcwrong := relayUDP_rc_toLC(rc, lc, tc, downLimit, &lc_mutex)
 					//rc到lc转发结束，一定也是因为读取/写入失败, 如果是rc的错误, 则我们要删掉rc, 释放资源
 
 					if rcwrong {
@@ -260,6 +262,10 @@ func RelayUDP_separate(rc, lc MsgConn, firstAddr *Addr, downloadByteCount, uploa
 				}()
 			}
 
+			if upLimit != nil {
+				upLimit.Wait(len(bs))
+			}
+
 			err = rc.WriteMsg(bs, raddr)
 			if err != nil {
 
@@ -273,7 +279,9 @@ func RelayUDP_separate(rc, lc MsgConn, firstAddr *Addr, downloadByteCount, uploa
 				continue
 			}
 
-			count += uint64(len(bs))
+			if tc != nil {
+				tc.AddUpload(uint64(len(bs)))
+			}
 		}
 		//上面循环 只有lc 读取失败时才会退出,
 
@@ -287,13 +295,9 @@ func RelayUDP_separate(rc, lc MsgConn, firstAddr *Addr, downloadByteCount, uploa
 
 		lc.Close()
 
-		if uploadByteCount != nil {
-			utils.AtomicAddUint64(uploadByteCount, count)
-		}
-
 	}()
 
-	count2, rcwrong := relayUDP_rc_toLC(rc, lc, downloadByteCount, &lc_mutex)
+	count2, rcwrong := relayUDP_rc_toLC(rc, lc, tc, downLimit, &lc_mutex)
 	if rcwrong {
 		lc_mutex.Lock()
 		delete(rc_raddrMap, mainhash)
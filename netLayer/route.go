@@ -2,6 +2,7 @@ package netLayer
 
 import (
 	"math/rand"
+	"net"
 	"net/netip"
 	"regexp"
 	"strings"
@@ -50,6 +51,18 @@ type TargetDescription struct {
 	InTag string
 
 	UserIdentityStr string
+
+	SourceIP net.IP //客户端的ip, 可为nil
+	Protocol string //嗅探出的 应用层协议, 见 SniffProtocol; 可为空
+}
+
+// 端口范围, 包含 From 和 To
+type PortRange struct {
+	From, To uint16
+}
+
+func (pr PortRange) Contains(port int) bool {
+	return port >= int(pr.From) && port <= int(pr.To)
 }
 
 /*
@@ -60,7 +73,7 @@ Set 是 “集合” 的意思, 是一组相同类型的数据放到一起。
 	这里的相同点，就是它们同属于 将发往一个方向, 即同属一个路由策略。
 
 任意一个网络参数匹配后，都将发往相同的方向，由该方向OutTag 指定。
-若还给出了 InTags, Users 或 传输层, 则这些条件都通过后, 才进行网络层判断.
+若还给出了 InTags, Users, 来源ip, 目标端口, 应用层协议 或 传输层, 则这些条件都通过后, 才进行网络层判断.
 */
 type RouteSet struct {
 	//网络层
@@ -80,18 +93,33 @@ type RouteSet struct {
 	//Users 包含所有可匹配的 用户的 identityStr
 	Users map[string]bool
 
+	//客户端的 来源ip, 范围 或 确定值
+	SourceRanger cidranger.Ranger
+	SourceIPs    map[netip.Addr]bool
+
+	//目标端口
+	Ports []PortRange
+
+	//Protocols 为 嗅探出的 应用层协议, 如 tls, http, quic, bittorrent
+	Protocols map[string]bool
+
 	//Regex是正则匹配域名.
 	Regex []*regexp.Regexp
 
 	//Match 匹配任意字符串
 	Match, Geosites []string
 
+	//RuleSets 为 引用的 rule-set 的 tag, 见 RuleSetFiles
+	RuleSets []string
+
 	//传输层
 	AllowedTransportLayerProtocols uint16
 
 	OutTag  string   //目标
 	OutTags []string //目标列表
 
+	matcher  *DomainMatcher //由 Compile 生成, 为nil时 逐项 判断 域名规则
+	ruleSets []*RouteSet    //由 Compile 加载
 }
 
 // 对于我的country，直接直连
@@ -100,6 +128,7 @@ func NewRouteSetForMyCountry(iso string) *RouteSet {
 		return nil
 	}
 	rs := &RouteSet{
+		NetRanger:                      cidranger.NewPCTrieRanger(),
 		Countries:                      make(map[string]bool),
 		Domains:                        make(map[string]bool),
 		OutTag:                         "direct",
@@ -108,6 +137,8 @@ func NewRouteSetForMyCountry(iso string) *RouteSet {
 	}
 	rs.Countries[strings.ToUpper(iso)] = true
 	rs.Domains[strings.ToLower(iso)] = true //iso字符串的小写正好可以作为顶级域名
+	rs.loadCountriesFromGeoipDat()
+	rs.Compile()
 	return rs
 }
 
@@ -122,6 +153,9 @@ func NewFullRouteSet() *RouteSet {
 		Geosites:                       make([]string, 0),
 		InTags:                         make(map[string]bool),
 		Countries:                      make(map[string]bool),
+		SourceRanger:                   cidranger.NewPCTrieRanger(),
+		SourceIPs:                      make(map[netip.Addr]bool),
+		Protocols:                      make(map[string]bool),
 		AllowedTransportLayerProtocols: TCP | UDP, //默认即支持tcp和udp
 	}
 }
@@ -153,10 +187,60 @@ func (rs *RouteSet) IsIn(td *TargetDescription) bool {
 		return false
 	}
 
+	if !rs.IsSourceIn(td.SourceIP) {
+		return false
+	}
+
+	if len(rs.Protocols) > 0 {
+		if td.Protocol == "" || !rs.Protocols[td.Protocol] {
+			return false
+		}
+	}
+
+	if !rs.IsPortIn(td.Addr.Port) {
+		return false
+	}
+
 	return rs.IsAddrIn(td.Addr)
 
 }
 
+// 没有给出 来源限制 时 总是返回 true; 给出了 但 ip 为nil 时 返回 false.
+func (rs *RouteSet) IsSourceIn(ip net.IP) bool {
+	hasRanger := rs.SourceRanger != nil && rs.SourceRanger.Len() > 0
+	if !hasRanger && len(rs.SourceIPs) == 0 {
+		return true
+	}
+	if len(ip) == 0 {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if hasRanger {
+		if has, _ := rs.SourceRanger.Contains(ip); has {
+			return true
+		}
+	}
+	if na, ok := netip.AddrFromSlice(ip); ok {
+		return rs.SourceIPs[na]
+	}
+	return false
+}
+
+// 没有给出 端口限制 时 总是返回 true
+func (rs *RouteSet) IsPortIn(port int) bool {
+	if len(rs.Ports) == 0 {
+		return true
+	}
+	for _, pr := range rs.Ports {
+		if pr.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
 func (rs *RouteSet) IsTransportProtocolAllowed(p uint16) bool {
 	return rs.AllowedTransportLayerProtocols&p > 0
 }
@@ -186,7 +270,7 @@ func (rs *RouteSet) IsTCPAllowed() bool {
 }
 
 func (rs *RouteSet) IsNoLimitForNetworkLayer() bool {
-	if (rs.NetRanger == nil || rs.NetRanger.Len() == 0) && len(rs.IPs) == 0 && len(rs.Match) == 0 && len(rs.Domains) == 0 && len(rs.Full) == 0 && len(rs.Countries) == 0 && len(rs.Geosites) == 0 {
+	if (rs.NetRanger == nil || rs.NetRanger.Len() == 0) && len(rs.IPs) == 0 && len(rs.Match) == 0 && len(rs.Domains) == 0 && len(rs.Full) == 0 && len(rs.Countries) == 0 && len(rs.Geosites) == 0 && len(rs.RuleSets) == 0 {
 		//如果仅限制了一个传输层协议，且本集合里没有任何其它内容，那就直接通过
 		return true
 	}
@@ -232,45 +316,67 @@ func (rs *RouteSet) IsAddrIn(a Addr) bool {
 	}
 
 	if a.Name != "" {
-
-		if len(rs.Full) > 0 {
-			if _, found := rs.Full[a.Name]; found {
+		if rs.matcher != nil {
+			if rs.matcher.Match(a.Name) {
 				return true
 			}
+		} else if rs.isDomainIn(a.Name) {
+			return true
 		}
+	}
 
-		if len(rs.Domains) > 0 {
+	for _, set := range rs.ruleSets {
+		if set.IsAddrIn(a) {
+			return true
+		}
+	}
+	return false
+}
 
-			if HasFullOrSubDomain(a.Name, MapDomainHaser(rs.Domains)) {
-				return true
-			}
+// 将 域名规则 编译为 DomainMatcher. 修改了 域名相关的 字段 后 需要 重新调用.
+func (rs *RouteSet) Compile() {
+	rs.matcher = NewDomainMatcher(rs)
+	rs.loadRuleSets()
+}
 
+// 逐项 判断 域名规则, 用于 未编译 的 情况
+func (rs *RouteSet) isDomainIn(name string) bool {
+	if len(rs.Full) > 0 {
+		if _, found := rs.Full[name]; found {
+			return true
 		}
+	}
 
-		if len(rs.Match) > 0 {
-			for _, m := range rs.Match {
-				if strings.Contains(a.Name, m) {
-					return true
-				}
+	if len(rs.Domains) > 0 {
+
+		if HasFullOrSubDomain(name, MapDomainHaser(rs.Domains)) {
+			return true
+		}
+
+	}
+
+	if len(rs.Match) > 0 {
+		for _, m := range rs.Match {
+			if strings.Contains(name, m) {
+				return true
 			}
 		}
+	}
 
-		if len(rs.Regex) > 0 {
-			for _, reg := range rs.Regex {
-				if reg.MatchString(a.Name) {
-					return true
-				}
+	if len(rs.Regex) > 0 {
+		for _, reg := range rs.Regex {
+			if reg.MatchString(name) {
+				return true
 			}
 		}
+	}
 
-		if len(rs.Geosites) > 0 && len(GeositeListMap) > 0 {
+	if len(rs.Geosites) > 0 && len(GeositeListMap) > 0 {
 
-			for _, g := range rs.Geosites {
-				if IsDomainInsideGeosite(g, a.Name) {
-					return true
-				}
+		for _, g := range rs.Geosites {
+			if IsDomainInsideGeosite(g, name) {
+				return true
 			}
-
 		}
 
 	}
@@ -286,41 +392,80 @@ func (rs *RouteSet) Clone() (newOne *RouteSet) {
 		Full:                           maps.Clone(rs.Full),
 		Users:                          maps.Clone(rs.Users),
 		Geosites:                       slices.Clone(rs.Geosites),
+		RuleSets:                       slices.Clone(rs.RuleSets),
 		InTags:                         maps.Clone(rs.InTags),
 		OutTags:                        slices.Clone(rs.OutTags),
 		OutTag:                         rs.OutTag,
 		Regex:                          slices.Clone(rs.Regex),
 		Countries:                      maps.Clone(rs.Countries),
+		SourceRanger:                   cidranger.NewPCTrieRanger(),
+		SourceIPs:                      maps.Clone(rs.SourceIPs),
+		Ports:                          slices.Clone(rs.Ports),
+		Protocols:                      maps.Clone(rs.Protocols),
 		AllowedTransportLayerProtocols: rs.AllowedTransportLayerProtocols,
 	}
 
-	entries, _ := newOne.NetRanger.CoveredNetworks(*cidranger.AllIPv4)
+	copyRanger(newOne.NetRanger, rs.NetRanger)
+	copyRanger(newOne.SourceRanger, rs.SourceRanger)
+
+	newOne.Compile()
+	return
+}
+
+func copyRanger(dst, src cidranger.Ranger) {
+	if src == nil {
+		return
+	}
+	entries, _ := src.CoveredNetworks(*cidranger.AllIPv4)
 	for _, v := range entries {
-		newOne.NetRanger.Insert(v)
+		dst.Insert(v)
 	}
-	ip6entries, _ := newOne.NetRanger.CoveredNetworks(*cidranger.AllIPv6)
+	ip6entries, _ := src.CoveredNetworks(*cidranger.AllIPv6)
 	for _, v := range ip6entries {
-		newOne.NetRanger.Insert(v)
+		dst.Insert(v)
 	}
-
-	return
 }
 
 // 一个完整的 所有RouteSet的列表，进行路由时，直接遍历即可。
 // 所谓的路由实际上就是分流。
+//
+// 直接修改 List 后 需要 调用 Compile.
 type RoutePolicy struct {
 	List []*RouteSet
+
+	cache *routeCache //可为nil, 为nil时 不缓存
+	uses  routeCacheUses
 }
 
 func NewRoutePolicy() *RoutePolicy {
 	return &RoutePolicy{
-		List: make([]*RouteSet, 0, 2),
+		List:  make([]*RouteSet, 0, 2),
+		cache: newRouteCache(DefaultRouteCacheSize),
 	}
 }
 
 func (rp *RoutePolicy) AddRouteSet(rs *RouteSet) {
 	if rs != nil {
 		rp.List = append(rp.List, rs)
+		rp.resetCache()
+	}
+}
+
+// 编译 所有 RouteSet 的 域名规则, 并 清空 路由缓存
+func (rp *RoutePolicy) Compile() {
+	for _, rs := range rp.List {
+		rs.Compile()
+	}
+	rp.resetCache()
+}
+
+func (rp *RoutePolicy) resetCache() {
+	rp.uses = routeCacheUses{}
+	for _, rs := range rp.List {
+		rp.uses.add(rs)
+	}
+	if rp.cache != nil {
+		rp.cache = newRouteCache(rp.cache.size)
 	}
 }
 
@@ -328,6 +473,10 @@ func (rp *RoutePolicy) Clone() (newOne RoutePolicy) {
 	for _, v := range rp.List {
 		newOne.List = append(newOne.List, v.Clone())
 	}
+	if rp.cache != nil {
+		newOne.cache = newRouteCache(rp.cache.size)
+	}
+	newOne.resetCache()
 	return
 }
 
@@ -335,18 +484,38 @@ func (rp *RoutePolicy) Clone() (newOne RoutePolicy) {
 // 默认情况下，始终具有direct这个tag以及 proxy这个tag，无需用户额外在配置文件中指定。
 // 默认如果不匹配任何值的话，就会流向 "proxy" tag，也就是客户设置的 remoteClient的值。
 func (rp *RoutePolicy) CalcuOutTag(td *TargetDescription) string {
-	for _, rs := range rp.List {
-		if rs.IsIn(td) {
-			switch n := len(rs.OutTags); n {
-			case 0:
-				return rs.OutTag
-			case 1:
-				return rs.OutTags[0]
-			default:
-				return rs.OutTags[rand.Intn(n)]
-			}
+	var index int
+	if rp.cache != nil {
+		k := rp.uses.key(td)
+		var found bool
+		if index, found = rp.cache.get(k); !found {
+			index = rp.calcuIndex(td)
+			rp.cache.set(k, index)
+		}
+	} else {
+		index = rp.calcuIndex(td)
+	}
+	if index < 0 || index >= len(rp.List) {
+		return "proxy"
+	}
+
+	rs := rp.List[index]
+	switch n := len(rs.OutTags); n {
+	case 0:
+		return rs.OutTag
+	case 1:
+		return rs.OutTags[0]
+	default:
+		return rs.OutTags[rand.Intn(n)]
+	}
+}
 
+// 返回 第一个 匹配的 RouteSet 的 序号, 都不匹配 时 返回 -1
+func (rp *RoutePolicy) calcuIndex(td *TargetDescription) int {
+	for i, rs := range rp.List {
+		if rs.IsIn(td) {
+			return i
 		}
 	}
-	return "proxy"
+	return -1
 }
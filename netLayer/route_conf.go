@@ -5,6 +5,7 @@ import (
 	"net/netip"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/e1732a364fed/v2ray_simple/utils"
@@ -22,19 +23,28 @@ type RuleConf struct {
 	IPs       []string `toml:"ip" json:"ip"`
 	Domains   []string `toml:"domain" json:"domain"`
 	Network   []string `toml:"network" json:"network"`
+	RuleSets  []string `toml:"rule_set" json:"rule_set"` //引用的 rule-set 的 tag, 同时 匹配 其中的 域名 与 ip
+
+	Port      any      `toml:"port" json:"port"`         //目标端口, 可为 整数, 如 "25,80,1000-2000" 的字符串, 或 二者组成的列表
+	Sources   []string `toml:"source" json:"source"`     //客户端的来源ip, 格式 与 ip 项 相同
+	Protocols []string `toml:"protocol" json:"protocol"` //嗅探出的 应用层协议, 可为 tls, http, quic, bittorrent
 }
 
 func (policy *RoutePolicy) LoadRulesForRoutePolicy(rules []*RuleConf) {
 	for _, rc := range rules {
-		policy.List = append(policy.List, LoadRuleForRouteSet(rc))
+		if rs := LoadRuleForRouteSet(rc); rs != nil {
+			policy.List = append(policy.List, rs)
+		}
 	}
+	policy.resetCache()
 }
 
+// 若 rule 中 有 无法解析 而 会 导致 规则 范围 扩大 的 项 (如 port), 则 返回 nil, 不使用 该规则.
 func LoadRuleForRouteSet(rule *RuleConf) (rs *RouteSet) {
 	if len(GeositeListMap) == 0 {
-		err := LoadGeositeFiles()
+		err := LoadGeosite()
 		if err != nil {
-			if ce := utils.CanLogErr("LoadGeositeFiles failed"); ce != nil {
+			if ce := utils.CanLogErr("LoadGeosite failed"); ce != nil {
 				ce.Write(zap.Error(err), zap.String("Note", "You can use interactive-mode to download geosite files."))
 
 			}
@@ -102,6 +112,8 @@ func LoadRuleForRouteSet(rule *RuleConf) (rs *RouteSet) {
 
 	}
 
+	rs.RuleSets = rule.RuleSets
+
 	for _, t := range rule.InTags {
 		rs.InTags[t] = true
 	}
@@ -110,50 +122,144 @@ func LoadRuleForRouteSet(rule *RuleConf) (rs *RouteSet) {
 		rs.Users[u] = true
 	}
 
-	//ip 过滤 需要 分辨 "private", cidr 和普通ip
+	rs.loadCountriesFromGeoipDat()
+	loadIPRules(rule.IPs, rs.NetRanger, rs.IPs)
+	loadIPRules(rule.Sources, rs.SourceRanger, rs.SourceIPs)
 
-	for _, ipStr := range rule.IPs {
-		if ipStr == "private" {
+	if rule.Port != nil {
+		ports, err := ParsePortRanges(rule.Port)
+		if err != nil {
+			//Ports 为空 表示 任意端口, 若 使用 部分结果 会 使 规则 匹配 本不该 匹配 的 端口, 所以 直接 丢弃 该规则
+			if ce := utils.CanLogErr("LoadRuleForRouteSet, parse port failed, rule dropped"); ce != nil {
+				ce.Write(zap.Any("port", rule.Port), zap.Any("toTag", rule.DialTag), zap.Error(err))
+			}
+			return nil
+		}
+		rs.Ports = ports
+	}
 
-			//https://www.arin.net/reference/research/statistics/address_filters/
+	for _, p := range rule.Protocols {
+		rs.Protocols[strings.ToLower(p)] = true
+	}
 
-			if _, net, err := net.ParseCIDR("10.0.0.0/8"); err == nil {
-				rs.NetRanger.Insert(cidranger.NewBasicRangerEntry(*net))
-			}
-			if _, net, err := net.ParseCIDR("172.16.0.0/12"); err == nil {
-				rs.NetRanger.Insert(cidranger.NewBasicRangerEntry(*net))
-			}
-			if _, net, err := net.ParseCIDR("192.168.0.0/16"); err == nil {
-				rs.NetRanger.Insert(cidranger.NewBasicRangerEntry(*net))
-			}
+	if len(rule.Network) > 0 {
+		rs.AllowedTransportLayerProtocols = 0 //因为 NewFullRouteSet 默认会同时允许 tcp和udp，所以在自定义网络层规则时，我们不用默认值。
 
+		for _, netStr := range rule.Network {
+			tp := StrToTransportProtocol(netStr)
+			rs.AllowedTransportLayerProtocols |= tp
+		}
+	}
+
+	rs.Compile()
+	return rs
+}
+
+// ip 过滤 需要 分辨 "private", "geoip:xx", cidr 和普通ip
+func loadIPRules(list []string, ranger cidranger.Ranger, ips map[netip.Addr]bool) {
+	for _, ipStr := range list {
+		if ipStr == "private" {
+			insertPrivateIPs(ranger)
+			continue
+		}
+		if strings.HasPrefix(ipStr, "geoip:") {
+			code := ipStr[len("geoip:"):]
+			if prefixes, ok := GetGeoIPPrefixes(code); ok {
+				insertPrefixes(ranger, prefixes)
+			} else if strings.EqualFold(code, "private") {
+				insertPrivateIPs(ranger)
+			} else {
+				if ce := utils.CanLogErr("LoadRuleForRouteSet, geoip list not found"); ce != nil {
+					ce.Write(zap.String("item", ipStr), zap.Bool("geoip.dat loaded", HasGeoipDat()))
+				}
+			}
 			continue
 		}
 		if strings.Contains(ipStr, "/") {
 			if _, net, err := net.ParseCIDR(ipStr); err == nil {
-				rs.NetRanger.Insert(cidranger.NewBasicRangerEntry(*net))
+				ranger.Insert(cidranger.NewBasicRangerEntry(*net))
 			}
 			continue
 		}
 
 		na, e := netip.ParseAddr(ipStr)
 		if e == nil {
-			rs.IPs[na] = true
+			ips[na] = true
 		} else {
 			if ce := utils.CanLogErr("LoadRuleForRouteSet, parse ip failed"); ce != nil {
 				ce.Write(zap.String("ipStr", ipStr), zap.Error(e))
 			}
 		}
 	}
+}
 
-	if len(rule.Network) > 0 {
-		rs.AllowedTransportLayerProtocols = 0 //因为 NewFullRouteSet 默认会同时允许 tcp和udp，所以在自定义网络层规则时，我们不用默认值。
+// 解析 端口配置, v 可为 整数, 如 "25,80,1000-2000" 的字符串, 或 二者组成的列表.
+// 出错时 依然返回 已经成功解析的部分.
+func ParsePortRanges(v any) (list []PortRange, err error) {
+	switch value := v.(type) {
+	case int:
+		return appendPort(list, int64(value), int64(value))
+	case int64:
+		return appendPort(list, value, value)
+	case float64: //json
+		if value == float64(int64(value)) {
+			return appendPort(list, int64(value), int64(value))
+		}
+	case string:
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			from, to, found := strings.Cut(item, "-")
+			if !found {
+				to = from
+			}
+			f, e1 := strconv.ParseInt(strings.TrimSpace(from), 10, 32)
+			t, e2 := strconv.ParseInt(strings.TrimSpace(to), 10, 32)
+			if e1 != nil || e2 != nil {
+				return list, utils.ErrInErr{ErrDesc: "port range illegal", ErrDetail: utils.ErrInvalidData, Data: item}
+			}
+			if list, err = appendPort(list, f, t); err != nil {
+				return
+			}
+		}
+		return
+	case []any:
+		for _, item := range value {
+			var sub []PortRange
+			sub, err = ParsePortRanges(item)
+			list = append(list, sub...)
+			if err != nil {
+				return
+			}
+		}
+		return
+	case []int64:
+		for _, item := range value {
+			if list, err = appendPort(list, item, item); err != nil {
+				return
+			}
+		}
+		return
+	case []string:
+		return ParsePortRanges(strings.Join(value, ","))
+	}
+	return nil, utils.ErrInErr{ErrDesc: "port type not supported", ErrDetail: utils.ErrInvalidData, Data: reflect.TypeOf(v).String()}
+}
 
-		for _, netStr := range rule.Network {
-			tp := StrToTransportProtocol(netStr)
-			rs.AllowedTransportLayerProtocols |= tp
+// https://www.arin.net/reference/research/statistics/address_filters/
+func insertPrivateIPs(ranger cidranger.Ranger) {
+	for _, s := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"} {
+		if _, net, err := net.ParseCIDR(s); err == nil {
+			ranger.Insert(cidranger.NewBasicRangerEntry(*net))
 		}
 	}
+}
 
-	return rs
+func appendPort(list []PortRange, from, to int64) ([]PortRange, error) {
+	if from < 0 || to > 65535 || from > to {
+		return list, utils.ErrInErr{ErrDesc: "port range illegal", ErrDetail: utils.ErrInvalidData, Data: [2]int64{from, to}}
+	}
+	return append(list, PortRange{From: uint16(from), To: uint16(to)}), nil
 }
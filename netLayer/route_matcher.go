@@ -0,0 +1,440 @@
+package netLayer
+
+import (
+	"container/list"
+	"net"
+	"net/netip"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+)
+
+/*
+RouteSet 原本的 域名判断 是 逐项 遍历 Match, Regex 与 每一个 Geosite 的, 规则 很多 (如 加载了 数万条 geosite 域名) 时 会 占用 大量 cpu.
+
+所以 在 加载规则 时, 我们 将 Full, Domains, Match, Regex 以及 Geosites 中 的 所有 项 编译为 一个 DomainMatcher:
+
+	full: 完整域名 的 map
+	domains: 按 标签 倒序 存储 的 域名后缀 树
+	keywords: 由 所有 Match 组成 的 Aho-Corasick 自动机, 一次 扫描 即可 判断 是否 包含 任一 关键字
+	regexes: 所有 正则 按 是否 以 ^ 开头 分为 两组, 每组 合并 成 一个 正则. 以 ^ 开头 的 一组 去掉 各自的 ^ 后 合并为 ^(?:a|b|...),
+	  因为 (?:^a)|(?:^b) 不会 被 识别为 锚定的, 会 在 每个位置 都 尝试 匹配, 比 逐个 判断 还慢
+
+RoutePolicy 还 缓存 最近的 路由结果, 相同的 TargetDescription 不再 重复 判断.
+
+直接 修改了 RoutePolicy.List 或 RouteSet 的 字段 后, 需要 调用 RoutePolicy.Compile 重新 编译, 否则 会 使用 旧的 结果.
+*/
+
+const DefaultRouteCacheSize = 4096
+
+// 编译好的 域名匹配器, 匹配结果 与 RouteSet 逐项 判断 的 结果 相同
+type DomainMatcher struct {
+	full     map[string]struct{}
+	domains  *domainTrie
+	keywords *keywordMatcher
+	regexes  []*regexp.Regexp
+}
+
+func (dm *DomainMatcher) Match(domain string) bool {
+	if _, found := dm.full[domain]; found {
+		return true
+	}
+	if dm.domains != nil && dm.domains.match(domain) {
+		return true
+	}
+	if dm.keywords != nil && dm.keywords.match(domain) {
+		return true
+	}
+	for _, reg := range dm.regexes {
+		if reg.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// 由 rs 的 域名规则 生成 DomainMatcher; rs 没有 任何 域名规则 时 返回 nil.
+// Geosites 中 的 列表 必须 已经 加载 到 GeositeListMap 中.
+func NewDomainMatcher(rs *RouteSet) *DomainMatcher {
+	dm := &DomainMatcher{full: make(map[string]struct{})}
+
+	var regs []*regexp.Regexp
+	var hasDomain bool
+
+	addDomain := func(d string) {
+		if dm.domains == nil {
+			dm.domains = newDomainTrie()
+		}
+		dm.domains.insert(d)
+		hasDomain = true
+	}
+
+	for d := range rs.Full {
+		dm.full[d] = struct{}{}
+		hasDomain = true
+	}
+	for d := range rs.Domains {
+		addDomain(d)
+	}
+	keywords := append([]string(nil), rs.Match...)
+	regs = append(regs, rs.Regex...)
+
+	if len(GeositeListMap) > 0 {
+		for _, g := range rs.Geosites {
+			glist := GeositeListMap[strings.ToUpper(g)]
+			if glist == nil {
+				continue
+			}
+			for d := range glist.FullDomains {
+				dm.full[d] = struct{}{}
+				hasDomain = true
+			}
+			for d := range glist.Domains {
+				addDomain(d)
+			}
+			regs = append(regs, glist.RegexDomains...)
+			keywords = append(keywords, glist.Keywords...)
+		}
+	}
+
+	if len(keywords) > 0 {
+		dm.keywords = newKeywordMatcher(keywords)
+		hasDomain = true
+	}
+
+	if len(regs) > 0 {
+		dm.regexes = combineRegex(regs)
+		hasDomain = true
+	}
+
+	if !hasDomain {
+		return nil
+	}
+	return dm
+}
+
+// 将 多个 正则 按 是否 以 ^ 开头 合并 为 至多 两个. 某组 合并后 无法编译 时, 该组 保留 原来的 各个 正则.
+func combineRegex(regs []*regexp.Regexp) (result []*regexp.Regexp) {
+	if len(regs) == 1 {
+		return regs
+	}
+	var anchored, unanchored []string
+	var anchoredRegs, unanchoredRegs []*regexp.Regexp
+
+	for _, r := range regs {
+		if rest, ok := trimBeginText(r); ok {
+			anchored = append(anchored, rest)
+			anchoredRegs = append(anchoredRegs, r)
+		} else {
+			unanchored = append(unanchored, r.String())
+			unanchoredRegs = append(unanchoredRegs, r)
+		}
+	}
+
+	combine := func(prefix string, list []string, originals []*regexp.Regexp) {
+		switch len(list) {
+		case 0:
+			return
+		case 1:
+			result = append(result, originals[0])
+			return
+		}
+		var sb strings.Builder
+		sb.WriteString(prefix)
+		sb.WriteString("(?:")
+		for i, s := range list {
+			if i > 0 {
+				sb.WriteByte('|')
+			}
+			sb.WriteString("(?:")
+			sb.WriteString(s)
+			sb.WriteByte(')')
+		}
+		sb.WriteByte(')')
+		if reg, err := regexp.Compile(sb.String()); err == nil {
+			result = append(result, reg)
+		} else {
+			result = append(result, originals...)
+		}
+	}
+	combine("^", anchored, anchoredRegs)
+	combine("", unanchored, unanchoredRegs)
+	return
+}
+
+// 若 r 以 ^ 开头, 返回 去掉 ^ 后的 表达式
+func trimBeginText(r *regexp.Regexp) (string, bool) {
+	re, err := syntax.Parse(r.String(), syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	if re.Op == syntax.OpConcat && len(re.Sub) > 0 && re.Sub[0].Op == syntax.OpBeginText {
+		re.Sub = re.Sub[1:]
+		return re.String(), true
+	}
+	return "", false
+}
+
+// 以 域名 的 标签 倒序 存储 的 后缀树, 如 www.google.com 存为 com -> google -> www.
+// 匹配 规则 与 HasFullOrSubDomain 相同.
+type domainTrie struct {
+	children map[string]*domainTrie
+	end      bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{}
+}
+
+func (t *domainTrie) insert(domain string) {
+	node := t
+	end := len(domain)
+	for {
+		dot := strings.LastIndexByte(domain[:end], '.')
+		label := domain[dot+1 : end]
+
+		if node.children == nil {
+			node.children = make(map[string]*domainTrie)
+		}
+		next := node.children[label]
+		if next == nil {
+			next = &domainTrie{}
+			node.children[label] = next
+		}
+		node = next
+
+		if dot < 0 {
+			break
+		}
+		end = dot
+	}
+	node.end = true
+}
+
+func (t *domainTrie) match(domain string) bool {
+	node := t
+	end := len(domain)
+	for {
+		dot := strings.LastIndexByte(domain[:end], '.')
+		node = node.children[domain[dot+1:end]]
+		if node == nil {
+			return false
+		}
+		if node.end {
+			return true
+		}
+		if dot < 0 {
+			return false
+		}
+		end = dot
+	}
+}
+
+// Aho-Corasick 自动机, 判断 字符串 中 是否 包含 任一 关键字
+type keywordMatcher struct {
+	nodes []acNode
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  bool //本节点 或 其 fail链 上 有 关键字 结束
+}
+
+func newKeywordMatcher(keywords []string) *keywordMatcher {
+	m := &keywordMatcher{nodes: []acNode{{}}}
+
+	for _, k := range keywords {
+		if k == "" {
+			//空字符串 被 任何 字符串 包含
+			m.nodes[0].out = true
+			continue
+		}
+		cur := int32(0)
+		for i := 0; i < len(k); i++ {
+			n := &m.nodes[cur]
+			next, ok := n.next[k[i]]
+			if !ok {
+				if n.next == nil {
+					n.next = make(map[byte]int32)
+				}
+				next = int32(len(m.nodes))
+				n.next[k[i]] = next
+				m.nodes = append(m.nodes, acNode{})
+			}
+			cur = next
+		}
+		m.nodes[cur].out = true
+	}
+
+	//广度优先 设置 fail
+	queue := make([]int32, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		for b, child := range m.nodes[cur].next {
+			f := m.nodes[cur].fail
+			for {
+				if next, ok := m.nodes[f].next[b]; ok {
+					m.nodes[child].fail = next
+					break
+				}
+				if f == 0 {
+					m.nodes[child].fail = 0
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if m.nodes[m.nodes[child].fail].out {
+				m.nodes[child].out = true
+			}
+			queue = append(queue, child)
+		}
+	}
+	return m
+}
+
+func (m *keywordMatcher) match(s string) bool {
+	if m.nodes[0].out {
+		return true
+	}
+	cur := int32(0)
+	for i := 0; i < len(s); i++ {
+		for {
+			if next, ok := m.nodes[cur].next[s[i]]; ok {
+				cur = next
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+		if m.nodes[cur].out {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutePolicy 所用的 缓存 的 key, 只 包含 有规则 用到的 字段
+type routeCacheKey struct {
+	name     string
+	ip       netip.Addr
+	network  string
+	port     int
+	inTag    string
+	user     string
+	source   netip.Addr
+	protocol string
+}
+
+// 路由缓存 中 需要 包含 的 字段
+type routeCacheUses struct {
+	port, inTag, user, source, protocol bool
+}
+
+func (u *routeCacheUses) add(rs *RouteSet) {
+	u.port = u.port || len(rs.Ports) > 0
+	u.inTag = u.inTag || len(rs.InTags) > 0
+	u.user = u.user || len(rs.Users) > 0
+	u.source = u.source || len(rs.SourceIPs) > 0 || (rs.SourceRanger != nil && rs.SourceRanger.Len() > 0)
+	u.protocol = u.protocol || len(rs.Protocols) > 0
+}
+
+func (u *routeCacheUses) key(td *TargetDescription) (k routeCacheKey) {
+	k.name = td.Addr.Name
+	k.ip = ipToNetipAddr(td.Addr.IP)
+	k.network = td.Addr.Network
+	if u.port {
+		k.port = td.Addr.Port
+	}
+	if u.inTag {
+		k.inTag = td.InTag
+	}
+	if u.user {
+		k.user = td.UserIdentityStr
+	}
+	if u.source {
+		k.source = ipToNetipAddr(td.SourceIP)
+	}
+	if u.protocol {
+		k.protocol = td.Protocol
+	}
+	return
+}
+
+func ipToNetipAddr(ip net.IP) netip.Addr {
+	if na, ok := netip.AddrFromSlice(ip); ok {
+		return na.Unmap()
+	}
+	return netip.Addr{}
+}
+
+type routeCacheEntry struct {
+	key   routeCacheKey
+	index int //匹配到的 RouteSet 在 List 中的 序号, -1 表示 都不匹配
+}
+
+// 按 LRU 淘汰 的 路由结果 缓存, 多线程安全
+type routeCache struct {
+	size int
+
+	mutex sync.Mutex
+	lru   *list.List //元素为 *routeCacheEntry, 越靠前 越是 最近使用的
+	m     map[routeCacheKey]*list.Element
+}
+
+func newRouteCache(size int) *routeCache {
+	return &routeCache{
+		size: size,
+		lru:  list.New(),
+		m:    make(map[routeCacheKey]*list.Element),
+	}
+}
+
+func (c *routeCache) get(k routeCacheKey) (index int, found bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e := c.m[k]
+	if e == nil {
+		return
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*routeCacheEntry).index, true
+}
+
+func (c *routeCache) set(k routeCacheKey, index int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e := c.m[k]; e != nil {
+		e.Value.(*routeCacheEntry).index = index
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	var entry *routeCacheEntry
+	if c.lru.Len() >= c.size {
+		//复用 最久未使用 的 条目
+		entry = c.lru.Remove(c.lru.Back()).(*routeCacheEntry)
+		delete(c.m, entry.key)
+	} else {
+		entry = &routeCacheEntry{}
+	}
+	entry.key = k
+	entry.index = index
+	c.m[k] = c.lru.PushFront(entry)
+}
+
+func (c *routeCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,205 @@
+package netLayer
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// 加入 一个 用于测试 的 geosite 列表, 返回 恢复 GeositeListMap 的 函数
+func addTestGeosite(name string, domains, full, regs []string) func() {
+	old := GeositeListMap
+	GeositeListMap = make(map[string]*GeositeList)
+	for k, v := range old {
+		GeositeListMap[k] = v
+	}
+
+	gl := &GeositeList{
+		Name:        name,
+		Domains:     make(map[string]GeositeDomain),
+		FullDomains: make(map[string]GeositeDomain),
+	}
+	for _, d := range domains {
+		gl.Domains[d] = GeositeDomain{Type: "domain", Value: d}
+	}
+	for _, d := range full {
+		gl.FullDomains[d] = GeositeDomain{Type: "full", Value: d}
+	}
+	for _, r := range regs {
+		gl.RegexDomains = append(gl.RegexDomains, regexp.MustCompile(r))
+	}
+	GeositeListMap[name] = gl
+
+	return func() { GeositeListMap = old }
+}
+
+func TestDomainMatcher(t *testing.T) {
+	defer addTestGeosite("TEST", []string{"google.com", "cn"}, []string{"www.apple.com"}, []string{`^ads\d+\.`})()
+
+	rs := LoadRuleForRouteSet(&RuleConf{
+		DialTag: "direct",
+		Domains: []string{
+			"geosite:test", "full:exact.org", "domain:example.com",
+			"keyword", "tracker", "regexp:(?i)^CDN-", "regexp:\\.local$",
+		},
+	})
+	if rs.matcher == nil {
+		t.Fatal("route set not compiled")
+	}
+
+	for _, name := range []string{
+		"google.com", "mail.google.com", "agoogle.com", "google.com.hk",
+		"baidu.cn", "cn", "n",
+		"www.apple.com", "apple.com", "a.www.apple.com",
+		"exact.org", "a.exact.org",
+		"example.com", "a.b.example.com", "example.co",
+		"mykeyword.net", "keywor.d", "x.trackers.io", "trackr.io",
+		"cdn-1.net", "CDN-2.net", "a.cdn-1.net", "printer.local", "local.com",
+		"ads12.site.com", "ads.site.com",
+		"", "a..b", "com.",
+	} {
+		want := rs.isDomainIn(name)
+		if got := rs.matcher.Match(name); got != want {
+			t.Fatal(name, "compiled matcher got", got, "but want", want)
+		}
+	}
+
+	if !rs.matcher.Match("mail.google.com") || rs.matcher.Match("agoogle.com") {
+		t.Fatal("domain suffix wrong")
+	}
+}
+
+func TestKeywordMatcher(t *testing.T) {
+	m := newKeywordMatcher([]string{"he", "she", "his", "hers", "abcd", "bc"})
+	for s, want := range map[string]bool{
+		"ushers": true, "ahishe": true, "xbcy": true, "abce": true,
+		"hi": false, "abd": false, "": false, "ab": false,
+	} {
+		if got := m.match(s); got != want {
+			t.Fatal(s, "got", got, "want", want)
+		}
+	}
+	if !newKeywordMatcher([]string{""}).match("any") {
+		t.Fatal("empty keyword should match any string")
+	}
+}
+
+func TestRoutePolicyCache(t *testing.T) {
+	rp := NewRoutePolicy()
+	rp.LoadRulesForRoutePolicy([]*RuleConf{
+		{DialTag: "office", Sources: []string{"192.168.10.0/24"}, Domains: []string{"domain:example.com"}},
+		{DialTag: "direct", Domains: []string{"domain:example.com"}},
+	})
+
+	office := &TargetDescription{Addr: Addr{Name: "www.example.com", Port: 443}, SourceIP: net.IPv4(192, 168, 10, 5)}
+	other := &TargetDescription{Addr: Addr{Name: "www.example.com", Port: 443}, SourceIP: net.IPv4(10, 0, 0, 1)}
+
+	for i := 0; i < 2; i++ {
+		if got := rp.CalcuOutTag(office); got != "office" {
+			t.Fatal(i, "want office, got", got)
+		}
+		if got := rp.CalcuOutTag(other); got != "direct" {
+			t.Fatal(i, "want direct, got", got)
+		}
+	}
+	if rp.cache.Len() != 2 {
+		t.Fatal("cache len should be 2", rp.cache.Len())
+	}
+
+	//修改规则 后 重新编译, 缓存 应被 清空
+	rp.List[1].Domains = map[string]bool{"example.org": true}
+	rp.Compile()
+	if got := rp.CalcuOutTag(other); got != "proxy" {
+		t.Fatal("want proxy after recompile, got", got)
+	}
+
+	rp.cache = newRouteCache(2)
+	for i := 0; i < 5; i++ {
+		rp.CalcuOutTag(&TargetDescription{Addr: Addr{Name: strconv.Itoa(i) + ".com"}})
+	}
+	if rp.cache.Len() != 2 {
+		t.Fatal("lru should keep 2 entries", rp.cache.Len())
+	}
+	if _, found := rp.cache.get(rp.uses.key(&TargetDescription{Addr: Addr{Name: "4.com"}})); !found {
+		t.Fatal("recent entry evicted")
+	}
+}
+
+// 生成 一个 较大的 规则集: 10个 geosite 列表 共 2万个 域名 与 50个 正则, 以及 200个 关键字
+func benchRouteSet(b *testing.B) (*RouteSet, func()) {
+	var restores []func()
+	ds := []string{}
+	for g := 0; g < 10; g++ {
+		var domains, full, regs []string
+		for i := 0; i < 2000; i++ {
+			domains = append(domains, "site"+strconv.Itoa(g*2000+i)+".com")
+		}
+		for i := 0; i < 200; i++ {
+			full = append(full, "www.full"+strconv.Itoa(g*200+i)+".net")
+		}
+		for i := 0; i < 5; i++ {
+			if i%2 == 0 {
+				regs = append(regs, `^ad`+strconv.Itoa(g*5+i)+`\.[a-z]+\.org$`)
+			} else {
+				regs = append(regs, `(^|\.)track`+strconv.Itoa(g*5+i)+`\.[a-z]+$`)
+			}
+		}
+		name := "BENCH" + strconv.Itoa(g)
+		restores = append(restores, addTestGeosite(name, domains, full, regs))
+		ds = append(ds, "geosite:"+name)
+	}
+	for i := 0; i < 200; i++ {
+		ds = append(ds, "kw"+strconv.Itoa(i)+"x")
+	}
+	rs := LoadRuleForRouteSet(&RuleConf{DialTag: "direct", Domains: ds})
+	return rs, func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+}
+
+var benchNames = []string{
+	"a.b.site19999.com", "site5.com", "www.full1999.net", "ad49.foo.org",
+	"my-kw199x.io", "www.notmatched.example.com", "cdn.unknown.net", "nomatch",
+}
+
+func BenchmarkRouteSet_IsIn(b *testing.B) {
+	rs, restore := benchRouteSet(b)
+	defer restore()
+	rs.matcher = nil
+
+	td := &TargetDescription{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		td.Addr.Name = benchNames[i%len(benchNames)]
+		rs.IsIn(td)
+	}
+}
+
+func BenchmarkRouteSet_IsIn_compiled(b *testing.B) {
+	rs, restore := benchRouteSet(b)
+	defer restore()
+
+	td := &TargetDescription{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		td.Addr.Name = benchNames[i%len(benchNames)]
+		rs.IsIn(td)
+	}
+}
+
+func BenchmarkRoutePolicy_CalcuOutTag_cached(b *testing.B) {
+	rs, restore := benchRouteSet(b)
+	defer restore()
+	rp := NewRoutePolicy()
+	rp.AddRouteSet(rs)
+
+	td := &TargetDescription{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		td.Addr.Name = benchNames[i%len(benchNames)]
+		rp.CalcuOutTag(td)
+	}
+}
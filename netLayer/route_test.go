@@ -0,0 +1,86 @@
+package netLayer
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	list, err := ParsePortRanges([]any{int64(25), "80, 1000-2000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0] != (PortRange{25, 25}) || list[2] != (PortRange{1000, 2000}) {
+		t.Fatal("parse wrong", list)
+	}
+
+	for _, bad := range []any{"2000-1000", "70000", "a", 1.5} {
+		if _, err = ParsePortRanges(bad); err == nil {
+			t.Fatal("should fail", bad)
+		}
+	}
+}
+
+func TestRouteSetPortSourceProtocol(t *testing.T) {
+	rp := NewRoutePolicy()
+	rp.LoadRulesForRoutePolicy([]*RuleConf{
+		{DialTag: "block", Port: "8o"}, //端口 写错 的 规则 应被 丢弃, 而 不是 匹配 任意端口
+		{DialTag: "direct", Protocols: []string{"BitTorrent"}},
+		{DialTag: "block", Port: int64(25)},
+		{DialTag: "office", Sources: []string{"192.168.10.0/24", "10.0.0.7"}, Domains: []string{"domain:example.com"}},
+	})
+
+	if len(rp.List) != 3 {
+		t.Fatal("rule with illegal port should be dropped", len(rp.List))
+	}
+
+	client := net.IPv4(192, 168, 10, 5)
+
+	for i, c := range []struct {
+		td   TargetDescription
+		want string
+	}{
+		{TargetDescription{Addr: Addr{Name: "a.com", Port: 6881}, Protocol: ProtocolBitTorrent}, "direct"},
+		{TargetDescription{Addr: Addr{Name: "a.com", Port: 6881}, Protocol: ProtocolTLS}, "proxy"},
+		{TargetDescription{Addr: Addr{IP: net.IPv4(1, 2, 3, 4), Port: 25}}, "block"},
+		{TargetDescription{Addr: Addr{IP: net.IPv4(1, 2, 3, 4), Port: 26}}, "proxy"},
+		{TargetDescription{Addr: Addr{Name: "www.example.com", Port: 443}, SourceIP: client}, "office"},
+		{TargetDescription{Addr: Addr{Name: "www.example.com", Port: 443}, SourceIP: net.IPv4(10, 0, 0, 7)}, "office"},
+		{TargetDescription{Addr: Addr{Name: "www.example.com", Port: 443}, SourceIP: net.IPv4(192, 168, 11, 5)}, "proxy"},
+		{TargetDescription{Addr: Addr{Name: "www.example.com", Port: 443}}, "proxy"},
+	} {
+		if got := rp.CalcuOutTag(&c.td); got != c.want {
+			t.Fatal(i, "should route to", c.want, "but got", got)
+		}
+	}
+
+	cloned := rp.Clone()
+	if got := cloned.CalcuOutTag(&TargetDescription{Addr: Addr{Name: "www.example.com"}, SourceIP: client}); got != "office" {
+		t.Fatal("clone should keep source ranges", got)
+	}
+}
+
+func TestSniffProtocol(t *testing.T) {
+	quicInitial := []byte{0xc3, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	quicShort := []byte{0x43, 0, 0, 0, 1, 8, 1, 2}
+
+	for i, c := range []struct {
+		p     []byte
+		isudp bool
+		want  string
+	}{
+		{[]byte{22, 3, 1, 0, 100, 1, 0, 0, 96}, false, ProtocolTLS},
+		{[]byte("GET / HTTP/1.1\r\n"), false, ProtocolHTTP},
+		{append([]byte("\x13BitTorrent protocol"), make([]byte, 8)...), false, ProtocolBitTorrent},
+		{[]byte("SSH-2.0-OpenSSH"), false, ""},
+		{quicInitial, true, ProtocolQUIC},
+		{quicShort, true, ""},
+		{[]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), true, ProtocolBitTorrent},
+		{append([]byte{0x41, 0}, make([]byte, 18)...), true, ProtocolBitTorrent},
+		{[]byte{0, 1, 0, 0, 0, 1}, true, ""},
+	} {
+		if got := SniffProtocol(c.p, c.isudp); got != c.want {
+			t.Fatal(i, "want", c.want, "got", got)
+		}
+	}
+}
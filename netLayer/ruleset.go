@@ -0,0 +1,496 @@
+package netLayer
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+/*
+sing-box 的 二进制 rule-set (.srs) 文件, 见 sing-box 的 common/srs/binary.go.
+
+文件 以 "SRS" 和 一字节 版本号 开头, 之后 是 zlib 压缩 的 内容: uvarint 的 规则数, 之后 为 各规则.
+
+每条规则 以 一字节 类型 开头, 0 为 普通规则, 1 为 逻辑规则. 普通规则 由 若干 项 组成, 每项 以 一字节 项类型 开头, 0xFF 表示 结束, 之后 是 一字节 的 invert.
+
+我们 只 使用 其中 的 目标地址 项, 即 domain, domain_suffix, domain_keyword, domain_regex 与 ip_cidr; 在 sing-box 中 它们 是 "或" 的关系, 正好 对应 一个 RouteSet.
+含有 其它项 (端口, 进程 等) 的 规则, 以及 逻辑规则 与 invert 的 规则, 会被 跳过.
+
+一个 rule-set 中 所有 可用的 规则 合并 为 一个 RouteSet, 路由规则 中 用 rule_set = ["tag"] 引用.
+没有 任何 可用规则 的 rule-set 会 加载失败, 引用它 的 路由规则 不会 因此 匹配 任何 地址.
+*/
+
+// rule-set 的 tag -> 文件路径, 由 AppConf 通过 SetRuleSetFiles 设置
+var RuleSetFiles map[string]string
+
+var (
+	ruleSetMap   = make(map[string]*RouteSet) //文件路径 -> 已加载的 rule-set
+	ruleSetMutex sync.Mutex                   //读写 RuleSetFiles 与 ruleSetMap 时 所用
+)
+
+const (
+	srsMaxVersion = 3
+	srsMaxLength  = 1 << 26 //单项 长度 的 上限, 防止 错误文件 导致 分配 过多 内存
+
+	srsItemQueryType            = 0
+	srsItemNetwork              = 1
+	srsItemDomain               = 2
+	srsItemDomainKeyword        = 3
+	srsItemDomainRegex          = 4
+	srsItemSourceIPCIDR         = 5
+	srsItemIPCIDR               = 6
+	srsItemSourcePort           = 7
+	srsItemSourcePortRange      = 8
+	srsItemPort                 = 9
+	srsItemPortRange            = 10
+	srsItemProcessName          = 11
+	srsItemProcessPath          = 12
+	srsItemPackageName          = 13
+	srsItemWIFISSID             = 14
+	srsItemWIFIBSSID            = 15
+	srsItemAdGuardDomain        = 16
+	srsItemProcessPathRegex     = 17
+	srsItemNetworkType          = 18
+	srsItemNetworkIsExpensive   = 19
+	srsItemNetworkIsConstrained = 20
+	srsItemFinal                = 0xFF
+
+	//succinct set 中 的 特殊标签, 见 sing 的 common/domain/matcher.go
+	srsPrefixLabel = '\r' //domain_suffix 以 . 开头 时, 后面 接 任意 内容 都 匹配
+	srsRootLabel   = '\n' //domain_suffix 不以 . 开头 时, 匹配 该域名 及其 子域名
+)
+
+// 设置 RuleSetFiles, 并 清空 已加载的 rule-set, 使 重新加载 配置 时 文件 的 改动 生效.
+func SetRuleSetFiles(files map[string]string) {
+	ruleSetMutex.Lock()
+	defer ruleSetMutex.Unlock()
+
+	RuleSetFiles = files
+	ruleSetMap = make(map[string]*RouteSet)
+}
+
+// 返回 tag 对应的 rule-set, 第一次 使用时 从 RuleSetFiles 中 给出的 文件 加载.
+func GetRuleSet(tag string) (*RouteSet, error) {
+	ruleSetMutex.Lock()
+	defer ruleSetMutex.Unlock()
+
+	fn, ok := RuleSetFiles[tag]
+	if !ok {
+		return nil, utils.ErrInErr{ErrDesc: "rule-set not configured", ErrDetail: os.ErrNotExist, Data: tag}
+	}
+
+	if rs := ruleSetMap[fn]; rs != nil {
+		return rs, nil
+	}
+	rs, err := LoadRuleSetFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	ruleSetMap[fn] = rs
+	return rs, nil
+}
+
+// 读取 sing-box 的 二进制 rule-set 文件
+func LoadRuleSetFile(fn string) (*RouteSet, error) {
+	f, err := os.Open(utils.GetFilePath(fn))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs, err := ReadRuleSet(f)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "read rule-set failed", ErrDetail: err, Data: fn}
+	}
+	return rs, nil
+}
+
+func ReadRuleSet(r io.Reader) (*RouteSet, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if string(head[:3]) != "SRS" {
+		return nil, utils.ErrInErr{ErrDesc: "not a rule-set file", ErrDetail: utils.ErrInvalidData}
+	}
+	if head[3] > srsMaxVersion {
+		return nil, utils.ErrInErr{ErrDesc: "rule-set version not supported", ErrDetail: utils.ErrInvalidData, Data: head[3]}
+	}
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	sr := srsReader{bufio.NewReader(zr)}
+	count, err := sr.uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	rs := NewFullRouteSet()
+	for i := uint64(0); i < count; i++ {
+		if err = sr.readRule(rs, i); err != nil {
+			return nil, err
+		}
+	}
+
+	//空的 RouteSet 会 匹配 任何 地址, 而 空的 rule-set 应该 什么 都 不匹配, 所以 不能 使用
+	if rs.IsNoLimitForNetworkLayer() {
+		return nil, utils.ErrInErr{ErrDesc: "rule-set has no usable rule", ErrDetail: utils.ErrInvalidData, Data: count}
+	}
+	rs.Compile()
+	return rs, nil
+}
+
+type srsReader struct {
+	*bufio.Reader
+}
+
+func (sr srsReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(sr)
+}
+
+func (sr srsReader) length() (int, error) {
+	l, err := sr.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if l > srsMaxLength {
+		return 0, utils.ErrInErr{ErrDesc: "rule-set item too long", ErrDetail: utils.ErrInvalidData, Data: l}
+	}
+	return int(l), nil
+}
+
+func (sr srsReader) bytes() ([]byte, error) {
+	l, err := sr.length()
+	if err != nil {
+		return nil, err
+	}
+	bs := make([]byte, l)
+	_, err = io.ReadFull(sr, bs)
+	return bs, err
+}
+
+func (sr srsReader) strings() ([]string, error) {
+	l, err := sr.length()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, l)
+	for i := range list {
+		bs, err := sr.bytes()
+		if err != nil {
+			return nil, err
+		}
+		list[i] = string(bs)
+	}
+	return list, nil
+}
+
+func (sr srsReader) uint16s() ([]uint16, error) {
+	l, err := sr.length()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]uint16, l)
+	return list, binary.Read(sr, binary.BigEndian, list)
+}
+
+func (sr srsReader) uint64s() ([]uint64, error) {
+	l, err := sr.length()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]uint64, l)
+	return list, binary.Read(sr, binary.BigEndian, list)
+}
+
+// 读取 一条规则, 若 可以使用, 则 合并到 rs 中
+func (sr srsReader) readRule(rs *RouteSet, index uint64) error {
+	ruleType, err := sr.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch ruleType {
+	case 0:
+		return sr.readDefaultRule(rs, index)
+	case 1:
+		if _, err = sr.ReadByte(); err != nil { //mode
+			return err
+		}
+		count, err := sr.uvarint()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			if err = sr.readRule(nil, index); err != nil {
+				return err
+			}
+		}
+		if _, err = sr.ReadByte(); err != nil { //invert
+			return err
+		}
+		if rs != nil {
+			if ce := utils.CanLogWarn("rule-set logical rule not supported, skipped"); ce != nil {
+				ce.Write(zap.Uint64("index", index))
+			}
+		}
+		return nil
+	default:
+		return utils.ErrInErr{ErrDesc: "rule-set unknown rule type", ErrDetail: utils.ErrInvalidData, Data: ruleType}
+	}
+}
+
+// rs 为 nil 时 只 读取 不 使用
+func (sr srsReader) readDefaultRule(rs *RouteSet, index uint64) error {
+	var (
+		full, domains, keywords, regs []string
+		suffixes                      []string
+		prefixes                      []netip.Prefix
+
+		unsupported []byte
+	)
+	for {
+		itemType, err := sr.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch itemType {
+		case srsItemDomain:
+			var keys []string
+			if keys, err = sr.succinctSet(); err != nil {
+				return err
+			}
+			for _, k := range keys {
+				switch {
+				case k != "" && k[0] == srsPrefixLabel:
+					suffixes = append(suffixes, k[1:])
+				case k != "" && k[0] == srsRootLabel:
+					k = k[1:]
+					if k != "" && k[0] == '.' {
+						k = k[1:]
+					}
+					domains = append(domains, k)
+				default:
+					full = append(full, k)
+				}
+			}
+		case srsItemDomainKeyword:
+			keywords, err = sr.strings()
+		case srsItemDomainRegex:
+			regs, err = sr.strings()
+		case srsItemIPCIDR:
+			prefixes, err = sr.ipSet()
+		case srsItemSourceIPCIDR:
+			_, err = sr.ipSet()
+		case srsItemAdGuardDomain:
+			_, err = sr.succinctSet()
+		case srsItemQueryType, srsItemSourcePort, srsItemPort:
+			_, err = sr.uint16s()
+		case srsItemNetworkType:
+			_, err = sr.bytes()
+		case srsItemNetwork, srsItemSourcePortRange, srsItemPortRange, srsItemProcessName, srsItemProcessPath,
+			srsItemPackageName, srsItemWIFISSID, srsItemWIFIBSSID, srsItemProcessPathRegex:
+			_, err = sr.strings()
+		case srsItemNetworkIsExpensive, srsItemNetworkIsConstrained:
+		case srsItemFinal:
+			invert, err := sr.ReadByte()
+			if err != nil {
+				return err
+			}
+			if rs == nil {
+				return nil
+			}
+			if invert != 0 || len(unsupported) > 0 {
+				if ce := utils.CanLogWarn("rule-set rule has items not supported, skipped"); ce != nil {
+					ce.Write(zap.Uint64("index", index), zap.Binary("items", unsupported), zap.Bool("invert", invert != 0))
+				}
+				return nil
+			}
+			for _, d := range full {
+				rs.Full[d] = true
+			}
+			for _, d := range domains {
+				rs.Domains[d] = true
+			}
+			rs.Match = append(rs.Match, keywords...)
+			for _, s := range suffixes {
+				regs = append(regs, regexp.QuoteMeta(s)+"$")
+			}
+			for _, s := range regs {
+				reg, err := regexp.Compile(s)
+				if err != nil {
+					if ce := utils.CanLogErr("rule-set regex illegal"); ce != nil {
+						ce.Write(zap.String("regex", s), zap.Error(err))
+					}
+					continue
+				}
+				rs.Regex = append(rs.Regex, reg)
+			}
+			insertPrefixes(rs.NetRanger, prefixes)
+			return nil
+		default:
+			return utils.ErrInErr{ErrDesc: "rule-set unknown item type", ErrDetail: utils.ErrInvalidData, Data: itemType}
+		}
+		if err != nil {
+			return err
+		}
+		switch itemType {
+		case srsItemDomain, srsItemDomainKeyword, srsItemDomainRegex, srsItemIPCIDR:
+		default:
+			unsupported = append(unsupported, itemType)
+		}
+	}
+}
+
+// 读取 sing 的 succinctSet, 返回 其中 所有的 key. key 是 倒序 存储 的 域名, 返回前 会 再 倒过来.
+//
+// succinctSet 是 按 广度优先 存储 的 字典树: 第i个节点 若 是 某个key 的 结尾, 则 leaves 的 第i位 为1;
+// 各节点 依次 在 labelBitmap 中 占 若干个0 与 一个1, 每个0 对应 labels 中 的 一个 子节点 标签.
+func (sr srsReader) succinctSet() ([]string, error) {
+	version, err := sr.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		return nil, utils.ErrInErr{ErrDesc: "rule-set succinct set version not supported", ErrDetail: utils.ErrInvalidData, Data: version}
+	}
+	leaves, err := sr.uint64s()
+	if err != nil {
+		return nil, err
+	}
+	bitmap, err := sr.uint64s()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := sr.bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	getBit := func(bm []uint64, i int) bool {
+		return i>>6 < len(bm) && bm[i>>6]&(1<<uint(i&63)) != 0
+	}
+
+	var keys []string
+	nodes := [][]byte{nil}
+	labelIdx := 0
+	bmIdx := 0
+	for i := 0; i < len(nodes); i++ {
+		if getBit(leaves, i) {
+			keys = append(keys, reverseDomainRunes(nodes[i]))
+		}
+		for ; !getBit(bitmap, bmIdx); bmIdx++ {
+			if labelIdx >= len(labels) {
+				return nil, utils.ErrInErr{ErrDesc: "rule-set succinct set corrupted", ErrDetail: utils.ErrInvalidData}
+			}
+			child := make([]byte, len(nodes[i])+1)
+			copy(child, nodes[i])
+			child[len(nodes[i])] = labels[labelIdx]
+			nodes = append(nodes, child)
+			labelIdx++
+		}
+		bmIdx++
+	}
+	return keys, nil
+}
+
+func reverseDomainRunes(bs []byte) string {
+	result := make([]byte, len(bs))
+	for i := 0; i < len(bs); {
+		r, n := utf8.DecodeRune(bs[i:])
+		i += n
+		utf8.EncodeRune(result[len(bs)-i:], r)
+	}
+	return string(result)
+}
+
+// 读取 sing-box 的 ip集合, 由 若干 [from, to] 范围 组成, 转换为 cidr 列表
+func (sr srsReader) ipSet() (list []netip.Prefix, err error) {
+	version, err := sr.ReadByte()
+	if err != nil {
+		return
+	}
+	if version != 1 {
+		err = utils.ErrInErr{ErrDesc: "rule-set ip set version not supported", ErrDetail: utils.ErrInvalidData, Data: version}
+		return
+	}
+	var count uint64
+	if err = binary.Read(sr, binary.BigEndian, &count); err != nil {
+		return
+	}
+	for i := uint64(0); i < count; i++ {
+		var fromBs, toBs []byte
+		if fromBs, err = sr.bytes(); err != nil {
+			return
+		}
+		if toBs, err = sr.bytes(); err != nil {
+			return
+		}
+		from, ok1 := netip.AddrFromSlice(fromBs)
+		to, ok2 := netip.AddrFromSlice(toBs)
+		if !ok1 || !ok2 || from.BitLen() != to.BitLen() || to.Less(from) {
+			err = utils.ErrInErr{ErrDesc: "rule-set ip range illegal", ErrDetail: utils.ErrInvalidData}
+			return
+		}
+		list = appendRangePrefixes(list, from, to)
+	}
+	return
+}
+
+// 将 [from, to] 拆分为 最少的 cidr
+func appendRangePrefixes(list []netip.Prefix, from, to netip.Addr) []netip.Prefix {
+	for {
+		bits := from.BitLen()
+		//找到 以 from 开头, 且 不超过 to 的 最大的 前缀
+		for bits > 0 {
+			p := netip.PrefixFrom(from, bits-1)
+			if p.Masked().Addr() != from || lastAddr(p).Compare(to) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		list = append(list, p)
+
+		last := lastAddr(p)
+		if last.Compare(to) >= 0 {
+			return list
+		}
+		from = last.Next()
+	}
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	bs := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(bs)*8; i++ {
+		bs[i/8] |= 1 << uint(7-i%8)
+	}
+	a, _ := netip.AddrFromSlice(bs)
+	return a
+}
+
+// 解析 rs.RuleSets 中 各 rule-set
+func (rs *RouteSet) loadRuleSets() {
+	rs.ruleSets = rs.ruleSets[:0]
+	for _, tag := range rs.RuleSets {
+		set, err := GetRuleSet(tag)
+		if err != nil {
+			if ce := utils.CanLogErr("load rule-set failed"); ce != nil {
+				ce.Write(zap.String("tag", tag), zap.Error(err))
+			}
+			continue
+		}
+		rs.ruleSets = append(rs.ruleSets, set)
+	}
+}
@@ -0,0 +1,249 @@
+package netLayer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// 与 sing 的 newSuccinctSet 相同 的 编码
+func encodeSuccinctSet(keys []string) []byte {
+	sort.Strings(keys)
+
+	var leaves, bitmap []uint64
+	var labels []byte
+	setBit := func(bm *[]uint64, i int) {
+		for i>>6 >= len(*bm) {
+			*bm = append(*bm, 0)
+		}
+		(*bm)[i>>6] |= 1 << uint(i&63)
+	}
+
+	type elt struct{ s, e, col int }
+	queue := []elt{{0, len(keys), 0}}
+	lIdx := 0
+	for i := 0; i < len(queue); i++ {
+		q := queue[i]
+		if q.col == len(keys[q.s]) {
+			q.s++
+			setBit(&leaves, i)
+		}
+		for j := q.s; j < q.e; {
+			frm := j
+			for ; j < q.e && keys[j][q.col] == keys[frm][q.col]; j++ {
+			}
+			queue = append(queue, elt{frm, j, q.col + 1})
+			labels = append(labels, keys[frm][q.col])
+			lIdx++
+		}
+		setBit(&bitmap, lIdx)
+		lIdx++
+	}
+
+	bs := []byte{1}
+	for _, bm := range [][]uint64{leaves, bitmap} {
+		bs = binary.AppendUvarint(bs, uint64(len(bm)))
+		for _, v := range bm {
+			bs = binary.BigEndian.AppendUint64(bs, v)
+		}
+	}
+	bs = binary.AppendUvarint(bs, uint64(len(labels)))
+	return append(bs, labels...)
+}
+
+func srsStrings(list ...string) []byte {
+	bs := binary.AppendUvarint(nil, uint64(len(list)))
+	for _, s := range list {
+		bs = binary.AppendUvarint(bs, uint64(len(s)))
+		bs = append(bs, s...)
+	}
+	return bs
+}
+
+func srsIPSet(ranges ...[2]string) []byte {
+	bs := binary.BigEndian.AppendUint64([]byte{1}, uint64(len(ranges)))
+	for _, r := range ranges {
+		for _, s := range r {
+			ip := netip.MustParseAddr(s).AsSlice()
+			bs = binary.AppendUvarint(bs, uint64(len(ip)))
+			bs = append(bs, ip...)
+		}
+	}
+	return bs
+}
+
+func TestRuleSet(t *testing.T) {
+	//与 sing 的 domain.NewMatcher 相同, domain_suffix 加上 特殊标签 后 倒序 存储
+	var domainKeys []string
+	for _, d := range []string{"www.full.org", "中文.com", "\nexample.com", "\nexample.cn", "\r.suffix.net"} {
+		domainKeys = append(domainKeys, reverseDomainRunes([]byte(d)))
+	}
+
+	var body []byte
+	body = binary.AppendUvarint(body, 4)
+
+	//可用的 规则
+	body = append(body, 0, srsItemDomain)
+	body = append(body, encodeSuccinctSet(domainKeys)...)
+	body = append(body, srsItemDomainKeyword)
+	body = append(body, srsStrings("tracker")...)
+	body = append(body, srsItemDomainRegex)
+	body = append(body, srsStrings(`^ads\d+\.`)...)
+	body = append(body, srsItemIPCIDR)
+	body = append(body, srsIPSet([2]string{"1.2.3.0", "1.2.3.255"}, [2]string{"10.0.0.1", "10.0.0.6"})...)
+	body = append(body, srsItemFinal, 0)
+
+	//含有 端口 的 规则 会被 跳过
+	body = append(body, 0, srsItemPort)
+	body = binary.AppendUvarint(body, 1)
+	body = binary.BigEndian.AppendUint16(body, 443)
+	body = append(body, srsItemDomainKeyword)
+	body = append(body, srsStrings("skipped")...)
+	body = append(body, srsItemFinal, 0)
+
+	//invert 的 规则 会被 跳过
+	body = append(body, 0, srsItemDomainKeyword)
+	body = append(body, srsStrings("inverted")...)
+	body = append(body, srsItemFinal, 1)
+
+	//逻辑规则 会被 跳过
+	body = append(body, 1, 0)
+	body = binary.AppendUvarint(body, 1)
+	body = append(body, 0, srsItemDomainKeyword)
+	body = append(body, srsStrings("logical")...)
+	body = append(body, srsItemFinal, 0, 0)
+
+	fn := writeTestRuleSet(t, body)
+
+	oldFiles := RuleSetFiles
+	defer func() { RuleSetFiles = oldFiles }()
+	RuleSetFiles = map[string]string{"test": fn}
+
+	rs := LoadRuleForRouteSet(&RuleConf{DialTag: "direct", RuleSets: []string{"test", "notexist"}})
+	if len(rs.ruleSets) != 1 {
+		t.Fatal("rule-set not loaded")
+	}
+
+	for name, want := range map[string]bool{
+		"www.full.org": true, "full.org": false, "a.www.full.org": false,
+		"example.com": true, "a.example.com": true, "aexample.com": false, "example.cn": true,
+		"a.suffix.net": true, "suffix.net": false, "中文.com": true,
+		"mytracker.io": true, "ads1.foo.com": true,
+		"skipped.com": false, "inverted.com": false, "logical.com": false,
+	} {
+		if got := rs.IsAddrIn(Addr{Name: name}); got != want {
+			t.Fatal(name, "got", got, "want", want)
+		}
+	}
+	for ip, want := range map[string]bool{
+		"1.2.3.4": true, "1.2.4.1": false, "10.0.0.1": true, "10.0.0.6": true, "10.0.0.7": false, "10.0.0.0": false,
+	} {
+		if got := rs.IsAddrIn(Addr{IP: net.ParseIP(ip)}); got != want {
+			t.Fatal(ip, "got", got, "want", want)
+		}
+	}
+
+	if clone := rs.Clone(); len(clone.ruleSets) != 1 || !clone.IsAddrIn(Addr{Name: "example.com"}) {
+		t.Fatal("clone lost rule-set")
+	}
+}
+
+func writeTestRuleSet(t *testing.T, body []byte) string {
+	var buf bytes.Buffer
+	buf.WriteString("SRS")
+	buf.WriteByte(1)
+	zw := zlib.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+
+	fn := filepath.Join(t.TempDir(), "test.srs")
+	if err := os.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// 重新 设置 RuleSetFiles 后, 同一路径 的 文件 应 重新加载
+func TestSetRuleSetFiles(t *testing.T) {
+	ruleSetBody := func(keyword string) []byte {
+		body := binary.AppendUvarint(nil, 1)
+		body = append(body, 0, srsItemDomainKeyword)
+		body = append(body, srsStrings(keyword)...)
+		return append(body, srsItemFinal, 0)
+	}
+	fn := writeTestRuleSet(t, ruleSetBody("old"))
+
+	oldFiles := RuleSetFiles
+	defer SetRuleSetFiles(oldFiles)
+	SetRuleSetFiles(map[string]string{"test": fn})
+
+	rs, err := GetRuleSet("test")
+	if err != nil || !rs.IsAddrIn(Addr{Name: "old.com"}) {
+		t.Fatal("rule-set not loaded", err)
+	}
+
+	newFn := writeTestRuleSet(t, ruleSetBody("new"))
+	bs, err := os.ReadFile(newFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(fn, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	SetRuleSetFiles(map[string]string{"test": fn})
+	rs, err = GetRuleSet("test")
+	if err != nil || !rs.IsAddrIn(Addr{Name: "new.com"}) || rs.IsAddrIn(Addr{Name: "old.com"}) {
+		t.Fatal("rule-set should be reloaded", err)
+	}
+}
+
+// 没有 可用规则 的 rule-set 不能 匹配 任何 地址
+func TestRuleSet_empty(t *testing.T) {
+	onlyPort := binary.AppendUvarint(nil, 1)
+	onlyPort = append(onlyPort, 0, srsItemPort)
+	onlyPort = binary.AppendUvarint(onlyPort, 1)
+	onlyPort = binary.BigEndian.AppendUint16(onlyPort, 443)
+	onlyPort = append(onlyPort, srsItemFinal, 0)
+
+	oldFiles := RuleSetFiles
+	defer func() { RuleSetFiles = oldFiles }()
+	RuleSetFiles = map[string]string{
+		"zero":     writeTestRuleSet(t, binary.AppendUvarint(nil, 0)),
+		"onlyport": writeTestRuleSet(t, onlyPort),
+	}
+
+	for tag := range RuleSetFiles {
+		if _, err := GetRuleSet(tag); err == nil {
+			t.Fatal(tag, "should fail to load")
+		}
+		rs := LoadRuleForRouteSet(&RuleConf{DialTag: "direct", RuleSets: []string{tag}})
+		if rs.IsAddrIn(Addr{Name: "anything.example"}) || rs.IsAddrIn(Addr{IP: net.IPv4(1, 2, 3, 4)}) {
+			t.Fatal(tag, "empty rule-set should match nothing")
+		}
+	}
+}
+
+func TestAppendRangePrefixes(t *testing.T) {
+	list := appendRangePrefixes(nil, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.6"))
+	want := []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}
+	if len(list) != len(want) {
+		t.Fatal(list)
+	}
+	for i, p := range list {
+		if p.String() != want[i] {
+			t.Fatal(list)
+		}
+	}
+
+	list = appendRangePrefixes(nil, netip.MustParseAddr("::"), netip.MustParseAddr("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+	if len(list) != 1 || list[0].String() != "::/0" {
+		t.Fatal(list)
+	}
+}
@@ -96,6 +96,11 @@ func (mc *MsgConn) SetFullcone(f bool) {
 	mc.fullcone = f
 }
 
+// 返回 客户端的地址
+func (mc *MsgConn) RemoteAddr() net.Addr {
+	return mc.ourSrcAddr
+}
+
 func (mc *MsgConn) ReadMsg() ([]byte, netLayer.Addr, error) {
 
 	must_timeoutChan := time.After(netLayer.UDP_timeout)
@@ -173,6 +173,7 @@ func Listen(dev device.Device, tcpFunc func(netLayer.TCPRequestInfo), udpFunc fu
 				RealTarget: ad,
 			},
 			Target: ad,
+			Source: &net.UDPAddr{IP: net.IP(id.RemoteAddress), Port: int(id.RemotePort)},
 		}
 
 		go udpFunc(info)
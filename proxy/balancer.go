@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+// 负载均衡策略
+const (
+	BalanceRoundRobin    = "round_robin"    //在存活的成员间 轮流选择
+	BalanceLeastConn     = "least_conn"     //选择 当前转发中连接数 最少的存活成员
+	BalanceLowestLatency = "lowest_latency" //选择 健康检查延迟 最低的存活成员
+	BalanceFailover      = "failover"       //按配置顺序, 选择 第一个存活的成员
+)
+
+const (
+	DefaultBalancerProbeURL      = "http://www.gstatic.com/generate_204"
+	DefaultBalancerProbeInterval = 60 //秒
+	DefaultBalancerProbeTimeout  = 5  //秒
+)
+
+// 通过 某个 Client 拨号到 target, 返回 完成握手的连接. 由 v2ray_simple.DialThroughClient 实现.
+type ClientDialFunc func(c Client, target netLayer.Addr) (io.ReadWriteCloser, error)
+
+// 负载均衡组 的配置, 在 标准配置的 [[balancer]] 中给出.
+//
+// Tag 可以作为 [[route]] 的 toTag 使用, 分流到该组时, 会按 Strategy 从 Members 中选出一个 dial.
+type BalancerConf struct {
+	Tag      string   `toml:"tag"`
+	Members  []string `toml:"members"`  //成员 dial 的 tag
+	Strategy string   `toml:"strategy"` //round_robin, least_conn, lowest_latency, failover; 默认为 round_robin
+
+	ProbeURL      string `toml:"probe_url"`      //健康检查所请求的 http/https url, 默认为 DefaultBalancerProbeURL
+	ProbeInterval int    `toml:"probe_interval"` //健康检查的间隔, 单位秒; 默认为60; 负数表示 不进行健康检查
+	ProbeTimeout  int    `toml:"probe_timeout"`  //单次检查的超时, 单位秒; 默认为5
+}
+
+type balancerMember struct {
+	tag string
+
+	activeConns int32 //原子更新
+
+	mutex    sync.RWMutex
+	alive    bool
+	latency  time.Duration
+	lastErr  error
+	lastTime time.Time
+}
+
+// 负载均衡组 中 一个成员的状态快照
+type BalancerMemberState struct {
+	Tag         string        `json:"tag"`
+	Alive       bool          `json:"alive"`
+	Latency     time.Duration `json:"latency"`
+	ActiveConns int32         `json:"active_connections"`
+	LastError   string        `json:"last_error,omitempty"`
+	LastProbe   time.Time     `json:"last_probe"`
+}
+
+// 负载均衡组. 在第一次健康检查之前, 所有成员都被视为存活.
+// 若所有成员都被检查为不可用, 则 在所有成员中 按策略选择, 以免完全断网.
+type Balancer struct {
+	BalancerConf
+
+	members []*balancerMember
+	rrIndex uint32
+
+	probeURL *url.URL
+
+	stopMutex sync.Mutex
+	stopChan  chan struct{}
+}
+
+func NewBalancer(bc *BalancerConf) (*Balancer, error) {
+	if bc.Tag == "" {
+		return nil, utils.ErrInErr{ErrDesc: "balancer tag empty", ErrDetail: utils.ErrInvalidData}
+	}
+	if len(bc.Members) == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "balancer has no members", ErrDetail: utils.ErrInvalidData, Data: bc.Tag}
+	}
+
+	b := &Balancer{BalancerConf: *bc}
+
+	switch b.Strategy {
+	case "":
+		b.Strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceLowestLatency, BalanceFailover:
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "unknown balancer strategy", ErrDetail: utils.ErrInvalidData, Data: b.Strategy}
+	}
+
+	if b.ProbeURL == "" {
+		b.ProbeURL = DefaultBalancerProbeURL
+	}
+	u, err := url.Parse(b.ProbeURL)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "balancer probe_url invalid", ErrDetail: err, Data: b.ProbeURL}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, utils.ErrInErr{ErrDesc: "balancer probe_url must be http or https", ErrDetail: utils.ErrInvalidData, Data: b.ProbeURL}
+	}
+	b.probeURL = u
+
+	if b.ProbeInterval == 0 {
+		b.ProbeInterval = DefaultBalancerProbeInterval
+	}
+	if b.ProbeTimeout <= 0 {
+		b.ProbeTimeout = DefaultBalancerProbeTimeout
+	}
+
+	for _, tag := range b.Members {
+		b.members = append(b.members, &balancerMember{tag: tag, alive: true})
+	}
+	return b, nil
+}
+
+// 按策略 选出一个 Client. 若选出, 返回的 done 必须在 该连接转发结束后 调用.
+// 若没有任何成员 对应到 re 中的 Client, 返回 nil, nil
+func (b *Balancer) Pick(re *RoutingEnv) (c Client, done func()) {
+	type candidate struct {
+		m *balancerMember
+		c Client
+	}
+	var alive, all []candidate
+
+	for _, m := range b.members {
+		mc := re.GetClient(m.tag)
+		if mc == nil {
+			continue
+		}
+		cd := candidate{m, mc}
+		all = append(all, cd)
+
+		m.mutex.RLock()
+		if m.alive {
+			alive = append(alive, cd)
+		}
+		m.mutex.RUnlock()
+	}
+	cands := alive
+	if len(cands) == 0 {
+		cands = all
+	}
+	if len(cands) == 0 {
+		return
+	}
+
+	chosen := cands[0]
+
+	switch b.Strategy {
+	case BalanceRoundRobin:
+		i := atomic.AddUint32(&b.rrIndex, 1)
+		chosen = cands[int(i)%len(cands)]
+
+	case BalanceLeastConn:
+		least := atomic.LoadInt32(&chosen.m.activeConns)
+		for _, cd := range cands[1:] {
+			if n := atomic.LoadInt32(&cd.m.activeConns); n < least {
+				least = n
+				chosen = cd
+			}
+		}
+
+	case BalanceLowestLatency:
+		var lowest time.Duration = -1
+		for _, cd := range cands {
+			cd.m.mutex.RLock()
+			l := cd.m.latency
+			cd.m.mutex.RUnlock()
+			if l > 0 && (lowest < 0 || l < lowest) {
+				lowest = l
+				chosen = cd
+			}
+		}
+
+	case BalanceFailover:
+		//cands 已经是按配置顺序排列的
+	}
+
+	m := chosen.m
+	atomic.AddInt32(&m.activeConns, 1)
+	return chosen.c, func() {
+		atomic.AddInt32(&m.activeConns, -1)
+	}
+}
+
+func (b *Balancer) State() (ss []BalancerMemberState) {
+	for _, m := range b.members {
+		m.mutex.RLock()
+		s := BalancerMemberState{
+			Tag:         m.tag,
+			Alive:       m.alive,
+			Latency:     m.latency,
+			ActiveConns: atomic.LoadInt32(&m.activeConns),
+			LastProbe:   m.lastTime,
+		}
+		if m.lastErr != nil {
+			s.LastError = m.lastErr.Error()
+		}
+		m.mutex.RUnlock()
+		ss = append(ss, s)
+	}
+	return
+}
+
+// 通过 c 请求 b.probeURL, 返回 从拨号开始 到 读到响应头 所用的时间
+func (b *Balancer) probe(c Client, dial ClientDialFunc) (latency time.Duration, err error) {
+	u := b.probeURL
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	target, err := netLayer.NewAddrByHostPort(net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	timeout := time.Duration(b.ProbeTimeout) * time.Second
+
+	//超时 也要 包含 拨号与握手 的时间, 否则 某个成员 卡住 时 整个组 的 健康检查 都会 停止.
+	// ClientDialFunc 不能 取消, 所以 在 另一个 goroutine 中 拨号, 超时后 迟到的 连接 会被 直接关闭
+	type dialResult struct {
+		rwc io.ReadWriteCloser
+		err error
+	}
+	resultChan := make(chan dialResult, 1)
+	go func() {
+		rwc, err := dial(c, target)
+		resultChan <- dialResult{rwc, err}
+	}()
+
+	dialTimer := time.NewTimer(timeout)
+	var rwc io.ReadWriteCloser
+	select {
+	case r := <-resultChan:
+		dialTimer.Stop()
+		if r.err != nil {
+			err = r.err
+			return
+		}
+		rwc = r.rwc
+	case <-dialTimer.C:
+		go func() {
+			if r := <-resultChan; r.err == nil {
+				r.rwc.Close()
+			}
+		}()
+		err = utils.ErrInErr{ErrDesc: "balancer probe dial timeout", ErrDetail: os.ErrDeadlineExceeded, Data: timeout.String()}
+		return
+	}
+	defer rwc.Close()
+
+	timer := time.AfterFunc(timeout-time.Since(start), func() {
+		rwc.Close()
+	})
+	defer timer.Stop()
+
+	var conn io.ReadWriter = rwc
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(&netLayer.IOWrapper{Reader: rwc, Writer: rwc, Closer: rwc}, &tls.Config{ServerName: u.Hostname()})
+		defer tlsConn.Close()
+		conn = tlsConn
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+	if err = req.Write(conn); err != nil {
+		return
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	latency = time.Since(start)
+	return
+}
+
+// 对所有成员 进行一次健康检查
+func (b *Balancer) ProbeAll(re *RoutingEnv, dial ClientDialFunc) {
+	var wg sync.WaitGroup
+	for _, m := range b.members {
+		c := re.GetClient(m.tag)
+		if c == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(m *balancerMember, c Client) {
+			defer wg.Done()
+
+			latency, err := b.probe(c, dial)
+
+			m.mutex.Lock()
+			m.lastTime = time.Now()
+			m.lastErr = err
+			m.alive = err == nil
+			if err == nil {
+				m.latency = latency
+			}
+			m.mutex.Unlock()
+
+			if err != nil {
+				if ce := utils.CanLogWarn("balancer member probe failed"); ce != nil {
+					ce.Write(zap.String("balancer", b.Tag), zap.String("member", m.tag), zap.Error(err))
+				}
+			} else if ce := utils.CanLogDebug("balancer member probe ok"); ce != nil {
+				ce.Write(zap.String("balancer", b.Tag), zap.String("member", m.tag), zap.Duration("latency", latency))
+			}
+		}(m, c)
+	}
+	wg.Wait()
+}
+
+// 非阻塞. 立即进行一次健康检查, 之后每隔 ProbeInterval 秒检查一次. ProbeInterval 为负时 不进行检查.
+func (b *Balancer) StartProbing(re *RoutingEnv, dial ClientDialFunc) {
+	if b.ProbeInterval < 0 || dial == nil {
+		return
+	}
+	b.stopMutex.Lock()
+	defer b.stopMutex.Unlock()
+	if b.stopChan != nil {
+		return
+	}
+	stopChan := make(chan struct{})
+	b.stopChan = stopChan
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(b.ProbeInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			b.ProbeAll(re, dial)
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (b *Balancer) StopProbing() {
+	b.stopMutex.Lock()
+	if b.stopChan != nil {
+		close(b.stopChan)
+		b.stopChan = nil
+	}
+	b.stopMutex.Unlock()
+}
@@ -0,0 +1,156 @@
+package proxy_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+)
+
+func newTestBalancerEnv(t *testing.T, tags ...string) *proxy.RoutingEnv {
+	re := &proxy.RoutingEnv{ClientsTagMap: make(map[string]proxy.Client)}
+	for _, tag := range tags {
+		c, err := proxy.ClientFromURL(proxy.DirectURL + "#" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re.SetClient(tag, c)
+	}
+	return re
+}
+
+func TestBalancerPick(t *testing.T) {
+	re := newTestBalancerEnv(t, "a", "b")
+
+	b, err := proxy.NewBalancer(&proxy.BalancerConf{Tag: "g", Members: []string{"a", "b", "missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]int{}
+	for i := 0; i < 10; i++ {
+		c, done := b.Pick(re)
+		if c == nil {
+			t.Fatal("pick nil")
+		}
+		seen[c.GetTag()]++
+		done()
+	}
+	if seen["a"] != 5 || seen["b"] != 5 {
+		t.Fatal("round robin not even", seen)
+	}
+
+	b, _ = proxy.NewBalancer(&proxy.BalancerConf{Tag: "g", Members: []string{"a", "b"}, Strategy: proxy.BalanceLeastConn})
+	c1, done1 := b.Pick(re)
+	c2, done2 := b.Pick(re)
+	if c1.GetTag() == c2.GetTag() {
+		t.Fatal("least_conn should pick different members", c1.GetTag())
+	}
+	done1()
+	done2()
+
+	if _, err = proxy.NewBalancer(&proxy.BalancerConf{Tag: "g", Members: []string{"a"}, Strategy: "bad"}); err == nil {
+		t.Fatal("should reject unknown strategy")
+	}
+}
+
+func TestBalancerProbe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	re := newTestBalancerEnv(t, "good", "bad")
+
+	b, err := proxy.NewBalancer(&proxy.BalancerConf{
+		Tag:      "g",
+		Members:  []string{"bad", "good"},
+		Strategy: proxy.BalanceFailover,
+		ProbeURL: ts.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//测试中 不走真实的代理, 而是直接拨号; "bad" 成员总是失败
+	dial := func(c proxy.Client, target netLayer.Addr) (io.ReadWriteCloser, error) {
+		if c.GetTag() == "bad" {
+			return nil, net.ErrClosed
+		}
+		return net.Dial("tcp", target.String())
+	}
+
+	if c, done := b.Pick(re); c.GetTag() != "bad" {
+		t.Fatal("failover should pick first member before probing", c.GetTag())
+	} else {
+		done()
+	}
+
+	b.ProbeAll(re, dial)
+
+	c, done := b.Pick(re)
+	if c.GetTag() != "good" {
+		t.Fatal("failover should skip dead member", c.GetTag())
+	}
+	done()
+
+	for _, s := range b.State() {
+		if s.Tag == "good" && (!s.Alive || s.Latency <= 0) {
+			t.Fatal("good member state wrong", s)
+		}
+		if s.Tag == "bad" && (s.Alive || s.LastError == "") {
+			t.Fatal("bad member state wrong", s)
+		}
+	}
+}
+
+// 拨号 卡住 的 成员 也要 在 probe_timeout 后 被 标记为 不可用, 且 不能 阻塞 其它成员 的 检查
+func TestBalancerProbeDialTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	re := newTestBalancerEnv(t, "hang", "good")
+	b, err := proxy.NewBalancer(&proxy.BalancerConf{
+		Tag:          "g",
+		Members:      []string{"hang", "good"},
+		Strategy:     proxy.BalanceFailover,
+		ProbeURL:     ts.URL,
+		ProbeTimeout: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	dial := func(c proxy.Client, target netLayer.Addr) (io.ReadWriteCloser, error) {
+		if c.GetTag() == "hang" {
+			<-block
+			return nil, net.ErrClosed
+		}
+		return net.Dial("tcp", target.String())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.ProbeAll(re, dial)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ProbeAll blocked by hanging dial")
+	}
+
+	if c, pickDone := b.Pick(re); c.GetTag() != "good" {
+		t.Fatal("hanging member should be marked dead", c.GetTag())
+	} else {
+		pickDone()
+	}
+}
@@ -10,9 +10,9 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/advLayer"
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
 	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
-	"github.com/xtaci/smux"
 	"go.uber.org/zap"
 )
 
@@ -44,6 +44,8 @@ type BaseInterface interface {
 
 	Sniffing() bool //for inServer, 是否开启嗅探功能
 
+	GetSniffConf() *SniffConf //for inServer, 可为 nil
+
 	/////////////////// TLS层 ///////////////////
 
 	IsUseTLS() bool
@@ -97,6 +99,8 @@ type Base struct {
 
 	IsFullcone bool
 
+	RateLimit *utils.RateLimitPair //可为nil
+
 	Tls_s   *tlsLayer.Server
 	Tls_c   *tlsLayer.Client
 	TlsConf tlsLayer.Conf
@@ -112,7 +116,8 @@ type Base struct {
 
 	FallbackAddr *netLayer.Addr
 
-	Innermux *smux.Session //用于存储 client的已拨号的mux连接
+	Innermux      *innerMux.Pool //用于存储 client的已拨号的mux连接
+	innerMuxMutex sync.Mutex     //用于 Innermux 的 创建
 
 	sync.Mutex
 
@@ -170,7 +175,8 @@ func (b *Base) MiddleName() string {
 	}
 	advL := b.AdvancedL
 	if b.Header != nil {
-		if advL != "ws" && advL != "grpc" {
+		//能自行处理 header 的 高级层 不需要 额外的 http 层
+		if creator := advLayer.ProtocolsMap[advL]; creator == nil || !creator.CanHandleHeaders() {
 			sb.WriteString("+http")
 		}
 	}
@@ -197,54 +203,102 @@ func (b *Base) Sniffing() bool {
 	return b.ListenConf.SniffConf.Enable
 }
 
-func (b *Base) InnerMuxEstablished() bool {
+func (b *Base) GetSniffConf() *SniffConf {
+	if b.ListenConf == nil {
+		return nil
+	}
+	return b.ListenConf.SniffConf
+}
 
-	return b.Innermux != nil && !b.Innermux.IsClosed()
+// 是否有 可以直接 打开新流 的 mux连接; 为 false 时 需要 拨号 新的 mux连接.
+// 要 使用 该连接 时 应 直接 调用 GetClientInnerMuxSession(nil), 而不是 先 调用 本函数.
+func (b *Base) InnerMuxEstablished() bool {
+	p := b.innerMuxPool(false)
+	return p != nil && p.Get() != nil
 }
 
-// placeholder
+// 配置了 sing-mux 时 返回 (2, "singmux"), 配置了 Mux.Cool 时 返回 (2, "muxcool"), 否则 返回 (0, "")
 func (b *Base) HasInnerMux() (int, string) {
+	if b.UseSingMux() {
+		return 2, "singmux"
+	}
+	if b.UseMuxCool() {
+		return 2, "muxcool"
+	}
 	return 0, ""
 }
 
-func (*Base) GetServerInnerMuxSession(wlc io.ReadWriteCloser) *smux.Session {
-	smuxConfig := smux.DefaultConfig()
-	smuxSession, err := smux.Server(wlc, smuxConfig)
+// 客户端 是否 使用 sing-mux. 使用时 外层代理 握手的 目标 为 innerMux.SingMuxAddr
+func (b *Base) UseSingMux() bool {
+	return b.DialConf != nil && b.DialConf.Mux && b.DialConf.MuxConf.IsSingMux()
+}
+
+// 客户端 是否 使用 Mux.Cool. 使用时 外层代理 握手的 目标 为 innerMux.MuxCoolAddr
+func (b *Base) UseMuxCool() bool {
+	return b.DialConf != nil && b.DialConf.Mux && b.DialConf.MuxConf.IsMuxCool()
+}
+
+func (*Base) GetServerInnerMuxSession(wlc io.ReadWriteCloser) innerMux.Session {
+	session, err := innerMux.NewServerSession(wlc)
 	if err != nil {
-		if ce := utils.CanLogErr("smux.Server call failed"); ce != nil {
+		if ce := utils.CanLogErr("innerMux.NewServerSession call failed"); ce != nil {
 			ce.Write(
 				zap.Error(err),
 			)
 		}
 		return nil
 	}
-	return smuxSession
+	return session
 }
 
 func (b *Base) CloseInnerMuxSession() {
-	if b.InnerMuxEstablished() {
-		b.Innermux.Close()
-		b.Innermux = nil
+	if p := b.innerMuxPool(false); p != nil {
+		p.CloseAll()
 	}
 }
 
-func (b *Base) GetClientInnerMuxSession(wrc io.ReadWriteCloser) *smux.Session {
-	if b.InnerMuxEstablished() {
-		return b.Innermux
-	} else {
-		smuxConfig := smux.DefaultConfig()
-		smuxSession, err := smux.Client(wrc, smuxConfig)
-		if err != nil {
-			if ce := utils.CanLogErr("smux.Client call failed"); ce != nil {
-				ce.Write(
-					zap.Error(err),
-				)
-			}
+// 返回 Innermux. 配置了 mux 时 Innermux 在 创建 client 时 就已 创建; 否则 create 为 true 时 在此 创建.
+func (b *Base) innerMuxPool(create bool) *innerMux.Pool {
+	b.innerMuxMutex.Lock()
+	defer b.innerMuxMutex.Unlock()
+
+	if b.Innermux == nil && create {
+		var conf *innerMux.Conf
+		if b.DialConf != nil {
+			conf = b.DialConf.MuxConf
+		}
+		b.Innermux = innerMux.NewPool(conf)
+	}
+	return b.Innermux
+}
+
+// wrc 为 nil 时 从 已有的 mux连接 中 选择 一个, 否则 在 wrc 上 建立 新的 mux连接.
+func (b *Base) GetClientInnerMuxSession(wrc io.ReadWriteCloser) innerMux.Session {
+	if wrc == nil {
+		pool := b.innerMuxPool(false)
+		if pool == nil {
 			return nil
 		}
-		b.Innermux = smuxSession
-		return smuxSession
+		return pool.Get()
 	}
+
+	var conf *innerMux.Conf
+	if b.DialConf != nil {
+		conf = b.DialConf.MuxConf
+	}
+
+	session, err := innerMux.NewClientSession(wrc, conf)
+	if err != nil {
+		if ce := utils.CanLogErr("innerMux.NewClientSession call failed"); ce != nil {
+			ce.Write(
+				zap.String("protocol", conf.GetProtocol()),
+				zap.Error(err),
+			)
+		}
+		return nil
+	}
+	b.innerMuxPool(true).Add(session)
+	return session
 }
 
 // return false. As a placeholder.
@@ -259,6 +313,14 @@ func (b *Base) GetSockopt() *netLayer.Sockopt {
 	return b.Sockopt
 }
 
+// 返回 DialConf.Via, 即 用于 拨号 底层连接 的 另一个 client 的 tag; 为空 表示 直接拨号
+func (b *Base) GetVia() string {
+	if b.DialConf == nil {
+		return ""
+	}
+	return b.DialConf.Via
+}
+
 func (b *Base) setNetwork(network string) {
 
 	b.TransportLayer = network
@@ -506,3 +568,7 @@ func (d *Base) DialUDP(target netLayer.Addr) (mc *netLayer.UDPMsgConn, err error
 func (d *Base) SelfListen() (is bool, tcp, udp int) {
 	return
 }
+
+func (d *Base) SelfDial() bool {
+	return false
+}
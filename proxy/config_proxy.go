@@ -2,9 +2,11 @@ package proxy
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
@@ -37,10 +39,12 @@ type CommonConf struct {
 
 	Fullcone bool `toml:"fullcone"` //在udp会用到, fullcone的话因为不能关闭udp连接, 所以 时间长后, 可能会导致too many open files. fullcone 的话一般人是用不到的, 所以 有需要的人自行手动打开 即可
 
+	RateLimit *utils.RateLimitConf `toml:"rate_limit"` //可选, 限速; 该 listen/dial 的所有连接 共享同一组令牌桶. 如 rate_limit = { up = "1MB", down = "5MB" }
+
 	/////////////////// tls层 ///////////////////
 
 	TLS      bool     `toml:"tls"`      //tls层; 可选. 如果不使用 's' 后缀法，则还可以配置这一项来更清晰地标明使用tls
-	TlsType  string   `toml:"tls_type"` //可选，可以为 utls或者shadowTls, 若不给出或为空, 则为golang的标准tls. utls 只在客户端有效。
+	TlsType  string   `toml:"tls_type"` //可选，可以为 utls, shadowTls 或 reality, 若不给出或为空, 则为golang的标准tls. utls 只在客户端有效。
 	Insecure bool     `toml:"insecure"` //tls 是否安全
 	Alpn     []string `toml:"alpn"`
 
@@ -66,6 +70,7 @@ type CommonConf struct {
 	UUID        string `toml:"uuid"`         //代理层用户的唯一标识，视代理层协议而定，一般使用uuid，但trojan协议是随便的password, 而socks5 和 http 则使用 user+pass 的形式。 我们为了简洁、一致，就统一放到了 这个字段里。
 	Version     int    `toml:"version"`      //可选，代理层协议版本号，vless v1 要用到。
 	EncryptAlgo string `toml:"encrypt_algo"` //内部加密算法，vmess/ss 等协议可指定
+	Flow        string `toml:"flow"`         //可选, vless v0 的 流控, 目前只支持 xtls-rprx-vision
 
 }
 
@@ -137,8 +142,35 @@ type DialConf struct {
 
 	SendThrough string `toml:"sendThrough"` //可选，用于发送数据的 IP 地址, 可以是ip:port, 或者 tcp:ip:port\nudp:ip:port
 	Mux         bool   `toml:"mux"`         //是否使用内层mux。在某些支持mux命令的协议中（vless v1/trojan）, 开启此开关会让 dial 使用 内层mux。
+
+	Via string `toml:"via"` //可选, 另一个 dial 的 tag. 给出后 本 dial 的 底层连接 不再 直接拨号, 而是 通过 该 dial 代理 到 本 dial 的 地址, 用于 多跳 链式代理. 同 xray 的 sockopt.dialerProxy. 对 quic 这种 自行拨号的 高级层 无效
+
+	MuxConf *innerMux.Conf `toml:"mux_conf"` //可选, 内层mux 的 配置; 给出 protocol 时 使用 sing-mux, 此时 任何 代理协议 都可以 使用 内层mux. 见 innerMux 包.
 }
 
 type SniffConf struct {
 	Enable bool `toml:"enabled"`
+
+	//启用的嗅探器, 可为 tls, http, quic; 不给出时 全部启用. tls 和 http 用于 tcp, quic 用于 udp.
+	Sniffers []string `toml:"sniffers"`
+
+	//若为 true, 嗅探出的域名 不仅用于分流, 也用于拨号, 即 清除 原目标的ip, 改为 拨号到 该域名.
+	//默认 只用于分流, 拨号时 依然使用 原来的ip.
+	OverrideDest bool `toml:"override_dest"`
+}
+
+// 是否启用了 名为 name 的嗅探器
+func (sc *SniffConf) IsSnifferEnabled(name string) bool {
+	if sc == nil || !sc.Enable {
+		return false
+	}
+	if len(sc.Sniffers) == 0 {
+		return true
+	}
+	for _, s := range sc.Sniffers {
+		if strings.EqualFold(s, name) {
+			return true
+		}
+	}
+	return false
 }
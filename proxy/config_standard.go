@@ -28,6 +28,8 @@ type StandardConf struct {
 
 	Route     []*netLayer.RuleConf      `toml:"route"`
 	Fallbacks []*httpLayer.FallbackConf `toml:"fallback"`
+
+	Balancers []*BalancerConf `toml:"balancer"`
 }
 
 // 第一种情况是 将一些较长的配置项 以较短的缩写 作为同义词. 然后代码读取时 只使用短的词.
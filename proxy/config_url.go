@@ -184,6 +184,7 @@ func URLToCommonConf(u *url.URL, conf *CommonConf) error {
 	conf.Path = u.Path
 	conf.AdvancedLayer = q.Get("adv")
 	conf.EncryptAlgo = q.Get("security")
+	conf.Flow = q.Get("flow")
 
 	if q.Get("v") != "" {
 		v, e := strconv.Atoi(q.Get("v"))
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
@@ -171,7 +172,19 @@ func configCommonForClient(cli BaseInterface, dc *DialConf) error {
 
 	clic.ConfigCommon(&dc.CommonConf)
 
-	return nil
+	if dc.Mux {
+		if err := dc.MuxConf.Check(); err != nil {
+			return err
+		}
+		clic.Innermux = innerMux.NewPool(dc.MuxConf)
+	}
+
+	return setRateLimit(clic, &dc.CommonConf)
+}
+
+func setRateLimit(b *Base, cc *CommonConf) (err error) {
+	b.RateLimit, err = utils.NewRateLimitPair(cc.RateLimit)
+	return
 }
 
 func NewServer(lc *ListenConf) (Server, error) {
@@ -209,6 +222,13 @@ func newServer(creator ServerCreator, lc *ListenConf, knownTls bool) (Server, er
 		}
 	}
 	creator.AfterCommonConfServer(ser)
+
+	if err = utils.UserTraffic.LoadQuotas(lc.Users); err != nil {
+		return nil, err
+	}
+	if err = utils.UserRateLimits.LoadUserConfs(lc.Users); err != nil {
+		return nil, err
+	}
 	return ser, nil
 
 }
@@ -225,6 +245,10 @@ func configCommonForServer(ser BaseInterface, lc *ListenConf) error {
 
 	serc.ConfigCommon(&lc.CommonConf)
 
+	if err := setRateLimit(serc, &lc.CommonConf); err != nil {
+		return err
+	}
+
 	if fallbackThing := lc.Fallback; fallbackThing != nil {
 		fa, err := netLayer.NewAddrFromAny(fallbackThing)
 
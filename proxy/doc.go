@@ -50,7 +50,7 @@ New Model - VSI 新的VSI 模型
 
 	11｜        --------------               （client real tcp/udp data)
 	--------------------------------------------------------------------------------
-	10｜        (simplesocks)           |    （inner proxy layer)
+	10｜    (simplesocks/singmux)       |    （inner proxy layer)
 	--------------------------------------------------------------------------------
 	9 ｜ [client real tcp/udp data]     or   [inner mux Layer]
 	--------------------------------------------------------------------------------
@@ -92,6 +92,9 @@ New Model - VSI 新的VSI 模型
 		"layer7_settings": {	//or advancedLayer_settings
 			"ws":{},
 			"grpc":{},
+			"h2":{},
+			"httpupgrade":{},
+			"splithttp":{},
 			"quic":{}
 		},
 		"layer8_settings": {	//or proxy_settings
@@ -99,15 +102,18 @@ New Model - VSI 新的VSI 模型
 			"trojan":{}
 		},
 		"layer9_settings": {	//or innerMux_settings
-			"smux":{}
+			"smux":{},
+			"yamux":{},
+			"h2mux":{}
 		},
 		"layer10_settings": {	//or innerProxy_settings
-			"simplesocks":{}
+			"simplesocks":{},
+			"singmux":{}
 		},
 	}
 
 我们项目的文件夹，netLayer 第3，4层，tlsLayer文件夹代表第5层; httpLayer第六层，
-advLayer文件夹 代表第七层, proxy文件夹代表第8层或第10层, 同时连带 处理了 第九层.
+advLayer文件夹 代表第七层, proxy文件夹代表第8层或第10层, 同时连带 处理了 第九层 (见 proxy/innerMux).
 
 
 同级的ws和grpc是独占的，可以都放到一个layer里，然后比如第八层配置了一个vless一个trojan，那么排列组合就是4种，vless+ws, vless+ grpc, trojan+ws, trojan+grpc.
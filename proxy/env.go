@@ -5,6 +5,8 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/httpLayer"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
 )
 
 // used in real relay progress. See source code of v2ray_simple for details.
@@ -15,6 +17,17 @@ type RoutingEnv struct {
 
 	ClientsTagMap      map[string]Client //ClientsTagMap 存储 tag 对应的 Client；因为分流时，需要通过某个tag找到Client对象。 若要访问map，请用 Get*, Set*, Del* 方法
 	clientsTagMapMutex sync.RWMutex
+
+	Balancers map[string]*Balancer //负载均衡组, key 为其 tag, 可作为 分流的 toTag. 只在加载配置时写入.
+}
+
+// 若 tag 为某个 Balancer 的 tag, 则通过该 Balancer 选出一个 Client, 返回的 done 必须在 该连接转发结束后 调用;
+// 否则返回 nil, nil
+func (re *RoutingEnv) GetBalancedClient(tag string) (c Client, done func()) {
+	if b := re.Balancers[tag]; b != nil {
+		return b.Pick(re)
+	}
+	return
 }
 
 func (re *RoutingEnv) GetClient(tag string) (c Client) {
@@ -49,9 +62,23 @@ func LoadEnvFromStandardConf(standardConf *StandardConf, myCountryISO_3166 strin
 		routingEnv.DnsMachine = netLayer.LoadDnsMachine(dnsConf)
 	}
 
+	for _, bc := range standardConf.Balancers {
+		b, err := NewBalancer(bc)
+		if err != nil {
+			if ce := utils.CanLogErr("load balancer failed"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			continue
+		}
+		if routingEnv.Balancers == nil {
+			routingEnv.Balancers = make(map[string]*Balancer)
+		}
+		routingEnv.Balancers[b.Tag] = b
+	}
+
 	if standardConf.Route != nil || myCountryISO_3166 != "" {
 
-		netLayer.LoadMaxmindGeoipFile("")
+		netLayer.LoadGeoipFile("")
 
 		rp := netLayer.NewRoutePolicy()
 		if myCountryISO_3166 != "" {
@@ -117,6 +117,15 @@ func (*Server) Name() string {
 	return Name
 }
 
+// implements proxy.UserManagedServer
+func (s *Server) NewUserByConf(uc utils.UserConf) (utils.User, error) {
+	up := utils.NewUserPass(uc)
+	if !up.Valid() {
+		return nil, utils.ErrNilOrWrongParameter
+	}
+	return up, nil
+}
+
 func (s *Server) Handshake(underlay net.Conn) (newconn net.Conn, _ netLayer.MsgConn, targetAddr netLayer.Addr, err error) {
 
 	if err = netLayer.SetCommonReadTimeout(underlay); err != nil {
@@ -0,0 +1,395 @@
+package hysteria2
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"go.uber.org/zap"
+)
+
+func init() {
+	proxy.RegisterClient(Name, ClientCreator{})
+}
+
+type ClientCreator struct{ proxy.CreatorCommonStruct }
+
+// 兼容 官方的 分享链接 hysteria2://密码@host:port/?sni=xxx&insecure=1&obfs=salamander&obfs-password=xxx
+func (ClientCreator) URLToDialConf(url *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	switch format {
+	case proxy.UrlStandardFormat:
+		if dc == nil {
+			dc = &proxy.DialConf{}
+			dc.UUID = url.User.Username()
+		}
+		if p, ok := url.User.Password(); ok {
+			dc.UUID += ":" + p
+		}
+		q := url.Query()
+		if sni := q.Get("sni"); sni != "" {
+			dc.Host = sni
+		}
+		dc.Insecure = dc.Insecure || utils.QueryPositive(q, "insecure")
+		if obfs := q.Get("obfs"); obfs != "" {
+			if dc.Extra == nil {
+				dc.Extra = make(map[string]any)
+			}
+			dc.Extra["obfs"] = obfs
+			dc.Extra["obfs_password"] = q.Get("obfs-password")
+		}
+		if dc.Port == 0 {
+			dc.Port = 443
+		}
+		return dc, nil
+	default:
+		return nil, utils.ErrUnImplemented
+	}
+}
+
+func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	conf, err := parseExtra(dc.Extra)
+	if err != nil {
+		return nil, err
+	}
+	if dc.Network == "" {
+		dc.Network = "udp"
+	}
+
+	var certConf *tlsLayer.CertConf
+	if dc.TLSCert != "" && dc.TLSKey != "" {
+		certConf = &tlsLayer.CertConf{
+			CertFile: dc.TLSCert,
+			KeyFile:  dc.TLSKey,
+		}
+	}
+
+	c := &Client{
+		auth: dc.UUID,
+		conf: conf,
+		tlsConf: tlsLayer.GetTlsConfig(false, tlsLayer.Conf{
+			Host:     dc.Host,
+			Insecure: dc.Insecure,
+			AlpnList: DefaultAlpnList,
+			CertConf: certConf,
+		}),
+	}
+	return c, nil
+}
+
+// implements proxy.Client.
+//
+// 所有请求 共用 一个 quic连接, 连接 断开 后 下一个 请求 会 重新拨号 并 认证.
+type Client struct {
+	proxy.Base
+
+	auth    string
+	conf    extraConf
+	tlsConf *tls.Config
+
+	connMutex sync.Mutex
+	conn      *clientConn
+}
+
+func (*Client) Name() string {
+	return Name
+}
+
+func (*Client) GetCreator() proxy.ClientCreator {
+	return ClientCreator{}
+}
+
+// true, hysteria2 自己 拨号 quic
+func (*Client) SelfDial() bool {
+	return true
+}
+
+// udp 通过 datagram 传输, 一个 会话 可 发往 任意地址
+func (*Client) IsUDP_MultiChannel() bool {
+	return false
+}
+
+func (c *Client) Stop() {
+	c.connMutex.Lock()
+	if c.conn != nil {
+		c.conn.close()
+		c.conn = nil
+	}
+	c.connMutex.Unlock()
+
+	c.Base.Stop()
+}
+
+// underlay 不会被使用, 可为 nil
+func (c *Client) Handshake(_ net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	cc, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := cc.OpenStreamSync(context.Background())
+	if err != nil {
+		cc.close()
+		return nil, err
+	}
+	if err = writeTCPRequest(stream, target.String()); err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, err
+	}
+	if len(firstPayload) > 0 {
+		_, err = stream.Write(firstPayload)
+		utils.PutBytes(firstPayload)
+		if err != nil {
+			stream.CancelRead(0)
+			stream.Close()
+			return nil, err
+		}
+	}
+
+	return &clientStream{streamConn: streamConn{Stream: stream, laddr: cc.LocalAddr(), raddr: cc.RemoteAddr()}}, nil
+}
+
+// underlay 不会被使用, 可为 nil
+func (c *Client) EstablishUDPChannel(_ net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	cc, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	if !cc.udpEnabled {
+		return nil, utils.ErrInErr{ErrDesc: "hysteria2: udp disabled by server", Data: c.AddrStr()}
+	}
+
+	u := cc.newUDPSession()
+	if len(firstPayload) > 0 {
+		if err = u.WriteMsg(firstPayload, target); err != nil {
+			u.Close()
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+func (c *Client) getConn() (*clientConn, error) {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+
+	if cc := c.conn; cc != nil && !cc.isClosed() {
+		return cc, nil
+	}
+	cc, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = cc
+	return cc, nil
+}
+
+// 拨号 quic 并 认证
+func (c *Client) dial() (*clientConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", c.AddrStr())
+	if err != nil {
+		return nil, err
+	}
+	uc, err := net.ListenUDP("udp", c.LUA)
+	if err != nil {
+		return nil, err
+	}
+	var pconn net.PacketConn = uc
+	if c.conf.obfsPassword != "" {
+		pconn = newSalamanderConn(uc, c.conf.obfsPassword)
+	}
+
+	qConf := common_DialConfig
+	qc, err := quic.DialEarly(pconn, raddr, c.AddrStr(), c.tlsConf, &qConf)
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+
+	rt := &http3.RoundTripper{
+		TLSClientConfig: c.tlsConf,
+		QuicConfig:      &qConf,
+		EnableDatagrams: true,
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return qc, nil
+		},
+	}
+	cc := &clientConn{
+		EarlyConnection: qc,
+		pconn:           uc,
+		rt:              rt,
+		udpSessions:     make(map[uint32]*udpConn),
+	}
+
+	rq := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: "https", Host: authHost, Path: authPath},
+		Header: http.Header{
+			headerAuth:    []string{c.auth},
+			headerCCRX:    []string{strconv.FormatUint(c.conf.downBps, 10)},
+			headerPadding: []string{randPadding(256, 2048)},
+		},
+	}
+	rsp, err := rt.RoundTrip(rq)
+	if err != nil {
+		cc.close()
+		return nil, err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != statusAuthOK {
+		cc.close()
+		return nil, utils.ErrInErr{ErrDesc: "hysteria2 auth failed", ErrDetail: utils.ErrInvalidData, Data: rsp.StatusCode}
+	}
+
+	cc.udpEnabled, _ = strconv.ParseBool(rsp.Header.Get(headerUDP))
+
+	//服务端 返回 auto 时 不使用 Brutal
+	if serverRx := rsp.Header.Get(headerCCRX); serverRx != "auto" {
+		tx, _ := strconv.ParseUint(serverRx, 10, 64)
+		if tx == 0 || (c.conf.upBps > 0 && tx > c.conf.upBps) {
+			tx = c.conf.upBps
+		}
+		setBrutal(qc, tx)
+	}
+
+	if ce := utils.CanLogInfo("hysteria2 connected"); ce != nil {
+		ce.Write(zap.String("server", c.AddrStr()), zap.Bool("udp", cc.udpEnabled))
+	}
+
+	go func() {
+		<-qc.Context().Done()
+		cc.close()
+	}()
+	if cc.udpEnabled {
+		go cc.receiveDatagrams()
+	}
+	return cc, nil
+}
+
+type clientConn struct {
+	quic.EarlyConnection
+
+	pconn      net.PacketConn
+	rt         *http3.RoundTripper
+	udpEnabled bool
+
+	udpMutex      sync.Mutex
+	udpSessions   map[uint32]*udpConn
+	nextSessionID uint32
+
+	closeOnce sync.Once
+}
+
+func (cc *clientConn) isClosed() bool {
+	select {
+	case <-cc.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (cc *clientConn) close() {
+	cc.closeOnce.Do(func() {
+		cc.CloseWithError(0, "")
+		cc.rt.Close()
+		cc.pconn.Close()
+	})
+}
+
+func (cc *clientConn) newUDPSession() *udpConn {
+	cc.udpMutex.Lock()
+	defer cc.udpMutex.Unlock()
+
+	cc.nextSessionID++
+	id := cc.nextSessionID
+	u := newUDPConn(cc.EarlyConnection, id, func() {
+		cc.udpMutex.Lock()
+		delete(cc.udpSessions, id)
+		cc.udpMutex.Unlock()
+	})
+	cc.udpSessions[id] = u
+	return u
+}
+
+func (cc *clientConn) receiveDatagrams() {
+	for {
+		bs, err := cc.ReceiveMessage()
+		if err != nil {
+			break
+		}
+		m, err := parseUDPMessage(bs)
+		if err != nil {
+			continue
+		}
+		cc.udpMutex.Lock()
+		u := cc.udpSessions[m.sessionID]
+		cc.udpMutex.Unlock()
+
+		if u != nil {
+			u.feed(m)
+		}
+	}
+
+	cc.udpMutex.Lock()
+	sessions := cc.udpSessions
+	cc.udpSessions = make(map[uint32]*udpConn)
+	cc.udpMutex.Unlock()
+
+	for _, u := range sessions {
+		u.Close()
+	}
+}
+
+// implements net.Conn
+type streamConn struct {
+	quic.Stream
+
+	// quic.Stream 没有 LocalAddr 和 RemoteAddr, 使用 所属 quic连接 的 地址
+	laddr, raddr net.Addr
+}
+
+func (sc *streamConn) LocalAddr() net.Addr {
+	return sc.laddr
+}
+
+func (sc *streamConn) RemoteAddr() net.Addr {
+	return sc.raddr
+}
+
+// quic.Stream 的 Close 只 关闭 写入 方向, 所以 还要 调用 CancelRead
+func (sc *streamConn) Close() error {
+	sc.CancelRead(0)
+	return sc.Stream.Close()
+}
+
+// 客户端的 tcp流, 第一次 Read 时 读取 服务端的 响应
+type clientStream struct {
+	streamConn
+	responseRead bool
+}
+
+func (cs *clientStream) Read(p []byte) (int, error) {
+	if !cs.responseRead {
+		cs.responseRead = true
+
+		ok, msg, err := readTCPResponse(cs.Stream)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, utils.ErrInErr{ErrDesc: "hysteria2: remote error", Data: msg}
+		}
+	}
+	return cs.Stream.Read(p)
+}
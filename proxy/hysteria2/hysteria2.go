@@ -0,0 +1,434 @@
+/*
+Package hysteria2 implements the Hysteria2 protocol for proxy.Client and proxy.Server.
+
+hysteria2 基于 quic, 自己 拨号 与 监听, 不经过 vs 的 传输层, tls层 和 高级层:
+客户端 实现了 proxy.Client 的 SelfDial, 服务端 实现了 proxy.ListenerServer.
+
+# Auth
+
+客户端 建立 quic连接 后 通过 http/3 发送
+
+	POST https://hysteria/auth
+	Hysteria-Auth: 密码
+	Hysteria-CC-RX: 客户端的 最大接收速率 (bytes/s), 0 表示 未知
+	Hysteria-Padding: 随机填充
+
+服务端 认证成功 时 返回 状态码 233, 并带有 Hysteria-UDP, Hysteria-CC-RX, Hysteria-Padding 头;
+认证失败 时 表现为 普通的 http/3 服务器, 返回 404.
+
+双方 根据 对方的 接收速率 和 自己的 up_mbps 决定 发送速率, 速率 不为0 时 使用 Brutal 阻控 (见 advLayer/quic).
+
+# TCP
+
+每个 tcp请求 为 一个 新的 quic流:
+
+	请求: varint(0x401) | varint(地址长度) | 地址 | varint(填充长度) | 填充
+	响应: status(1) | varint(信息长度) | 信息 | varint(填充长度) | 填充
+
+地址 为 host:port 形式, status 为 0 表示 成功.
+
+# UDP
+
+udp 使用 quic datagram 传输, 不再需要 udp over stream. 每个 datagram 为
+
+	会话id(4) | 包id(2) | 分片id(1) | 分片数(1) | varint(地址长度) | 地址 | 数据
+
+超过 datagram 最大长度 的 包 会被 分片.
+
+# Salamander
+
+配置 obfs = "salamander" 后, 每个 udp包 为 salt(8) | 混淆后的数据, 混淆方式 为 与 blake2b-256(obfs_password + salt) 循环 异或.
+
+# Config
+
+	protocol = "hysteria2"
+	uuid = "密码"
+	extra = { up_mbps = 100, down_mbps = 100, obfs = "salamander", obfs_password = "xxx" }
+
+服务端 的 users 中 给出 user 时, 认证字符串 为 "user:pass", 与 官方的 userpass 认证 相同; 服务端 可 配置 extra.disable_udp = true 来 关闭 udp.
+
+See https://v2.hysteria.network/docs/developers/Protocol/
+*/
+package hysteria2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"time"
+
+	advquic "github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/congestion"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+const (
+	Name = "hysteria2"
+
+	authHost     = "hysteria"
+	authPath     = "/auth"
+	statusAuthOK = 233
+
+	headerAuth    = "Hysteria-Auth"
+	headerUDP     = "Hysteria-UDP"
+	headerCCRX    = "Hysteria-CC-RX"
+	headerPadding = "Hysteria-Padding"
+
+	frameTypeTCPRequest = 0x401
+
+	tcpStatusOK    byte = 0
+	tcpStatusError byte = 1
+
+	maxAddressLength = 2048
+	maxMessageLength = 2048
+	maxPaddingLength = 4096
+
+	udpHeaderFixedLen = 8 //会话id(4) | 包id(2) | 分片id(1) | 分片数(1)
+)
+
+var (
+	DefaultAlpnList = []string{"h3"}
+
+	common_ListenConfig = quic.Config{
+		HandshakeIdleTimeout:           time.Second * 10,
+		MaxIdleTimeout:                 time.Second * 30,
+		MaxIncomingStreams:             1024,
+		InitialStreamReceiveWindow:     8 * 1024 * 1024,
+		MaxStreamReceiveWindow:         8 * 1024 * 1024,
+		InitialConnectionReceiveWindow: 20 * 1024 * 1024,
+		MaxConnectionReceiveWindow:     20 * 1024 * 1024,
+		EnableDatagrams:                true,
+	}
+
+	common_DialConfig = quic.Config{
+		HandshakeIdleTimeout:           time.Second * 10,
+		MaxIdleTimeout:                 time.Second * 30,
+		KeepAlivePeriod:                time.Second * 10,
+		InitialStreamReceiveWindow:     8 * 1024 * 1024,
+		MaxStreamReceiveWindow:         8 * 1024 * 1024,
+		InitialConnectionReceiveWindow: 20 * 1024 * 1024,
+		MaxConnectionReceiveWindow:     20 * 1024 * 1024,
+		EnableDatagrams:                true,
+	}
+)
+
+// 从 extra 中 读取的 配置
+type extraConf struct {
+	upBps, downBps uint64 //bytes/s, 0 表示 不限
+
+	obfsPassword string //不为空 时 使用 salamander
+
+	disableUDP bool
+}
+
+func parseExtra(extra map[string]any) (c extraConf, err error) {
+	if len(extra) == 0 {
+		return
+	}
+	if thing := extra["up_mbps"]; thing != nil {
+		if mbps, ok := utils.AnyToInt64(thing); ok && mbps > 0 {
+			c.upBps = uint64(mbps) * 1024 * 1024 / 8
+		}
+	}
+	if thing := extra["down_mbps"]; thing != nil {
+		if mbps, ok := utils.AnyToInt64(thing); ok && mbps > 0 {
+			c.downBps = uint64(mbps) * 1024 * 1024 / 8
+		}
+	}
+	if thing := extra["disable_udp"]; thing != nil {
+		c.disableUDP, _ = utils.AnyToBool(thing)
+	}
+	if thing := extra["obfs"]; thing != nil {
+		obfs, _ := thing.(string)
+		switch obfs {
+		case "":
+		case "salamander":
+			c.obfsPassword, _ = extra["obfs_password"].(string)
+			if c.obfsPassword == "" {
+				err = utils.ErrInErr{ErrDesc: "hysteria2: salamander requires obfs_password", ErrDetail: utils.ErrInvalidData}
+			}
+		default:
+			err = utils.ErrInErr{ErrDesc: "hysteria2: unknown obfs", ErrDetail: utils.ErrInvalidData, Data: obfs}
+		}
+	}
+	return
+}
+
+// bps 为0 时 保持 quic-go 默认的 阻控
+func setBrutal(conn quic.Connection, bps uint64) {
+	if bps > 0 {
+		conn.SetCongestionControl(advquic.NewBrutalSender(congestion.ByteCount(bps)))
+	}
+}
+
+// implements utils.User
+type User struct {
+	name, auth string
+}
+
+// name 为空 时 认证字符串 为 pass, 否则 为 name:pass
+func NewUser(name, pass string) *User {
+	u := &User{name: name, auth: pass}
+	if name != "" {
+		u.auth = name + ":" + pass
+	}
+	return u
+}
+
+func (u *User) IdentityStr() string {
+	if u.name != "" {
+		return u.name
+	}
+	return u.auth
+}
+
+func (u *User) IdentityBytes() []byte {
+	return []byte(u.IdentityStr())
+}
+
+func (u *User) AuthStr() string {
+	return u.auth
+}
+
+func (u *User) AuthBytes() []byte {
+	return []byte(u.auth)
+}
+
+const paddingChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// 返回 长度在 [min,max) 之间的 随机字符串, 可直接用于 http头
+func randPadding(min, max int) string {
+	bs := make([]byte, min+rand.Intn(max-min))
+	for i := range bs {
+		bs[i] = paddingChars[rand.Intn(len(paddingChars))]
+	}
+	return string(bs)
+}
+
+func writeTCPRequest(w io.Writer, addr string) error {
+	padding := randPadding(64, 512)
+
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	qw := quicvarint.NewWriter(buf)
+	quicvarint.Write(qw, frameTypeTCPRequest)
+	quicvarint.Write(qw, uint64(len(addr)))
+	buf.WriteString(addr)
+	quicvarint.Write(qw, uint64(len(padding)))
+	buf.WriteString(padding)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// 读取 frameTypeTCPRequest 之后的 部分, frame type 已被 http3 读取.
+func readTCPRequest(r io.Reader) (addr string, err error) {
+	br := quicvarint.NewReader(r)
+	bs, err := readVarBytes(br, maxAddressLength)
+	if err != nil {
+		return
+	}
+	if len(bs) == 0 {
+		err = utils.ErrInErr{ErrDesc: "hysteria2: empty address", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+	addr = string(bs)
+	err = skipPadding(br)
+	return
+}
+
+func writeTCPResponse(w io.Writer, ok bool, msg string) error {
+	padding := randPadding(128, 1024)
+
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	if ok {
+		buf.WriteByte(tcpStatusOK)
+	} else {
+		buf.WriteByte(tcpStatusError)
+	}
+	qw := quicvarint.NewWriter(buf)
+	quicvarint.Write(qw, uint64(len(msg)))
+	buf.WriteString(msg)
+	quicvarint.Write(qw, uint64(len(padding)))
+	buf.WriteString(padding)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readTCPResponse(r io.Reader) (ok bool, msg string, err error) {
+	br := quicvarint.NewReader(r)
+	status, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+	bs, err := readVarBytes(br, maxMessageLength)
+	if err != nil {
+		return
+	}
+	if err = skipPadding(br); err != nil {
+		return
+	}
+	return status == tcpStatusOK, string(bs), nil
+}
+
+func readVarBytes(br quicvarint.Reader, max uint64) ([]byte, error) {
+	l, err := quicvarint.Read(br)
+	if err != nil {
+		return nil, err
+	}
+	if l > max {
+		return nil, utils.ErrInErr{ErrDesc: "hysteria2: field too long", ErrDetail: utils.ErrInvalidData, Data: l}
+	}
+	bs := make([]byte, l)
+	_, err = io.ReadFull(br, bs)
+	return bs, err
+}
+
+func skipPadding(br quicvarint.Reader) error {
+	l, err := quicvarint.Read(br)
+	if err != nil {
+		return err
+	}
+	if l > maxPaddingLength {
+		return utils.ErrInErr{ErrDesc: "hysteria2: padding too long", ErrDetail: utils.ErrInvalidData, Data: l}
+	}
+	_, err = io.CopyN(io.Discard, br, int64(l))
+	return err
+}
+
+type udpMessage struct {
+	sessionID         uint32
+	packetID          uint16
+	fragID, fragCount uint8
+	addr              string
+	data              []byte
+}
+
+func (m *udpMessage) headerSize() int {
+	return udpHeaderFixedLen + int(quicvarint.Len(uint64(len(m.addr)))) + len(m.addr)
+}
+
+func (m *udpMessage) size() int {
+	return m.headerSize() + len(m.data)
+}
+
+func (m *udpMessage) bytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, m.size()))
+	binary.Write(buf, binary.BigEndian, m.sessionID)
+	binary.Write(buf, binary.BigEndian, m.packetID)
+	buf.WriteByte(m.fragID)
+	buf.WriteByte(m.fragCount)
+	quicvarint.Write(quicvarint.NewWriter(buf), uint64(len(m.addr)))
+	buf.WriteString(m.addr)
+	buf.Write(m.data)
+	return buf.Bytes()
+}
+
+func parseUDPMessage(bs []byte) (m udpMessage, err error) {
+	if len(bs) < udpHeaderFixedLen {
+		err = utils.ErrInErr{ErrDesc: "hysteria2: udp message too short", ErrDetail: utils.ErrInvalidData, Data: len(bs)}
+		return
+	}
+	m.sessionID = binary.BigEndian.Uint32(bs[:4])
+	m.packetID = binary.BigEndian.Uint16(bs[4:6])
+	m.fragID = bs[6]
+	m.fragCount = bs[7]
+
+	r := bytes.NewReader(bs[udpHeaderFixedLen:])
+	addr, err := readVarBytes(r, maxAddressLength)
+	if err != nil {
+		return
+	}
+	if len(addr) == 0 {
+		err = utils.ErrInErr{ErrDesc: "hysteria2: empty udp address", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+	m.addr = string(addr)
+	m.data = bs[len(bs)-r.Len():]
+	return
+}
+
+// 将 m 分为 每个 不超过 maxSize 的 分片; 不需要 分片 时 返回 m 本身.
+func fragUDPMessage(m udpMessage, maxSize int) []udpMessage {
+	if m.size() <= maxSize {
+		return []udpMessage{m}
+	}
+	maxPayload := maxSize - m.headerSize()
+	if maxPayload <= 0 {
+		return nil
+	}
+	count := (len(m.data) + maxPayload - 1) / maxPayload
+	if count > 255 {
+		return nil
+	}
+
+	frags := make([]udpMessage, 0, count)
+	data := m.data
+	for i := 0; i < count; i++ {
+		frag := m
+		frag.fragID = uint8(i)
+		frag.fragCount = uint8(count)
+		n := maxPayload
+		if n > len(data) {
+			n = len(data)
+		}
+		frag.data = data[:n]
+		data = data[n:]
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// defragger 只 重组 最新的 一个包, 收到 新的 包id 时 丢弃 未完成的 旧包. 不是 并发安全的.
+type defragger struct {
+	packetID uint16
+	frags    []*udpMessage
+	count    int
+	size     int
+}
+
+// 返回 完整的 包, 尚未 收齐 时 返回 nil
+func (d *defragger) feed(m udpMessage) *udpMessage {
+	if m.fragCount <= 1 {
+		return &m
+	}
+	if m.fragID >= m.fragCount {
+		return nil
+	}
+	if m.packetID != d.packetID || int(m.fragCount) != len(d.frags) {
+		d.packetID = m.packetID
+		d.frags = make([]*udpMessage, m.fragCount)
+		d.count = 0
+		d.size = 0
+	}
+	if d.frags[m.fragID] != nil {
+		return nil
+	}
+	d.frags[m.fragID] = &m
+	d.count++
+	d.size += len(m.data)
+	if d.count < len(d.frags) {
+		return nil
+	}
+
+	data := make([]byte, 0, d.size)
+	for _, frag := range d.frags {
+		data = append(data, frag.data...)
+	}
+	whole := m
+	whole.fragID = 0
+	whole.fragCount = 1
+	whole.data = data
+
+	d.frags = nil
+	d.count = 0
+	d.size = 0
+	return &whole
+}
@@ -0,0 +1,220 @@
+package hysteria2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+)
+
+func TestTCPRequest(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeTCPRequest(&buf, "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	ft, err := quicvarint.Read(&buf)
+	if err != nil || ft != frameTypeTCPRequest {
+		t.Fatal("wrong frame type", ft, err)
+	}
+	addr, err := readTCPRequest(&buf)
+	if err != nil || addr != "example.com:443" || buf.Len() != 0 {
+		t.Fatal("tcp request not match", addr, err, buf.Len())
+	}
+
+	for _, ok := range []bool{true, false} {
+		buf.Reset()
+		writeTCPResponse(&buf, ok, "msg")
+		buf.WriteString("rest")
+
+		gotOk, msg, err := readTCPResponse(&buf)
+		if err != nil || gotOk != ok || msg != "msg" || buf.String() != "rest" {
+			t.Fatal("tcp response not match", gotOk, msg, err, buf.String())
+		}
+	}
+}
+
+func TestUDPMessageFrag(t *testing.T) {
+	data := make([]byte, 3000)
+	rand.Read(data)
+
+	m := udpMessage{sessionID: 7, packetID: 3, fragCount: 1, addr: "1.2.3.4:53", data: data}
+	frags := fragUDPMessage(m, 1200)
+	if len(frags) != 3 {
+		t.Fatal("wrong frag count", len(frags))
+	}
+
+	var d defragger
+	for i, frag := range frags {
+		parsed, err := parseUDPMessage(frag.bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frag.bytes()) > 1200 {
+			t.Fatal("frag too large", len(frag.bytes()))
+		}
+		whole := d.feed(parsed)
+		if i < len(frags)-1 {
+			if whole != nil {
+				t.Fatal("should not be complete")
+			}
+			continue
+		}
+		if whole == nil || whole.sessionID != 7 || whole.addr != m.addr || !bytes.Equal(whole.data, data) {
+			t.Fatal("defrag failed")
+		}
+	}
+}
+
+func TestSalamander(t *testing.T) {
+	c1, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	s1 := newSalamanderConn(c1, "pass")
+	s2 := newSalamanderConn(c2, "pass")
+
+	data := []byte("hello salamander")
+	if _, err := s1.WriteTo(data, c2.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	bs := make([]byte, 100)
+	c2.SetReadDeadline(time.Now().Add(time.Second * 2))
+	n, _, err := s2.ReadFrom(bs)
+	if err != nil || !bytes.Equal(bs[:n], data) {
+		t.Fatal("salamander not match", string(bs[:n]), err)
+	}
+}
+
+func newTestPair(t *testing.T, extra map[string]any, pass string) (*Server, proxy.Client) {
+	port := netLayer.RandPort(true, true, 0)
+
+	lc := &proxy.ListenConf{}
+	lc.Protocol = Name
+	lc.IP = "127.0.0.1"
+	lc.Port = port
+	lc.UUID = "password"
+	lc.Extra = extra
+	server, err := proxy.NewServer(lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &proxy.DialConf{}
+	dc.Protocol = Name
+	dc.IP = "127.0.0.1"
+	dc.Port = port
+	dc.UUID = pass
+	dc.Insecure = true
+	dc.Extra = extra
+	client, err := proxy.NewClient(dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.(*Server), client
+}
+
+func TestClientServer(t *testing.T) {
+	for _, extra := range []map[string]any{
+		nil,
+		{"obfs": "salamander", "obfs_password": "obfs", "up_mbps": 100, "down_mbps": 100},
+	} {
+		testClientServer(t, extra)
+	}
+}
+
+func testClientServer(t *testing.T, extra map[string]any) {
+	server, client := newTestPair(t, extra, "password")
+
+	//tcp 与 udp 都 回显
+	closer := server.StartListen(func(info netLayer.TCPRequestInfo) {
+		if info.Target.String() != "example.com:80" {
+			t.Log("wrong target", info.Target.String())
+		}
+		io.Copy(info.Conn, info.Conn)
+		info.Conn.Close()
+	}, func(info netLayer.UDPRequestInfo) {
+		for {
+			bs, addr, err := info.ReadMsg()
+			if err != nil {
+				return
+			}
+			info.WriteMsg(bs, addr)
+		}
+	})
+	if closer == nil {
+		t.Fatal("listen failed")
+	}
+	defer server.Stop()
+	defer client.Stop()
+
+	target := netLayer.Addr{Name: "example.com", Port: 80}
+	conn, err := client.Handshake(nil, []byte("hello"), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	go conn.Write(data)
+
+	got := make([]byte, 5+len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:5]) != "hello" || !bytes.Equal(got[5:], data) {
+		t.Fatal("tcp echo not match")
+	}
+	conn.Close()
+
+	udpTarget := netLayer.Addr{IP: net.IPv4(1, 2, 3, 4), Port: 53, Network: "udp"}
+	mc, err := client.EstablishUDPChannel(nil, []byte("first"), udpTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	bigPacket := make([]byte, 3000) //需要 分片
+	rand.Read(bigPacket)
+
+	for _, p := range [][]byte{[]byte("first"), bigPacket} {
+		if !bytes.Equal(p, []byte("first")) {
+			if err := mc.WriteMsg(p, udpTarget); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mc.SetReadDeadline(time.Now().Add(time.Second * 5))
+		bs, addr, err := mc.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs, p) || addr.String() != udpTarget.String() {
+			t.Fatal("udp echo not match", len(bs), addr.String())
+		}
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	server, client := newTestPair(t, nil, "wrong")
+
+	if server.StartListen(func(info netLayer.TCPRequestInfo) { info.Conn.Close() }, nil) == nil {
+		t.Fatal("listen failed")
+	}
+	defer server.Stop()
+	defer client.Stop()
+
+	if _, err := client.Handshake(nil, nil, netLayer.Addr{Name: "example.com", Port: 80}); err == nil {
+		t.Fatal("should fail with wrong password")
+	}
+}
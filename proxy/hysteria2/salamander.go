@@ -0,0 +1,63 @@
+package hysteria2
+
+import (
+	"crypto/rand"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/crypto/blake2b"
+)
+
+const salamanderSaltLen = 8
+
+// salamanderConn 对 每个 udp包 进行 salamander 混淆, 用于 quic 的 底层.
+type salamanderConn struct {
+	net.PacketConn
+	psk []byte
+}
+
+func newSalamanderConn(conn net.PacketConn, password string) *salamanderConn {
+	return &salamanderConn{PacketConn: conn, psk: []byte(password)}
+}
+
+// 用 blake2b-256(psk + salt) 循环 异或 in, 写入 out
+func (c *salamanderConn) xor(salt, in, out []byte) {
+	key := blake2b.Sum256(append(append(make([]byte, 0, len(c.psk)+len(salt)), c.psk...), salt...))
+	for i, b := range in {
+		out[i] = b ^ key[i%blake2b.Size256]
+	}
+}
+
+func (c *salamanderConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	bs := utils.GetPacket()
+	defer utils.PutPacket(bs)
+
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(bs)
+		if err != nil {
+			return
+		}
+		if n <= salamanderSaltLen {
+			continue //无效包 直接丢弃
+		}
+		data := bs[salamanderSaltLen:n]
+		if len(data) > len(p) {
+			data = data[:len(p)]
+		}
+		c.xor(bs[:salamanderSaltLen], data, p)
+		return len(data), addr, nil
+	}
+}
+
+func (c *salamanderConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	bs := make([]byte, salamanderSaltLen+len(p))
+	if _, err = rand.Read(bs[:salamanderSaltLen]); err != nil {
+		return
+	}
+	c.xor(bs[:salamanderSaltLen], p, bs[salamanderSaltLen:])
+
+	if _, err = c.PacketConn.WriteTo(bs, addr); err != nil {
+		return
+	}
+	return len(p), nil
+}
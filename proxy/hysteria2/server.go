@@ -0,0 +1,381 @@
+package hysteria2
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+func init() {
+	proxy.RegisterServer(Name, &ServerCreator{})
+}
+
+type ServerCreator struct{ proxy.CreatorCommonStruct }
+
+func (ServerCreator) URLToListenConf(url *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	switch format {
+	case proxy.UrlStandardFormat:
+		if lc == nil {
+			lc = &proxy.ListenConf{}
+			lc.UUID = url.User.Username()
+		}
+		q := url.Query()
+		if obfs := q.Get("obfs"); obfs != "" {
+			if lc.Extra == nil {
+				lc.Extra = make(map[string]any)
+			}
+			lc.Extra["obfs"] = obfs
+			lc.Extra["obfs_password"] = q.Get("obfs-password")
+		}
+		lc.TLSCert = q.Get("cert")
+		lc.TLSKey = q.Get("key")
+		return lc, nil
+	default:
+		return nil, utils.ErrUnImplemented
+	}
+}
+
+func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	conf, err := parseExtra(lc.Extra)
+	if err != nil {
+		return nil, err
+	}
+	if lc.Network == "" {
+		lc.Network = "udp"
+	}
+
+	s := &Server{
+		MultiUserMap: utils.NewMultiUserMap(),
+		conf:         conf,
+		tlsConf: tlsLayer.GetTlsConfig(true, tlsLayer.Conf{
+			Host:     lc.Host,
+			AlpnList: DefaultAlpnList,
+			CertConf: &tlsLayer.CertConf{
+				CertFile: lc.TLSCert, KeyFile: lc.TLSKey, CA: lc.CA,
+			},
+		}),
+	}
+	s.StoreKeyByStr = true
+
+	if lc.UUID != "" {
+		s.AddUser(NewUser("", lc.UUID))
+	}
+	for _, uc := range lc.Users {
+		s.AddUser(NewUser(uc.User, uc.Pass))
+	}
+
+	return s, nil
+}
+
+func (ServerCreator) AfterCommonConfServer(ps proxy.Server) (err error) {
+	s := ps.(*Server)
+	s.LUA, err = net.ResolveUDPAddr("udp", s.AddrStr())
+	return
+}
+
+// implements proxy.ListenerServer
+type Server struct {
+	proxy.Base
+
+	*utils.MultiUserMap
+
+	conf    extraConf
+	tlsConf *tls.Config
+
+	listener io.Closer
+}
+
+func (*Server) Name() string {
+	return Name
+}
+
+// implements proxy.UserManagedServer
+func (s *Server) NewUserByConf(uc utils.UserConf) (utils.User, error) {
+	if uc.Pass == "" {
+		return nil, utils.ErrNilOrWrongParameter
+	}
+	return NewUser(uc.User, uc.Pass), nil
+}
+
+// 自己 监听 tcp 和 udp, 不需要 vs 监听
+func (s *Server) SelfListen() (is bool, tcp, udp int) {
+	if s.conf.disableUDP {
+		return true, 1, -1
+	}
+	return true, 1, 1
+}
+
+// hysteria2 的 请求 都在 StartListen 中 处理
+func (s *Server) Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error) {
+	return nil, nil, netLayer.Addr{}, utils.ErrUnImplemented
+}
+
+func (s *Server) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	s.Base.Stop()
+}
+
+// 非阻塞
+func (s *Server) StartListen(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) io.Closer {
+	uc, err := net.ListenUDP("udp", s.LUA)
+	if err != nil {
+		if ce := utils.CanLogErr("hysteria2 listen udp failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return nil
+	}
+	var pconn net.PacketConn = uc
+	if s.conf.obfsPassword != "" {
+		pconn = newSalamanderConn(uc, s.conf.obfsPassword)
+	}
+
+	qConf := common_ListenConfig
+	l, err := quic.ListenEarly(pconn, s.tlsConf, &qConf)
+	if err != nil {
+		uc.Close()
+		if ce := utils.CanLogErr("hysteria2 listen quic failed"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return nil
+	}
+	s.listener = &listenerCloser{EarlyListener: l, pconn: uc}
+
+	if s.conf.disableUDP {
+		udpFunc = nil
+	}
+
+	go func() {
+		for {
+			qc, err := l.Accept(context.Background())
+			if err != nil {
+				if ce := utils.CanLogDebug("hysteria2 accept quic ended"); ce != nil {
+					ce.Write(zap.Error(err))
+				}
+				return
+			}
+			sc := &serverConn{
+				Connection:  qc,
+				server:      s,
+				tcpFunc:     tcpFunc,
+				udpFunc:     udpFunc,
+				udpSessions: make(map[uint32]*serverUDPConn),
+			}
+			go sc.serve()
+		}
+	}()
+
+	return s.listener
+}
+
+type listenerCloser struct {
+	quic.EarlyListener
+	pconn net.PacketConn
+}
+
+func (lc *listenerCloser) Close() error {
+	lc.EarlyListener.Close()
+	return lc.pconn.Close()
+}
+
+// 一个 客户端的 quic连接
+type serverConn struct {
+	quic.Connection
+
+	server  *Server
+	tcpFunc func(netLayer.TCPRequestInfo)
+	udpFunc func(netLayer.UDPRequestInfo)
+
+	authMutex sync.Mutex  //并发的 认证请求 依次 进行, 保证 user 只在 authed 为 true 之前 被写入 一次
+	user      utils.User  //在 authed 为 true 之前 设置, 之后 只读
+	authed    atomic.Bool //为 true 后 才会 接管 流 和 数据报, 因此 它们 读到的 user 总是 已设置好的
+
+	udpMutex    sync.Mutex
+	udpSessions map[uint32]*serverUDPConn
+}
+
+func (sc *serverConn) serve() {
+	h3s := http3.Server{
+		Handler:         sc,
+		EnableDatagrams: true,
+		StreamHijacker:  sc.hijackStream,
+	}
+	err := h3s.ServeQUICConn(sc.Connection)
+	if ce := utils.CanLogDebug("hysteria2 conn ended"); ce != nil {
+		ce.Write(zap.String("from", sc.RemoteAddr().String()), zap.Error(err))
+	}
+	sc.CloseWithError(0, "")
+}
+
+// 认证失败 或 非认证请求 一律 返回 404, 表现为 普通的 http/3 服务器
+func (sc *serverConn) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	if rq.Method != http.MethodPost || rq.Host != authHost || rq.URL.Path != authPath {
+		http.NotFound(rw, rq)
+		return
+	}
+
+	if !sc.authed.Load() && !sc.auth(rq) {
+		http.NotFound(rw, rq)
+		return
+	}
+
+	rw.Header().Set(headerUDP, strconv.FormatBool(sc.udpFunc != nil))
+	rw.Header().Set(headerCCRX, strconv.FormatUint(sc.server.conf.downBps, 10))
+	rw.Header().Set(headerPadding, randPadding(256, 2048))
+	rw.WriteHeader(statusAuthOK)
+}
+
+// 认证 成功 时 设置 user 和 拥塞控制, 然后 才 将 authed 设为 true; 已经 认证过 时 直接 返回 true
+func (sc *serverConn) auth(rq *http.Request) bool {
+	sc.authMutex.Lock()
+	defer sc.authMutex.Unlock()
+
+	if sc.authed.Load() {
+		return true
+	}
+
+	user := sc.server.AuthUserByStr(rq.Header.Get(headerAuth))
+	if user == nil {
+		if ce := utils.CanLogWarn("hysteria2 auth failed"); ce != nil {
+			ce.Write(zap.String("from", sc.RemoteAddr().String()))
+		}
+		return false
+	}
+	if id := user.IdentityStr(); utils.UserTraffic.ExceedQuota(id) {
+		if ce := utils.CanLogWarn("hysteria2 user rejected"); ce != nil {
+			ce.Write(zap.String("from", sc.RemoteAddr().String()), zap.Error(utils.ErrQuotaExceeded))
+		}
+		return false
+	}
+	sc.user = user
+
+	clientRx, _ := strconv.ParseUint(rq.Header.Get(headerCCRX), 10, 64)
+	tx := clientRx
+	if sc.server.conf.upBps > 0 && tx > sc.server.conf.upBps {
+		tx = sc.server.conf.upBps
+	}
+	setBrutal(sc.Connection, tx)
+
+	sc.authed.Store(true)
+	if sc.udpFunc != nil {
+		go sc.receiveDatagrams()
+	}
+	return true
+}
+
+// 认证后 接管 以 frameTypeTCPRequest 开头的 流
+func (sc *serverConn) hijackStream(ft http3.FrameType, _ quic.Connection, stream quic.Stream, err error) (bool, error) {
+	if err != nil || ft != frameTypeTCPRequest || !sc.authed.Load() || sc.tcpFunc == nil {
+		return false, nil
+	}
+	go sc.handleStream(stream)
+	return true, nil
+}
+
+func (sc *serverConn) handleStream(stream quic.Stream) {
+	conn := &serverStream{
+		streamConn: streamConn{Stream: stream, laddr: sc.LocalAddr(), raddr: sc.RemoteAddr()},
+		User:       sc.user,
+	}
+
+	addrStr, err := readTCPRequest(stream)
+	if err != nil {
+		if ce := utils.CanLogWarn("hysteria2 read tcp request failed"); ce != nil {
+			ce.Write(zap.String("from", sc.RemoteAddr().String()), zap.Error(err))
+		}
+		conn.Close()
+		return
+	}
+	target, err := netLayer.NewAddr(addrStr)
+	if err != nil {
+		writeTCPResponse(stream, false, err.Error())
+		conn.Close()
+		return
+	}
+	target.Network = "tcp"
+
+	if err = writeTCPResponse(stream, true, ""); err != nil {
+		conn.Close()
+		return
+	}
+
+	sc.tcpFunc(netLayer.TCPRequestInfo{Conn: conn, Target: target})
+}
+
+func (sc *serverConn) receiveDatagrams() {
+	for {
+		bs, err := sc.ReceiveMessage()
+		if err != nil {
+			break
+		}
+		m, err := parseUDPMessage(bs)
+		if err != nil {
+			continue
+		}
+
+		sc.udpMutex.Lock()
+		u := sc.udpSessions[m.sessionID]
+		if u == nil {
+			id := m.sessionID
+			u = &serverUDPConn{
+				udpConn: newUDPConn(sc.Connection, id, func() {
+					sc.udpMutex.Lock()
+					delete(sc.udpSessions, id)
+					sc.udpMutex.Unlock()
+				}),
+				User: sc.user,
+			}
+			sc.udpSessions[id] = u
+		}
+		sc.udpMutex.Unlock()
+
+		if target, ok := u.feed(m); ok && !u.started {
+			//收到 第一个 完整的 包 后 才 交给 vs 处理
+			u.started = true
+
+			go sc.udpFunc(netLayer.UDPRequestInfo{
+				MsgConn: u,
+				Target:  target,
+				Source:  sc.RemoteAddr(),
+			})
+		}
+	}
+
+	sc.udpMutex.Lock()
+	sessions := sc.udpSessions
+	sc.udpSessions = make(map[uint32]*serverUDPConn)
+	sc.udpMutex.Unlock()
+
+	for _, u := range sessions {
+		u.Close()
+	}
+}
+
+// 实现 utils.User, 使 按 user 的 分流 与 流量统计 可用
+type serverStream struct {
+	streamConn
+	utils.User
+}
+
+type serverUDPConn struct {
+	*udpConn
+	utils.User
+
+	started bool //只在 datagram 循环 中 使用
+}
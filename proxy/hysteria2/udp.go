@@ -0,0 +1,135 @@
+package hysteria2
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// udpConn 是 一个 udp会话, 客户端 与 服务端 共用. 读取 由 所属 quic连接 的 datagram 循环 推送.
+//
+// implements netLayer.MsgConn
+type udpConn struct {
+	netLayer.EasyDeadline
+
+	sessionID uint32
+	conn      quic.Connection
+	packetID  atomic.Uint32
+
+	defrag defragger //只在 datagram 循环 中 使用
+
+	readChan  chan netLayer.AddrData
+	closeChan chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func newUDPConn(conn quic.Connection, sessionID uint32, onClose func()) *udpConn {
+	u := &udpConn{
+		sessionID: sessionID,
+		conn:      conn,
+		readChan:  make(chan netLayer.AddrData, 64),
+		closeChan: make(chan struct{}),
+		onClose:   onClose,
+	}
+	u.InitEasyDeadline()
+	return u
+}
+
+// 在 datagram 循环 中 调用, 得到了 完整的 包 时 返回 其 地址 与 true
+func (u *udpConn) feed(m udpMessage) (addr netLayer.Addr, ok bool) {
+	whole := u.defrag.feed(m)
+	if whole == nil {
+		return
+	}
+	addr, err := netLayer.NewAddr(whole.addr)
+	if err != nil {
+		if ce := utils.CanLogDebug("hysteria2 got bad udp addr"); ce != nil {
+			ce.Write(zap.String("addr", whole.addr), zap.Error(err))
+		}
+		return
+	}
+	addr.Network = "udp"
+
+	select {
+	case u.readChan <- netLayer.AddrData{Data: whole.data, Addr: addr}:
+	case <-u.closeChan:
+	default: //读取 不及时 时 丢弃, 与 udp 的 语义 一致
+	}
+	return addr, true
+}
+
+func (u *udpConn) ReadMsg() ([]byte, netLayer.Addr, error) {
+	must_timeoutChan := time.After(netLayer.UDP_timeout)
+	select {
+	case <-u.closeChan:
+		return nil, netLayer.Addr{}, io.EOF
+	case <-u.ReadTimeoutChan():
+		return nil, netLayer.Addr{}, os.ErrDeadlineExceeded
+	case <-must_timeoutChan:
+		return nil, netLayer.Addr{}, os.ErrDeadlineExceeded
+	case msg := <-u.readChan:
+		return msg.Data, msg.Addr, nil
+	}
+}
+
+func (u *udpConn) WriteMsg(p []byte, peer netLayer.Addr) error {
+	select {
+	case <-u.closeChan:
+		return net.ErrClosed
+	case <-u.WriteTimeoutChan():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+
+	m := udpMessage{
+		sessionID: u.sessionID,
+		packetID:  uint16(u.packetID.Inc()),
+		fragCount: 1,
+		addr:      peer.String(),
+		data:      p,
+	}
+	err := u.conn.SendMessage(m.bytes())
+
+	var tooLarge quic.ErrMessageToLarge
+	if !errors.As(err, &tooLarge) {
+		return err
+	}
+	frags := fragUDPMessage(m, int(tooLarge))
+	if len(frags) == 0 {
+		return utils.ErrInErr{ErrDesc: "hysteria2: udp packet too long", Data: len(p)}
+	}
+	for _, frag := range frags {
+		if err = u.conn.SendMessage(frag.bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *udpConn) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return u.Close()
+}
+
+func (u *udpConn) Close() error {
+	u.closeOnce.Do(func() {
+		close(u.closeChan)
+		if u.onClose != nil {
+			u.onClose()
+		}
+	})
+	return nil
+}
+
+func (u *udpConn) Fullcone() bool {
+	return false
+}
@@ -0,0 +1,296 @@
+package innerMux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/atomic"
+	"golang.org/x/net/http2"
+)
+
+// h2mux 同 sing-mux: 每条流 是 一个 CONNECT 请求, 请求体/响应体 为 双向的 原始数据流.
+
+type h2muxClient struct {
+	cc         *http2.ClientConn
+	numStreams atomic.Int32
+}
+
+func newH2muxClient(conn net.Conn) (Session, error) {
+	cc, err := (&http2.Transport{DisableCompression: true}).NewClientConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &h2muxClient{cc: cc}, nil
+}
+
+func (s *h2muxClient) OpenStream() (net.Conn, error) {
+	if !s.cc.CanTakeNewRequest() {
+		return nil, errors.New("h2mux: session can't take new stream")
+	}
+	reader, writer := io.Pipe()
+
+	c := &h2muxClientConn{
+		session: s,
+		request: &http.Request{
+			Method:        http.MethodConnect,
+			URL:           &url.URL{Scheme: "https", Host: "localhost"},
+			Header:        make(http.Header),
+			Body:          reader,
+			ContentLength: -1,
+		},
+		writer: writer,
+		ready:  make(chan struct{}),
+	}
+	c.InitEasyDeadline()
+	s.numStreams.Inc()
+
+	go c.roundTrip()
+
+	return c, nil
+}
+
+func (s *h2muxClient) AcceptStream() (net.Conn, error) {
+	return nil, errors.New("h2mux: client session can't accept stream")
+}
+
+func (s *h2muxClient) NumStreams() int {
+	return int(s.numStreams.Load())
+}
+
+func (s *h2muxClient) IsClosed() bool {
+	st := s.cc.State()
+	return st.Closed || st.Closing
+}
+
+func (s *h2muxClient) Close() error {
+	return s.cc.Close()
+}
+
+// implements net.Conn
+type h2muxClientConn struct {
+	netLayer.EasyDeadline
+
+	session *h2muxClient
+	request *http.Request
+	writer  *io.PipeWriter
+
+	ready    chan struct{}
+	response *http.Response
+	err      error
+
+	closeOnce sync.Once
+}
+
+func (c *h2muxClientConn) LocalAddr() net.Addr  { return nil }
+func (c *h2muxClientConn) RemoteAddr() net.Addr { return nil }
+
+func (c *h2muxClientConn) roundTrip() {
+	defer close(c.ready)
+
+	response, err := c.session.cc.RoundTrip(c.request)
+	if err != nil {
+		c.err = err
+		c.writer.CloseWithError(err)
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		c.err = utils.ErrInErr{ErrDesc: "h2mux got wrong status", Data: response.Status}
+		c.writer.CloseWithError(c.err)
+		return
+	}
+	c.response = response
+}
+
+func (c *h2muxClientConn) Read(b []byte) (n int, err error) {
+	select {
+	case <-c.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.ready:
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.response.Body.Read(b)
+}
+
+func (c *h2muxClientConn) Write(b []byte) (n int, err error) {
+	select {
+	case <-c.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return c.writer.Write(b)
+	}
+}
+
+func (c *h2muxClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.session.numStreams.Dec()
+		c.writer.Close()
+
+		go func() {
+			<-c.ready
+			if c.response != nil {
+				c.response.Body.Close()
+			}
+		}()
+	})
+	return nil
+}
+
+type h2muxServer struct {
+	conn   net.Conn
+	server http2.Server
+
+	conns      chan net.Conn
+	numStreams atomic.Int32
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newH2muxServer(conn net.Conn) Session {
+	s := &h2muxServer{
+		conn:   conn,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	go func() {
+		s.server.ServeConn(conn, &http2.ServeConnOpts{Handler: s})
+		s.Close()
+	}()
+	return s
+}
+
+func (s *h2muxServer) ServeHTTP(rw http.ResponseWriter, rq *http.Request) {
+	if rq.Method != http.MethodConnect {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.(http.Flusher).Flush()
+
+	sc := &h2muxServerConn{
+		Reader: rq.Body,
+		Closer: rq.Body,
+		rw:     rw,
+		done:   make(chan struct{}),
+	}
+	sc.InitEasyDeadline()
+
+	select {
+	case s.conns <- sc:
+	case <-s.closed:
+		return
+	}
+
+	s.numStreams.Inc()
+	defer s.numStreams.Dec()
+
+	//handler 返回后 rw 不可再用, 所以 要等到 流 关闭
+	select {
+	case <-sc.done:
+	case <-rq.Context().Done():
+		sc.Close()
+	}
+}
+
+func (s *h2muxServer) OpenStream() (net.Conn, error) {
+	return nil, errors.New("h2mux: server session can't open stream")
+}
+
+func (s *h2muxServer) AcceptStream() (net.Conn, error) {
+	select {
+	case c := <-s.conns:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *h2muxServer) NumStreams() int {
+	return int(s.numStreams.Load())
+}
+
+func (s *h2muxServer) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *h2muxServer) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+	})
+	return nil
+}
+
+// implements net.Conn
+type h2muxServerConn struct {
+	netLayer.EasyDeadline
+	io.Reader
+	io.Closer
+
+	rw http.ResponseWriter
+
+	writeMutex sync.Mutex
+	closed     bool
+	closeOnce  sync.Once
+	done       chan struct{}
+}
+
+func (sc *h2muxServerConn) LocalAddr() net.Addr  { return nil }
+func (sc *h2muxServerConn) RemoteAddr() net.Addr { return nil }
+
+func (sc *h2muxServerConn) Read(p []byte) (int, error) {
+	select {
+	case <-sc.ReadTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return sc.Reader.Read(p)
+	}
+}
+
+func (sc *h2muxServerConn) Write(p []byte) (n int, err error) {
+	select {
+	case <-sc.WriteTimeoutChan():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+
+	//handler 返回后 调用 rw 会 panic
+	if sc.closed {
+		return 0, net.ErrClosed
+	}
+	n, err = sc.rw.Write(p)
+	if err == nil {
+		sc.rw.(http.Flusher).Flush()
+	}
+	return
+}
+
+func (sc *h2muxServerConn) Close() error {
+	sc.closeOnce.Do(func() {
+		sc.writeMutex.Lock()
+		sc.closed = true
+		sc.writeMutex.Unlock()
+
+		sc.Closer.Close()
+		close(sc.done)
+	})
+	return nil
+}
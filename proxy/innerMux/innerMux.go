@@ -0,0 +1,181 @@
+/*
+Package innerMux 定义 内层mux 的 会话接口, 并提供 smux, yamux, h2mux 三种实现.
+
+内层mux 指的是 在 代理层 握手之后, 在 代理连接 内部 再进行 多路复用, 与 高级层 的 mux (grpc, quic 等) 不同.
+
+# 传统模式
+
+vless v1 / trojan / vmess 的 mux 命令 开启的 内层mux 使用 smux v1 (smux.DefaultConfig), 内层代理协议 为 simplesocks, 兼容 trojan-go.
+
+# sing-mux
+
+Conf.Protocol 不为空 时, 使用 sing-mux 协议, 兼容 sing-box 的 multiplex.
+
+此时 外层 代理握手 的 目标 为 sp.mux.sing-box.arpa:444, 握手后 先发送 sing-mux 的 会话请求头 (版本, mux协议, 是否填充),
+然后才是 所选 mux协议 的 数据. 每一条 流 以 sing-mux 的 流请求 开头, 见 proxy/singmux.
+
+sing-mux 不依赖 外层代理协议 的 mux 命令, 所以 任何 代理协议 都可以使用.
+
+# Mux.Cool
+
+Conf.Protocol 为 muxcool 时, 使用 v2ray/xray 的 Mux.Cool 协议, 支持 XUDP, 见 muxcool.go.
+
+vmess 与 vless v0 以 mux 命令 开启 Mux.Cool, 兼容 v2ray/xray; 其它 代理协议 以 v1.mux.cool:9527 为 目标 开启.
+内层 没有 代理协议 握手, 每一条 流 的 目标 在 Mux.Cool 的 帧 中 给出, 对应的 内层代理 见 proxy/muxcool.
+
+# Config
+
+在 dial 中 以 mux_conf 给出, 需要同时 给出 mux = true:
+
+	mux = true
+	mux_conf = { protocol = "h2mux", max_streams = 8, idle_timeout = 60, padding = true }
+
+max_connections, max_streams, idle_timeout 对 传统模式 也有效.
+*/
+package innerMux
+
+import (
+	"io"
+	"net"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const (
+	Smux  = "smux"
+	Yamux = "yamux"
+	H2mux = "h2mux"
+
+	MuxCool = "muxcool"
+)
+
+// Session 是 一个 mux连接. 所有实现 在 底层连接 断开后 IsClosed 都会返回 true.
+type Session interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
+
+// Conf 为 内层mux 的 配置.
+type Conf struct {
+	Protocol string `toml:"protocol"` //可为 smux, yamux, h2mux, muxcool; 不给出时 使用 传统模式, muxcool 使用 Mux.Cool, 其它 使用 sing-mux.
+
+	MaxConnections int `toml:"max_connections"` //最多同时存在的 mux连接数. 为0时 若 max_streams 也为0 则只使用一个连接, 否则不限制.
+	MaxStreams     int `toml:"max_streams"`     //每个 mux连接 的 最大流数, 所有连接 都满后 新建连接. 0 表示不限制.
+	IdleTimeout    int `toml:"idle_timeout"`    //秒; 没有任何流的 mux连接 超过该时间后 被关闭. 0 表示不关闭.
+
+	Padding bool `toml:"padding"` //仅 sing-mux 有效, 对应 sing-box 的 padding 选项.
+}
+
+// 是否使用 sing-mux
+func (c *Conf) IsSingMux() bool {
+	return c != nil && c.Protocol != "" && c.Protocol != MuxCool
+}
+
+// 是否使用 Mux.Cool
+func (c *Conf) IsMuxCool() bool {
+	return c != nil && c.Protocol == MuxCool
+}
+
+// 是否使用 传统模式 (smux+simplesocks)
+func (c *Conf) IsTraditional() bool {
+	return c == nil || c.Protocol == ""
+}
+
+// 返回 所使用的 mux协议 名称
+func (c *Conf) GetProtocol() string {
+	if c == nil || c.Protocol == "" {
+		return Smux
+	}
+	return c.Protocol
+}
+
+func (c *Conf) Check() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Protocol = strings.ToLower(c.Protocol); c.Protocol {
+	case "", Smux, Yamux, H2mux, MuxCool:
+	default:
+		return utils.ErrInErr{ErrDesc: "innerMux: unknown protocol", Data: c.Protocol}
+	}
+	if c.MaxConnections < 0 || c.MaxStreams < 0 || c.IdleTimeout < 0 {
+		return utils.ErrInErr{ErrDesc: "innerMux: negative value in conf", Data: *c}
+	}
+	if c.Padding && !c.IsSingMux() {
+		return utils.ErrInErr{ErrDesc: "innerMux: padding is only supported by sing-mux, protocol must be given"}
+	}
+	return nil
+}
+
+// NewClientSession 在 已握手好的 代理连接 rwc 上 建立 客户端 mux会话. conf 为 nil 或 Protocol 为空 时 使用 传统模式.
+func NewClientSession(rwc io.ReadWriteCloser, conf *Conf) (Session, error) {
+	if conf.IsTraditional() {
+		return newSmuxClient(rwc, false)
+	}
+	if conf.IsMuxCool() {
+		return NewMuxCoolClientSession(rwc), nil
+	}
+
+	protocol, ok := singMuxProtocolFromName(conf.Protocol)
+	if !ok {
+		return nil, utils.ErrInErr{ErrDesc: "innerMux: unknown protocol", Data: conf.Protocol}
+	}
+	if err := writeSingMuxRequest(rwc, protocol, conf.Padding); err != nil {
+		return nil, err
+	}
+	conn := toNetConn(rwc)
+	if conf.Padding {
+		conn = newPaddingConn(conn)
+	}
+	switch protocol {
+	case singMuxProtocolSmux:
+		return newSmuxClient(conn, true)
+	case singMuxProtocolYamux:
+		return newYamuxClient(conn)
+	default:
+		return newH2muxClient(conn)
+	}
+}
+
+// NewServerSession 建立 传统模式 的 服务端 mux会话
+func NewServerSession(rwc io.ReadWriteCloser) (Session, error) {
+	return newSmuxServer(rwc, false)
+}
+
+// NewSingMuxServerSession 读取 sing-mux 会话请求头, 并 建立 对应的 服务端 mux会话.
+// 调用者 应先用 IsSingMuxAddr 判断 代理握手 所得到的 目标地址.
+func NewSingMuxServerSession(rwc io.ReadWriteCloser) (Session, error) {
+	protocol, padding, err := readSingMuxRequest(rwc)
+	if err != nil {
+		return nil, err
+	}
+	conn := toNetConn(rwc)
+	if padding {
+		conn = newPaddingConn(conn)
+	}
+	switch protocol {
+	case singMuxProtocolSmux:
+		return newSmuxServer(conn, true)
+	case singMuxProtocolYamux:
+		return newYamuxServer(conn)
+	default:
+		return newH2muxServer(conn), nil
+	}
+}
+
+// h2mux 需要 net.Conn, 而 代理层 握手 得到的 不一定是
+func toNetConn(rwc io.ReadWriteCloser) net.Conn {
+	if c, ok := rwc.(net.Conn); ok {
+		return c
+	}
+	return &netLayer.IOWrapper{
+		Reader: rwc,
+		Writer: rwc,
+		Closer: rwc,
+	}
+}
@@ -0,0 +1,232 @@
+package innerMux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+func TestSessions(t *testing.T) {
+	for _, conf := range []*Conf{
+		nil,
+		{Protocol: Smux},
+		{Protocol: Yamux},
+		{Protocol: H2mux},
+		{Protocol: Smux, Padding: true},
+		{Protocol: H2mux, Padding: true},
+	} {
+		t.Run(conf.GetProtocol(), func(t *testing.T) {
+			testSession(t, conf)
+		})
+	}
+}
+
+func testSession(t *testing.T, conf *Conf) {
+	listener, err := net.Listen("tcp", netLayer.GetRandLocalAddr(true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		var s Session
+		if conf.IsSingMux() {
+			s, err = NewSingMuxServerSession(conn)
+		} else {
+			s, err = NewServerSession(conn)
+		}
+		if err != nil {
+			t.Log(err)
+			conn.Close()
+			return
+		}
+		for {
+			stream, err := s.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := NewClientSession(conn, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	const streamCount = 3
+	done := make(chan error, streamCount)
+	for i := 0; i < streamCount; i++ {
+		stream, err := session.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			defer stream.Close()
+
+			data := make([]byte, 100*1024)
+			rand.Read(data)
+			go stream.Write(data)
+
+			got := make([]byte, len(data))
+			stream.SetReadDeadline(time.Now().Add(time.Second * 10))
+			if _, err := io.ReadFull(stream, got); err != nil {
+				done <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				done <- io.ErrUnexpectedEOF
+				return
+			}
+			done <- nil
+		}()
+	}
+	for i := 0; i < streamCount; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if session.IsClosed() {
+		t.Fatal("session closed unexpectedly")
+	}
+}
+
+func TestSingMuxRequest(t *testing.T) {
+	for _, padding := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := writeSingMuxRequest(&buf, singMuxProtocolYamux, padding); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("rest")
+
+		protocol, gotPadding, err := readSingMuxRequest(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protocol != singMuxProtocolYamux || gotPadding != padding || buf.String() != "rest" {
+			t.Fatal("sing-mux request not match", protocol, gotPadding, buf.String())
+		}
+	}
+
+	if _, _, err := readSingMuxRequest(bytes.NewReader([]byte{2, 0})); err == nil {
+		t.Fatal("should fail on unknown version")
+	}
+}
+
+type fakeSession struct {
+	streams int
+	closed  bool
+}
+
+func (s *fakeSession) OpenStream() (net.Conn, error)   { return nil, nil }
+func (s *fakeSession) AcceptStream() (net.Conn, error) { return nil, nil }
+func (s *fakeSession) NumStreams() int                 { return s.streams }
+func (s *fakeSession) IsClosed() bool                  { return s.closed }
+func (s *fakeSession) Close() error                    { s.closed = true; return nil }
+
+func TestPool(t *testing.T) {
+	//默认 只使用 一个 连接
+	p := NewPool(nil)
+	if p.Get() != nil {
+		t.Fatal("empty pool should return nil")
+	}
+	s1 := &fakeSession{streams: 5}
+	p.Add(s1)
+	if p.Get() != s1 {
+		t.Fatal("default pool should reuse the only session")
+	}
+	s1.closed = true
+	if p.Get() != nil || p.Len() != 0 {
+		t.Fatal("closed session should be removed")
+	}
+
+	//max_streams: 满了 之后 新建
+	p = NewPool(&Conf{MaxStreams: 2})
+	s1 = &fakeSession{streams: 1}
+	p.Add(s1)
+	if p.Get() != s1 {
+		t.Fatal("should fill the session first")
+	}
+	s1.streams = 2
+	if p.Get() != nil {
+		t.Fatal("should dial new session when all are full")
+	}
+
+	//max_connections: 达到 之前 分散 到 新连接, 达到后 使用 流数 最少 的
+	p = NewPool(&Conf{MaxConnections: 2})
+	s1 = &fakeSession{streams: 1}
+	p.Add(s1)
+	if p.Get() != nil {
+		t.Fatal("should dial new session under max_connections")
+	}
+	s2 := &fakeSession{streams: 3}
+	p.Add(s2)
+	if p.Get() != s1 {
+		t.Fatal("should use the least loaded session when max_connections reached")
+	}
+
+	p.Close()
+	if !s1.closed || !s2.closed {
+		t.Fatal("Close should close all sessions")
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	p := NewPool(&Conf{IdleTimeout: 1})
+	s := &fakeSession{}
+	busy := &fakeSession{streams: 1}
+	p.Add(s)
+	p.Add(busy)
+
+	time.Sleep(time.Millisecond * 3500)
+	if p.Len() != 1 || !s.closed || busy.closed {
+		t.Fatal("idle session should be closed", s.closed, busy.closed)
+	}
+	p.Close()
+}
+
+// 刚被 Get 返回 的 空闲会话 不应 被 清理, 因为 调用者 马上 就要 在 其上 打开 流
+func TestPoolSweepSkipsHandedOut(t *testing.T) {
+	timeout := time.Second
+	p := NewPool(&Conf{IdleTimeout: 1})
+	s := &fakeSession{}
+	p.sessions = append(p.sessions, &pooledSession{Session: s, idleSince: time.Now().Add(-2 * timeout)})
+
+	if p.Get() != s {
+		t.Fatal("should get the idle session")
+	}
+	now := time.Now()
+	p.mutex.Lock()
+	p.sweep(now, timeout)
+	p.sweep(now.Add(timeout/2), timeout)
+	p.mutex.Unlock()
+	if s.closed {
+		t.Fatal("handed out session should not be closed")
+	}
+
+	//之后 一直 没有流, 依然 会被 清理
+	p.mutex.Lock()
+	p.sweep(now.Add(timeout*2), timeout)
+	p.sweep(now.Add(timeout*3), timeout)
+	p.mutex.Unlock()
+	if !s.closed {
+		t.Fatal("idle session should be closed after timeout")
+	}
+}
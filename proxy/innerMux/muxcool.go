@@ -0,0 +1,716 @@
+package innerMux
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+/*
+Mux.Cool 是 v2ray/xray 的 mux 协议, 由 vmess/vless 的 mux 命令 (3) 开启, 此时 外层 握手 没有 地址;
+其它 代理协议 则以 v1.mux.cool 为 目标 开启.
+
+每一帧 为 元数据长度(2) | 元数据 | [数据长度(2) | 数据], 元数据 为:
+
+	会话id(2) | 状态(1) | 选项(1) | [网络(1) | 端口(2) | 地址类型(1) | 地址] | [XUDP GlobalID(8)]
+
+状态 为 New 时 带有 地址; udp 的 Keep 帧 也可以 带有 地址, 用于 fullcone. 选项 为 1 时 带有 数据, 为 2 时 表示 出错.
+
+XUDP 是 xray 对 Mux.Cool 的 扩展: udp 会话 的 New 帧 带有 8字节的 GlobalID, 客户端 换了 mux连接 后
+用 同一个 GlobalID 新建 会话 时, 服务端 会 继续 使用 原来的 udp会话, 于是 出口 的 端口 保持不变 (fullcone).
+
+See https://www.v2fly.org/developer/protocols/muxcool.html and https://github.com/XTLS/Xray-core/discussions/252
+*/
+
+const (
+	muxCoolStatusNew       byte = 1
+	muxCoolStatusKeep      byte = 2
+	muxCoolStatusEnd       byte = 3
+	muxCoolStatusKeepAlive byte = 4
+
+	muxCoolOptionData  byte = 1
+	muxCoolOptionError byte = 2
+
+	muxCoolNetworkTCP byte = 1
+	muxCoolNetworkUDP byte = 2
+
+	muxCoolDomain = "v1.mux.cool"
+	muxCoolPort   = 9527
+
+	muxCoolMaxMetaLen = 512
+	muxCoolMaxData    = 8192 //tcp数据 每一帧 最多 这么长, 与 v2ray 相同
+
+	//每个 流 最多 缓存 这么多 帧 尚未被读取 的 数据. 满了 之后 udp 丢弃 新的包, tcp 关闭 该流,
+	// 与 xray 相同, 以免 一个 读得慢的 流 阻塞 整个 mux连接 的 读取.
+	muxCoolStreamBufferFrames = 64
+
+	xudpGlobalIDLen = 8
+
+	//mux连接 断开 后, 带有 GlobalID 的 udp会话 保留 这么久, 等待 客户端 用 新的 mux连接 恢复
+	xudpKeepTime = time.Minute
+)
+
+// 代理层 握手 的 目标 为 该地址 时, 表示 之后 的 数据 为 Mux.Cool
+func MuxCoolAddr() netLayer.Addr {
+	return netLayer.Addr{Name: muxCoolDomain, Port: muxCoolPort, Network: "tcp"}
+}
+
+func IsMuxCoolAddr(a netLayer.Addr) bool {
+	return a.Name == muxCoolDomain
+}
+
+type muxCoolFrame struct {
+	id     uint16
+	status byte
+	option byte
+
+	network  byte //为0 时 不带 地址
+	target   netLayer.Addr
+	globalID [xudpGlobalIDLen]byte //全为0 时 不写入
+
+	data []byte
+}
+
+func (f *muxCoolFrame) writeTo(buf *bytes.Buffer) {
+	metaStart := buf.Len()
+	buf.Write([]byte{0, 0}) //元数据长度, 最后 填入
+	binary.Write(buf, binary.BigEndian, f.id)
+	buf.WriteByte(f.status)
+	buf.WriteByte(f.option)
+	if f.network != 0 {
+		buf.WriteByte(f.network)
+		binary.Write(buf, binary.BigEndian, uint16(f.target.Port))
+		addr, atyp := f.target.AddressBytes()
+		buf.WriteByte(atyp)
+		buf.Write(addr)
+
+		if f.status == muxCoolStatusNew && f.globalID != [xudpGlobalIDLen]byte{} {
+			buf.Write(f.globalID[:])
+		}
+	}
+	binary.BigEndian.PutUint16(buf.Bytes()[metaStart:], uint16(buf.Len()-metaStart-2))
+
+	if f.option&muxCoolOptionData != 0 {
+		binary.Write(buf, binary.BigEndian, uint16(len(f.data)))
+		buf.Write(f.data)
+	}
+}
+
+func readMuxCoolFrame(r io.Reader) (f muxCoolFrame, err error) {
+	var lenbs [2]byte
+	if _, err = io.ReadFull(r, lenbs[:]); err != nil {
+		return
+	}
+	metaLen := int(binary.BigEndian.Uint16(lenbs[:]))
+	if metaLen < 4 || metaLen > muxCoolMaxMetaLen {
+		err = utils.ErrInErr{ErrDesc: "muxcool: invalid metadata length", ErrDetail: utils.ErrInvalidData, Data: metaLen}
+		return
+	}
+	meta := make([]byte, metaLen)
+	if _, err = io.ReadFull(r, meta); err != nil {
+		return
+	}
+	f.id = binary.BigEndian.Uint16(meta)
+	f.status = meta[2]
+	f.option = meta[3]
+
+	if metaLen > 4 && (f.status == muxCoolStatusNew || f.status == muxCoolStatusKeep) {
+		f.network = meta[4]
+		if f.network != muxCoolNetworkTCP && f.network != muxCoolNetworkUDP {
+			err = utils.ErrInErr{ErrDesc: "muxcool: unknown network", ErrDetail: utils.ErrInvalidData, Data: f.network}
+			return
+		}
+		mr := bytes.NewReader(meta[5:])
+		if f.target, err = netLayer.V2rayGetAddrFrom(mr); err != nil {
+			err = utils.ErrInErr{ErrDesc: "muxcool: read target failed", ErrDetail: err}
+			return
+		}
+		if f.network == muxCoolNetworkUDP {
+			f.target.Network = "udp"
+			if f.status == muxCoolStatusNew && mr.Len() >= xudpGlobalIDLen {
+				mr.Read(f.globalID[:])
+			}
+		} else {
+			f.target.Network = "tcp"
+		}
+	} else if f.status == muxCoolStatusNew {
+		err = utils.ErrInErr{ErrDesc: "muxcool: new frame without target", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+
+	if f.option&muxCoolOptionData != 0 {
+		if _, err = io.ReadFull(r, lenbs[:]); err != nil {
+			return
+		}
+		f.data = make([]byte, binary.BigEndian.Uint16(lenbs[:]))
+		_, err = io.ReadFull(r, f.data)
+	}
+	return
+}
+
+// 服务端 所有 mux连接 共享, 以 GlobalID 找到 可以 恢复 的 udp会话
+var xudpStreams = struct {
+	sync.Mutex
+	m map[[xudpGlobalIDLen]byte]*MuxCoolStream
+}{m: make(map[[xudpGlobalIDLen]byte]*MuxCoolStream)}
+
+type muxCoolSession struct {
+	conn     io.ReadWriteCloser
+	isClient bool
+
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	streams map[uint16]*MuxCoolStream
+	nextID  uint16
+	closed  bool
+
+	acceptChan chan *MuxCoolStream
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+}
+
+// 在 已握手好的 代理连接 rwc 上 建立 Mux.Cool 客户端 会话
+func NewMuxCoolClientSession(rwc io.ReadWriteCloser) Session {
+	return newMuxCoolSession(rwc, true)
+}
+
+// 在 目标 为 MuxCoolAddr 的 代理连接 rwc 上 建立 Mux.Cool 服务端 会话
+func NewMuxCoolServerSession(rwc io.ReadWriteCloser) Session {
+	return newMuxCoolSession(rwc, false)
+}
+
+func newMuxCoolSession(rwc io.ReadWriteCloser, isClient bool) *muxCoolSession {
+	s := &muxCoolSession{
+		conn:       rwc,
+		isClient:   isClient,
+		streams:    make(map[uint16]*MuxCoolStream),
+		acceptChan: make(chan *MuxCoolStream, 16),
+		closeChan:  make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// 客户端 打开的 流 要 先 调用 MuxCoolStream.Start
+func (s *muxCoolSession) OpenStream() (net.Conn, error) {
+	if !s.isClient {
+		return nil, utils.ErrUnImplemented
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		if _, has := s.streams[s.nextID]; !has {
+			break
+		}
+	}
+	ms := newMuxCoolStream(s, s.nextID)
+	s.streams[ms.id] = ms
+	return ms, nil
+}
+
+func (s *muxCoolSession) AcceptStream() (net.Conn, error) {
+	select {
+	case ms := <-s.acceptChan:
+		return ms, nil
+	case <-s.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *muxCoolSession) NumStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxCoolSession) IsClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *muxCoolSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.mutex.Lock()
+		s.closed = true
+		streams := s.streams
+		s.streams = make(map[uint16]*MuxCoolStream)
+		s.mutex.Unlock()
+
+		close(s.closeChan)
+		s.conn.Close()
+
+		for _, ms := range streams {
+			ms.sessionClosed(s)
+		}
+	})
+	return nil
+}
+
+func (s *muxCoolSession) writeFrame(f *muxCoolFrame) error {
+	buf := utils.GetBuf()
+	f.writeTo(buf)
+
+	s.writeMutex.Lock()
+	_, err := s.conn.Write(buf.Bytes())
+	s.writeMutex.Unlock()
+
+	utils.PutBuf(buf)
+	return err
+}
+
+func (s *muxCoolSession) getStream(id uint16) *MuxCoolStream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxCoolSession) removeStream(ms *MuxCoolStream, id uint16) {
+	s.mutex.Lock()
+	if s.streams[id] == ms {
+		delete(s.streams, id)
+	}
+	s.mutex.Unlock()
+}
+
+func (s *muxCoolSession) readLoop() {
+	defer s.Close()
+
+	r := bufio.NewReader(s.conn)
+	for {
+		f, err := readMuxCoolFrame(r)
+		if err != nil {
+			if ce := utils.CanLogDebug("muxcool session ended"); ce != nil {
+				ce.Write(zap.Bool("isClient", s.isClient), zap.Error(err))
+			}
+			return
+		}
+
+		switch f.status {
+		case muxCoolStatusNew:
+			if s.isClient {
+				continue
+			}
+			s.handleNew(f)
+
+		case muxCoolStatusKeep:
+			if ms := s.getStream(f.id); ms != nil {
+				ms.push(f)
+			} else {
+				//与 v2ray 相同, 告诉 对方 该会话 已经 不存在
+				s.writeFrame(&muxCoolFrame{id: f.id, status: muxCoolStatusEnd, option: muxCoolOptionError})
+			}
+
+		case muxCoolStatusEnd:
+			if ms := s.getStream(f.id); ms != nil {
+				s.removeStream(ms, f.id)
+				ms.remoteEnd()
+			}
+
+		case muxCoolStatusKeepAlive:
+
+		default:
+			if ce := utils.CanLogWarn("muxcool got unknown status"); ce != nil {
+				ce.Write(zap.Uint8("status", f.status))
+			}
+			return
+		}
+	}
+}
+
+func (s *muxCoolSession) handleNew(f muxCoolFrame) {
+	xudp := f.network == muxCoolNetworkUDP && f.globalID != [xudpGlobalIDLen]byte{}
+
+	if xudp {
+		xudpStreams.Lock()
+		ms := xudpStreams.m[f.globalID]
+		xudpStreams.Unlock()
+
+		if ms != nil && ms.rebind(s, f.id) {
+			if ce := utils.CanLogDebug("xudp session resumed"); ce != nil {
+				ce.Write(zap.String("target", ms.target.String()))
+			}
+			if len(f.data) > 0 {
+				ms.push(f)
+			}
+			return
+		}
+	}
+
+	ms := newMuxCoolStream(s, f.id)
+	ms.network = f.network
+	ms.target = f.target
+	ms.started = true
+	if xudp {
+		ms.globalID = f.globalID
+
+		xudpStreams.Lock()
+		xudpStreams.m[f.globalID] = ms
+		xudpStreams.Unlock()
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		ms.Close()
+		return
+	}
+	s.streams[f.id] = ms
+	s.mutex.Unlock()
+
+	if len(f.data) > 0 {
+		ms.push(f)
+	}
+
+	select {
+	case s.acceptChan <- ms:
+	case <-s.closeChan:
+	}
+}
+
+type muxCoolPacket struct {
+	data []byte
+	addr netLayer.Addr
+}
+
+// Mux.Cool 的 一个 会话. tcp 会话 作为 net.Conn 使用, udp 会话 作为 netLayer.MsgConn 使用.
+//
+// 服务端 accept 到的 流 已经 带有 目标; 客户端 open 的 流 要 先 调用 Start.
+type MuxCoolStream struct {
+	netLayer.EasyDeadline
+
+	mutex   sync.Mutex
+	session *muxCoolSession //xudp 的 会话 可能 换到 另一个 mux连接 上; 为 nil 时 正在 等待 恢复
+	id      uint16
+	started bool
+
+	network  byte
+	target   netLayer.Addr
+	globalID [xudpGlobalIDLen]byte
+
+	readChan  chan muxCoolPacket
+	remain    []byte
+	eofChan   chan struct{}
+	eofOnce   sync.Once
+	closeChan chan struct{}
+	closeOnce sync.Once
+
+	detachTimer *time.Timer
+}
+
+func newMuxCoolStream(s *muxCoolSession, id uint16) *MuxCoolStream {
+	ms := &MuxCoolStream{
+		session:   s,
+		id:        id,
+		readChan:  make(chan muxCoolPacket, muxCoolStreamBufferFrames),
+		eofChan:   make(chan struct{}),
+		closeChan: make(chan struct{}),
+	}
+	ms.InitEasyDeadline()
+	return ms
+}
+
+// 会话 的 目标, 对于 udp 为 第一个包 的 目标
+func (ms *MuxCoolStream) Target() netLayer.Addr {
+	return ms.target
+}
+
+func (ms *MuxCoolStream) IsUDP() bool {
+	return ms.network == muxCoolNetworkUDP
+}
+
+// 客户端 发送 New帧. udp 会话 会 带上 随机的 GlobalID, 使 xray 服务端 使用 fullcone 的 XUDP.
+func (ms *MuxCoolStream) Start(target netLayer.Addr, firstPayload []byte) error {
+	ms.mutex.Lock()
+	if ms.started {
+		ms.mutex.Unlock()
+		return utils.ErrInErr{ErrDesc: "muxcool: stream already started", Data: ms.id}
+	}
+	ms.started = true
+	ms.target = target
+	f := muxCoolFrame{
+		id:      ms.id,
+		status:  muxCoolStatusNew,
+		network: muxCoolNetworkTCP,
+		target:  target,
+	}
+	if target.IsUDP() {
+		ms.network = muxCoolNetworkUDP
+		f.network = muxCoolNetworkUDP
+		rand.Read(ms.globalID[:])
+		f.globalID = ms.globalID
+	}
+	s := ms.session
+	ms.mutex.Unlock()
+
+	if len(firstPayload) > 0 {
+		f.option = muxCoolOptionData
+		f.data = firstPayload
+	}
+	return s.writeFrame(&f)
+}
+
+func (ms *MuxCoolStream) current() (*muxCoolSession, uint16) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.session, ms.id
+}
+
+// 在 readLoop 中 调用, 不会阻塞. 缓存 满了 时 udp 丢弃 该包, tcp 关闭 该流.
+func (ms *MuxCoolStream) push(f muxCoolFrame) {
+	p := muxCoolPacket{data: f.data, addr: ms.target}
+	if f.network != 0 {
+		p.addr = f.target
+	}
+	select {
+	case ms.readChan <- p:
+		return
+	case <-ms.closeChan:
+		return
+	default:
+	}
+
+	if ms.IsUDP() {
+		if ce := utils.CanLogDebug("muxcool udp stream buffer full, packet dropped"); ce != nil {
+			ce.Write(zap.String("target", ms.target.String()))
+		}
+		return
+	}
+	if ce := utils.CanLogInfo("muxcool stream buffer full, closing stream"); ce != nil {
+		ce.Write(zap.String("target", ms.target.String()))
+	}
+	ms.remoteEnd()
+	ms.Close()
+}
+
+// 对方 发来 End
+func (ms *MuxCoolStream) remoteEnd() {
+	ms.eofOnce.Do(func() {
+		close(ms.eofChan)
+	})
+}
+
+// 将 xudp 会话 换到 新的 mux连接 上. 若 已经 关闭, 返回 false
+func (ms *MuxCoolStream) rebind(s *muxCoolSession, id uint16) bool {
+	ms.mutex.Lock()
+	select {
+	case <-ms.closeChan:
+		ms.mutex.Unlock()
+		return false
+	default:
+	}
+	oldSession, oldID := ms.session, ms.id
+	ms.session = s
+	ms.id = id
+	if ms.detachTimer != nil {
+		ms.detachTimer.Stop()
+		ms.detachTimer = nil
+	}
+	ms.mutex.Unlock()
+
+	if oldSession != nil {
+		oldSession.removeStream(ms, oldID)
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		ms.sessionClosed(s)
+		return true
+	}
+	s.streams[id] = ms
+	s.mutex.Unlock()
+	return true
+}
+
+// 所属 mux连接 断开. 带有 GlobalID 的 udp会话 等待 xudpKeepTime 后 才 关闭
+func (ms *MuxCoolStream) sessionClosed(s *muxCoolSession) {
+	ms.mutex.Lock()
+	if ms.session != s {
+		ms.mutex.Unlock()
+		return
+	}
+	ms.session = nil
+
+	if ms.globalID != [xudpGlobalIDLen]byte{} && !s.isClient {
+		if ms.detachTimer == nil {
+			ms.detachTimer = time.AfterFunc(xudpKeepTime, func() {
+				ms.mutex.Lock()
+				detached := ms.session == nil
+				ms.mutex.Unlock()
+				if detached {
+					ms.Close()
+				}
+			})
+		}
+		ms.mutex.Unlock()
+		return
+	}
+	ms.mutex.Unlock()
+
+	ms.remoteEnd()
+	ms.Close()
+}
+
+func (ms *MuxCoolStream) readPacket() (muxCoolPacket, error) {
+	select {
+	case p := <-ms.readChan:
+		return p, nil
+	case <-ms.closeChan:
+		return muxCoolPacket{}, net.ErrClosed
+	case <-ms.ReadTimeoutChan():
+		return muxCoolPacket{}, os.ErrDeadlineExceeded
+	case <-ms.eofChan:
+		select {
+		case p := <-ms.readChan:
+			return p, nil
+		default:
+			return muxCoolPacket{}, io.EOF
+		}
+	}
+}
+
+func (ms *MuxCoolStream) Read(b []byte) (int, error) {
+	if len(ms.remain) == 0 {
+		p, err := ms.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		ms.remain = p.data
+	}
+	n := copy(b, ms.remain)
+	ms.remain = ms.remain[n:]
+	return n, nil
+}
+
+func (ms *MuxCoolStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > muxCoolMaxData {
+			n = muxCoolMaxData
+		}
+		if err := ms.writeData(b[:n], nil); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (ms *MuxCoolStream) ReadMsg() ([]byte, netLayer.Addr, error) {
+	p, err := ms.readPacket()
+	return p.data, p.addr, err
+}
+
+// 包 总是 带有 地址
+func (ms *MuxCoolStream) WriteMsg(b []byte, peer netLayer.Addr) error {
+	if len(b) > 0xffff {
+		return utils.ErrInErr{ErrDesc: "muxcool: udp packet too long", Data: len(b)}
+	}
+	peer.Network = "udp"
+	return ms.writeData(b, &peer)
+}
+
+func (ms *MuxCoolStream) writeData(b []byte, addr *netLayer.Addr) error {
+	select {
+	case <-ms.closeChan:
+		return net.ErrClosed
+	case <-ms.WriteTimeoutChan():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+	s, id := ms.current()
+	if s == nil {
+		return nil //xudp 正在 等待 恢复, 与 udp 的 语义 一致, 丢弃
+	}
+	f := muxCoolFrame{
+		id:     id,
+		status: muxCoolStatusKeep,
+		option: muxCoolOptionData,
+		data:   b,
+	}
+	if addr != nil {
+		f.network = muxCoolNetworkUDP
+		f.target = *addr
+	}
+	return s.writeFrame(&f)
+}
+
+func (ms *MuxCoolStream) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return ms.Close()
+}
+
+// 带有 地址 的 udp会话 是 fullcone 的; 服务端 只有 XUDP 会话 是.
+func (ms *MuxCoolStream) Fullcone() bool {
+	return ms.IsUDP() && ms.globalID != [xudpGlobalIDLen]byte{}
+}
+
+// 发送 End帧 并 关闭
+func (ms *MuxCoolStream) Close() error {
+	ms.closeOnce.Do(func() {
+		close(ms.closeChan)
+
+		ms.mutex.Lock()
+		s, id := ms.session, ms.id
+		if ms.detachTimer != nil {
+			ms.detachTimer.Stop()
+			ms.detachTimer = nil
+		}
+		ms.mutex.Unlock()
+
+		if ms.globalID != [xudpGlobalIDLen]byte{} {
+			xudpStreams.Lock()
+			if xudpStreams.m[ms.globalID] == ms {
+				delete(xudpStreams.m, ms.globalID)
+			}
+			xudpStreams.Unlock()
+		}
+
+		if s != nil {
+			s.removeStream(ms, id)
+			if ms.started && !s.IsClosed() {
+				s.writeFrame(&muxCoolFrame{id: id, status: muxCoolStatusEnd})
+			}
+		}
+	})
+	return nil
+}
+
+func (ms *MuxCoolStream) LocalAddr() net.Addr {
+	if s, _ := ms.current(); s != nil {
+		if c, ok := s.conn.(net.Conn); ok {
+			return c.LocalAddr()
+		}
+	}
+	return nil
+}
+
+func (ms *MuxCoolStream) RemoteAddr() net.Addr {
+	if s, _ := ms.current(); s != nil {
+		if c, ok := s.conn.(net.Conn); ok {
+			return c.RemoteAddr()
+		}
+	}
+	return nil
+}
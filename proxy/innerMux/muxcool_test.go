@@ -0,0 +1,252 @@
+package innerMux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+func TestMuxCoolFrame(t *testing.T) {
+	target := netLayer.Addr{Name: "example.com", Port: 53, Network: "udp"}
+	frames := []muxCoolFrame{
+		{id: 1, status: muxCoolStatusNew, network: muxCoolNetworkTCP, target: netLayer.Addr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 80, Network: "tcp"}},
+		{id: 2, status: muxCoolStatusNew, option: muxCoolOptionData, network: muxCoolNetworkUDP, target: target, globalID: [8]byte{1, 2, 3}, data: []byte("query")},
+		{id: 2, status: muxCoolStatusKeep, option: muxCoolOptionData, network: muxCoolNetworkUDP, target: target, data: []byte("answer")},
+		{id: 1, status: muxCoolStatusKeep, option: muxCoolOptionData, data: []byte("tcp data")},
+		{id: 1, status: muxCoolStatusEnd},
+		{status: muxCoolStatusKeepAlive},
+	}
+
+	var buf bytes.Buffer
+	for i := range frames {
+		frames[i].writeTo(&buf)
+	}
+	for _, want := range frames {
+		got, err := readMuxCoolFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.id != want.id || got.status != want.status || got.option != want.option || got.network != want.network || got.globalID != want.globalID || !bytes.Equal(got.data, want.data) {
+			t.Fatalf("frame not match, got %+v, want %+v", got, want)
+		}
+		if want.network != 0 && got.target.String() != want.target.String() {
+			t.Fatal("target not match", got.target.String(), want.target.String())
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatal("remain data", buf.Len())
+	}
+}
+
+func TestMuxCoolSession(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxCoolClientSession(c1)
+	server := NewMuxCoolServerSession(c2)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			ms := stream.(*MuxCoolStream)
+			if ms.IsUDP() {
+				go func() {
+					for {
+						bs, addr, err := ms.ReadMsg()
+						if err != nil {
+							return
+						}
+						ms.WriteMsg(bs, addr)
+					}
+				}()
+			} else {
+				go func() {
+					io.Copy(ms, ms)
+					ms.Close()
+				}()
+			}
+		}
+	}()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := stream.(*MuxCoolStream)
+	if err := ms.Start(netLayer.Addr{Name: "example.com", Port: 443, Network: "tcp"}, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*muxCoolMaxData+100)
+	rand.Read(data)
+	go ms.Write(data)
+
+	got := make([]byte, 5+len(data))
+	ms.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if _, err := io.ReadFull(ms, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:5]) != "hello" || !bytes.Equal(got[5:], data) {
+		t.Fatal("tcp data not match")
+	}
+	ms.Close()
+
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	us := stream.(*MuxCoolStream)
+	first := netLayer.Addr{IP: net.IPv4(8, 8, 8, 8).To4(), Port: 53, Network: "udp"}
+	if err := us.Start(first, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if !us.Fullcone() {
+		t.Fatal("xudp stream should be fullcone")
+	}
+	us.SetReadDeadline(time.Now().Add(time.Second * 10))
+	bs, addr, err := us.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "first" || addr.String() != first.String() {
+		t.Fatal("udp first packet not match", string(bs), addr.String())
+	}
+
+	other := netLayer.Addr{IP: net.IPv4(1, 1, 1, 1).To4(), Port: 5353, Network: "udp"}
+	if err := us.WriteMsg([]byte("other"), other); err != nil {
+		t.Fatal(err)
+	}
+	bs, addr, err = us.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "other" || addr.String() != other.String() {
+		t.Fatal("udp packet not match", string(bs), addr.String())
+	}
+}
+
+// 客户端 换了 mux连接 后, 以 相同的 GlobalID 新建 udp会话, 服务端 应 继续 使用 原来的 会话
+func TestXUDPResume(t *testing.T) {
+	accepted := make(chan *MuxCoolStream, 4)
+	serve := func(s Session) {
+		for {
+			stream, err := s.AcceptStream()
+			if err != nil {
+				return
+			}
+			accepted <- stream.(*MuxCoolStream)
+		}
+	}
+
+	c1, c2 := net.Pipe()
+	client := NewMuxCoolClientSession(c1)
+	server := NewMuxCoolServerSession(c2)
+	go serve(server)
+
+	stream, _ := client.OpenStream()
+	us := stream.(*MuxCoolStream)
+	target := netLayer.Addr{IP: net.IPv4(8, 8, 8, 8).To4(), Port: 53, Network: "udp"}
+	if err := us.Start(target, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	serverStream := <-accepted
+	serverStream.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if bs, _, err := serverStream.ReadMsg(); err != nil || string(bs) != "1" {
+		t.Fatal("first packet not match", string(bs), err)
+	}
+
+	client.Close()
+	server.Close()
+
+	c3, c4 := net.Pipe()
+	client2 := NewMuxCoolClientSession(c3)
+	server2 := NewMuxCoolServerSession(c4)
+	defer client2.Close()
+	defer server2.Close()
+	go serve(server2)
+
+	stream, _ = client2.OpenStream()
+	us2 := stream.(*MuxCoolStream)
+	us2.started = true
+	us2.network = muxCoolNetworkUDP
+	us2.globalID = us.globalID
+	us2.target = target
+	if err := client2.(*muxCoolSession).writeFrame(&muxCoolFrame{
+		id: us2.id, status: muxCoolStatusNew, option: muxCoolOptionData,
+		network: muxCoolNetworkUDP, target: target, globalID: us.globalID, data: []byte("2"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if bs, _, err := serverStream.ReadMsg(); err != nil || string(bs) != "2" {
+		t.Fatal("resumed packet not match", string(bs), err)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("resumed xudp session should not be accepted again")
+	default:
+	}
+
+	if err := serverStream.WriteMsg([]byte("3"), target); err != nil {
+		t.Fatal(err)
+	}
+	us2.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if bs, _, err := us2.ReadMsg(); err != nil || string(bs) != "3" {
+		t.Fatal("reply on resumed session not match", string(bs), err)
+	}
+	serverStream.Close()
+}
+
+// 一个 不读取 的 流 不应 阻塞 同一 mux连接 上的 其它流; 其缓存 满了 之后 会被 关闭
+func TestMuxCoolSlowStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewMuxCoolClientSession(c1)
+	server := NewMuxCoolServerSession(c2)
+	defer client.Close()
+	defer server.Close()
+
+	slowChan := make(chan *MuxCoolStream, 1)
+	go func() {
+		stream, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		slowChan <- stream.(*MuxCoolStream)
+
+		stream, err = server.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+	}()
+
+	slow, _ := client.OpenStream()
+	if err := slow.(*MuxCoolStream).Start(netLayer.Addr{Name: "slow.example.com", Port: 80, Network: "tcp"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	serverSlow := <-slowChan
+	slow.Write(make([]byte, (muxCoolStreamBufferFrames+2)*muxCoolMaxData))
+
+	fast, _ := client.OpenStream()
+	if err := fast.(*MuxCoolStream).Start(netLayer.Addr{Name: "fast.example.com", Port: 80, Network: "tcp"}, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	fast.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadFull(fast, got); err != nil || string(got) != "hello" {
+		t.Fatal("fast stream blocked by slow stream", err, string(got))
+	}
+
+	select {
+	case <-serverSlow.closeChan:
+	case <-time.After(time.Second * 5):
+		t.Fatal("overflowed stream should be closed")
+	}
+}
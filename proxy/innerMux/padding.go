@@ -0,0 +1,100 @@
+package innerMux
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 前 firstPaddings 次 读写 会进行 填充, 之后 直接读写
+const firstPaddings = 16
+
+// paddingConn 实现 sing-mux 的 填充: 前 firstPaddings 次 写入 的 格式为
+//
+//	dataLen(2) | paddingLen(2) | data(dataLen) | padding(paddingLen)
+//
+// 对端 以 同样的 格式 读取.
+type paddingConn struct {
+	net.Conn
+
+	readPadding      int
+	writePadding     int
+	readRemaining    int
+	paddingRemaining int
+}
+
+func newPaddingConn(c net.Conn) net.Conn {
+	return &paddingConn{Conn: c}
+}
+
+func (c *paddingConn) Read(p []byte) (n int, err error) {
+	if c.readRemaining > 0 {
+		if len(p) > c.readRemaining {
+			p = p[:c.readRemaining]
+		}
+		n, err = c.Conn.Read(p)
+		c.readRemaining -= n
+		return
+	}
+	if c.paddingRemaining > 0 {
+		if _, err = io.CopyN(io.Discard, c.Conn, int64(c.paddingRemaining)); err != nil {
+			return
+		}
+		c.paddingRemaining = 0
+	}
+	if c.readPadding >= firstPaddings {
+		return c.Conn.Read(p)
+	}
+
+	var header [4]byte
+	if _, err = io.ReadFull(c.Conn, header[:]); err != nil {
+		return
+	}
+	dataLen := int(binary.BigEndian.Uint16(header[:2]))
+	c.paddingRemaining = int(binary.BigEndian.Uint16(header[2:]))
+	c.readPadding++
+
+	if len(p) > dataLen {
+		p = p[:dataLen]
+	}
+	n, err = c.Conn.Read(p)
+	c.readRemaining = dataLen - n
+	return
+}
+
+func (c *paddingConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if c.writePadding >= firstPaddings {
+			var n2 int
+			n2, err = c.Conn.Write(p)
+			n += n2
+			return
+		}
+
+		data := p
+		if len(data) > 65535 {
+			data = data[:65535]
+		}
+		p = p[len(data):]
+
+		paddingLen := 256 + rand.Intn(512)
+
+		buf := utils.GetBuf()
+		binary.Write(buf, binary.BigEndian, uint16(len(data)))
+		binary.Write(buf, binary.BigEndian, uint16(paddingLen))
+		buf.Write(data)
+		buf.Write(make([]byte, paddingLen))
+
+		_, err = c.Conn.Write(buf.Bytes())
+		utils.PutBuf(buf)
+		c.writePadding++
+		if err != nil {
+			return
+		}
+		n += len(data)
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package innerMux
+
+import (
+	"sync"
+	"time"
+)
+
+// Pool 管理 一个 客户端 的 全部 mux连接, 按 Conf 的 max_connections, max_streams, idle_timeout 进行 选择 与 清理.
+type Pool struct {
+	conf Conf
+
+	mutex    sync.Mutex
+	sessions []*pooledSession
+
+	cleaning bool
+	closed   bool
+}
+
+type pooledSession struct {
+	Session
+	idleSince time.Time //没有任何流 时 开始 计时; 有流 时 为 零值
+	lastGet   time.Time //最近一次 被 Get 返回 的 时间; 之后 一个 idle_timeout 内 不会 因 空闲 被关闭
+}
+
+func NewPool(conf *Conf) *Pool {
+	p := &Pool{}
+	if conf != nil {
+		p.conf = *conf
+	}
+	return p
+}
+
+func (p *Pool) removeClosed() {
+	alive := p.sessions[:0]
+	for _, s := range p.sessions {
+		if !s.IsClosed() {
+			alive = append(alive, s)
+		}
+	}
+	for i := len(alive); i < len(p.sessions); i++ {
+		p.sessions[i] = nil
+	}
+	p.sessions = alive
+}
+
+func (p *Pool) underConnLimit() bool {
+	if p.conf.MaxConnections > 0 {
+		return len(p.sessions) < p.conf.MaxConnections
+	}
+	return p.conf.MaxStreams > 0 || len(p.sessions) == 0
+}
+
+// Get 返回 一个 可以 打开新流 的 会话; 返回 nil 表示 应该 拨号 新的 mux连接.
+//
+// 有 max_streams 时 先 填满 已有的连接; 否则 在 max_connections 以内 每个 新请求 都 优先 使用 空闲的 或 新的 连接.
+// 达到 max_connections 后 所有连接 都满 时, 使用 流数 最少 的 连接.
+func (p *Pool) Get() Session {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.removeClosed()
+
+	var best, leastLoaded *pooledSession
+	for _, s := range p.sessions {
+		n := s.NumStreams()
+		if leastLoaded == nil || n < leastLoaded.NumStreams() {
+			leastLoaded = s
+		}
+		if p.conf.MaxStreams > 0 && n >= p.conf.MaxStreams {
+			continue
+		}
+		if best == nil || n < best.NumStreams() {
+			best = s
+		}
+	}
+	if best != nil && (p.conf.MaxStreams > 0 || best.NumStreams() == 0 || !p.underConnLimit()) {
+		return best.handOut()
+	}
+	if p.underConnLimit() || leastLoaded == nil {
+		return nil
+	}
+	return leastLoaded.handOut()
+}
+
+// 调用者 拿到 会话 后 才会 打开 流, 在此之前 会话 依然 没有流, 所以 要 避免 被 清理.
+func (s *pooledSession) handOut() Session {
+	s.lastGet = time.Now()
+	s.idleSince = time.Time{}
+	return s.Session
+}
+
+// Add 将 新拨号的 会话 加入 Pool
+func (p *Pool) Add(s Session) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		s.Close()
+		return
+	}
+	p.sessions = append(p.sessions, &pooledSession{Session: s})
+
+	if p.conf.IdleTimeout > 0 && !p.cleaning {
+		p.cleaning = true
+		go p.cleanLoop()
+	}
+}
+
+// 定期 关闭 空闲 超时 的 会话, 没有 会话 时 退出.
+func (p *Pool) cleanLoop() {
+	timeout := time.Duration(p.conf.IdleTimeout) * time.Second
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		p.mutex.Lock()
+		p.sweep(now, timeout)
+
+		if len(p.sessions) == 0 || p.closed {
+			p.cleaning = false
+			p.mutex.Unlock()
+			return
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// 关闭 空闲 超过 timeout 的 会话; 刚被 Get 返回 的 会话 即使 没有流 也 跳过. 调用前须持有mutex
+func (p *Pool) sweep(now time.Time, timeout time.Duration) {
+	p.removeClosed()
+	for _, s := range p.sessions {
+		if s.NumStreams() > 0 || now.Sub(s.lastGet) < timeout {
+			s.idleSince = time.Time{}
+		} else if s.idleSince.IsZero() {
+			s.idleSince = now
+		} else if now.Sub(s.idleSince) >= timeout {
+			s.Close()
+		}
+	}
+	p.removeClosed()
+}
+
+// 当前 存活的 会话 数
+func (p *Pool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.removeClosed()
+	return len(p.sessions)
+}
+
+// 关闭 所有 会话, 之后 Pool 依然 可以 继续使用
+func (p *Pool) CloseAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, s := range p.sessions {
+		s.Close()
+	}
+	p.sessions = nil
+}
+
+// 关闭 所有 会话, 之后 Add 的 会话 会被 直接 关闭
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+	p.CloseAll()
+}
@@ -0,0 +1,105 @@
+package innerMux
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// sing-mux 会话请求头:
+//
+//	version(1) | protocol(1) | [ padding(1) | [ paddingLen(2) | padding(paddingLen) ] ]
+//
+// 中括号部分 只在 version 为1 时存在. sing-box 只在 开启 padding 时 使用 version 1.
+const (
+	singMuxVersion0 byte = 0
+	singMuxVersion1 byte = 1
+
+	singMuxProtocolH2mux byte = 0
+	singMuxProtocolSmux  byte = 1
+	singMuxProtocolYamux byte = 2
+
+	SingMuxDomain = "sp.mux.sing-box.arpa"
+	SingMuxPort   = 444
+)
+
+// sing-mux 客户端 在 外层代理握手 时 请求的 目标地址
+func SingMuxAddr() netLayer.Addr {
+	return netLayer.Addr{Name: SingMuxDomain, Port: SingMuxPort, Network: "tcp"}
+}
+
+// 判断 服务端 代理握手 得到的 目标地址 是否表示 sing-mux 连接
+func IsSingMuxAddr(a netLayer.Addr) bool {
+	return a.Name == SingMuxDomain && a.Port == SingMuxPort && !a.IsUDP()
+}
+
+func singMuxProtocolFromName(name string) (byte, bool) {
+	switch name {
+	case H2mux:
+		return singMuxProtocolH2mux, true
+	case Smux:
+		return singMuxProtocolSmux, true
+	case Yamux:
+		return singMuxProtocolYamux, true
+	}
+	return 0, false
+}
+
+func writeSingMuxRequest(w io.Writer, protocol byte, padding bool) error {
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	if padding {
+		buf.WriteByte(singMuxVersion1)
+		buf.WriteByte(protocol)
+		buf.WriteByte(1)
+
+		paddingLen := 256 + rand.Intn(512)
+		binary.Write(buf, binary.BigEndian, uint16(paddingLen))
+		buf.Write(make([]byte, paddingLen))
+	} else {
+		buf.WriteByte(singMuxVersion0)
+		buf.WriteByte(protocol)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readSingMuxRequest(r io.Reader) (protocol byte, padding bool, err error) {
+	var head [3]byte
+	if _, err = io.ReadFull(r, head[:2]); err != nil {
+		return
+	}
+	version := head[0]
+	protocol = head[1]
+
+	if version > singMuxVersion1 {
+		err = utils.ErrInErr{ErrDesc: "sing-mux: unsupported version", ErrDetail: utils.ErrInvalidData, Data: version}
+		return
+	}
+	if protocol > singMuxProtocolYamux {
+		err = utils.ErrInErr{ErrDesc: "sing-mux: unsupported protocol", ErrDetail: utils.ErrInvalidData, Data: protocol}
+		return
+	}
+	if version == singMuxVersion0 {
+		return
+	}
+
+	if _, err = io.ReadFull(r, head[2:3]); err != nil {
+		return
+	}
+	padding = head[2] != 0
+	if !padding {
+		return
+	}
+
+	var lenbs [2]byte
+	if _, err = io.ReadFull(r, lenbs[:]); err != nil {
+		return
+	}
+	_, err = io.CopyN(io.Discard, r, int64(binary.BigEndian.Uint16(lenbs[:])))
+	return
+}
@@ -0,0 +1,45 @@
+package innerMux
+
+import (
+	"io"
+	"net"
+
+	"github.com/xtaci/smux"
+)
+
+// smux v1, 传统模式 使用 smux.DefaultConfig, 以 兼容 trojan-go; sing-mux 关闭了 keepalive, 同 sing-box.
+func smuxConfig(singMux bool) *smux.Config {
+	config := smux.DefaultConfig()
+	if singMux {
+		config.KeepAliveDisabled = true
+	}
+	return config
+}
+
+type smuxSession struct {
+	*smux.Session
+}
+
+func newSmuxClient(rwc io.ReadWriteCloser, singMux bool) (Session, error) {
+	s, err := smux.Client(rwc, smuxConfig(singMux))
+	if err != nil {
+		return nil, err
+	}
+	return smuxSession{s}, nil
+}
+
+func newSmuxServer(rwc io.ReadWriteCloser, singMux bool) (Session, error) {
+	s, err := smux.Server(rwc, smuxConfig(singMux))
+	if err != nil {
+		return nil, err
+	}
+	return smuxSession{s}, nil
+}
+
+func (s smuxSession) OpenStream() (net.Conn, error) {
+	return s.Session.OpenStream()
+}
+
+func (s smuxSession) AcceptStream() (net.Conn, error) {
+	return s.Session.AcceptStream()
+}
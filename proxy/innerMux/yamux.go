@@ -0,0 +1,46 @@
+package innerMux
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// 同 sing-mux
+func yamuxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	config.StreamCloseTimeout = time.Second * 5
+	config.StreamOpenTimeout = time.Second * 5
+	return config
+}
+
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func newYamuxClient(conn net.Conn) (Session, error) {
+	s, err := yamux.Client(conn, yamuxConfig())
+	if err != nil {
+		return nil, err
+	}
+	return yamuxSession{s}, nil
+}
+
+func newYamuxServer(conn net.Conn) (Session, error) {
+	s, err := yamux.Server(conn, yamuxConfig())
+	if err != nil {
+		return nil, err
+	}
+	return yamuxSession{s}, nil
+}
+
+func (s yamuxSession) OpenStream() (net.Conn, error) {
+	return s.Session.Open()
+}
+
+func (s yamuxSession) AcceptStream() (net.Conn, error) {
+	return s.Session.Accept()
+}
@@ -0,0 +1,165 @@
+/*
+Package muxcool 是 Mux.Cool 的 内层代理协议, 用于 proxy.Server 与 proxy.Client.
+
+它 只作为 innerMux 在 muxcool 模式 下 的 内层代理协议 使用, 对应 传统模式 中的 simplesocks 与 sing-mux 模式 中的 singmux.
+
+Mux.Cool 的 流 没有 内层 握手, 目标 在 新建会话 的 帧 中 给出, 所以 Server 与 Client 只是 将 innerMux.MuxCoolStream 包装 为 tcp/udp 连接.
+协议 本身 见 innerMux 包 的 muxcool.go.
+*/
+package muxcool
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const Name = innerMux.MuxCool
+
+var errNotMuxCoolStream = errors.New("muxcool: underlay is not a mux.cool stream")
+
+func init() {
+	proxy.RegisterServer(Name, &ServerCreator{})
+	proxy.RegisterClient(Name, ClientCreator{})
+}
+
+type ServerCreator struct{ proxy.CreatorCommonStruct }
+
+func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	return &Server{}, nil
+}
+
+func (ServerCreator) URLToListenConf(u *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	if lc == nil {
+		lc = &proxy.ListenConf{}
+	}
+	return lc, nil
+}
+
+// implements proxy.Server
+type Server struct {
+	proxy.Base
+}
+
+func (*Server) Name() string {
+	return Name
+}
+
+// underlay 必须是 innerMux.MuxCoolStream
+func (s *Server) Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error) {
+	ms, ok := underlay.(*innerMux.MuxCoolStream)
+	if !ok {
+		return nil, nil, netLayer.Addr{}, errNotMuxCoolStream
+	}
+	c := &Conn{MuxCoolStream: ms}
+	if ms.IsUDP() {
+		return nil, c, ms.Target(), nil
+	}
+	return c, nil, ms.Target(), nil
+}
+
+type ClientCreator struct{ proxy.CreatorCommonStruct }
+
+func (ClientCreator) URLToDialConf(u *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	if dc == nil {
+		dc = &proxy.DialConf{}
+	}
+	return dc, nil
+}
+
+func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	return &Client{}, nil
+}
+
+// implements proxy.Client
+type Client struct {
+	proxy.Base
+}
+
+func (*Client) GetCreator() proxy.ClientCreator {
+	return ClientCreator{}
+}
+
+func (*Client) Name() string {
+	return Name
+}
+
+// underlay 必须是 innerMux 的 muxcool 会话 打开的 流
+func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	ms, ok := underlay.(*innerMux.MuxCoolStream)
+	if !ok {
+		return nil, errNotMuxCoolStream
+	}
+	if target.Port <= 0 {
+		return nil, errors.New("muxcool Client Handshake failed, target port invalid")
+	}
+	target.Network = "tcp"
+	err := ms.Start(target, firstPayload)
+	if len(firstPayload) > 0 {
+		utils.PutBytes(firstPayload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// 总是 使用 XUDP, 每个包 都带有 地址, 支持 fullcone
+func (c *Client) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	ms, ok := underlay.(*innerMux.MuxCoolStream)
+	if !ok {
+		return nil, errNotMuxCoolStream
+	}
+	if target.Port <= 0 {
+		return nil, errors.New("muxcool Client EstablishUDPChannel failed, target port invalid")
+	}
+	target.Network = "udp"
+	if err := ms.Start(target, firstPayload); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// 服务端 的 流, 实现 utils.User, utils.UserAssigner, 用于 将 外层连接 的 user 传递 到 流 中
+type Conn struct {
+	*innerMux.MuxCoolStream
+	user utils.User
+}
+
+func (c *Conn) SetUser(user utils.User) {
+	c.user = user
+}
+
+func (c *Conn) IdentityStr() string {
+	if c.user != nil {
+		return c.user.IdentityStr()
+	}
+	return ""
+}
+
+func (c *Conn) IdentityBytes() []byte {
+	if c.user != nil {
+		return c.user.IdentityBytes()
+	}
+	return nil
+}
+
+func (c *Conn) AuthStr() string {
+	if c.user != nil {
+		return c.user.AuthStr()
+	}
+	return ""
+}
+
+func (c *Conn) AuthBytes() []byte {
+	if c.user != nil {
+		return c.user.AuthBytes()
+	}
+	return nil
+}
@@ -8,8 +8,8 @@ import (
 	"time"
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
-	"github.com/xtaci/smux"
 )
 
 // 规定，如果 proxy的server的handshake如果返回的是具有内层mux的连接，该连接要实现 MuxMarker 接口.
@@ -50,7 +50,7 @@ type Client interface {
 	IsUDP_MultiChannel() bool
 
 	//get/listen a useable inner mux
-	GetClientInnerMuxSession(wrc io.ReadWriteCloser) *smux.Session
+	GetClientInnerMuxSession(wrc io.ReadWriteCloser) innerMux.Session
 	InnerMuxEstablished() bool
 	CloseInnerMuxSession()
 
@@ -58,6 +58,9 @@ type Client interface {
 	LocalTCPAddr() *net.TCPAddr
 	LocalUDPAddr() *net.UDPAddr
 
+	//hysteria2 用到了 SelfDial; 若为true, 则vs不会为其拨号, Handshake 和 EstablishUDPChannel 的 underlay 为 nil.
+	SelfDial() bool
+
 	GetCreator() ClientCreator
 
 	sync.Locker //用于锁定 innerMux
@@ -81,7 +84,7 @@ type Server interface {
 	Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error)
 
 	//get/listen a useable inner mux
-	GetServerInnerMuxSession(wlc io.ReadWriteCloser) *smux.Session
+	GetServerInnerMuxSession(wlc io.ReadWriteCloser) innerMux.Session
 
 	//tproxy,tun 和 shadowsocks(udp) 都用到了 SelfListen
 	//
@@ -96,11 +99,50 @@ type ListenerServer interface {
 	StartListen(func(netLayer.TCPRequestInfo), func(netLayer.UDPRequestInfo)) io.Closer
 }
 
+// BindConn 是 inServer 在收到 需要 目标主机 反向连入 的请求 (如 socks5 的 BIND) 时 返回的 wlc.
+// 此时 vs 照常 对 其目标地址 分流, 但不会 拨号: 分流到 direct 时 调用 AcceptBound, 将 连入的连接 作为 wrc 转发;
+// 分流到 实现了 BindClient 的 outClient 时, 通过 它 在上游 进行 BIND, 并用 ReplyBind 转告 客户端;
+// 分流到 其它 outClient 时 调用 RejectBind.
+type BindConn interface {
+	net.Conn
+
+	//阻塞, 直到 目标主机 连入 或 失败. 失败时 已 告知 客户端.
+	AcceptBound() (net.Conn, netLayer.Addr, error)
+
+	//告知 客户端 BIND 的 进展: 先为 所监听的地址, 后为 连入的主机地址. err 非空时 告知 客户端 失败.
+	ReplyBind(addr netLayer.Addr, err error) error
+
+	//告知 客户端 该请求 不被允许
+	RejectBind()
+}
+
+// BindClient 是 可以 在 上游 进行 BIND 的 Client, 如 socks5.
+type BindClient interface {
+	Client
+
+	//在 underlay 上 发送 BIND 请求, 返回 上游 所监听的地址. target 为 预期连入的主机.
+	Bind(underlay net.Conn, target netLayer.Addr) (bindAddr netLayer.Addr, err error)
+
+	//等待 目标主机 连入 上游, 返回 其地址. 成功后 underlay 即 与该主机 之间的连接.
+	ReadBindReply(underlay net.Conn) (peerAddr netLayer.Addr, err error)
+}
+
 type UserServer interface {
 	Server
 	utils.UserContainer
 }
 
+// 可以在运行时 增删用户 的 Server. 增删 只影响之后的握手, 已建立的连接 不受影响.
+type UserManagedServer interface {
+	Server
+	utils.UserBus
+
+	AllUsers() []utils.User
+
+	//按 该协议 解析 ListenConf.Users 的方式, 由 uc 生成一个 User
+	NewUserByConf(uc utils.UserConf) (utils.User, error)
+}
+
 // FullName can fully represent the VSI model for a proxy.
 // We think tcp/udp/kcp/raw_socket is FirstName，protocol of the proxy is LastName, and the rest is  MiddleName。
 //
@@ -173,7 +215,15 @@ func getFullNameBuilder(pc BaseInterface, n string) *strings.Builder {
 	sb.WriteString(n)
 
 	if i, innerProxyName := pc.HasInnerMux(); i == 2 {
-		sb.WriteString("+smux+")
+		muxProtocol := innerMux.Smux
+		if dc := pc.GetBase().DialConf; dc != nil {
+			muxProtocol = dc.MuxConf.GetProtocol()
+		}
+		if muxProtocol != innerProxyName { //Mux.Cool 没有 单独的 内层代理协议
+			sb.WriteString("+")
+			sb.WriteString(muxProtocol)
+		}
+		sb.WriteString("+")
 		sb.WriteString(innerProxyName)
 
 	}
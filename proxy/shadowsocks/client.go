@@ -41,7 +41,7 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 	uuidStr := dc.UUID
 	var mp MethodPass
 	if mp.InitWithStr(uuidStr) {
-		return newClient(mp), nil
+		return newClient(mp)
 
 	}
 
@@ -52,12 +52,20 @@ type Client struct {
 	proxy.Base
 	utils.UserPass
 	cipher core.Cipher
+	ss2022 *ss2022Keys //使用 ss2022 时 cipher 为nil
 }
 
-func newClient(mp MethodPass) *Client {
+func newClient(mp MethodPass) (*Client, error) {
+	if IsSS2022Method(mp.Method) {
+		keys, err := newSS2022Keys(mp.Method, mp.Password)
+		if err != nil {
+			return nil, err
+		}
+		return &Client{ss2022: keys}, nil
+	}
 	return &Client{
 		cipher: initShadowCipher(mp),
-	}
+	}, nil
 }
 func (*Client) GetCreator() proxy.ClientCreator {
 	return ClientCreator{}
@@ -73,12 +81,18 @@ func (c *Client) Network() string {
 	}
 }
 func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (conn io.ReadWriteCloser, err error) {
+	if c.ss2022 != nil {
+		sc := &ss2022StreamConn{Conn: underlay, keys: c.ss2022, psk: c.ss2022.userPSK()}
+		err = sc.writeRequest(firstPayload, target)
+		conn = sc
+		return
+	}
+
 	conn = c.cipher.StreamConn(underlay)
 
-	buf := utils.GetBuf()
+	buf := makeWriteBuf(firstPayload, target)
 	defer utils.PutBuf(buf)
 
-	makeWriteBuf(firstPayload, target)
 	_, err = conn.Write(buf.Bytes())
 
 	return
@@ -101,6 +115,11 @@ func (c *Client) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, tar
 
 	if c.cipher != nil {
 		pc = c.cipher.PacketConn(pc)
+	} else if c.ss2022 != nil {
+		pc, err = c.ss2022.clientPacketConn(pc)
+		if err != nil {
+			return
+		}
 	}
 
 	mc = &clientUDPMsgConn{
@@ -34,7 +34,7 @@ func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
 
 	var mp MethodPass
 	if mp.InitWithStr(uuidStr) {
-		return newServer(mp, lc), nil
+		return newServer(mp, lc)
 
 	}
 
@@ -67,13 +67,14 @@ func (ServerCreator) AfterCommonConfServer(ps proxy.Server) (err error) {
 	return
 }
 
-// 目前的实现只支持单用户
+// 旧式 AEAD 只支持单用户; ss2022 可通过 EIH 支持多用户, 用户的 uPSK 在 lc.Users 的 pass 项中给出.
 type Server struct {
 	proxy.Base
 
 	*utils.MultiUserMap
 
 	cipher core.Cipher
+	ss2022 *ss2022Keys //使用 ss2022 时 cipher 为nil
 
 	m             sync.RWMutex
 	udpMsgConnMap map[netLayer.HashableAddr]*serverMsgConn
@@ -81,14 +82,32 @@ type Server struct {
 	mp MethodPass
 }
 
-func newServer(info MethodPass, lc *proxy.ListenConf) *Server {
+func newServer(info MethodPass, lc *proxy.ListenConf) (*Server, error) {
 	s := &Server{
-		cipher:        initShadowCipher(info),
 		udpMsgConnMap: make(map[netLayer.HashableAddr]*serverMsgConn),
 		mp:            info,
 	}
 
-	return s
+	if IsSS2022Method(info.Method) {
+		keys, err := newSS2022Keys(info.Method, info.Password)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys.psks) > 1 {
+			return nil, utils.ErrInErr{ErrDesc: "ss2022 server accepts only one psk", ErrDetail: utils.ErrInvalidData}
+		}
+		for _, uc := range lc.Users {
+			if err = keys.addUser(uc); err != nil {
+				return nil, err
+			}
+		}
+		keys.saltPool = newSS2022SaltPool()
+		s.ss2022 = keys
+	} else {
+		s.cipher = initShadowCipher(info)
+	}
+
+	return s, nil
 }
 func (*Server) Name() string {
 	return Name
@@ -119,6 +138,10 @@ func (s *Server) SelfListen() (is bool, _, udp int) {
 }
 
 func (s *Server) Handshake(underlay net.Conn) (result net.Conn, _ netLayer.MsgConn, targetAddr netLayer.Addr, returnErr error) {
+	if s.ss2022 != nil {
+		return s.handshake2022(underlay)
+	}
+
 	stream := s.cipher.StreamConn(underlay)
 	readbs := utils.GetBytes(utils.MTU)
 
@@ -160,6 +183,40 @@ realPart:
 	return
 }
 
+func (s *Server) handshake2022(underlay net.Conn) (result net.Conn, _ netLayer.MsgConn, targetAddr netLayer.Addr, returnErr error) {
+	//记录 读到的原始数据, 以便 握手失败时 回落
+	readbuf := utils.GetBuf()
+
+	sc := &ss2022StreamConn{Conn: underlay, keys: s.ss2022}
+
+	targetAddr, user, err := sc.readRequest(io.TeeReader(underlay, readbuf), s.ss2022.saltPool)
+	if err != nil {
+		returnErr = &utils.ErrBuffer{
+			Err: err,
+			Buf: readbuf,
+		}
+		return
+	}
+	utils.PutBuf(readbuf)
+
+	var u utils.User = s.mp
+	if user != nil {
+		if id := user.IdentityStr(); utils.UserTraffic.ExceedQuota(id) {
+			returnErr = utils.ErrInErr{ErrDesc: "ss2022 user rejected ", ErrDetail: utils.ErrQuotaExceeded, Data: id}
+			return
+		}
+		u = user
+	}
+
+	result = &proxy.UserReadWrapper{
+		ReadWrapper: netLayer.ReadWrapper{
+			Conn: sc,
+		},
+		User: u,
+	}
+	return
+}
+
 func (m *Server) removeUDPByHash(hash netLayer.HashableAddr) {
 	m.Lock()
 	delete(m.udpMsgConnMap, hash)
@@ -172,7 +229,12 @@ func (s *Server) StartListen(_ func(netLayer.TCPRequestInfo), udpFunc func(netLa
 	if err != nil {
 		log.Panicln("shadowsocks listen udp failed", err)
 	}
-	pc := s.cipher.PacketConn(uc)
+	var pc net.PacketConn
+	if s.ss2022 != nil {
+		pc = s.ss2022.serverPacketConn(uc)
+	} else {
+		pc = s.cipher.PacketConn(uc)
+	}
 
 	if ce := utils.CanLogInfo("shadowsocks listening udp"); ce != nil {
 		ce.Write(zap.String("listen addr", s.LUA.String()))
@@ -201,6 +263,13 @@ func (s *Server) StartListen(_ func(netLayer.TCPRequestInfo), udpFunc func(netLa
 			s.m.RUnlock()
 
 			if !found {
+				var user utils.User = s.mp
+				if spc, ok := pc.(*ss2022ServerPacketConn); ok {
+					if u := spc.userOf(addr); u != nil {
+						user = u
+					}
+				}
+
 				conn = &serverMsgConn{
 					raddr:         addr,
 					ourPacketConn: pc,
@@ -208,7 +277,7 @@ func (s *Server) StartListen(_ func(netLayer.TCPRequestInfo), udpFunc func(netLa
 					closeChan:     make(chan struct{}),
 					server:        s,
 					hash:          hash,
-					User:          s.mp,
+					User:          user,
 				}
 				conn.InitEasyDeadline()
 
@@ -234,7 +303,7 @@ func (s *Server) StartListen(_ func(netLayer.TCPRequestInfo), udpFunc func(netLa
 			if !found {
 
 				go udpFunc(netLayer.UDPRequestInfo{
-					MsgConn: conn, Target: destAddr,
+					MsgConn: conn, Target: destAddr, Source: addr,
 				})
 			}
 
@@ -13,11 +13,12 @@ https://github.com/shadowsocks/shadowsocks-org/wiki/AEAD-Ciphers
 
 如dual话，特征必很明显。
 
-另外，本包是普通的ss AEAD Ciphers ，不过它还是有问题。所以以后要研究ss-2022
+另外，普通的ss AEAD Ciphers 还是有问题, 见
 
 https://github.com/shadowsocks/shadowsocks-org/issues/183
 
-关于ss-2022
+所以本包也实现了 ss-2022 (SIP022), 包括 多用户的 EIH; 见 ss2022.go
+
 https://github.com/shadowsocks/shadowsocks-org/issues/196
 */
 package shadowsocks
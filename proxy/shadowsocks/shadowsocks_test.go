@@ -2,6 +2,9 @@ package shadowsocks_test
 
 import (
 	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
 )
 
 func TestTCP(t *testing.T) {
@@ -14,3 +17,9 @@ func TestTCP(t *testing.T) {
 
 	//这里把该情况记录下来。 测试只能使用外部测试，ss已经通过测试。
 }
+
+// ss2022 使用自己的 salt池, 不存在上面的问题
+func TestTCP_2022(t *testing.T) {
+	proxy.TestTCP("shadowsocks", "2022-blake3-aes-128-gcm:MTIzNDU2Nzg5MGFiY2RlZg==", 0, netLayer.RandPortStr_safe(true, false), "", t)
+	proxy.TestTCP("shadowsocks", "2022-blake3-chacha20-poly1305:MTIzNDU2Nzg5MGFiY2RlZjEyMzQ1Njc4OTBhYmNkZWY=", 0, netLayer.RandPortStr_safe(true, false), "", t)
+}
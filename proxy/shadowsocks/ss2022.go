@@ -0,0 +1,295 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+/*
+ss-2022 (SIP022) 的实现.
+
+https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md
+
+https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-2-shadowsocks-2022-extensible-identity-headers.md
+
+密码为 base64 编码的 预共享密钥(PSK), 长度必须与 method 的密钥长度一致.
+
+多用户时 (EIH, 仅 aes 系列支持), 客户端的密码格式为 "iPSK:uPSK", 服务端的密码为 iPSK, 每个用户的 uPSK 在 users 的 pass 项中给出.
+*/
+
+const (
+	SS2022_AES128 = "2022-blake3-aes-128-gcm"
+	SS2022_AES256 = "2022-blake3-aes-256-gcm"
+	SS2022_Chacha = "2022-blake3-chacha20-poly1305"
+)
+
+const (
+	ss2022HeaderTypeClient = 0
+	ss2022HeaderTypeServer = 1
+
+	ss2022MaxTimeDiff     = 30 * time.Second
+	ss2022MaxPaddingLen   = 900
+	ss2022MaxPayloadLen   = 0xffff
+	ss2022TagLen          = 16
+	ss2022IdentityHashLen = 16
+
+	ss2022SessionSubkeyCtx  = "shadowsocks 2022 session subkey"
+	ss2022IdentitySubkeyCtx = "shadowsocks 2022 identity subkey"
+)
+
+var (
+	ErrSS2022BadTimestamp = errors.New("ss2022 timestamp out of range")
+	ErrSS2022RepeatedSalt = errors.New("ss2022 repeated salt")
+	ErrSS2022BadType      = errors.New("ss2022 wrong header type")
+	ErrSS2022NoUser       = errors.New("ss2022 identity header matches no user")
+)
+
+func IsSS2022Method(method string) bool {
+	return strings.HasPrefix(strings.ToLower(method), "2022-")
+}
+
+func ss2022KeyLen(method string) int {
+	switch strings.ToLower(method) {
+	case SS2022_AES128:
+		return 16
+	case SS2022_AES256, SS2022_Chacha:
+		return 32
+	}
+	return 0
+}
+
+// 解析 base64 编码的 PSK, 并检查长度
+func ss2022DecodePSK(str string, keyLen int) ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "ss2022 psk is not valid base64", ErrDetail: err, Data: str}
+	}
+	if len(k) != keyLen {
+		return nil, utils.ErrInErr{ErrDesc: "ss2022 psk length wrong", ErrDetail: utils.ErrInvalidData, Data: len(k)}
+	}
+	return k, nil
+}
+
+// 服务端 EIH 模式下的用户, 以 UserConf.User 为 IdentityStr. 实现 utils.User
+type ss2022User struct {
+	name string
+	pass string
+	psk  []byte
+}
+
+func (u *ss2022User) IdentityStr() string   { return u.name }
+func (u *ss2022User) IdentityBytes() []byte { return []byte(u.name) }
+func (u *ss2022User) AuthStr() string       { return u.name + "\n" + u.pass }
+func (u *ss2022User) AuthBytes() []byte     { return []byte(u.AuthStr()) }
+
+// ss2022 一端的 密钥信息
+type ss2022Keys struct {
+	method   string
+	keyLen   int
+	isChacha bool
+
+	//客户端: 依次为 各个 iPSK, 最后一个为 uPSK; 单用户时 只有一个.
+	//服务端: 只有一个, 为 iPSK 或 单用户的 PSK.
+	psks [][]byte
+
+	//服务端 EIH 用户, key 为 blake3.Sum512(uPSK)[:16]
+	users map[[ss2022IdentityHashLen]byte]*ss2022User
+
+	saltPool *ss2022SaltPool
+}
+
+// password 中, 多个 PSK 以冒号分隔
+func newSS2022Keys(method, password string) (*ss2022Keys, error) {
+	method = strings.ToLower(method)
+	k := &ss2022Keys{
+		method:   method,
+		keyLen:   ss2022KeyLen(method),
+		isChacha: method == SS2022_Chacha,
+	}
+	if k.keyLen == 0 {
+		return nil, utils.ErrInErr{ErrDesc: "unknown ss2022 method", ErrDetail: utils.ErrInvalidData, Data: method}
+	}
+
+	strs := strings.Split(password, ":")
+	if len(strs) > 1 && k.isChacha {
+		return nil, utils.ErrInErr{ErrDesc: "ss2022 chacha20-poly1305 doesn't support multiple psk", ErrDetail: utils.ErrInvalidData}
+	}
+	for _, s := range strs {
+		psk, err := ss2022DecodePSK(s, k.keyLen)
+		if err != nil {
+			return nil, err
+		}
+		k.psks = append(k.psks, psk)
+	}
+	return k, nil
+}
+
+// 服务端 添加 EIH 用户. uc.Pass 为 base64 编码的 uPSK
+func (k *ss2022Keys) addUser(uc utils.UserConf) error {
+	if k.isChacha {
+		return utils.ErrInErr{ErrDesc: "ss2022 chacha20-poly1305 doesn't support multiple users", ErrDetail: utils.ErrInvalidData}
+	}
+	psk, err := ss2022DecodePSK(uc.Pass, k.keyLen)
+	if err != nil {
+		return err
+	}
+	if k.users == nil {
+		k.users = make(map[[ss2022IdentityHashLen]byte]*ss2022User)
+	}
+	k.users[ss2022IdentityHash(psk)] = &ss2022User{name: uc.User, pass: uc.Pass, psk: psk}
+	return nil
+}
+
+// 客户端 实际用于 会话 的 key, 即 uPSK
+func (k *ss2022Keys) userPSK() []byte {
+	return k.psks[len(k.psks)-1]
+}
+
+func (k *ss2022Keys) hasEIH() bool {
+	return len(k.users) > 0
+}
+
+func ss2022IdentityHash(psk []byte) (h [ss2022IdentityHashLen]byte) {
+	sum := blake3.Sum512(psk)
+	copy(h[:], sum[:])
+	return
+}
+
+func ss2022DeriveKey(ctx string, psk, salt []byte) []byte {
+	material := make([]byte, len(psk)+len(salt))
+	copy(material, psk)
+	copy(material[len(psk):], salt)
+
+	subkey := make([]byte, len(psk))
+	blake3.DeriveKey(subkey, ctx, material)
+	return subkey
+}
+
+func (k *ss2022Keys) newAEAD(key []byte) (cipher.AEAD, error) {
+	if k.isChacha {
+		return chacha20poly1305.New(key)
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// 由 psk 与 salt(或 udp 的 session id) 导出 会话 AEAD
+func (k *ss2022Keys) sessionAEAD(psk, salt []byte) (cipher.AEAD, error) {
+	return k.newAEAD(ss2022DeriveKey(ss2022SessionSubkeyCtx, psk, salt))
+}
+
+func ss2022CheckTimestamp(ts uint64) error {
+	diff := time.Since(time.Unix(int64(ts), 0))
+	if diff > ss2022MaxTimeDiff || diff < -ss2022MaxTimeDiff {
+		return utils.ErrInErr{ErrDesc: "ss2022 check timestamp failed", ErrDetail: ErrSS2022BadTimestamp, Data: diff.String()}
+	}
+	return nil
+}
+
+func ss2022PutTimestamp(bs []byte) {
+	binary.BigEndian.PutUint64(bs, uint64(time.Now().Unix()))
+}
+
+// 返回 [1, ss2022MaxPaddingLen] 之间的随机数
+func ss2022RandPaddingLen() int {
+	var b [2]byte
+	rand.Read(b[:])
+	return int(binary.BigEndian.Uint16(b[:]))%ss2022MaxPaddingLen + 1
+}
+
+// 递增 小端序的 nonce
+func ss2022IncreaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// 服务端 tcp 的 salt 防重放池. salt 保存 2*ss2022MaxTimeDiff, 超过此时间的 salt 会被 时间戳检查 拒绝.
+type ss2022SaltPool struct {
+	sync.Mutex
+	m         map[string]time.Time
+	lastPurge time.Time
+}
+
+func newSS2022SaltPool() *ss2022SaltPool {
+	return &ss2022SaltPool{m: make(map[string]time.Time)}
+}
+
+// 若 salt 已存在, 返回false; 否则 将其加入并返回true
+func (sp *ss2022SaltPool) checkAndAdd(salt []byte) bool {
+	now := time.Now()
+	sp.Lock()
+	defer sp.Unlock()
+
+	if now.Sub(sp.lastPurge) > ss2022MaxTimeDiff {
+		for k, t := range sp.m {
+			if now.Sub(t) > 2*ss2022MaxTimeDiff {
+				delete(sp.m, k)
+			}
+		}
+		sp.lastPurge = now
+	}
+
+	key := string(salt)
+	if t, ok := sp.m[key]; ok && now.Sub(t) <= 2*ss2022MaxTimeDiff {
+		return false
+	}
+	sp.m[key] = now
+	return true
+}
+
+// udp 的 packet id 滑动窗口 防重放过滤器
+type ss2022ReplayWindow struct {
+	last   uint64
+	bitmap uint64
+	inited bool
+}
+
+const ss2022ReplayWindowSize = 64
+
+// 若 id 可接受, 则记录之并返回true
+func (w *ss2022ReplayWindow) check(id uint64) bool {
+	if !w.inited {
+		w.inited = true
+		w.last = id
+		w.bitmap = 1
+		return true
+	}
+	if id > w.last {
+		shift := id - w.last
+		if shift >= ss2022ReplayWindowSize {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.last = id
+		return true
+	}
+	diff := w.last - id
+	if diff >= ss2022ReplayWindowSize {
+		return false
+	}
+	mask := uint64(1) << diff
+	if w.bitmap&mask != 0 {
+		return false
+	}
+	w.bitmap |= mask
+	return true
+}
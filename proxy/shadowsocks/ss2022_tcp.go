@@ -0,0 +1,328 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// ss2022 的 tcp 连接. 读写两个方向 各自使用 由各自的 salt 导出的 AEAD, nonce 均从0开始.
+//
+// 客户端: 握手时 即发出请求头, 第一次 Read 时 读取响应头.
+// 服务端: 握手时 读取请求头, 第一次 Write 时 发出响应头.
+type ss2022StreamConn struct {
+	net.Conn
+	keys *ss2022Keys
+
+	psk []byte //会话所用的 key, 即 uPSK 或 单用户的 PSK
+
+	requestSalt []byte
+
+	readAEAD  cipher.AEAD
+	readNonce []byte
+	readBuf   []byte //已解密 但尚未被读走的数据
+
+	writeAEAD  cipher.AEAD
+	writeNonce []byte
+}
+
+func (c *ss2022StreamConn) seal(dst, plain []byte) []byte {
+	dst = c.writeAEAD.Seal(dst, c.writeNonce, plain, nil)
+	ss2022IncreaseNonce(c.writeNonce)
+	return dst
+}
+
+func (c *ss2022StreamConn) open(ciphertext []byte) ([]byte, error) {
+	plain, err := c.readAEAD.Open(ciphertext[:0], c.readNonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	ss2022IncreaseNonce(c.readNonce)
+	return plain, nil
+}
+
+// 从 r 读出 n 字节密文 并解密
+func (c *ss2022StreamConn) readAndOpen(r io.Reader, n int) ([]byte, error) {
+	bs := make([]byte, n+ss2022TagLen)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, err
+	}
+	return c.open(bs)
+}
+
+// 将 p 按 长度块+数据块 的格式 加密后 追加到 dst
+func (c *ss2022StreamConn) sealChunks(dst, p []byte) []byte {
+	var lenbs [2]byte
+	for len(p) > 0 {
+		n := len(p)
+		if n > ss2022MaxPayloadLen {
+			n = ss2022MaxPayloadLen
+		}
+		binary.BigEndian.PutUint16(lenbs[:], uint16(n))
+		dst = c.seal(dst, lenbs[:])
+		dst = c.seal(dst, p[:n])
+		p = p[n:]
+	}
+	return dst
+}
+
+// 客户端 发出请求头. firstPayload 中 放不进 请求头 的部分 会以普通数据块的形式 紧随其后发出.
+func (c *ss2022StreamConn) writeRequest(firstPayload []byte, target netLayer.Addr) error {
+	keyLen := c.keys.keyLen
+	salt := make([]byte, keyLen)
+	rand.Read(salt)
+	c.requestSalt = salt
+
+	var err error
+	c.writeAEAD, err = c.keys.sessionAEAD(c.psk, salt)
+	if err != nil {
+		return err
+	}
+	c.writeNonce = make([]byte, c.writeAEAD.NonceSize())
+
+	buf := bytes.NewBuffer(make([]byte, 0, keyLen+utils.MTU))
+	buf.Write(salt)
+
+	//EIH: 对每一个 iPSK, 用 由其导出的 identity subkey 加密 下一个 PSK 的 hash
+	psks := c.keys.psks
+	for i := 0; i+1 < len(psks); i++ {
+		b, err := aes.NewCipher(ss2022DeriveKey(ss2022IdentitySubkeyCtx, psks[i], salt))
+		if err != nil {
+			return err
+		}
+		h := ss2022IdentityHash(psks[i+1])
+		var eih [ss2022IdentityHashLen]byte
+		b.Encrypt(eih[:], h[:])
+		buf.Write(eih[:])
+	}
+
+	abuf := makeWriteBuf(nil, target)
+	addrbs := abuf.Bytes()
+
+	var paddingLen int
+	if len(firstPayload) == 0 {
+		paddingLen = ss2022RandPaddingLen()
+	}
+
+	var rest []byte
+	if maxPayload := ss2022MaxPayloadLen - len(addrbs) - 2 - paddingLen; len(firstPayload) > maxPayload {
+		rest = firstPayload[maxPayload:]
+		firstPayload = firstPayload[:maxPayload]
+	}
+
+	varHeader := make([]byte, 0, len(addrbs)+2+paddingLen+len(firstPayload))
+	varHeader = append(varHeader, addrbs...)
+	utils.PutBuf(abuf)
+	varHeader = binary.BigEndian.AppendUint16(varHeader, uint16(paddingLen))
+	if paddingLen > 0 {
+		padding := make([]byte, paddingLen)
+		rand.Read(padding)
+		varHeader = append(varHeader, padding...)
+	}
+	varHeader = append(varHeader, firstPayload...)
+
+	var fixedHeader [11]byte
+	fixedHeader[0] = ss2022HeaderTypeClient
+	ss2022PutTimestamp(fixedHeader[1:9])
+	binary.BigEndian.PutUint16(fixedHeader[9:], uint16(len(varHeader)))
+
+	out := c.seal(buf.Bytes(), fixedHeader[:])
+	out = c.seal(out, varHeader)
+	out = c.sealChunks(out, rest)
+
+	_, err = c.Conn.Write(out)
+	return err
+}
+
+// 客户端 读取响应头 以及 第一个数据块
+func (c *ss2022StreamConn) readResponse() error {
+	keyLen := c.keys.keyLen
+	salt := make([]byte, keyLen)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	var err error
+	c.readAEAD, err = c.keys.sessionAEAD(c.psk, salt)
+	if err != nil {
+		return err
+	}
+	c.readNonce = make([]byte, c.readAEAD.NonceSize())
+
+	fixedHeader, err := c.readAndOpen(c.Conn, 1+8+keyLen+2)
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "ss2022 open response header failed", ErrDetail: err}
+	}
+	if fixedHeader[0] != ss2022HeaderTypeServer {
+		return utils.ErrInErr{ErrDesc: "ss2022 read response header", ErrDetail: ErrSS2022BadType, Data: fixedHeader[0]}
+	}
+	if err = ss2022CheckTimestamp(binary.BigEndian.Uint64(fixedHeader[1:9])); err != nil {
+		return err
+	}
+	if !bytes.Equal(fixedHeader[9:9+keyLen], c.requestSalt) {
+		return utils.ErrInErr{ErrDesc: "ss2022 response request salt mismatch", ErrDetail: utils.ErrInvalidData}
+	}
+	l := int(binary.BigEndian.Uint16(fixedHeader[9+keyLen:]))
+
+	c.readBuf, err = c.readAndOpen(c.Conn, l)
+	return err
+}
+
+// 服务端 读取请求头, 返回 目标地址 以及 所认证的用户(非EIH时为nil). r 为 underlay, 可能被记录以用于回落.
+func (c *ss2022StreamConn) readRequest(r io.Reader, saltPool *ss2022SaltPool) (target netLayer.Addr, user *ss2022User, err error) {
+	keyLen := c.keys.keyLen
+	salt := make([]byte, keyLen)
+	if _, err = io.ReadFull(r, salt); err != nil {
+		return
+	}
+	c.requestSalt = salt
+	c.psk = c.keys.psks[0]
+
+	if c.keys.hasEIH() {
+		var eih [ss2022IdentityHashLen]byte
+		if _, err = io.ReadFull(r, eih[:]); err != nil {
+			return
+		}
+		var b cipher.Block
+		b, err = aes.NewCipher(ss2022DeriveKey(ss2022IdentitySubkeyCtx, c.psk, salt))
+		if err != nil {
+			return
+		}
+		b.Decrypt(eih[:], eih[:])
+		user = c.keys.users[eih]
+		if user == nil {
+			err = ErrSS2022NoUser
+			return
+		}
+		c.psk = user.psk
+	}
+
+	c.readAEAD, err = c.keys.sessionAEAD(c.psk, salt)
+	if err != nil {
+		return
+	}
+	c.readNonce = make([]byte, c.readAEAD.NonceSize())
+
+	var fixedHeader []byte
+	fixedHeader, err = c.readAndOpen(r, 11)
+	if err != nil {
+		err = utils.ErrInErr{ErrDesc: "ss2022 open request header failed", ErrDetail: err}
+		return
+	}
+	if fixedHeader[0] != ss2022HeaderTypeClient {
+		err = utils.ErrInErr{ErrDesc: "ss2022 read request header", ErrDetail: ErrSS2022BadType, Data: fixedHeader[0]}
+		return
+	}
+	if err = ss2022CheckTimestamp(binary.BigEndian.Uint64(fixedHeader[1:9])); err != nil {
+		return
+	}
+	if !saltPool.checkAndAdd(salt) {
+		err = ErrSS2022RepeatedSalt
+		return
+	}
+
+	var varHeader []byte
+	varHeader, err = c.readAndOpen(r, int(binary.BigEndian.Uint16(fixedHeader[9:])))
+	if err != nil {
+		err = utils.ErrInErr{ErrDesc: "ss2022 open request variable header failed", ErrDetail: err}
+		return
+	}
+	vbuf := bytes.NewBuffer(varHeader)
+	target, err = GetAddrFrom(vbuf)
+	if err != nil {
+		return
+	}
+	var plbs [2]byte
+	if _, err = io.ReadFull(vbuf, plbs[:]); err != nil {
+		return
+	}
+	paddingLen := int(binary.BigEndian.Uint16(plbs[:]))
+	if paddingLen > ss2022MaxPaddingLen || paddingLen > vbuf.Len() {
+		err = utils.ErrInErr{ErrDesc: "ss2022 padding length wrong", ErrDetail: utils.ErrInvalidData, Data: paddingLen}
+		return
+	}
+	vbuf.Next(paddingLen)
+	c.readBuf = vbuf.Bytes()
+	if paddingLen == 0 && len(c.readBuf) == 0 {
+		err = utils.ErrInErr{ErrDesc: "ss2022 request has neither padding nor payload", ErrDetail: utils.ErrInvalidData}
+	}
+	return
+}
+
+// 服务端 第一次写入时, 发出响应头, 并将 p 的开头 作为第一个数据块.
+func (c *ss2022StreamConn) writeResponse(p []byte) (int, error) {
+	keyLen := c.keys.keyLen
+	salt := make([]byte, keyLen)
+	rand.Read(salt)
+
+	var err error
+	c.writeAEAD, err = c.keys.sessionAEAD(c.psk, salt)
+	if err != nil {
+		return 0, err
+	}
+	c.writeNonce = make([]byte, c.writeAEAD.NonceSize())
+
+	first := p
+	if len(first) > ss2022MaxPayloadLen {
+		first = first[:ss2022MaxPayloadLen]
+	}
+
+	fixedHeader := make([]byte, 0, 1+8+keyLen+2)
+	fixedHeader = append(fixedHeader, ss2022HeaderTypeServer)
+	fixedHeader = binary.BigEndian.AppendUint64(fixedHeader, 0)
+	ss2022PutTimestamp(fixedHeader[1:9])
+	fixedHeader = append(fixedHeader, c.requestSalt...)
+	fixedHeader = binary.BigEndian.AppendUint16(fixedHeader, uint16(len(first)))
+
+	out := make([]byte, 0, keyLen+len(fixedHeader)+len(p)+4*ss2022TagLen)
+	out = append(out, salt...)
+	out = c.seal(out, fixedHeader)
+	out = c.seal(out, first)
+	out = c.sealChunks(out, p[len(first):])
+
+	if _, err = c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *ss2022StreamConn) Read(p []byte) (int, error) {
+	if c.readAEAD == nil {
+		if err := c.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+	for len(c.readBuf) == 0 {
+		lenbs, err := c.readAndOpen(c.Conn, 2)
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf, err = c.readAndOpen(c.Conn, int(binary.BigEndian.Uint16(lenbs)))
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *ss2022StreamConn) Write(p []byte) (int, error) {
+	if c.writeAEAD == nil {
+		return c.writeResponse(p)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	out := c.sealChunks(make([]byte, 0, len(p)+(len(p)/ss2022MaxPayloadLen+1)*(2+2*ss2022TagLen)), p)
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,193 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const (
+	testIPSK  = "MTIzNDU2Nzg5MGFiY2RlZg=="
+	testUPSK1 = "YWJjZGVmMTIzNDU2Nzg5MA=="
+	testUPSK2 = "cXdlcnR5dWlvcGFzZGZnaA=="
+)
+
+func newTestEIHServer(t *testing.T) *Server {
+	s, err := newServer(MethodPass{Method: SS2022_AES128, Password: testIPSK}, &proxy.ListenConf{
+		Users: []utils.UserConf{
+			{User: "u1", Pass: testUPSK1},
+			{User: "u2", Pass: testUPSK2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSS2022_EIH_TCP(t *testing.T) {
+	s := newTestEIHServer(t)
+
+	c, err := newClient(MethodPass{Method: SS2022_AES128, Password: testIPSK + ":" + testUPSK2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := netLayer.Addr{Name: "dummy.com", Port: 80}
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	go func() {
+		wlc, _, targetAddr, err := s.Handshake(sc)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if targetAddr.String() != target.String() {
+			t.Error("target wrong", targetAddr.String())
+			return
+		}
+		if u, ok := wlc.(utils.User); !ok || u.IdentityStr() != "u2" {
+			t.Error("user wrong")
+			return
+		}
+		var hello [5]byte
+		io.ReadFull(wlc, hello[:])
+		if string(hello[:]) != "hello" {
+			t.Error("hello wrong", hello)
+			return
+		}
+		wlc.Write([]byte("world"))
+	}()
+
+	wrc, err := c.Handshake(cc, []byte("hello"), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var world [5]byte
+	if _, err = io.ReadFull(wrc, world[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(world[:]) != "world" {
+		t.Fatal("world wrong", world)
+	}
+}
+
+func TestSS2022_EIH_UnknownUser(t *testing.T) {
+	s := newTestEIHServer(t)
+
+	c, err := newClient(MethodPass{Method: SS2022_AES128, Password: testIPSK + ":" + testIPSK})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	defer sc.Close()
+
+	go c.Handshake(cc, []byte("hello"), netLayer.Addr{Name: "dummy.com", Port: 80})
+
+	_, _, _, err = s.Handshake(sc)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+	if _, ok := err.(*utils.ErrBuffer); !ok {
+		t.Fatal("should return ErrBuffer for fallback", err)
+	}
+}
+
+func TestSS2022_UDP(t *testing.T) {
+	for _, m := range []MethodPass{
+		{Method: SS2022_AES128, Password: testIPSK + ":" + testUPSK1},
+		{Method: SS2022_Chacha, Password: "MTIzNDU2Nzg5MGFiY2RlZjEyMzQ1Njc4OTBhYmNkZWY="},
+	} {
+		var s *Server
+		if m.Method == SS2022_AES128 {
+			s = newTestEIHServer(t)
+		} else {
+			var err error
+			s, err = newServer(m, &proxy.ListenConf{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		c, err := newClient(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		suc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cuc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spc := s.ss2022.serverPacketConn(suc).(*ss2022ServerPacketConn)
+		cpc, err := c.ss2022.clientPacketConn(cuc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		target := netLayer.Addr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 53}
+		wb := makeWriteBuf([]byte("hello"), target)
+		if _, err = cpc.WriteTo(wb.Bytes(), suc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+
+		bs := make([]byte, utils.MaxPacketLen)
+		n, from, err := spc.ReadFrom(bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs[:n], wb.Bytes()) {
+			t.Fatal("server read wrong", bs[:n])
+		}
+		if m.Method == SS2022_AES128 {
+			if u := spc.userOf(from); u == nil || u.IdentityStr() != "u1" {
+				t.Fatal("udp user wrong", u)
+			}
+		}
+
+		if _, err = spc.WriteTo(wb.Bytes(), from); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err = cpc.ReadFrom(bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bs[:n], wb.Bytes()) {
+			t.Fatal("client read wrong", bs[:n])
+		}
+
+		utils.PutBuf(wb)
+		suc.Close()
+		cuc.Close()
+	}
+}
+
+func TestSS2022ReplayWindow(t *testing.T) {
+	var w ss2022ReplayWindow
+	for _, id := range []uint64{0, 1, 5, 3, 100} {
+		if !w.check(id) {
+			t.Fatal("should accept", id)
+		}
+	}
+	for _, id := range []uint64{0, 1, 5, 3, 100, 30} {
+		if w.check(id) {
+			t.Fatal("should reject", id)
+		}
+	}
+	if !w.check(99) {
+		t.Fatal("should accept 99")
+	}
+}
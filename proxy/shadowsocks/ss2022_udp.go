@@ -0,0 +1,449 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/*
+ss2022 的 udp 包格式
+
+aes 系列:
+
+	AES-ECB(session id + packet id) | [EIH] | AEAD(body)
+
+	AEAD 的 key 由 PSK 与 session id 导出, nonce 为 separate header 的 后12字节.
+
+chacha20-poly1305:
+
+	nonce(24) | XChaCha20-Poly1305(PSK)(session id + packet id + body)
+
+客户端的 body: type | timestamp | padding length | padding | socks addr | payload
+
+服务端的 body: type | timestamp | client session id | padding length | padding | socks addr | payload
+
+ss2022 的 PacketConn 读写的 都是 socks addr + payload, 与 core.Cipher.PacketConn 一致, 所以 可以直接替代之.
+*/
+
+const (
+	ss2022SeparateHeaderLen = 16
+	ss2022XNonceLen         = chacha20poly1305.NonceSizeX
+)
+
+// udp 一个方向上的 会话状态
+type ss2022UDPSession struct {
+	id       [8]byte
+	packetID uint64
+	aead     cipher.AEAD
+	window   ss2022ReplayWindow
+	lastSeen time.Time
+}
+
+func newSS2022UDPSession(keys *ss2022Keys, psk []byte, id []byte) (*ss2022UDPSession, error) {
+	s := &ss2022UDPSession{lastSeen: time.Now()}
+	copy(s.id[:], id)
+	if !keys.isChacha {
+		var err error
+		s.aead, err = keys.sessionAEAD(psk, s.id[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func newSS2022UDPSessionRandom(keys *ss2022Keys, psk []byte) (*ss2022UDPSession, error) {
+	var id [8]byte
+	rand.Read(id[:])
+	return newSS2022UDPSession(keys, psk, id[:])
+}
+
+// 将 body 封装为 ss2022 udp 包. headerKey 为 加密 separate header 所用的 key, psks 非空时 写入 EIH.
+func (keys *ss2022Keys) sealPacket(s *ss2022UDPSession, headerKey []byte, eihPSKs [][]byte, body []byte) ([]byte, error) {
+	var header [ss2022SeparateHeaderLen]byte
+	copy(header[:8], s.id[:])
+	binary.BigEndian.PutUint64(header[8:], s.packetID)
+	s.packetID++
+
+	if keys.isChacha {
+		aead, err := chacha20poly1305.NewX(keys.psks[0])
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, ss2022XNonceLen, ss2022XNonceLen+len(header)+len(body)+ss2022TagLen)
+		rand.Read(out)
+		plain := make([]byte, 0, len(header)+len(body))
+		plain = append(plain, header[:]...)
+		plain = append(plain, body...)
+		return aead.Seal(out, out[:ss2022XNonceLen], plain, nil), nil
+	}
+
+	out := make([]byte, ss2022SeparateHeaderLen, ss2022SeparateHeaderLen*(1+len(eihPSKs))+len(body)+ss2022TagLen)
+
+	for i := 0; i+1 < len(eihPSKs); i++ {
+		b, err := aes.NewCipher(eihPSKs[i])
+		if err != nil {
+			return nil, err
+		}
+		h := ss2022IdentityHash(eihPSKs[i+1])
+		var eih [ss2022IdentityHashLen]byte
+		for j := range eih {
+			eih[j] = h[j] ^ header[j]
+		}
+		b.Encrypt(eih[:], eih[:])
+		out = append(out, eih[:]...)
+	}
+
+	b, err := aes.NewCipher(headerKey)
+	if err != nil {
+		return nil, err
+	}
+	b.Encrypt(out[:ss2022SeparateHeaderLen], header[:])
+
+	return s.aead.Seal(out, header[4:], body, nil), nil
+}
+
+// 解出 separate header. aes 系列时 返回的 rest 为 包中 separate header 之后的部分(可能含 EIH);
+// chacha 时 返回的 rest 为 已解密的 body.
+func (keys *ss2022Keys) openPacketHeader(headerKey []byte, packet []byte) (header [ss2022SeparateHeaderLen]byte, rest []byte, err error) {
+	if keys.isChacha {
+		if len(packet) < ss2022XNonceLen+ss2022SeparateHeaderLen+ss2022TagLen {
+			err = utils.ErrShortRead
+			return
+		}
+		var aead cipher.AEAD
+		aead, err = chacha20poly1305.NewX(keys.psks[0])
+		if err != nil {
+			return
+		}
+		var plain []byte
+		plain, err = aead.Open(nil, packet[:ss2022XNonceLen], packet[ss2022XNonceLen:], nil)
+		if err != nil {
+			return
+		}
+		copy(header[:], plain)
+		rest = plain[ss2022SeparateHeaderLen:]
+		return
+	}
+
+	if len(packet) < ss2022SeparateHeaderLen+ss2022TagLen {
+		err = utils.ErrShortRead
+		return
+	}
+	var b cipher.Block
+	b, err = aes.NewCipher(headerKey)
+	if err != nil {
+		return
+	}
+	b.Decrypt(header[:], packet[:ss2022SeparateHeaderLen])
+	rest = packet[ss2022SeparateHeaderLen:]
+	return
+}
+
+// 解密 body(aes 系列时), 检查类型与时间戳, 跳过 padding, 返回 socks addr + payload.
+// 若 wantType 为 ss2022HeaderTypeServer, 还会返回 body 中的 client session id.
+func (keys *ss2022Keys) openPacketBody(s *ss2022UDPSession, header [ss2022SeparateHeaderLen]byte, rest []byte, wantType byte) (payload []byte, clientSID []byte, err error) {
+	body := rest
+	if !keys.isChacha {
+		body, err = s.aead.Open(rest[:0], header[4:], rest, nil)
+		if err != nil {
+			return
+		}
+	}
+
+	buf := bytes.NewBuffer(body)
+	var fixed [9]byte
+	if _, err = io.ReadFull(buf, fixed[:]); err != nil {
+		return
+	}
+	if fixed[0] != wantType {
+		err = utils.ErrInErr{ErrDesc: "ss2022 udp", ErrDetail: ErrSS2022BadType, Data: fixed[0]}
+		return
+	}
+	if err = ss2022CheckTimestamp(binary.BigEndian.Uint64(fixed[1:])); err != nil {
+		return
+	}
+	if wantType == ss2022HeaderTypeServer {
+		clientSID = buf.Next(8)
+		if len(clientSID) != 8 {
+			err = utils.ErrShortRead
+			return
+		}
+	}
+	var plbs [2]byte
+	if _, err = io.ReadFull(buf, plbs[:]); err != nil {
+		return
+	}
+	paddingLen := int(binary.BigEndian.Uint16(plbs[:]))
+	if paddingLen > buf.Len() {
+		err = utils.ErrInErr{ErrDesc: "ss2022 udp padding length wrong", ErrDetail: utils.ErrInvalidData, Data: paddingLen}
+		return
+	}
+	buf.Next(paddingLen)
+
+	if !s.window.check(binary.BigEndian.Uint64(header[8:])) {
+		err = utils.ErrInErr{ErrDesc: "ss2022 udp replayed packet", ErrDetail: utils.ErrInvalidData}
+		return
+	}
+	s.lastSeen = time.Now()
+	payload = buf.Bytes()
+	return
+}
+
+// 客户端的 ss2022 udp PacketConn
+type ss2022ClientPacketConn struct {
+	net.PacketConn
+	keys *ss2022Keys
+
+	mutex          sync.Mutex
+	session        *ss2022UDPSession
+	serverSessions map[[8]byte]*ss2022UDPSession
+}
+
+func (keys *ss2022Keys) clientPacketConn(pc net.PacketConn) (net.PacketConn, error) {
+	s, err := newSS2022UDPSessionRandom(keys, keys.userPSK())
+	if err != nil {
+		return nil, err
+	}
+	return &ss2022ClientPacketConn{
+		PacketConn:     pc,
+		keys:           keys,
+		session:        s,
+		serverSessions: make(map[[8]byte]*ss2022UDPSession),
+	}, nil
+}
+
+func (c *ss2022ClientPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	body := make([]byte, 11, 11+len(p))
+	body[0] = ss2022HeaderTypeClient
+	ss2022PutTimestamp(body[1:9])
+	body = append(body, p...)
+
+	c.mutex.Lock()
+	packet, err := c.keys.sealPacket(c.session, c.keys.psks[0], c.keys.psks, body)
+	c.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *ss2022ClientPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		payload, err := c.open(p[:n])
+		if err != nil {
+			if ce := utils.CanLogDebug("ss2022 client drop udp packet"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+			continue
+		}
+		return copy(p, payload), addr, nil
+	}
+}
+
+func (c *ss2022ClientPacketConn) open(packet []byte) ([]byte, error) {
+	header, rest, err := c.keys.openPacketHeader(c.keys.userPSK(), packet)
+	if err != nil {
+		return nil, err
+	}
+	var sid [8]byte
+	copy(sid[:], header[:8])
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ss := c.serverSessions[sid]
+	if ss == nil {
+		ss, err = newSS2022UDPSession(c.keys, c.keys.userPSK(), sid[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	payload, clientSID, err := c.keys.openPacketBody(ss, header, rest, ss2022HeaderTypeServer)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(clientSID, c.session.id[:]) {
+		return nil, utils.ErrInErr{ErrDesc: "ss2022 udp client session id mismatch", ErrDetail: utils.ErrInvalidData}
+	}
+	c.serverSessions[sid] = ss
+	return payload, nil
+}
+
+// 服务端 对 某个客户端会话 的状态
+type ss2022ServerUDPClient struct {
+	user   *ss2022User //非EIH时为nil
+	psk    []byte
+	client *ss2022UDPSession
+	server *ss2022UDPSession
+}
+
+// 服务端的 ss2022 udp PacketConn. 客户端会话 以 client session id 区分, 回复时 按 地址 找到 最近使用该地址的会话.
+type ss2022ServerPacketConn struct {
+	net.PacketConn
+	keys *ss2022Keys
+
+	mutex     sync.Mutex
+	clients   map[[8]byte]*ss2022ServerUDPClient
+	addrs     map[string]*ss2022ServerUDPClient
+	lastPurge time.Time
+}
+
+func (keys *ss2022Keys) serverPacketConn(pc net.PacketConn) net.PacketConn {
+	return &ss2022ServerPacketConn{
+		PacketConn: pc,
+		keys:       keys,
+		clients:    make(map[[8]byte]*ss2022ServerUDPClient),
+		addrs:      make(map[string]*ss2022ServerUDPClient),
+	}
+}
+
+// 返回 最近从 addr 发来的 会话 所认证的用户; 非EIH时 返回nil
+func (c *ss2022ServerPacketConn) userOf(addr net.Addr) utils.User {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if sc := c.addrs[addr.String()]; sc != nil && sc.user != nil {
+		return sc.user
+	}
+	return nil
+}
+
+func (c *ss2022ServerPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		payload, err := c.open(p[:n], addr)
+		if err != nil {
+			if ce := utils.CanLogDebug("ss2022 server drop udp packet"); ce != nil {
+				ce.Write(zap.String("from", addr.String()), zap.Error(err))
+			}
+			continue
+		}
+		return copy(p, payload), addr, nil
+	}
+}
+
+func (c *ss2022ServerPacketConn) open(packet []byte, addr net.Addr) ([]byte, error) {
+	keys := c.keys
+	header, rest, err := keys.openPacketHeader(keys.psks[0], packet)
+	if err != nil {
+		return nil, err
+	}
+	var sid [8]byte
+	copy(sid[:], header[:8])
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.purge_nolock()
+
+	sc := c.clients[sid]
+	if sc == nil {
+		sc = &ss2022ServerUDPClient{psk: keys.psks[0]}
+
+		if keys.hasEIH() {
+			if len(rest) < ss2022IdentityHashLen {
+				return nil, utils.ErrShortRead
+			}
+			b, err := aes.NewCipher(keys.psks[0])
+			if err != nil {
+				return nil, err
+			}
+			var eih [ss2022IdentityHashLen]byte
+			b.Decrypt(eih[:], rest[:ss2022IdentityHashLen])
+			for i := range eih {
+				eih[i] ^= header[i]
+			}
+			sc.user = keys.users[eih]
+			if sc.user == nil {
+				return nil, ErrSS2022NoUser
+			}
+			sc.psk = sc.user.psk
+		}
+
+		sc.client, err = newSS2022UDPSession(keys, sc.psk, sid[:])
+		if err != nil {
+			return nil, err
+		}
+		sc.server, err = newSS2022UDPSessionRandom(keys, sc.psk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if keys.hasEIH() {
+		rest = rest[ss2022IdentityHashLen:]
+	}
+
+	payload, _, err := keys.openPacketBody(sc.client, header, rest, ss2022HeaderTypeClient)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[sid] = sc
+	c.addrs[addr.String()] = sc
+	return payload, nil
+}
+
+// 清除 超时的会话. 调用前须持有mutex
+func (c *ss2022ServerPacketConn) purge_nolock() {
+	now := time.Now()
+	if now.Sub(c.lastPurge) < netLayer.UDP_timeout {
+		return
+	}
+	c.lastPurge = now
+	for sid, sc := range c.clients {
+		if now.Sub(sc.client.lastSeen) > netLayer.UDP_timeout {
+			delete(c.clients, sid)
+		}
+	}
+	for a, sc := range c.addrs {
+		if now.Sub(sc.client.lastSeen) > netLayer.UDP_timeout {
+			delete(c.addrs, a)
+		}
+	}
+}
+
+func (c *ss2022ServerPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	sc := c.addrs[addr.String()]
+	if sc == nil {
+		c.mutex.Unlock()
+		return 0, utils.ErrInErr{ErrDesc: "ss2022 udp write to unknown client", ErrDetail: net.ErrClosed, Data: addr.String()}
+	}
+
+	body := make([]byte, 19, 19+len(p))
+	body[0] = ss2022HeaderTypeServer
+	ss2022PutTimestamp(body[1:9])
+	copy(body[9:17], sc.client.id[:])
+	body = append(body, p...)
+
+	packet, err := c.keys.sealPacket(sc.server, sc.psk, nil, body)
+	c.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
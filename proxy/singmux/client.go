@@ -0,0 +1,86 @@
+package singmux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func init() {
+	proxy.RegisterClient(Name, ClientCreator{})
+}
+
+type ClientCreator struct{ proxy.CreatorCommonStruct }
+
+func (ClientCreator) URLToDialConf(u *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	if dc == nil {
+		dc = &proxy.DialConf{}
+	}
+	return dc, nil
+}
+
+func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	return &Client{}, nil
+}
+
+type Client struct {
+	proxy.Base
+}
+
+func (*Client) GetCreator() proxy.ClientCreator {
+	return ClientCreator{}
+}
+
+func (*Client) Name() string {
+	return Name
+}
+
+func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	if target.Port <= 0 {
+		return nil, errors.New("singmux Client Handshake failed, target port invalid")
+	}
+	buf := utils.GetBuf()
+	buf.Write([]byte{0, 0}) //flags
+	writeAddr(buf, target)
+	if len(firstPayload) > 0 {
+		buf.Write(firstPayload)
+		utils.PutBytes(firstPayload)
+	}
+
+	_, err := underlay.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientConn{Conn: underlay}, nil
+}
+
+// 总是 使用 带有地址 的 udp 格式, 这样 才能 支持 fullcone
+func (c *Client) EstablishUDPChannel(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	if target.Port <= 0 {
+		return nil, errors.New("singmux Client EstablishUDPChannel failed, target port invalid")
+	}
+	buf := utils.GetBuf()
+	buf.Write([]byte{0, byte(flagUDP | flagAddr)})
+	writeAddr(buf, target)
+
+	uc := &UDPConn{
+		Conn:         underlay,
+		isClient:     true,
+		packetAddr:   true,
+		target:       target,
+		handshakeBuf: buf,
+		fullcone:     c.IsFullcone,
+	}
+
+	if len(firstPayload) == 0 {
+		return uc, nil
+	} else {
+		return uc, uc.WriteMsg(firstPayload, target)
+	}
+}
@@ -0,0 +1,132 @@
+package singmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 客户端 的 tcp 流, 第一次 Read 时 先读取 服务端的 状态
+type ClientConn struct {
+	net.Conn
+	statusRead bool
+}
+
+func (c *ClientConn) Read(p []byte) (int, error) {
+	if !c.statusRead {
+		c.statusRead = true
+		if err := readStatus(c.Conn); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+// 服务端 的 tcp 流, 第一次 Write 时 先写入 成功状态. 实现 utils.User, utils.UserAssigner
+type ServerConn struct {
+	net.Conn
+	upstreamUser
+	statusWritten bool
+}
+
+func (c *ServerConn) Write(p []byte) (int, error) {
+	if c.statusWritten {
+		return c.Conn.Write(p)
+	}
+	c.statusWritten = true
+
+	buf := utils.GetBuf()
+	buf.WriteByte(statusSuccess)
+	buf.Write(p)
+	_, err := c.Conn.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// implements netLayer.MsgConn, utils.User, utils.UserAssigner
+type UDPConn struct {
+	net.Conn
+	upstreamUser
+
+	isClient   bool
+	packetAddr bool          //每个包 是否 带有 地址
+	target     netLayer.Addr //不带地址 时 的 目标
+
+	handshakeBuf *bytes.Buffer //客户端 在 第一次 WriteMsg 时 写入 流请求
+
+	statusRead    bool
+	statusWritten bool
+
+	fullcone bool
+}
+
+func (u *UDPConn) Fullcone() bool {
+	return u.fullcone
+}
+
+func (u *UDPConn) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return u.Close()
+}
+
+func (u *UDPConn) ReadMsg() ([]byte, netLayer.Addr, error) {
+	if u.isClient && !u.statusRead {
+		u.statusRead = true
+		if err := readStatus(u.Conn); err != nil {
+			return nil, netLayer.Addr{}, err
+		}
+	}
+
+	addr := u.target
+	if u.packetAddr {
+		var err error
+		addr, err = readAddr(u.Conn)
+		if err != nil {
+			return nil, addr, err
+		}
+		addr.Network = "udp"
+	}
+
+	var lenbs [2]byte
+	if _, err := io.ReadFull(u.Conn, lenbs[:]); err != nil {
+		return nil, addr, err
+	}
+	bs := make([]byte, binary.BigEndian.Uint16(lenbs[:]))
+	if _, err := io.ReadFull(u.Conn, bs); err != nil {
+		return nil, addr, err
+	}
+	return bs, addr, nil
+}
+
+func (u *UDPConn) WriteMsg(p []byte, peer netLayer.Addr) error {
+	if len(p) > 65535 {
+		return utils.ErrInErr{ErrDesc: "singmux: udp packet too long", Data: len(p)}
+	}
+
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	if u.handshakeBuf != nil {
+		buf.Write(u.handshakeBuf.Bytes())
+		utils.PutBuf(u.handshakeBuf)
+		u.handshakeBuf = nil
+	}
+	if !u.isClient && !u.statusWritten {
+		u.statusWritten = true
+		buf.WriteByte(statusSuccess)
+	}
+	if u.packetAddr {
+		writeAddr(buf, peer)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(p)))
+	buf.Write(p)
+
+	_, err := u.Conn.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,72 @@
+package singmux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func init() {
+	proxy.RegisterServer(Name, &ServerCreator{})
+}
+
+type ServerCreator struct{ proxy.CreatorCommonStruct }
+
+func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	return &Server{}, nil
+}
+
+func (ServerCreator) URLToListenConf(u *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	if lc == nil {
+		lc = &proxy.ListenConf{}
+	}
+	return lc, nil
+}
+
+// implements proxy.Server
+type Server struct {
+	proxy.Base
+}
+
+func (*Server) Name() string {
+	return Name
+}
+
+// 只 读取 流请求 本身, 之后的 数据 留在 underlay 中
+func (s *Server) Handshake(underlay net.Conn) (result net.Conn, msgConn netLayer.MsgConn, targetAddr netLayer.Addr, returnErr error) {
+	if err := netLayer.SetCommonReadTimeout(underlay); err != nil {
+		returnErr = err
+		return
+	}
+	defer netLayer.PersistConn(underlay)
+
+	var flagbs [2]byte
+	if _, err := io.ReadFull(underlay, flagbs[:]); err != nil {
+		returnErr = utils.ErrInErr{ErrDesc: "Err, singmux handshake, read flags", ErrDetail: err}
+		return
+	}
+	flags := binary.BigEndian.Uint16(flagbs[:])
+
+	targetAddr, err := readAddr(underlay)
+	if err != nil {
+		returnErr = utils.ErrInErr{ErrDesc: "Err, singmux handshake, read addr", ErrDetail: err}
+		return
+	}
+
+	if flags&flagUDP == 0 {
+		return &ServerConn{Conn: underlay}, nil, targetAddr, nil
+	}
+
+	targetAddr.Network = "udp"
+	return nil, &UDPConn{
+		Conn:       underlay,
+		packetAddr: flags&flagAddr != 0,
+		target:     targetAddr,
+		fullcone:   s.IsFullcone,
+	}, targetAddr, nil
+}
@@ -0,0 +1,159 @@
+/*
+Package singmux implements the stream request of sing-mux for proxy.Server and proxy.Client.
+
+它 只作为 innerMux 在 sing-mux 模式 下 的 内层代理协议 使用, 对应 传统模式 中的 simplesocks.
+
+每一条 流 的 开头 为:
+
+	flags(2) | atyp(1) | addr | port(2)
+
+地址 为 socks5 格式. flags 为 1 表示 udp, 为 3 表示 udp 且 每个包 都带有 地址.
+
+服务端 在 第一次 写入 数据 时 先写入 一个 状态字节, 0 表示 成功; 1 表示 失败, 其后 为 uvarint 长度 的 错误信息.
+
+udp 的 每个包 为 len(2) | data, 带有地址 时 为 atyp(1) | addr | port(2) | len(2) | data.
+
+See https://github.com/SagerNet/sing-mux
+*/
+package singmux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+const (
+	Name = "singmux"
+
+	flagUDP  uint16 = 1
+	flagAddr uint16 = 2
+
+	statusSuccess byte = 0
+	statusError   byte = 1
+
+	atypIP4    byte = 1
+	atypDomain byte = 3
+	atypIP6    byte = 4
+)
+
+func writeAddr(buf *bytes.Buffer, a netLayer.Addr) {
+	if len(a.IP) > 0 {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			buf.WriteByte(atypIP4)
+			buf.Write(ip4)
+		} else {
+			buf.WriteByte(atypIP6)
+			buf.Write(a.IP.To16())
+		}
+	} else {
+		buf.WriteByte(atypDomain)
+		buf.WriteByte(byte(len(a.Name)))
+		buf.WriteString(a.Name)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(a.Port))
+}
+
+// 按 确切的 长度 读取, 不会 多读
+func readAddr(r io.Reader) (a netLayer.Addr, err error) {
+	var bs [net.IPv6len]byte
+	if _, err = io.ReadFull(r, bs[:1]); err != nil {
+		return
+	}
+	switch atyp := bs[0]; atyp {
+	case atypIP4:
+		if _, err = io.ReadFull(r, bs[:4]); err != nil {
+			return
+		}
+		a.IP = net.IP(append([]byte{}, bs[:4]...))
+	case atypIP6:
+		if _, err = io.ReadFull(r, bs[:]); err != nil {
+			return
+		}
+		a.IP = net.IP(append([]byte{}, bs[:]...))
+	case atypDomain:
+		if _, err = io.ReadFull(r, bs[:1]); err != nil {
+			return
+		}
+		name := make([]byte, bs[0])
+		if _, err = io.ReadFull(r, name); err != nil {
+			return
+		}
+		a.Name = string(name)
+	default:
+		err = utils.ErrInErr{ErrDesc: "singmux: unknown atyp", ErrDetail: utils.ErrInvalidData, Data: atyp}
+		return
+	}
+	if _, err = io.ReadFull(r, bs[:2]); err != nil {
+		return
+	}
+	a.Port = int(binary.BigEndian.Uint16(bs[:2]))
+	return
+}
+
+// 客户端 在 第一次 读取 时 读取 服务端的 状态
+func readStatus(r io.Reader) error {
+	var bs [1]byte
+	if _, err := io.ReadFull(r, bs[:]); err != nil {
+		return err
+	}
+	switch bs[0] {
+	case statusSuccess:
+		return nil
+	case statusError:
+		br := bufio.NewReader(r) //错误信息 之后 不会 再有数据, 可以 多读
+		l, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		msg := make([]byte, l)
+		if _, err = io.ReadFull(br, msg); err != nil {
+			return err
+		}
+		return utils.ErrInErr{ErrDesc: "singmux: remote error", Data: string(msg)}
+	default:
+		return utils.ErrInErr{ErrDesc: "singmux: unknown status", ErrDetail: utils.ErrInvalidData, Data: bs[0]}
+	}
+}
+
+// 实现 utils.User, utils.UserAssigner, 用于 将 外层连接 的 user 传递 到 流 中, 使 按 user 的 分流 依然可用
+type upstreamUser struct {
+	user utils.User
+}
+
+func (u *upstreamUser) SetUser(user utils.User) {
+	u.user = user
+}
+
+func (u *upstreamUser) IdentityStr() string {
+	if u.user != nil {
+		return u.user.IdentityStr()
+	}
+	return ""
+}
+
+func (u *upstreamUser) IdentityBytes() []byte {
+	if u.user != nil {
+		return u.user.IdentityBytes()
+	}
+	return nil
+}
+
+func (u *upstreamUser) AuthStr() string {
+	if u.user != nil {
+		return u.user.AuthStr()
+	}
+	return ""
+}
+
+func (u *upstreamUser) AuthBytes() []byte {
+	if u.user != nil {
+		return u.user.AuthBytes()
+	}
+	return nil
+}
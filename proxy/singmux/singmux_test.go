@@ -0,0 +1,16 @@
+package singmux_test
+
+import (
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+)
+
+func TestTCP(t *testing.T) {
+	proxy.TestTCP("singmux", "", 0, netLayer.RandPortStr_safe(true, false), "", t)
+}
+
+func TestUDP(t *testing.T) {
+	proxy.TestUDP("singmux", 0, netLayer.RandPortStr_safe(true, true), 0, t)
+}
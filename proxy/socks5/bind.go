@@ -0,0 +1,225 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+)
+
+var _ proxy.BindClient = (*Client)(nil)
+
+// BIND 请求中, 服务端 等待对端连入 的最长时间
+const BindAcceptTimeout = time.Minute * 2
+
+/*
+根据 rfc1928, BIND 用于 需要 由目标主机 反向连入 的协议, 如 FTP 的主动模式.
+
+客户端 先以 CONNECT 建立 主连接, 然后 另开一条连接 发送 BIND, 其 DST.ADDR 为 预期连入的主机.
+服务端 随即监听一个端口, 并通过 第一个回复 告知 该端口; 客户端 再通过 主连接 将该端口 告诉 目标主机.
+目标主机 连入后, 服务端 发送 第二个回复, 其 BND.ADDR 为 连入主机的地址, 之后 该连接 即 与连入的主机 相互转发.
+
+BIND 默认 关闭, 需要在 listen 的 extra 中 给出 bind = true 才会开启, 见 Server.EnableBind.
+
+开启后, Handshake 对 BIND 请求 返回 一个 proxy.BindConn 作为 wlc, 其 目标地址 为 DST.ADDR; vs 会 照常 对其 分流,
+分流到 direct 时 会 在 socks5 服务端 所在的主机上 监听 并 等待 目标主机 连入; 分流到 socks5 的 outClient 时
+则 通过 Client.Bind 与 ReadBindReply 在 上游 socks5 服务器 进行 BIND, 并将 两个回复 转告 客户端.
+之后 与 普通连接 一样 进行 流量统计 与 限速 地 转发. 分流到 其它 outClient 时 回复 RepNotAllowed.
+*/
+
+// 写入 socks5 回复. addr 为 nil 时, BND.ADDR 和 BND.PORT 均为0
+func writeReply(w io.Writer, rep byte, addr *net.TCPAddr) error {
+	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
+	buf.WriteByte(Version5)
+	buf.WriteByte(rep)
+	buf.WriteByte(0)
+
+	var ip net.IP = net.IPv4zero.To4()
+	var port int
+	if addr != nil {
+		ip = addr.IP
+		port = addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		buf.WriteByte(ATypIP4)
+		buf.Write(ip4)
+	} else {
+		buf.WriteByte(ATypIP6)
+		buf.Write(ip.To16())
+	}
+	buf.WriteByte(byte(port >> 8))
+	buf.WriteByte(byte(port))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// 读取一个 socks5 回复, 返回 BND.ADDR 和 BND.PORT. 只读取回复 所占的字节, 不会多读.
+func readReply(r io.Reader) (addr netLayer.Addr, err error) {
+	var head [4]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	if head[0] != Version5 {
+		err = utils.ErrInErr{ErrDesc: "socks5 reply version wrong", ErrDetail: utils.ErrInvalidData, Data: head[0]}
+		return
+	}
+	if head[1] != RepSucceeded {
+		err = utils.ErrInErr{ErrDesc: "socks5 reply failed", Data: head[1]}
+		return
+	}
+
+	var bs []byte
+	switch head[3] {
+	case ATypIP4:
+		bs = make([]byte, net.IPv4len+2)
+	case ATypIP6:
+		bs = make([]byte, net.IPv6len+2)
+	case ATypDomain:
+		var l [1]byte
+		if _, err = io.ReadFull(r, l[:]); err != nil {
+			return
+		}
+		bs = make([]byte, int(l[0])+2)
+	default:
+		err = utils.ErrInErr{ErrDesc: "socks5 reply unknown atype", ErrDetail: utils.ErrInvalidData, Data: head[3]}
+		return
+	}
+	if _, err = io.ReadFull(r, bs); err != nil {
+		return
+	}
+
+	if head[3] == ATypDomain {
+		addr.Name = string(bs[:len(bs)-2])
+	} else {
+		addr.IP = net.IP(bs[:len(bs)-2])
+	}
+	addr.Port = int(bs[len(bs)-2])<<8 | int(bs[len(bs)-1])
+	addr.Network = "tcp"
+	return
+}
+
+// bindConn 是 BIND 请求 的 wlc, 实现 proxy.BindConn
+type bindConn struct {
+	net.Conn
+	expected netLayer.Addr //DST.ADDR, 即 预期连入的主机
+}
+
+func (bc *bindConn) RejectBind() {
+	writeReply(bc.Conn, RepNotAllowed, nil)
+}
+
+func (bc *bindConn) ReplyBind(addr netLayer.Addr, err error) error {
+	if err != nil {
+		return writeReply(bc.Conn, RepGeneralFailure, nil)
+	}
+	//回复 与 请求 格式相同, 只是 CMD 的位置 为 REP
+	return writeRequest(bc.Conn, RepSucceeded, addr)
+}
+
+// 监听 并 发送 第一个回复, 然后 等待 对端连入 或 超时; 成功时 发送 第二个回复.
+func (bc *bindConn) AcceptBound() (net.Conn, netLayer.Addr, error) {
+
+	//在 与客户端 通信所用的 ip 上 监听, 这样 第一个回复 中的 BND.ADDR 对客户端 才是有意义的
+	var ip net.IP
+	if ta, ok := bc.LocalAddr().(*net.TCPAddr); ok {
+		ip = ta.IP
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		writeReply(bc.Conn, RepGeneralFailure, nil)
+		return nil, netLayer.Addr{}, utils.ErrInErr{ErrDesc: "socks5 bind listen failed", ErrDetail: err}
+	}
+	defer listener.Close()
+
+	bindAddr := listener.Addr().(*net.TCPAddr)
+	if err = writeReply(bc.Conn, RepSucceeded, bindAddr); err != nil {
+		return nil, netLayer.Addr{}, utils.ErrInErr{ErrDesc: "socks5 bind write first reply failed", ErrDetail: err}
+	}
+
+	listener.SetDeadline(time.Now().Add(BindAcceptTimeout))
+
+	peer, err := listener.AcceptTCP()
+	if err != nil {
+		writeReply(bc.Conn, RepTTLExpired, nil)
+		return nil, netLayer.Addr{}, utils.ErrInErr{ErrDesc: "socks5 bind accept failed", ErrDetail: err, Data: bindAddr.String()}
+	}
+
+	peerAddr := peer.RemoteAddr().(*net.TCPAddr)
+
+	//rfc1928: DST.ADDR 用于 评估 BIND 请求. 客户端 一般不知道 对端 的端口, 所以只比较 ip; 未给出 ip 时 不检查
+	expected := bc.expected
+	if len(expected.IP) > 0 && !expected.IP.IsUnspecified() && !expected.IP.Equal(peerAddr.IP) {
+		peer.Close()
+		writeReply(bc.Conn, RepNotAllowed, nil)
+		return nil, netLayer.Addr{}, utils.ErrInErr{ErrDesc: "socks5 bind got conn from unexpected addr", ErrDetail: utils.ErrInvalidData, Data: []string{expected.String(), peerAddr.String()}}
+	}
+
+	if err = writeReply(bc.Conn, RepSucceeded, peerAddr); err != nil {
+		peer.Close()
+		return nil, netLayer.Addr{}, utils.ErrInErr{ErrDesc: "socks5 bind write second reply failed", ErrDetail: err}
+	}
+
+	if ce := utils.CanLogInfo("socks5 bind accepted"); ce != nil {
+		ce.Write(
+			zap.String("bind", bindAddr.String()),
+			zap.String("peer", peerAddr.String()),
+		)
+	}
+
+	return peer, netLayer.NewAddrFromTCPAddr(peerAddr), nil
+}
+
+// Bind 在 underlay 上 完成 socks5 握手 并发送 BIND 请求; target 为 预期连入的主机, 可以为空.
+//
+// 返回 服务端 为此 所监听的地址, 即 第一个回复. 调用者 应将 该地址 告知 目标主机, 然后调用 ReadBindReply 等待 其连入.
+func (c *Client) Bind(underlay net.Conn, target netLayer.Addr) (bindAddr netLayer.Addr, err error) {
+	if underlay == nil {
+		panic("socks5 client bind, nil underlay is not allowed")
+	}
+
+	if err = c.negotiate(underlay); err != nil {
+		return
+	}
+
+	if target.IsEmpty() {
+		target.IP = net.IPv4zero.To4()
+	}
+	if err = writeRequest(underlay, CmdBind, target); err != nil {
+		return
+	}
+
+	netLayer.SetCommonReadTimeout(underlay)
+	bindAddr, err = readReply(underlay)
+	netLayer.PersistConn(underlay)
+	if err != nil {
+		return
+	}
+
+	//服务端 监听在 0.0.0.0 时, 其地址 应与 我们所连的地址 相同
+	if bindAddr.IP != nil && bindAddr.IP.IsUnspecified() {
+		if ta, ok := underlay.RemoteAddr().(*net.TCPAddr); ok {
+			bindAddr.IP = ta.IP
+		}
+	}
+	return
+}
+
+// ReadBindReply 等待并读取 BIND 的 第二个回复, 返回 连入的主机地址. 成功后 underlay 即 与该主机 之间的连接.
+//
+// 该函数 不设超时, 服务端 会在 超时后 发送 失败的回复 或 关闭连接.
+func ReadBindReply(underlay net.Conn) (peerAddr netLayer.Addr, err error) {
+	return readReply(underlay)
+}
+
+// 同 ReadBindReply, 实现 proxy.BindClient
+func (c *Client) ReadBindReply(underlay net.Conn) (netLayer.Addr, error) {
+	return ReadBindReply(underlay)
+}
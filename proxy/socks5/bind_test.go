@@ -0,0 +1,183 @@
+package socks5_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/socks5"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 用本作的 socks5 客户端 向 本作的 socks5 服务端 发起 BIND, 然后模拟 目标主机 连入
+func TestBind(t *testing.T) {
+	utils.InitLog("")
+
+	s := socks5.NewServer()
+	s.EnableBind = true
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		lc, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		wlc, _, _, err := s.Handshake(lc)
+		bc, ok := wlc.(proxy.BindConn)
+		if err != nil || !ok {
+			t.Error("bind should return a BindConn", err)
+			lc.Close()
+			return
+		}
+		peer, peerAddr, err := bc.AcceptBound()
+		if err != nil {
+			t.Error(err)
+			lc.Close()
+			return
+		}
+		netLayer.Relay(&peerAddr, peer, bc, 0, nil, nil, nil)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := &socks5.Client{}
+	bindAddr, err := c.Bind(conn, netLayer.Addr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bindAddr.Port == 0 || !bindAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatal("bind addr wrong", bindAddr.String())
+	}
+
+	//模拟 目标主机 按 第一个回复 所告知的地址 连入
+	peer, err := net.Dial("tcp", bindAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	peerAddr, err := socks5.ReadBindReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peerAddr.String() != peer.LocalAddr().String() {
+		t.Fatal("peer addr wrong", peerAddr.String(), peer.LocalAddr().String())
+	}
+
+	peer.Write([]byte("hello"))
+	var bs [5]byte
+	if _, err = io.ReadFull(conn, bs[:]); err != nil || string(bs[:]) != "hello" {
+		t.Fatal("read from peer wrong", err, bs)
+	}
+
+	conn.Write([]byte("world"))
+	if _, err = io.ReadFull(peer, bs[:]); err != nil || string(bs[:]) != "world" {
+		t.Fatal("read from client wrong", err, bs)
+	}
+}
+
+// 连入的主机 与 BIND 请求中的 DST.ADDR 不符时, 应当拒绝
+func TestBind_UnexpectedPeer(t *testing.T) {
+	utils.InitLog("")
+
+	s := socks5.NewServer()
+	s.EnableBind = true
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		lc, err := listener.Accept()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer lc.Close()
+		wlc, _, _, err := s.Handshake(lc)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		_, _, err = wlc.(proxy.BindConn).AcceptBound()
+		errChan <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := &socks5.Client{}
+	bindAddr, err := c.Bind(conn, netLayer.Addr{IP: net.IPv4(10, 2, 3, 4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.Dial("tcp", bindAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	if _, err = socks5.ReadBindReply(conn); err == nil {
+		t.Fatal("should reject unexpected peer")
+	}
+	if err = <-errChan; err == nil {
+		t.Fatal("server should fail")
+	}
+}
+
+// BIND 默认 不开启
+func TestBind_Disabled(t *testing.T) {
+	utils.InitLog("")
+
+	s := socks5.NewServer()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		lc, err := listener.Accept()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		_, _, _, err = s.Handshake(lc)
+		errChan <- err
+		lc.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := &socks5.Client{}
+	if _, err = c.Bind(conn, netLayer.Addr{}); err == nil {
+		t.Fatal("bind should be refused when not enabled")
+	}
+	if err = <-errChan; err == nil {
+		t.Fatal("server should fail")
+	}
+}
@@ -57,11 +57,8 @@ func (*Client) Name() string {
 	return Name
 }
 
-func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (result io.ReadWriteCloser, err error) {
-	if underlay == nil {
-		panic("socks5 client handshake, nil underlay is not allowed")
-	}
-
+// 完成 方法协商 以及 可能的 用户名密码认证
+func (c *Client) negotiate(underlay net.Conn) (err error) {
 	var ba [10]byte
 
 	//握手阶段
@@ -92,7 +89,7 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 	netLayer.PersistConn(underlay)
 
 	if n != 2 || ba[0] != Version5 || ba[1] != adoptedMethod {
-		return nil, utils.ErrInErr{ErrDesc: "socks5 client handshake,protocol err", Data: ba[1]}
+		return utils.ErrInErr{ErrDesc: "socks5 client handshake,protocol err", Data: ba[1]}
 	}
 	if adoptedMethod == AuthPassword {
 		buf := utils.GetBuf()
@@ -105,7 +102,7 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 		_, err = underlay.Write(buf.Bytes())
 		utils.PutBuf(buf)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		netLayer.SetCommonReadTimeout(underlay)
 
@@ -116,13 +113,19 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 		netLayer.PersistConn(underlay)
 
 		if n != 2 || ba[0] != 1 || ba[1] != 0 {
-			return nil, utils.ErrInErr{ErrDesc: "socks5 client handshake,auth failed", Data: ba[1]}
+			return utils.ErrInErr{ErrDesc: "socks5 client handshake,auth failed", Data: ba[1]}
 		}
 	}
+	return
+}
 
+// 写入 socks5 请求
+func writeRequest(w io.Writer, cmd byte, target netLayer.Addr) error {
 	buf := utils.GetBuf()
+	defer utils.PutBuf(buf)
+
 	buf.WriteByte(Version5)
-	buf.WriteByte(CmdConnect)
+	buf.WriteByte(cmd)
 	buf.WriteByte(0)
 	abs, atype := target.AddressBytes()
 
@@ -131,9 +134,20 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 	buf.WriteByte(byte(target.Port >> 8))
 	buf.WriteByte(byte(target.Port << 8 >> 8))
 
-	_, err = underlay.Write(buf.Bytes())
-	utils.PutBuf(buf)
-	if err != nil {
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (result io.ReadWriteCloser, err error) {
+	if underlay == nil {
+		panic("socks5 client handshake, nil underlay is not allowed")
+	}
+
+	if err = c.negotiate(underlay); err != nil {
+		return
+	}
+
+	if err = writeRequest(underlay, CmdConnect, target); err != nil {
 		return
 	}
 
@@ -141,7 +155,7 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 	var bigBs = utils.GetBytes(100)
 	defer utils.PutBytes(bigBs)
 
-	n, err = underlay.Read(bigBs)
+	n, err := underlay.Read(bigBs)
 
 	if err != nil {
 		return
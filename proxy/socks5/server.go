@@ -29,6 +29,8 @@ type Server struct {
 	*utils.MultiUserMap
 
 	TrustClient bool //如果为true，则每次握手读取客户端响应前, 不设置deadline. 这能减少一些开销, 但要保证客户端确实可信，不是坏蛋。如果客户端无法被信任，比如在公网或者 不止你一个人使用，则一定要为false，否则会被攻击，导致Server卡住, 造成大量悬垂连接。
+
+	EnableBind bool //是否允许 BIND 命令, 默认不允许. 可通过 listen 的 extra 中的 bind = true 开启. 见 bind.go
 }
 
 func NewServer() *Server {
@@ -86,11 +88,25 @@ func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
 			s.AddUser(up)
 		}
 	}
+	if thing := lc.Extra["bind"]; thing != nil {
+		if enable, ok := utils.AnyToBool(thing); ok && enable {
+			s.EnableBind = true
+		}
+	}
 	return s, nil
 }
 
 func (*Server) Name() string { return Name }
 
+// implements proxy.UserManagedServer
+func (s *Server) NewUserByConf(uc utils.UserConf) (utils.User, error) {
+	up := utils.NewUserPass(uc)
+	if !up.Valid() {
+		return nil, utils.ErrNilOrWrongParameter
+	}
+	return up, nil
+}
+
 // 若没有IDMap，则直接写入AuthNone响应，否则返回错误
 func (s *Server) authNone(underlay net.Conn) (returnErr error) {
 	var err error
@@ -240,6 +256,11 @@ For:
 			thisUP := utils.NewUserPassByData(ubytes, pbytes)
 
 			if s.AuthUserByStr(thisUP.AuthStr()) != nil {
+				if utils.UserTraffic.ExceedQuota(thisUP.IdentityStr()) {
+					underlay.Write([]byte{1, 1})
+					returnErr = utils.ErrInErr{ErrDesc: "socks5 user rejected", ErrDetail: utils.ErrQuotaExceeded, Data: thisUP.IdentityStr()}
+					return
+				}
 				_, err = underlay.Write([]byte{1, 0})
 				if err != nil {
 					returnErr = fmt.Errorf("failed to write auth response: %w", err)
@@ -286,7 +307,8 @@ For:
 	//  比如百度就是  [5 1 0 3 13 119 119 119 46 98]
 
 	cmd := bs[1]
-	if cmd == CmdBind {
+	if cmd != CmdConnect && cmd != CmdBind && cmd != CmdUDPAssociate {
+		writeReply(underlay, RepCmdNotSupported, nil)
 		returnErr = fmt.Errorf("unsuppoted command %v", cmd)
 		return
 	}
@@ -324,6 +346,24 @@ For:
 	}
 	thePort := int(bs[off+l-2])<<8 | int(bs[off+l-1])
 
+	if cmd == CmdBind {
+		if ip := net.ParseIP(theName); ip != nil {
+			theIP = ip
+		}
+		if !s.EnableBind {
+			writeReply(underlay, RepCmdNotSupported, nil)
+			returnErr = utils.ErrInErr{ErrDesc: "socks5 bind not enabled", ErrDetail: utils.ErrUnImplemented}
+			return
+		}
+		targetAddr = netLayer.Addr{
+			IP:      theIP,
+			Name:    theName,
+			Port:    thePort,
+			Network: "tcp",
+		}
+		return &bindConn{Conn: underlay, expected: targetAddr}, nil, targetAddr, nil
+	}
+
 	//根据 socks5标准，“使用UDP ASSOCIATE时，客户端的请求包中(DST.ADDR, DST.PORT)不再是目标的地址，而是客户端指定本身用于发送UDP数据包的地址和端口”
 	//然后服务器会传回专门适用于客户端的 一个 服务器的 udp的ip和地址；然后之后客户端再专门 向udp地址发送连接，此tcp连接就已经没用。
 	//总之，UDP Associate方法并不是 UDP over TCP，完全不同，而且过程中握手用tcp，传输用udp，使用到了两个连接。
@@ -3,6 +3,8 @@ Package socks5 provies socks5 proxy for proxy.Client and proxy.Server.
 
 Supports USER/PASSWORD authentication.
 
+Supports CONNECT, BIND and UDP ASSOCIATE commands.
+
 # Reference
 
 English: https://www.ietf.org/rfc/rfc1928.txt
@@ -54,3 +56,12 @@ const (
 	ATypDomain = 0x3
 	ATypIP6    = 0x4
 )
+
+// SOCKS reply codes as defined in RFC 1928 section 6
+const (
+	RepSucceeded       = 0x00
+	RepGeneralFailure  = 0x01
+	RepNotAllowed      = 0x02
+	RepTTLExpired      = 0x06
+	RepCmdNotSupported = 0x07
+)
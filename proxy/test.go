@@ -44,58 +44,83 @@ func TestTCP(protocol string, specialUUID string, version int, port string, extr
 		Name: "dummy.com",
 		Port: 80,
 	}
-	// 开始监听
-	listener, err := net.Listen("tcp", server.AddrStr())
-	if err != nil {
-		t.Logf("can not listen on %v: %v", server.AddrStr(), err)
-		t.FailNow()
+	serverHandle := func(wlc io.ReadWriter, targetAddr netLayer.Addr) {
+		if targetAddr.String() != targetStr {
+			t.Log("fail x1")
+			t.Fail()
+			return
+		}
+
+		var hello [5]byte
+		io.ReadFull(wlc, hello[:])
+		if !bytes.Equal(hello[:], []byte("hello")) {
+			t.Log("fail x2")
+			t.Fail()
+			return
+		}
+
+		wlc.Write([]byte("world"))
 	}
+
 	var testOK bool
-	defer listener.Close()
-	go func() {
-		for {
-			lc, err := listener.Accept()
-			if err != nil && !testOK {
-				t.Logf("failed in accept: %v", err)
-				t.Fail()
-				return
-			}
+
+	// 开始监听
+	if ls := getSelfListener(server, false); ls != nil {
+		closer := ls.StartListen(func(info netLayer.TCPRequestInfo) {
 			t.Log(protocol + " server got new conn")
-			if lc == nil {
-				return
-			}
-			go func() {
-				defer lc.Close()
-				wlc, _, targetAddr, err := server.Handshake(lc)
-				if err != nil {
-					t.Logf("failed in handshake from %v: %v", server.AddrStr(), err)
-					t.Fail()
-					return
-				}
+			defer info.Conn.Close()
+			serverHandle(info.Conn, info.Target)
+		}, nil)
+		if closer == nil {
+			t.Log("self listen failed")
+			t.FailNow()
+		}
+		defer closer.Close()
 
-				if targetAddr.String() != targetStr {
-					t.Log("fail x1")
+	} else {
+		listener, err := net.Listen("tcp", server.AddrStr())
+		if err != nil {
+			t.Logf("can not listen on %v: %v", server.AddrStr(), err)
+			t.FailNow()
+		}
+		defer listener.Close()
+		go func() {
+			for {
+				lc, err := listener.Accept()
+				if err != nil && !testOK {
+					t.Logf("failed in accept: %v", err)
 					t.Fail()
 					return
 				}
-
-				var hello [5]byte
-				io.ReadFull(wlc, hello[:])
-				if !bytes.Equal(hello[:], []byte("hello")) {
-					t.Log("fail x2")
-					t.Fail()
+				t.Log(protocol + " server got new conn")
+				if lc == nil {
 					return
 				}
-
-				wlc.Write([]byte("world"))
-			}()
-		}
-	}()
+				go func() {
+					defer lc.Close()
+					wlc, _, targetAddr, err := server.Handshake(lc)
+					if err != nil {
+						t.Logf("failed in handshake from %v: %v", server.AddrStr(), err)
+						t.Fail()
+						return
+					}
+					serverHandle(wlc, targetAddr)
+				}()
+			}
+		}()
+	}
 
 	t.Log("client try dial ", server.AddrStr())
 	// 连接
-	rc, _ := net.Dial("tcp", server.AddrStr())
-	defer rc.Close()
+	var rc net.Conn
+	if !client.SelfDial() {
+		var err error
+		rc, err = net.Dial("tcp", server.AddrStr())
+		if err != nil {
+			t.Fatalf("failed dial %v: %v", server.AddrStr(), err)
+		}
+		defer rc.Close()
+	}
 
 	t.Log("client Dial success")
 
@@ -132,16 +157,27 @@ func TestTCP(protocol string, specialUUID string, version int, port string, extr
 // 完整模拟整个 protocol 的udp请求 过程，即 客户端连接代理服务器，代理服务器试图访问远程服务器，这里是使用的模拟的办法模拟出一个远程udp服务器；
 // 其他tcp测试因为比较简单，不需要第二步测试，而这里需要
 func TestUDP(protocol string, version int, proxyPort string, use_multi int, t *testing.T) {
+	TestUDPWithQuery(protocol, "", version, proxyPort, use_multi, "", t)
+}
+
+// 与 TestUDP 相同, 但 可 指定 uuid 并 给 url 附加 参数; 对于 自己监听/拨号 的 协议(如 tuic), 会 使用 StartListen 并 不进行 拨号
+func TestUDPWithQuery(protocol string, specialUUID string, version int, proxyPort string, use_multi int, extraQuery string, t *testing.T) {
 	utils.LogLevel = utils.Log_debug
 	utils.InitLog("")
 
 	t.Log("fakeServerEndLocalServer port is ", proxyPort)
 
 	uuid := "a684455c-b14f-11ea-bf0d-42010aaa0003"
+	if specialUUID != "" {
+		uuid = specialUUID
+	}
 
 	fmtStr := protocol + "://%s@127.0.0.1:%s?v=%d&vless1_udp_multi=%d"
 
 	url := fmt.Sprintf(fmtStr, uuid, proxyPort, version, use_multi)
+	if extraQuery != "" {
+		url += "&" + extraQuery
+	}
 	fakeServerEndLocalServer, errx := ServerFromURL(url)
 	if errx != nil {
 		t.Log("fakeClientEndLocalServer parse err", errx)
@@ -223,101 +259,125 @@ func TestUDP(protocol string, version int, proxyPort string, use_multi int, t *t
 		Port:    fakeRealUDPServerPort,
 		Network: "udp",
 	}
-	// 监听 Client End LocalServer
-	listener, err := net.Listen("tcp", fakeServerEndLocalServer.AddrStr())
-	if err != nil {
-		t.Logf("can not listen on %v: %v", fakeServerEndLocalServer.AddrStr(), err)
-		t.FailNow()
-	}
-	defer listener.Close()
-
 	//一个完整的 protocol 服务端， 将客户端发来的udp数据转发到 目的地
-	go func() {
-		for {
-			lc, err := listener.Accept()
-			if err != nil {
-				t.Logf("failed in accept: %v", err)
-				break
-			}
-			go func() {
-				defer lc.Close()
-				_, wlc, targetAddr, err := fakeServerEndLocalServer.Handshake(lc)
-				if err != nil {
-					t.Logf("failed in handshake form %v: %v", fakeServerEndLocalServer.AddrStr(), err)
-					t.Fail()
-					return
-				}
+	serverHandle := func(wlc netLayer.MsgConn, targetAddr netLayer.Addr) {
+		remoteAddrStr := targetAddr.String()
+		t.Log(protocol+" server got new wlc", remoteAddrStr)
+
+		if remoteAddrStr != targetStr_forFakeUDPServer || targetAddr.Network != "udp" {
+			t.Log("remoteAddrStr != targetStr_forFakeUDPServer || targetAddr.IsUDP == false ", remoteAddrStr, targetStr_forFakeUDPServer, targetAddr.Network)
+			t.Fail()
+			return
+		}
 
-				remoteAddrStr := targetAddr.String()
-				t.Log(protocol+" server got new wlc", remoteAddrStr)
+		//这里的测试是，第一个发来的包必须是 hello，然后传递到目标udp服务器中
 
-				if remoteAddrStr != targetStr_forFakeUDPServer || targetAddr.Network != "udp" {
-					t.Log("remoteAddrStr != targetStr_forFakeUDPServer || targetAddr.IsUDP == false ", remoteAddrStr, targetStr_forFakeUDPServer, targetAddr.Network)
-					t.Fail()
-					return
-				}
+		//发现既可能读取 firstbuf，也可能读取 wlc，随机发生？
 
-				//这里的测试是，第一个发来的包必须是 hello，然后传递到目标udp服务器中
+		t.Log(protocol + " read from wlc")
+		bs, raddr, _ := wlc.ReadMsg()
 
-				//发现既可能读取 firstbuf，也可能读取 wlc，随机发生？
+		t.Log(protocol+" got wlc", bs)
 
-				t.Log(protocol + " read from wlc")
-				bs, raddr, _ := wlc.ReadMsg()
+		if !bytes.Equal(bs, hellodata) {
+			t.Log("!bytes.Equal(hello[:], hellodata)")
+			t.Fail()
+			return
+		}
 
-				t.Log(protocol+" got wlc", bs)
+		t.Log(protocol + " got wlc with right hello data")
 
-				if !bytes.Equal(bs, hellodata) {
-					t.Log("!bytes.Equal(hello[:], hellodata)")
-					t.Fail()
-					return
-				}
+		t.Log(protocol+" server dialed remote udp server", remoteAddrStr)
 
-				t.Log(protocol + " got wlc with right hello data")
+		na, _ := netLayer.NewAddr(remoteAddrStr)
+		na.Network = "udp"
 
-				t.Log(protocol+" server dialed remote udp server", remoteAddrStr)
+		wrc, err := netLayer.NewUDPMsgConn(nil, false, false, nil)
+		if err != nil {
+			t.Logf("failed netLayer.NewUDPMsgConn\n")
+			t.Fail()
+			return
+		}
 
-				na, _ := netLayer.NewAddr(remoteAddrStr)
-				na.Network = "udp"
+		err = wrc.WriteMsg(bs, na)
+		if err != nil {
+			t.Logf("failed wrc.WriteMsg : %v", err)
+			t.Fail()
+			return
+		}
 
-				wrc, err := netLayer.NewUDPMsgConn(nil, false, false, nil)
-				if err != nil {
-					t.Logf("failed netLayer.NewUDPMsgConn\n")
-					t.Fail()
-					return
-				}
+		bs, _, err = wrc.ReadMsg()
 
-				err = wrc.WriteMsg(bs, na)
-				if err != nil {
-					t.Logf("failed wrc.WriteMsg : %v", err)
-					t.Fail()
-					return
-				}
+		if err != nil {
+			t.Logf("failed wrc.ReadMsg : %v", err)
+			t.Fail()
+			return
+		}
+
+		err = wlc.WriteMsg(bs, raddr)
+		if err != nil {
+			t.Logf("failed wlc.WriteMsg : %v", err)
+			t.Fail()
+			return
+		}
 
-				bs, _, err = wrc.ReadMsg()
+		// 之后转发所有流量，不再特定限制数据
+		netLayer.RelayUDP(wrc, wlc, nil, nil, nil)
+	}
 
-				if err != nil {
-					t.Logf("failed wrc.ReadMsg : %v", err)
-					t.Fail()
-					return
-				}
+	// 监听 Client End LocalServer
+	if ls := getSelfListener(fakeServerEndLocalServer, true); ls != nil {
+		closer := ls.StartListen(func(info netLayer.TCPRequestInfo) {
+			info.Conn.Close()
+		}, func(info netLayer.UDPRequestInfo) {
+			defer info.MsgConn.Close()
+			serverHandle(info.MsgConn, info.Target)
+		})
+		if closer == nil {
+			t.Log("self listen failed")
+			t.FailNow()
+		}
+		defer closer.Close()
+
+	} else {
+		listener, err := net.Listen("tcp", fakeServerEndLocalServer.AddrStr())
+		if err != nil {
+			t.Logf("can not listen on %v: %v", fakeServerEndLocalServer.AddrStr(), err)
+			t.FailNow()
+		}
+		defer listener.Close()
 
-				err = wlc.WriteMsg(bs, raddr)
+		go func() {
+			for {
+				lc, err := listener.Accept()
 				if err != nil {
-					t.Logf("failed wlc.WriteMsg : %v", err)
-					t.Fail()
-					return
+					t.Logf("failed in accept: %v", err)
+					break
 				}
-
-				// 之后转发所有流量，不再特定限制数据
-				netLayer.RelayUDP(wrc, wlc, nil, nil)
-				//t.Log("Copy End?!")
-			}()
-		}
-	}()
+				go func() {
+					defer lc.Close()
+					_, wlc, targetAddr, err := fakeServerEndLocalServer.Handshake(lc)
+					if err != nil {
+						t.Logf("failed in handshake form %v: %v", fakeServerEndLocalServer.AddrStr(), err)
+						t.Fail()
+						return
+					}
+					serverHandle(wlc, targetAddr)
+				}()
+			}
+		}()
+	}
 
 	// 连接 Client End LocalServer
-	rc, _ := net.Dial("tcp", fakeServerEndLocalServer.AddrStr())
-	defer rc.Close()
+	var rc net.Conn
+	if !fakeClientEndRemoteClient.SelfDial() {
+		var err error
+		rc, err = net.Dial("tcp", fakeServerEndLocalServer.AddrStr())
+		if err != nil {
+			t.Fatalf("failed dial %v: %v", fakeServerEndLocalServer.AddrStr(), err)
+		}
+		defer rc.Close()
+	}
 
 	t.Log("client Dial success")
 
@@ -384,3 +444,15 @@ func TestUDP(protocol string, version int, proxyPort string, use_multi int, t *t
 	}
 
 }
+
+// 返回 自己监听 tcp (udp为true时 为 udp) 的 服务端, 不是 时 返回 nil.
+//
+// 如 shadowsocks 只 自己监听 udp, tcp 依然 需要 由 我们 监听.
+func getSelfListener(server Server, udp bool) ListenerServer {
+	is, tcpN, udpN := server.SelfListen()
+	if !is || (!udp && tcpN <= 0) || (udp && udpN <= 0) {
+		return nil
+	}
+	ls, _ := server.(ListenerServer)
+	return ls
+}
@@ -174,7 +174,7 @@ func (s *Server) StartListen(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func
 					return
 				}
 
-				go udpFunc(netLayer.UDPRequestInfo{MsgConn: msgConn, Target: raddr})
+				go udpFunc(netLayer.UDPRequestInfo{MsgConn: msgConn, Target: raddr, Source: msgConn.RemoteAddr()})
 
 			}
 		}()
@@ -40,7 +40,7 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 	uuidStr := dc.UUID
 
 	c := Client{
-		use_mux: dc.Mux,
+		use_mux: dc.Mux && dc.MuxConf.IsTraditional(),
 		User:    NewUserByPlainTextPassword(uuidStr),
 	}
 
@@ -65,7 +65,7 @@ func (c *Client) HasInnerMux() (int, string) {
 		return 2, "simplesocks"
 
 	} else {
-		return 0, ""
+		return c.Base.HasInnerMux() //sing-mux, Mux.Cool
 
 	}
 }
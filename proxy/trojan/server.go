@@ -72,6 +72,14 @@ func (*Server) Name() string {
 	return Name
 }
 
+// user 项 为 明文密码. implements proxy.UserManagedServer
+func (s *Server) NewUserByConf(uc utils.UserConf) (utils.User, error) {
+	if uc.User == "" {
+		return nil, utils.ErrNilOrWrongParameter
+	}
+	return NewUserByPlainTextPassword(uc.User), nil
+}
+
 func (*Server) HasInnerMux() (int, string) {
 	return 1, "simplesocks"
 }
@@ -168,6 +176,11 @@ realPart:
 		goto errorPart
 	}
 
+	if utils.UserTraffic.ExceedQuota(theUser.IdentityStr()) {
+		returnErr = utils.ErrInErr{ErrDesc: "trojan user rejected", ErrDetail: utils.ErrQuotaExceeded, Data: theUser.IdentityStr()}
+		return
+	}
+
 	crb, _ := readbuf.ReadByte()
 	lfb, _ := readbuf.ReadByte()
 	if crb != crlf[0] || lfb != crlf[1] {
@@ -0,0 +1,328 @@
+package tuic
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	advquic "github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/zap"
+)
+
+const heartbeatInterval = time.Second * 10
+
+func init() {
+	proxy.RegisterClient(Name, ClientCreator{})
+}
+
+type ClientCreator struct{ proxy.CreatorCommonStruct }
+
+// 兼容 常见的 分享链接 tuic://uuid:密码@host:port?sni=xxx&alpn=h3&udp_relay_mode=quic&allow_insecure=1
+func (ClientCreator) URLToDialConf(url *url.URL, dc *proxy.DialConf, format int) (*proxy.DialConf, error) {
+	switch format {
+	case proxy.UrlStandardFormat:
+		if dc == nil {
+			dc = &proxy.DialConf{}
+			dc.UUID = url.User.Username()
+		}
+		if p, ok := url.User.Password(); ok {
+			dc.UUID += ":" + p
+		}
+		q := url.Query()
+		if sni := q.Get("sni"); sni != "" {
+			dc.Host = sni
+		}
+		if alpn := q.Get("alpn"); alpn != "" {
+			dc.Alpn = strings.Split(alpn, ",")
+		}
+		dc.Insecure = dc.Insecure || utils.QueryPositive(q, "insecure") || utils.QueryPositive(q, "allow_insecure")
+		if mode := q.Get("udp_relay_mode"); mode != "" {
+			if dc.Extra == nil {
+				dc.Extra = make(map[string]any)
+			}
+			dc.Extra["udp_relay_mode"] = mode
+		}
+		if dc.Port == 0 {
+			dc.Port = 443
+		}
+		return dc, nil
+	default:
+		return nil, utils.ErrUnImplemented
+	}
+}
+
+func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
+	user, err := NewUserByStr(dc.UUID)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{user: user}
+
+	if thing := dc.Extra["udp_relay_mode"]; thing != nil {
+		switch mode, _ := thing.(string); mode {
+		case UDPRelayNative:
+		case UDPRelayQuic:
+			c.udpQuicMode = true
+		default:
+			return nil, utils.ErrInErr{ErrDesc: "tuic: unknown udp_relay_mode", ErrDetail: utils.ErrInvalidData, Data: thing}
+		}
+	}
+	if dc.Network == "" {
+		dc.Network = "udp"
+	}
+
+	addr, err := netLayer.NewAddr(dc.GetAddrStrForListenOrDial())
+	if err != nil {
+		return nil, err
+	}
+
+	var certConf *tlsLayer.CertConf
+	if dc.TLSCert != "" && dc.TLSKey != "" {
+		certConf = &tlsLayer.CertConf{
+			CertFile: dc.TLSCert,
+			KeyFile:  dc.TLSKey,
+		}
+	}
+	alpn := dc.Alpn
+	if len(alpn) == 0 {
+		alpn = DefaultAlpnList
+	}
+	tlsConf := tlsLayer.GetTlsConfig(false, tlsLayer.Conf{
+		Host:     dc.Host,
+		Insecure: dc.Insecure,
+		AlpnList: alpn,
+		CertConf: certConf,
+	})
+
+	c.qc = advquic.NewProxyClient(&addr, tlsConf, advquic.ProxyConf{
+		Early:           dc.IsEarly,
+		EnableDatagrams: true,
+		Extra:           dc.Extra,
+	}, c.newConn)
+
+	return c, nil
+}
+
+// implements proxy.Client.
+//
+// quic连接 由 advLayer/quic 的 连接池 管理, 每个 新连接 拨号 后 都会 先 认证.
+type Client struct {
+	proxy.Base
+
+	user        *User
+	udpQuicMode bool
+
+	qc *advquic.Client
+}
+
+func (*Client) Name() string {
+	return Name
+}
+
+func (*Client) GetCreator() proxy.ClientCreator {
+	return ClientCreator{}
+}
+
+// true, tuic 自己 拨号 quic
+func (*Client) SelfDial() bool {
+	return true
+}
+
+// 一个 udp关联 可 发往 任意地址
+func (*Client) IsUDP_MultiChannel() bool {
+	return false
+}
+
+func (c *Client) Stop() {
+	c.qc.CloseConns()
+	c.Base.Stop()
+}
+
+// underlay 不会被使用, 可为 nil
+func (c *Client) Handshake(_ net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
+	thing, err := c.qc.GetCommonConn(nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.qc.DialSubConn(thing)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(connectBytes(target, firstPayload))
+	if len(firstPayload) > 0 {
+		utils.PutBytes(firstPayload)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// underlay 不会被使用, 可为 nil
+func (c *Client) EstablishUDPChannel(_ net.Conn, firstPayload []byte, target netLayer.Addr) (netLayer.MsgConn, error) {
+	thing, err := c.qc.GetCommonConn(nil)
+	if err != nil {
+		return nil, err
+	}
+	cc, ok := advquic.UnderlayConn(thing).(*clientConn)
+	if !ok {
+		return nil, utils.ErrNilOrWrongParameter
+	}
+	if !c.udpQuicMode && !cc.ConnectionState().SupportsDatagrams {
+		return nil, utils.ErrInErr{ErrDesc: "tuic: server doesn't support datagrams, try udp_relay_mode = quic", Data: c.AddrStr()}
+	}
+
+	u := cc.newUDPSession()
+	if len(firstPayload) > 0 {
+		if err = u.WriteMsg(firstPayload, target); err != nil {
+			u.Close()
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// 由 advLayer/quic 的 连接池 在 拨号 后 调用
+func (c *Client) newConn(conn quic.Connection) (quic.Connection, error) {
+	cc := &clientConn{
+		Connection:  conn,
+		client:      c,
+		udpSessions: make(map[uint16]*udpConn),
+	}
+	go cc.authenticate()
+	go cc.receiveDatagrams()
+	go cc.acceptUniStreams()
+	go cc.keepAlive()
+	return cc, nil
+}
+
+// 客户端的 一个 quic连接
+type clientConn struct {
+	quic.Connection
+
+	client *Client
+
+	udpMutex    sync.Mutex
+	udpSessions map[uint16]*udpConn
+	nextAssocID uint16
+}
+
+// 0-rtt 时 要 等 握手 完成 后 才能 导出 token
+func (cc *clientConn) authenticate() {
+	if ec, ok := cc.Connection.(quic.EarlyConnection); ok {
+		select {
+		case <-ec.HandshakeComplete().Done():
+		case <-cc.Context().Done():
+			return
+		}
+	}
+
+	token, err := cc.client.user.token(cc.Connection)
+	if err == nil {
+		err = writeUniStream(cc.Connection, authenticateBytes(cc.client.user, token))
+	}
+	if err != nil {
+		if ce := utils.CanLogErr("tuic authenticate failed"); ce != nil {
+			ce.Write(zap.String("server", cc.client.AddrStr()), zap.Error(err))
+		}
+		cc.CloseWithError(0, "")
+	}
+}
+
+func (cc *clientConn) newUDPSession() *udpConn {
+	cc.udpMutex.Lock()
+	defer cc.udpMutex.Unlock()
+
+	cc.nextAssocID++
+	id := cc.nextAssocID
+	u := newUDPConn(cc.Connection, id, cc.client.udpQuicMode, func() {
+		cc.udpMutex.Lock()
+		delete(cc.udpSessions, id)
+		cc.udpMutex.Unlock()
+
+		go writeUniStream(cc.Connection, dissociateBytes(id))
+	})
+	cc.udpSessions[id] = u
+	return u
+}
+
+func (cc *clientConn) dispatch(p packet) {
+	cc.udpMutex.Lock()
+	u := cc.udpSessions[p.assocID]
+	cc.udpMutex.Unlock()
+
+	if u != nil {
+		u.feed(p)
+	}
+}
+
+func (cc *clientConn) receiveDatagrams() {
+	for {
+		bs, err := cc.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(bs)
+		if cmd, err := readHeader(r); err != nil || cmd != cmdPacket {
+			continue
+		}
+		if p, err := readPacket(r); err == nil {
+			cc.dispatch(p)
+		}
+	}
+}
+
+// 服务端 在 quic 模式 下 用 单向流 发回 udp包
+func (cc *clientConn) acceptUniStreams() {
+	for {
+		stream, err := cc.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			if cmd, err := readHeader(stream); err != nil || cmd != cmdPacket {
+				stream.CancelRead(0)
+				return
+			}
+			if p, err := readPacket(stream); err == nil {
+				cc.dispatch(p)
+			}
+		}()
+	}
+}
+
+// 定时 发送 心跳, 连接 断开 后 关闭 所有 udp关联
+func (cc *clientConn) keepAlive() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cc.Context().Done():
+			cc.udpMutex.Lock()
+			sessions := cc.udpSessions
+			cc.udpSessions = make(map[uint16]*udpConn)
+			cc.udpMutex.Unlock()
+
+			for _, u := range sessions {
+				u.Close()
+			}
+			return
+		case <-ticker.C:
+			if cc.ConnectionState().SupportsDatagrams {
+				cc.SendMessage(heartbeatBytes())
+			}
+		}
+	}
+}
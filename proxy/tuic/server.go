@@ -0,0 +1,425 @@
+package tuic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	advquic "github.com/e1732a364fed/v2ray_simple/advLayer/quic"
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+const (
+	authTimeout = time.Second * 3
+
+	errCodeAuthFailed  quic.ApplicationErrorCode = 1
+	errCodeAuthTimeout quic.ApplicationErrorCode = 2
+)
+
+func init() {
+	proxy.RegisterServer(Name, &ServerCreator{})
+}
+
+type ServerCreator struct{ proxy.CreatorCommonStruct }
+
+func (ServerCreator) URLToListenConf(url *url.URL, lc *proxy.ListenConf, format int) (*proxy.ListenConf, error) {
+	switch format {
+	case proxy.UrlStandardFormat:
+		if lc == nil {
+			lc = &proxy.ListenConf{}
+			lc.UUID = url.User.Username()
+		}
+		if p, ok := url.User.Password(); ok {
+			lc.UUID += ":" + p
+		}
+		q := url.Query()
+		if alpn := q.Get("alpn"); alpn != "" {
+			lc.Alpn = strings.Split(alpn, ",")
+		}
+		lc.TLSCert = q.Get("cert")
+		lc.TLSKey = q.Get("key")
+		return lc, nil
+	default:
+		return nil, utils.ErrUnImplemented
+	}
+}
+
+func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
+	if lc.Network == "" {
+		lc.Network = "udp"
+	}
+	alpn := lc.Alpn
+	if len(alpn) == 0 {
+		alpn = DefaultAlpnList
+	}
+
+	s := &Server{
+		MultiUserMap: utils.NewMultiUserMap(),
+		tlsConf: tlsLayer.GetTlsConfig(true, tlsLayer.Conf{
+			Host:     lc.Host,
+			AlpnList: alpn,
+			CertConf: &tlsLayer.CertConf{
+				CertFile: lc.TLSCert, KeyFile: lc.TLSKey, CA: lc.CA,
+			},
+		}),
+		pc: advquic.ProxyConf{
+			Early:           lc.IsEarly,
+			EnableDatagrams: true,
+			Extra:           lc.Extra,
+		},
+	}
+	s.TheIDBytesLen = utils.UUID_BytesLen
+	s.TheAuthBytesLen = utils.UUID_BytesLen
+
+	if lc.UUID != "" {
+		u, err := NewUserByStr(lc.UUID)
+		if err != nil {
+			return nil, err
+		}
+		s.AddUser(u)
+	}
+	for _, uc := range lc.Users {
+		u, err := NewUser(uc.User, uc.Pass)
+		if err != nil {
+			return nil, err
+		}
+		s.AddUser(u)
+	}
+
+	return s, nil
+}
+
+// implements proxy.ListenerServer
+type Server struct {
+	proxy.Base
+
+	*utils.MultiUserMap
+
+	tlsConf *tls.Config
+	pc      advquic.ProxyConf
+
+	listener io.Closer
+}
+
+func (*Server) Name() string {
+	return Name
+}
+
+// implements proxy.UserManagedServer
+func (s *Server) NewUserByConf(uc utils.UserConf) (utils.User, error) {
+	return NewUser(uc.User, uc.Pass)
+}
+
+// 自己 监听 tcp 和 udp, 不需要 vs 监听
+func (*Server) SelfListen() (is bool, tcp, udp int) {
+	return true, 1, 1
+}
+
+// tuic 的 请求 都在 StartListen 中 处理
+func (*Server) Handshake(underlay net.Conn) (net.Conn, netLayer.MsgConn, netLayer.Addr, error) {
+	return nil, nil, netLayer.Addr{}, utils.ErrUnImplemented
+}
+
+func (s *Server) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	s.Base.Stop()
+}
+
+// 非阻塞
+func (s *Server) StartListen(tcpFunc func(netLayer.TCPRequestInfo), udpFunc func(netLayer.UDPRequestInfo)) io.Closer {
+	s.listener = advquic.ListenForProxy(s.AddrStr(), s.tlsConf, s.pc, func(conn quic.Connection) {
+		sc := &serverConn{
+			Connection:  conn,
+			server:      s,
+			tcpFunc:     tcpFunc,
+			udpFunc:     udpFunc,
+			authDone:    make(chan struct{}),
+			udpSessions: make(map[uint16]*serverUDPConn),
+		}
+		sc.serve()
+	})
+	return s.listener
+}
+
+// 一个 客户端的 quic连接
+type serverConn struct {
+	quic.Connection
+
+	server  *Server
+	tcpFunc func(netLayer.TCPRequestInfo)
+	udpFunc func(netLayer.UDPRequestInfo)
+
+	user     utils.User //在 authDone 关闭 之前 设置
+	authDone chan struct{}
+	authOnce sync.Once
+
+	udpMutex    sync.Mutex
+	udpSessions map[uint16]*serverUDPConn
+}
+
+// 阻塞
+func (sc *serverConn) serve() {
+	go sc.checkAuthTimeout()
+	go sc.acceptUniStreams()
+	go sc.receiveDatagrams()
+
+	for {
+		stream, err := sc.AcceptStream(context.Background())
+		if err != nil {
+			if ce := utils.CanLogDebug("tuic conn ended"); ce != nil {
+				ce.Write(zap.String("from", sc.RemoteAddr().String()), zap.Error(err))
+			}
+			break
+		}
+		go sc.handleStream(stream)
+	}
+
+	sc.udpMutex.Lock()
+	sessions := sc.udpSessions
+	sc.udpSessions = make(map[uint16]*serverUDPConn)
+	sc.udpMutex.Unlock()
+
+	for _, u := range sessions {
+		u.Close()
+	}
+}
+
+func (sc *serverConn) checkAuthTimeout() {
+	select {
+	case <-sc.authDone:
+	case <-sc.Context().Done():
+	case <-time.After(authTimeout):
+		if ce := utils.CanLogWarn("tuic auth timeout"); ce != nil {
+			ce.Write(zap.String("from", sc.RemoteAddr().String()))
+		}
+		sc.CloseWithError(errCodeAuthTimeout, "")
+	}
+}
+
+// 客户端 可能 在 认证 之前 就 发来 其它命令, 需要 等待 认证 完成; 连接 关闭 时 返回 false
+func (sc *serverConn) waitAuth() bool {
+	select {
+	case <-sc.authDone:
+		return true
+	case <-sc.Context().Done():
+		return false
+	}
+}
+
+func (sc *serverConn) authenticate(r io.Reader) {
+	var bs [utils.UUID_BytesLen + tokenLen]byte
+	if _, err := io.ReadFull(r, bs[:]); err != nil {
+		return
+	}
+	if ec, ok := sc.Connection.(quic.EarlyConnection); ok {
+		select {
+		case <-ec.HandshakeComplete().Done():
+		case <-sc.Context().Done():
+			return
+		}
+	}
+
+	user, _ := sc.server.HasUserByBytes(bs[:utils.UUID_BytesLen]).(*User)
+	if user == nil || !user.checkToken(sc.Connection, bs[utils.UUID_BytesLen:]) {
+		if ce := utils.CanLogWarn("tuic auth failed"); ce != nil {
+			ce.Write(zap.String("from", sc.RemoteAddr().String()))
+		}
+		sc.CloseWithError(errCodeAuthFailed, "")
+		return
+	}
+	if utils.UserTraffic.ExceedQuota(user.IdentityStr()) {
+		if ce := utils.CanLogWarn("tuic user rejected"); ce != nil {
+			ce.Write(zap.String("from", sc.RemoteAddr().String()), zap.Error(utils.ErrQuotaExceeded))
+		}
+		sc.CloseWithError(errCodeAuthFailed, "")
+		return
+	}
+
+	sc.authOnce.Do(func() {
+		sc.user = user
+		close(sc.authDone)
+	})
+}
+
+func (sc *serverConn) handleStream(stream quic.Stream) {
+	conn := &serverStream{
+		streamConn: streamConn{Stream: stream, laddr: sc.LocalAddr(), raddr: sc.RemoteAddr()},
+	}
+	if !sc.waitAuth() {
+		conn.Close()
+		return
+	}
+	conn.User = sc.user
+
+	cmd, err := readHeader(stream)
+	if err == nil && cmd != cmdConnect {
+		err = utils.ErrInErr{ErrDesc: "tuic: unexpected command in bidirectional stream", ErrDetail: utils.ErrInvalidData, Data: cmd}
+	}
+	var target *netLayer.Addr
+	if err == nil {
+		target, err = readAddr(stream)
+		if err == nil && target == nil {
+			err = utils.ErrInErr{ErrDesc: "tuic: connect without address", ErrDetail: utils.ErrInvalidData}
+		}
+	}
+	if err != nil {
+		if ce := utils.CanLogWarn("tuic read connect failed"); ce != nil {
+			ce.Write(zap.String("from", sc.RemoteAddr().String()), zap.Error(err))
+		}
+		conn.Close()
+		return
+	}
+	target.Network = "tcp"
+
+	sc.tcpFunc(netLayer.TCPRequestInfo{Conn: conn, Target: *target})
+}
+
+func (sc *serverConn) acceptUniStreams() {
+	for {
+		stream, err := sc.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go sc.handleUniStream(stream)
+	}
+}
+
+func (sc *serverConn) handleUniStream(stream quic.ReceiveStream) {
+	defer stream.CancelRead(0)
+
+	cmd, err := readHeader(stream)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case cmdAuthenticate:
+		sc.authenticate(stream)
+
+	case cmdPacket:
+		if !sc.waitAuth() {
+			return
+		}
+		if p, err := readPacket(stream); err == nil {
+			sc.dispatch(p, true)
+		}
+
+	case cmdDissociate:
+		if !sc.waitAuth() {
+			return
+		}
+		var bs [2]byte
+		if _, err := io.ReadFull(stream, bs[:]); err != nil {
+			return
+		}
+		sc.udpMutex.Lock()
+		u := sc.udpSessions[binary.BigEndian.Uint16(bs[:])]
+		sc.udpMutex.Unlock()
+
+		if u != nil {
+			u.Close()
+		}
+	}
+}
+
+func (sc *serverConn) receiveDatagrams() {
+	for {
+		bs, err := sc.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(bs)
+		if cmd, err := readHeader(r); err != nil || cmd != cmdPacket { //心跳 不需要 处理
+			continue
+		}
+		p, err := readPacket(r)
+		if err != nil || !sc.waitAuth() {
+			continue
+		}
+		sc.dispatch(p, false)
+	}
+}
+
+// quicMode 表示 p 是否 来自 单向流, 服务端 按 同样的 方式 回复
+func (sc *serverConn) dispatch(p packet, quicMode bool) {
+	if sc.udpFunc == nil {
+		return
+	}
+
+	sc.udpMutex.Lock()
+	u := sc.udpSessions[p.assocID]
+	if u == nil {
+		id := p.assocID
+		u = &serverUDPConn{
+			udpConn: newUDPConn(sc.Connection, id, quicMode, func() {
+				sc.udpMutex.Lock()
+				delete(sc.udpSessions, id)
+				sc.udpMutex.Unlock()
+			}),
+			User: sc.user,
+		}
+		sc.udpSessions[id] = u
+	}
+	sc.udpMutex.Unlock()
+
+	u.quicMode.Store(quicMode)
+
+	if target, ok := u.feed(p); ok && u.started.CAS(false, true) {
+		//收到 第一个 完整的 包 后 才 交给 vs 处理
+		go sc.udpFunc(netLayer.UDPRequestInfo{
+			MsgConn: u,
+			Target:  target,
+			Source:  sc.RemoteAddr(),
+		})
+	}
+}
+
+// implements net.Conn
+type streamConn struct {
+	quic.Stream
+
+	// quic.Stream 没有 LocalAddr 和 RemoteAddr, 使用 所属 quic连接 的 地址
+	laddr, raddr net.Addr
+}
+
+func (sc *streamConn) LocalAddr() net.Addr {
+	return sc.laddr
+}
+
+func (sc *streamConn) RemoteAddr() net.Addr {
+	return sc.raddr
+}
+
+// quic.Stream 的 Close 只 关闭 写入 方向, 所以 还要 调用 CancelRead
+func (sc *streamConn) Close() error {
+	sc.CancelRead(0)
+	return sc.Stream.Close()
+}
+
+// 实现 utils.User, 使 按 user 的 分流 与 流量统计 可用
+type serverStream struct {
+	streamConn
+	utils.User
+}
+
+type serverUDPConn struct {
+	*udpConn
+	utils.User
+
+	started atomic.Bool
+}
@@ -0,0 +1,351 @@
+/*
+Package tuic implements the TUIC v5 protocol for proxy.Client and proxy.Server.
+
+tuic 基于 quic, 与 hysteria2 一样 自己 拨号 与 监听; 客户端 复用 advLayer/quic 的 连接池, 服务端 复用 其 监听 逻辑.
+
+# Command
+
+每个 命令 都以 VER(1) | TYPE(1) 开头, VER 为 5:
+
+	Authenticate 0x00: UUID(16) | TOKEN(32), 在 单向流 中 发送
+	Connect      0x01: ADDR, 在 双向流 中 发送, 之后 即为 tcp数据, 没有 响应
+	Packet       0x02: ASSOC_ID(2) | PKT_ID(2) | FRAG_TOTAL(1) | FRAG_ID(1) | SIZE(2) | ADDR | 数据
+	Dissociate   0x03: ASSOC_ID(2), 在 单向流 中 发送
+	Heartbeat    0x04: 无, 在 datagram 中 发送
+
+TOKEN 为 以 UUID 为 label, 密码 为 context 导出的 32字节 tls keying material (RFC 5705).
+
+ADDR 为 TYPE(1) | 地址 | PORT(2), TYPE 为 0xff(无地址, 不带PORT), 0x00(域名, 前面 带 1字节 长度), 0x01(ipv4), 0x02(ipv6).
+
+# UDP
+
+udp_relay_mode 为 native 时, Packet 在 datagram 中 发送, 超过 datagram 最大长度 的 包 会被 分片, 只有 第一个 分片 带 地址;
+为 quic 时, 每个 Packet 为 一个 单向流, 不会 丢包. 服务端 按 收到的 包 的 方式 回复.
+
+# Config
+
+	protocol = "tuic"
+	uuid = "uuid:密码"
+	extra = { udp_relay_mode = "quic" }
+
+服务端 也可 在 users 中 给出 多个 用户, user 为 uuid, pass 为 密码.
+extra 中的 congestion_control = "hy" 等 配置 与 quic 高级层 相同; early = true 开启 0-rtt.
+
+See https://github.com/EAimTY/tuic/blob/dev/SPEC.md
+*/
+package tuic
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	Name = "tuic"
+
+	version = 5
+
+	cmdAuthenticate byte = 0
+	cmdConnect      byte = 1
+	cmdPacket       byte = 2
+	cmdDissociate   byte = 3
+	cmdHeartbeat    byte = 4
+
+	addrTypeNone   byte = 0xff
+	addrTypeDomain byte = 0
+	addrTypeIPv4   byte = 1
+	addrTypeIPv6   byte = 2
+
+	tokenLen = 32
+
+	packetFixedLen = 8 //ASSOC_ID(2) | PKT_ID(2) | FRAG_TOTAL(1) | FRAG_ID(1) | SIZE(2)
+
+	UDPRelayNative = "native"
+	UDPRelayQuic   = "quic"
+)
+
+var DefaultAlpnList = []string{"h3"}
+
+// implements utils.UserWithPass
+type User struct {
+	utils.V2rayUser
+	password string
+}
+
+// str 为 uuid:密码 格式
+func NewUserByStr(str string) (*User, error) {
+	uuidStr, pass, _ := strings.Cut(str, ":")
+	return NewUser(uuidStr, pass)
+}
+
+func NewUser(uuidStr, pass string) (*User, error) {
+	vu, err := utils.NewV2rayUser(uuidStr)
+	if err != nil {
+		return nil, err
+	}
+	return &User{V2rayUser: vu, password: pass}, nil
+}
+
+func (u *User) GetPassword() []byte {
+	return []byte(u.password)
+}
+
+// 握手 完成 后 才能 调用
+func (u *User) token(conn quic.Connection) ([]byte, error) {
+	cs := conn.ConnectionState().TLS
+	return cs.ExportKeyingMaterial(string(u.V2rayUser[:]), []byte(u.password), tokenLen)
+}
+
+func (u *User) checkToken(conn quic.Connection, token []byte) bool {
+	expected, err := u.token(conn)
+	return err == nil && subtle.ConstantTimeCompare(expected, token) == 1
+}
+
+func writeHeader(buf *bytes.Buffer, cmd byte) {
+	buf.WriteByte(version)
+	buf.WriteByte(cmd)
+}
+
+func readHeader(r io.Reader) (cmd byte, err error) {
+	var bs [2]byte
+	if _, err = io.ReadFull(r, bs[:]); err != nil {
+		return
+	}
+	if bs[0] != version {
+		err = utils.ErrInErr{ErrDesc: "tuic: unsupported version", ErrDetail: utils.ErrInvalidData, Data: bs[0]}
+		return
+	}
+	return bs[1], nil
+}
+
+// addr 为 nil 时 写入 无地址
+func writeAddr(buf *bytes.Buffer, addr *netLayer.Addr) {
+	if addr == nil {
+		buf.WriteByte(addrTypeNone)
+		return
+	}
+	if addr.Name != "" {
+		buf.WriteByte(addrTypeDomain)
+		buf.WriteByte(byte(len(addr.Name)))
+		buf.WriteString(addr.Name)
+	} else if ip4 := addr.IP.To4(); ip4 != nil {
+		buf.WriteByte(addrTypeIPv4)
+		buf.Write(ip4)
+	} else {
+		buf.WriteByte(addrTypeIPv6)
+		buf.Write(addr.IP.To16())
+	}
+	binary.Write(buf, binary.BigEndian, uint16(addr.Port))
+}
+
+func addrLen(addr *netLayer.Addr) int {
+	switch {
+	case addr == nil:
+		return 1
+	case addr.Name != "":
+		return 2 + len(addr.Name) + 2
+	case addr.IP.To4() != nil:
+		return 1 + net.IPv4len + 2
+	default:
+		return 1 + net.IPv6len + 2
+	}
+}
+
+// 无地址 时 返回 nil
+func readAddr(r io.Reader) (*netLayer.Addr, error) {
+	var bs [2]byte
+	if _, err := io.ReadFull(r, bs[:1]); err != nil {
+		return nil, err
+	}
+	addr := &netLayer.Addr{}
+	switch bs[0] {
+	case addrTypeNone:
+		return nil, nil
+	case addrTypeDomain:
+		if _, err := io.ReadFull(r, bs[:1]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, bs[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		addr.Name = string(name)
+	case addrTypeIPv4:
+		addr.IP = make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(r, addr.IP); err != nil {
+			return nil, err
+		}
+	case addrTypeIPv6:
+		addr.IP = make(net.IP, net.IPv6len)
+		if _, err := io.ReadFull(r, addr.IP); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "tuic: unknown address type", ErrDetail: utils.ErrInvalidData, Data: bs[0]}
+	}
+	if _, err := io.ReadFull(r, bs[:]); err != nil {
+		return nil, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(bs[:]))
+	return addr, nil
+}
+
+func authenticateBytes(u *User, token []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 2+len(u.V2rayUser)+tokenLen))
+	writeHeader(buf, cmdAuthenticate)
+	buf.Write(u.V2rayUser[:])
+	buf.Write(token)
+	return buf.Bytes()
+}
+
+func connectBytes(target netLayer.Addr, firstPayload []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 2+addrLen(&target)+len(firstPayload)))
+	writeHeader(buf, cmdConnect)
+	writeAddr(buf, &target)
+	buf.Write(firstPayload)
+	return buf.Bytes()
+}
+
+func dissociateBytes(assocID uint16) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 4))
+	writeHeader(buf, cmdDissociate)
+	binary.Write(buf, binary.BigEndian, assocID)
+	return buf.Bytes()
+}
+
+func heartbeatBytes() []byte {
+	return []byte{version, cmdHeartbeat}
+}
+
+type packet struct {
+	assocID, packetID uint16
+	fragTotal, fragID uint8
+	addr              *netLayer.Addr //分片中 只有 第一个 带 地址
+	data              []byte
+}
+
+func (p *packet) size() int {
+	return 2 + packetFixedLen + addrLen(p.addr) + len(p.data)
+}
+
+// 包括 命令头
+func (p *packet) bytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, p.size()))
+	writeHeader(buf, cmdPacket)
+	binary.Write(buf, binary.BigEndian, p.assocID)
+	binary.Write(buf, binary.BigEndian, p.packetID)
+	buf.WriteByte(p.fragTotal)
+	buf.WriteByte(p.fragID)
+	binary.Write(buf, binary.BigEndian, uint16(len(p.data)))
+	writeAddr(buf, p.addr)
+	buf.Write(p.data)
+	return buf.Bytes()
+}
+
+// 读取 命令头 之后 的 部分
+func readPacket(r io.Reader) (p packet, err error) {
+	var bs [packetFixedLen]byte
+	if _, err = io.ReadFull(r, bs[:]); err != nil {
+		return
+	}
+	p.assocID = binary.BigEndian.Uint16(bs[:2])
+	p.packetID = binary.BigEndian.Uint16(bs[2:4])
+	p.fragTotal = bs[4]
+	p.fragID = bs[5]
+	size := binary.BigEndian.Uint16(bs[6:8])
+
+	if p.addr, err = readAddr(r); err != nil {
+		return
+	}
+	p.data = make([]byte, size)
+	_, err = io.ReadFull(r, p.data)
+	return
+}
+
+// 将 p 分为 每个 不超过 maxSize 的 分片; 不需要 分片 时 返回 p 本身.
+func fragPacket(p packet, maxSize int) []packet {
+	if p.size() <= maxSize {
+		return []packet{p}
+	}
+	maxPayload := maxSize - (p.size() - len(p.data))
+	if maxPayload <= 0 {
+		return nil
+	}
+	count := (len(p.data) + maxPayload - 1) / maxPayload
+	if count > 255 {
+		return nil
+	}
+
+	frags := make([]packet, 0, count)
+	data := p.data
+	for i := 0; i < count; i++ {
+		frag := p
+		frag.fragID = uint8(i)
+		frag.fragTotal = uint8(count)
+		if i > 0 {
+			frag.addr = nil
+		}
+		n := maxPayload
+		if n > len(data) {
+			n = len(data)
+		}
+		frag.data = data[:n]
+		data = data[n:]
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// defragger 只 重组 最新的 一个包, 收到 新的 包id 时 丢弃 未完成的 旧包. 不是 并发安全的.
+type defragger struct {
+	packetID uint16
+	frags    []*packet
+	count    int
+	size     int
+}
+
+// 返回 完整的 包, 尚未 收齐 时 返回 nil
+func (d *defragger) feed(p packet) *packet {
+	if p.fragTotal <= 1 {
+		return &p
+	}
+	if p.fragID >= p.fragTotal {
+		return nil
+	}
+	if p.packetID != d.packetID || int(p.fragTotal) != len(d.frags) {
+		d.packetID = p.packetID
+		d.frags = make([]*packet, p.fragTotal)
+		d.count = 0
+		d.size = 0
+	}
+	if d.frags[p.fragID] != nil {
+		return nil
+	}
+	d.frags[p.fragID] = &p
+	d.count++
+	d.size += len(p.data)
+	if d.count < len(d.frags) {
+		return nil
+	}
+
+	data := make([]byte, 0, d.size)
+	for _, frag := range d.frags {
+		data = append(data, frag.data...)
+	}
+	whole := *d.frags[0]
+	whole.fragTotal = 1
+	whole.data = data
+
+	d.frags = nil
+	d.count = 0
+	d.size = 0
+	return &whole
+}
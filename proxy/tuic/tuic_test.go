@@ -0,0 +1,23 @@
+package tuic_test
+
+import (
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/tuic"
+)
+
+const testUUID = "a684455c-b14f-11ea-bf0d-42010aaa0003:password"
+
+func TestTuic(t *testing.T) {
+	proxy.TestTCP("tuic", testUUID, 0, netLayer.RandPortStr_safe(true, true), "insecure=1", t)
+}
+
+func TestTuic_udp_native(t *testing.T) {
+	proxy.TestUDPWithQuery("tuic", testUUID, 0, netLayer.RandPortStr_safe(true, true), 0, "insecure=1&udp_relay_mode=native", t)
+}
+
+func TestTuic_udp_quic(t *testing.T) {
+	proxy.TestUDPWithQuery("tuic", testUUID, 0, netLayer.RandPortStr_safe(true, true), 0, "insecure=1&udp_relay_mode=quic", t)
+}
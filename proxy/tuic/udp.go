@@ -0,0 +1,156 @@
+package tuic
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"github.com/lucas-clemente/quic-go"
+	"go.uber.org/atomic"
+)
+
+// udpConn 是 一个 udp关联(association), 客户端 与 服务端 共用.
+// 读取 由 所属 quic连接 的 datagram 循环 或 单向流 推送.
+//
+// implements netLayer.MsgConn
+type udpConn struct {
+	netLayer.EasyDeadline
+
+	assocID  uint16
+	conn     quic.Connection
+	packetID atomic.Uint32
+
+	quicMode atomic.Bool //为 true 时 使用 单向流 发送; 服务端 会 随着 收到的 包 改变
+
+	defragMutex sync.Mutex
+	defrag      defragger
+
+	readChan  chan netLayer.AddrData
+	closeChan chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func newUDPConn(conn quic.Connection, assocID uint16, quicMode bool, onClose func()) *udpConn {
+	u := &udpConn{
+		assocID:   assocID,
+		conn:      conn,
+		readChan:  make(chan netLayer.AddrData, 64),
+		closeChan: make(chan struct{}),
+		onClose:   onClose,
+	}
+	u.quicMode.Store(quicMode)
+	u.InitEasyDeadline()
+	return u
+}
+
+// 得到了 完整的 包 时 返回 其 地址 与 true
+func (u *udpConn) feed(p packet) (addr netLayer.Addr, ok bool) {
+	u.defragMutex.Lock()
+	whole := u.defrag.feed(p)
+	u.defragMutex.Unlock()
+
+	if whole == nil || whole.addr == nil {
+		return
+	}
+	addr = *whole.addr
+	addr.Network = "udp"
+
+	select {
+	case u.readChan <- netLayer.AddrData{Data: whole.data, Addr: addr}:
+	case <-u.closeChan:
+	default: //读取 不及时 时 丢弃, 与 udp 的 语义 一致
+	}
+	return addr, true
+}
+
+func (u *udpConn) ReadMsg() ([]byte, netLayer.Addr, error) {
+	must_timeoutChan := time.After(netLayer.UDP_timeout)
+	select {
+	case <-u.closeChan:
+		return nil, netLayer.Addr{}, io.EOF
+	case <-u.ReadTimeoutChan():
+		return nil, netLayer.Addr{}, os.ErrDeadlineExceeded
+	case <-must_timeoutChan:
+		return nil, netLayer.Addr{}, os.ErrDeadlineExceeded
+	case msg := <-u.readChan:
+		return msg.Data, msg.Addr, nil
+	}
+}
+
+func (u *udpConn) WriteMsg(p []byte, peer netLayer.Addr) error {
+	select {
+	case <-u.closeChan:
+		return net.ErrClosed
+	case <-u.WriteTimeoutChan():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+
+	pk := packet{
+		assocID:   u.assocID,
+		packetID:  uint16(u.packetID.Inc()),
+		fragTotal: 1,
+		addr:      &peer,
+		data:      p,
+	}
+	if pk.size() > 0xffff {
+		return utils.ErrInErr{ErrDesc: "tuic: udp packet too long", Data: len(p)}
+	}
+
+	if u.quicMode.Load() {
+		return writeUniStream(u.conn, pk.bytes())
+	}
+
+	err := u.conn.SendMessage(pk.bytes())
+
+	var tooLarge quic.ErrMessageToLarge
+	if !errors.As(err, &tooLarge) {
+		return err
+	}
+	frags := fragPacket(pk, int(tooLarge))
+	if len(frags) == 0 {
+		return utils.ErrInErr{ErrDesc: "tuic: udp packet too long", Data: len(p)}
+	}
+	for _, frag := range frags {
+		if err = u.conn.SendMessage(frag.bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *udpConn) CloseConnWithRaddr(raddr netLayer.Addr) error {
+	return u.Close()
+}
+
+func (u *udpConn) Close() error {
+	u.closeOnce.Do(func() {
+		close(u.closeChan)
+		if u.onClose != nil {
+			u.onClose()
+		}
+	})
+	return nil
+}
+
+func (u *udpConn) Fullcone() bool {
+	return false
+}
+
+// 打开 一个 单向流 写入 bs 后 关闭
+func writeUniStream(conn quic.Connection, bs []byte) error {
+	stream, err := conn.OpenUniStreamSync(context.Background())
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(bs)
+	stream.Close()
+	return err
+}
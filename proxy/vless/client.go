@@ -9,6 +9,8 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
@@ -36,7 +38,7 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 		if v == 1 {
 			c.version = 1
 
-			c.use_mux = dc.Mux
+			c.use_mux = dc.Mux && dc.MuxConf.IsTraditional()
 
 			if dc.Extra != nil {
 				if thing := dc.Extra["vless1_udp_multi"]; thing != nil {
@@ -51,6 +53,17 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 
 	}
 
+	switch dc.Flow {
+	case "":
+	case FlowVision:
+		if c.version != 0 {
+			return nil, utils.ErrInErr{ErrDesc: "vless flow only supported by v0", ErrDetail: utils.ErrInvalidData, Data: dc.Flow}
+		}
+		c.flow = dc.Flow
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "vless unsupported flow", ErrDetail: utils.ErrInvalidData, Data: dc.Flow}
+	}
+
 	return &c, nil
 }
 
@@ -82,6 +95,8 @@ type Client struct {
 
 	udp_multi bool
 	use_mux   bool
+
+	flow string //v0 的 tcp 与 Mux.Cool 连接 使用, udp 不使用
 }
 
 func (*Client) GetCreator() proxy.ClientCreator {
@@ -101,13 +116,13 @@ func (c *Client) GetUser() utils.User {
 	return c.user
 }
 
-// 我们只支持 vless v1 的 mux
+// vless v1 的 mux 命令 使用 smux+simplesocks; 否则 可以 使用 sing-mux
 func (c *Client) HasInnerMux() (int, string) {
 	if c.version == 1 && c.use_mux {
 		return 2, "simplesocks"
 
 	} else {
-		return 0, ""
+		return c.Base.HasInnerMux() //sing-mux, Mux.Cool
 
 	}
 }
@@ -120,6 +135,13 @@ func (c *Client) IsUDP_MultiChannel() bool {
 func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLayer.Addr) (io.ReadWriteCloser, error) {
 	var err error
 
+	var visionTls tlsLayer.Conn
+	if c.flow == FlowVision {
+		if visionTls, _ = underlay.(tlsLayer.Conn); visionTls == nil {
+			return nil, utils.ErrInErr{ErrDesc: "vless vision requires tls or reality as underlay", ErrDetail: utils.ErrInvalidData}
+		}
+	}
+
 	port := target.Port
 	addr, atyp := target.AddressBytes()
 
@@ -127,17 +149,32 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 	if c.use_mux {
 		buf = c.getBufWithCmd(CmdMux)
 
+	} else if c.version == 0 && innerMux.IsMuxCoolAddr(target) {
+		//与 v2ray/xray 相同, v0 的 mux 命令 开启 Mux.Cool, 不带 地址
+		buf = c.getBufWithCmd(CmdMux)
+		addr = nil
+
 	} else {
 		buf = c.getBufWithCmd(CmdTCP)
 	}
 
-	buf.WriteByte(byte(uint16(port) >> 8))
-	buf.WriteByte(byte(uint16(port) << 8 >> 8))
+	if addr != nil {
+		buf.WriteByte(byte(uint16(port) >> 8))
+		buf.WriteByte(byte(uint16(port) << 8 >> 8))
 
-	buf.WriteByte(atyp)
-	buf.Write(addr)
+		buf.WriteByte(atyp)
+		buf.Write(addr)
+	}
 
-	if len(firstPayload) > 0 {
+	var vc *VisionConn
+	if visionTls != nil {
+		//第一个包 就要 填充, 与 握手头 一同 写入
+		vc = newVisionConn(nil, visionTls, c.user)
+		vc.pad(buf, firstPayload)
+		if len(firstPayload) > 0 {
+			utils.PutBytes(firstPayload)
+		}
+	} else if len(firstPayload) > 0 {
 		buf.Write(firstPayload)
 		utils.PutBytes(firstPayload)
 	}
@@ -166,6 +203,10 @@ func (c *Client) Handshake(underlay net.Conn, firstPayload []byte, target netLay
 		if mw, ok := underlay.(utils.MultiWriter); ok {
 			uc.mw = mw
 		}
+		if vc != nil {
+			vc.Conn = uc
+			return vc, nil
+		}
 
 		return uc, nil
 	} else {
@@ -212,7 +253,11 @@ func (c *Client) getBufWithCmd(cmd byte) *bytes.Buffer {
 	buf.WriteByte(byte(c.version)) //version
 	buf.Write(c.user[:])
 	if v == 0 {
-		buf.WriteByte(0) //addon length
+		if cmd == CmdUDP {
+			writeAddons(buf, "")
+		} else {
+			writeAddons(buf, c.flow)
+		}
 	} else {
 		switch {
 		default:
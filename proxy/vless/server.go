@@ -10,8 +10,9 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
 	"github.com/e1732a364fed/v2ray_simple/utils"
-	"go.uber.org/zap"
 )
 
 func init() {
@@ -41,6 +42,17 @@ func (ServerCreator) NewServer(lc *proxy.ListenConf) (proxy.Server, error) {
 		us := utils.InitV2rayUsers(lc.Users)
 		s.LoadUsers(us)
 	}
+
+	switch lc.Flow {
+	case "":
+	case FlowVision:
+		if !onlyV0 {
+			return nil, utils.ErrInErr{ErrDesc: "vless flow only supported by v0", ErrDetail: utils.ErrInvalidData, Data: lc.Flow}
+		}
+		s.flow = lc.Flow
+	default:
+		return nil, utils.ErrInErr{ErrDesc: "vless unsupported flow", ErrDetail: utils.ErrInvalidData, Data: lc.Flow}
+	}
 	return s, nil
 
 }
@@ -93,6 +105,8 @@ type Server struct {
 	*utils.MultiUserMap
 
 	onlyV0 bool
+
+	flow string //为 FlowVision 时, 客户端 的 v0 tcp 请求 必须 使用 vision
 }
 
 func (s *Server) HasInnerMux() (int, string) {
@@ -110,6 +124,11 @@ func (*Server) CanFallback() bool {
 
 func (s *Server) Name() string { return Name }
 
+// implements proxy.UserManagedServer
+func (s *Server) NewUserByConf(uc utils.UserConf) (utils.User, error) {
+	return utils.NewV2rayUser(uc.User)
+}
+
 // 返回的bytes.Buffer 是用于 回落使用的，内含了整个读取的数据;不回落时不要使用该Buffer
 func (s *Server) Handshake(underlay net.Conn) (tcpConn net.Conn, msgConn netLayer.MsgConn, targetAddr netLayer.Addr, returnErr error) {
 
@@ -141,6 +160,8 @@ func (s *Server) Handshake(underlay net.Conn) (tcpConn net.Conn, msgConn netLaye
 
 	readbuf := bytes.NewBuffer(readbs[:wholeReadLen])
 	var use_udp_multi bool
+	var flow string
+	var visionTls tlsLayer.Conn
 
 	goto realPart
 
@@ -171,10 +192,12 @@ realPart:
 
 	thisUUIDBytes := *(*[16]byte)(unsafe.Pointer(&idBytes[0]))
 
-	if s.AuthUserByBytes(thisUUIDBytes[:]) != nil {
-	} else {
+	if u := s.AuthUserByBytes(thisUUIDBytes[:]); u == nil {
 		returnErr = utils.ErrInErr{ErrDesc: "Vless Invalid user ", ErrDetail: utils.ErrInvalidData, Data: utils.UUIDToStr(thisUUIDBytes[:])}
 		goto errorPart
+	} else if utils.UserTraffic.ExceedQuota(u.IdentityStr()) {
+		returnErr = utils.ErrInErr{ErrDesc: "Vless user rejected ", ErrDetail: utils.ErrQuotaExceeded, Data: u.IdentityStr()}
+		return
 	}
 
 	if version == 0 {
@@ -185,16 +208,16 @@ realPart:
 			return
 		}
 		if addonLenByte != 0 {
-			//v2ray的vless中没有对应的任何处理。
-			//v2ray 的 vless 虽然有一个没用的Flow，但是 EncodeBodyAddons里根本没向里写任何数据。所以理论上正常这部分始终应该为0
-			if ce := utils.CanLogWarn("Vless potential illegal client"); ce != nil {
-				ce.Write(zap.Uint8("addonLenByte", addonLenByte))
-			}
-
-			if tmpbs := readbuf.Next(int(addonLenByte)); len(tmpbs) != int(addonLenByte) {
+			tmpbs := readbuf.Next(int(addonLenByte))
+			if len(tmpbs) != int(addonLenByte) {
 				returnErr = errors.New("vless short read in addon")
 				return
 			}
+			flow, err = parseAddonsFlow(tmpbs)
+			if err != nil {
+				returnErr = err
+				return
+			}
 		}
 	} else {
 		addonFlagByte, err := readbuf.ReadByte()
@@ -223,17 +246,15 @@ realPart:
 	switch commandByte {
 	case CmdMux:
 
-		//verysimple 没有实现 mux.cool,  因为 v2ray的 mux.cool 有很多问题, 本作不会支持v0 的mux
-
 		if version == 0 {
-			returnErr = errors.New("mux for vless v0 is not supported by verysimple")
-			return // 这个就不回落了.
-		} else {
-			//v1我们将采用 smux+simplesocks 的方式
+			//与 v2ray/xray 相同, v0 的 mux 命令 开启 Mux.Cool, 不带 地址. 按 普通tcp连接 返回, 调用者 以 目标地址 识别.
+			targetAddr = innerMux.MuxCoolAddr()
+			break
+		}
 
-			ismux = true
+		//v1我们将采用 smux+simplesocks 的方式
+		ismux = true
 
-		}
 		fallthrough
 
 	case CmdTCP, CmdUDP:
@@ -256,6 +277,31 @@ realPart:
 		goto errorPart
 	}
 
+	//与 xray 一致: 开启 vision 的 服务端 不接受 不带 flow 的 tcp 请求, 但 udp 与 mux 可以 不带 flow
+	switch flow {
+	case "":
+		if s.flow == FlowVision && commandByte == CmdTCP {
+			returnErr = utils.ErrInErr{ErrDesc: "Vless client didn't use flow", ErrDetail: utils.ErrInvalidData, Data: s.flow}
+			return
+		}
+	case FlowVision:
+		if s.flow != FlowVision {
+			returnErr = utils.ErrInErr{ErrDesc: "Vless flow not enabled", ErrDetail: utils.ErrInvalidData, Data: flow}
+			return
+		}
+		if commandByte == CmdUDP {
+			returnErr = utils.ErrInErr{ErrDesc: "Vless vision doesn't support udp", ErrDetail: utils.ErrInvalidData}
+			return
+		}
+		if visionTls, _ = underlay.(tlsLayer.Conn); visionTls == nil {
+			returnErr = utils.ErrInErr{ErrDesc: "Vless vision requires tls or reality as underlay", ErrDetail: utils.ErrInvalidData}
+			return
+		}
+	default:
+		returnErr = utils.ErrInErr{ErrDesc: "Vless unsupported flow", ErrDetail: utils.ErrInvalidData, Data: flow}
+		return
+	}
+
 	if ismux {
 		mm := &proxy.UserReadWrapper{
 			Mux:  true,
@@ -312,6 +358,9 @@ realPart:
 		if mw, ok := underlay.(utils.MultiWriter); ok {
 			uc.mw = mw
 		}
+		if visionTls != nil {
+			return newVisionConn(uc, visionTls, thisUUIDBytes), nil, targetAddr, nil
+		}
 		return uc, nil, targetAddr, nil
 
 	}
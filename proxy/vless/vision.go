@@ -0,0 +1,497 @@
+package vless
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/tlsLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/atomic"
+)
+
+/*
+xtls vision 流控, 与 xray 兼容.
+
+vision 只用于 vless v0 的 tcp 连接 (以及 v0 的 Mux.Cool 连接), 且 vless 必须 直接 运行在 tls/reality 之上.
+
+内层 tls 握手 阶段的 数据 会被 分成 若干 填充块, 每一方向 第一个 块 前 有 uuid:
+
+	[uuid(16)] | command(1) | contentLen(2) | paddingLen(2) | content | padding
+
+command 为 0 表示 后面 还有 填充块, 1 表示 填充 结束, 2 表示 填充 结束 且 之后 直接 读写 外层tls 的 底层连接.
+
+当 内层 为 tls1.3 时, 在 发送 第一个 application data 后 双方 就 不再 经过 外层tls 加密, 而是 直接 读写 底层连接,
+此时 若 另一端 也是 基本连接, 就可以 splice.
+
+与 tls lazy 是 两种 不同的 方案, 不能 同时 使用.
+*/
+
+const (
+	FlowVision = "xtls-rprx-vision"
+
+	visionCommandContinue byte = 0
+	visionCommandEnd      byte = 1
+	visionCommandDirect   byte = 2
+
+	visionBufSize                = 8192 //与 xray 的 buf.Size 一致, 每个 填充块 不超过 该长度
+	visionHeaderLen              = 21   //uuid + 5字节 块头
+	visionNumberOfPacketToFilter = 8
+
+	tlsHandshakeTypeClientHello byte = 1
+	tlsHandshakeTypeServerHello byte = 2
+)
+
+var (
+	tls13SupportedVersions  = []byte{0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}
+	tlsClientHandShakeStart = []byte{0x16, 0x03}
+	tlsServerHandShakeStart = []byte{0x16, 0x03, 0x03}
+	tlsApplicationDataStart = []byte{0x17, 0x03, 0x03}
+)
+
+// vless v0 的 addons 为 protobuf 编码的 { string Flow = 1; bytes Seed = 2; }, 我们只用到 Flow.
+// 写入 addons 的 长度 与 内容.
+func writeAddons(buf *bytes.Buffer, flow string) {
+	if flow == "" {
+		buf.WriteByte(0)
+		return
+	}
+	buf.WriteByte(byte(2 + len(flow)))
+	buf.WriteByte(0x0a)
+	buf.WriteByte(byte(len(flow)))
+	buf.WriteString(flow)
+}
+
+// 从 addons 中 解析出 Flow
+func parseAddonsFlow(bs []byte) (flow string, err error) {
+	for len(bs) > 0 {
+		key, n := binary.Uvarint(bs)
+		if n <= 0 {
+			return "", utils.ErrInErr{ErrDesc: "vless addons invalid key", ErrDetail: utils.ErrInvalidData}
+		}
+		bs = bs[n:]
+
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(bs)
+			if n <= 0 {
+				return "", utils.ErrInErr{ErrDesc: "vless addons invalid varint", ErrDetail: utils.ErrInvalidData}
+			}
+			bs = bs[n:]
+		case 2:
+			l, n := binary.Uvarint(bs)
+			if n <= 0 || l > uint64(len(bs)-n) {
+				return "", utils.ErrInErr{ErrDesc: "vless addons invalid length", ErrDetail: utils.ErrInvalidData}
+			}
+			if key>>3 == 1 {
+				flow = string(bs[n : n+int(l)])
+			}
+			bs = bs[n+int(l):]
+		default:
+			return "", utils.ErrInErr{ErrDesc: "vless addons unsupported wire type", ErrDetail: utils.ErrInvalidData, Data: key & 7}
+		}
+	}
+	return
+}
+
+// 一个 vision 连接 的 内层tls 过滤状态, 读写 两个方向 共享
+type visionFilter struct {
+	sync.Mutex
+
+	numberOfPacketToFilter int
+	remainingServerHello   int
+	cipher                 uint16
+
+	isTLS          bool
+	isTLS12orAbove bool
+	enableXtls     bool
+}
+
+// 对应 xray 的 XtlsFilterTls
+func (f *visionFilter) filter(chunks ...[]byte) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.numberOfPacketToFilter <= 0 {
+		return
+	}
+	for _, b := range chunks {
+		f.numberOfPacketToFilter--
+
+		if len(b) >= 6 {
+			if bytes.Equal(tlsServerHandShakeStart, b[:3]) && b[5] == tlsHandshakeTypeServerHello {
+				f.remainingServerHello = (int(b[3])<<8 | int(b[4])) + 5
+				f.isTLS12orAbove = true
+				f.isTLS = true
+				if len(b) >= 79 && f.remainingServerHello >= 79 {
+					sessionIdLen := int(b[43])
+					if len(b) >= 43+sessionIdLen+3 {
+						f.cipher = binary.BigEndian.Uint16(b[43+sessionIdLen+1:])
+					}
+				}
+			} else if bytes.Equal(tlsClientHandShakeStart, b[:2]) && b[5] == tlsHandshakeTypeClientHello {
+				f.isTLS = true
+			}
+		}
+
+		if f.remainingServerHello > 0 {
+			end := f.remainingServerHello
+			if end > len(b) {
+				end = len(b)
+			}
+			f.remainingServerHello -= len(b)
+
+			if bytes.Contains(b[:end], tls13SupportedVersions) {
+				//TLS_AES_128_CCM_8_SHA256 (0x1305) 的 记录 不能 直接 转发, 见 xray 的 Tls13CipherSuiteDic
+				f.enableXtls = f.cipher >= 0x1301 && f.cipher <= 0x1304
+				f.numberOfPacketToFilter = 0
+				return
+			} else if f.remainingServerHello <= 0 {
+				//tls1.2
+				f.numberOfPacketToFilter = 0
+				return
+			}
+		}
+	}
+}
+
+// 实现 net.Conn, io.ReaderFrom, utils.User, netLayer.Splicer, netLayer.SpliceReader
+//
+// 在填充阶段 读写 内嵌的 vless连接; 切换到 直接拷贝 后, 读写 tls连接 的 底层连接.
+type VisionConn struct {
+	net.Conn
+
+	utils.V2rayUser
+
+	tlsConn tlsLayer.Conn
+	raw     net.Conn
+
+	filter visionFilter
+
+	//读
+	readBuf       []byte
+	readRemain    []byte
+	readErr       error
+	withinPadding bool
+
+	remainingCommand, remainingContent, remainingPadding, currentCommand int
+
+	readDirect atomic.Bool
+
+	//写
+	isPadding   bool
+	uuidWritten bool
+	writeDirect atomic.Bool
+}
+
+// conn 为 vless连接, tc 为 其 所在的 tls连接
+func newVisionConn(conn net.Conn, tc tlsLayer.Conn, user utils.V2rayUser) *VisionConn {
+	return &VisionConn{
+		Conn:             conn,
+		V2rayUser:        user,
+		tlsConn:          tc,
+		raw:              tc.GetRawConn(),
+		filter:           visionFilter{numberOfPacketToFilter: visionNumberOfPacketToFilter},
+		withinPadding:    true,
+		remainingCommand: -1,
+		remainingContent: -1,
+		remainingPadding: -1,
+		isPadding:        true,
+	}
+}
+
+func (c *VisionConn) Upstream() net.Conn {
+	return c.Conn
+}
+
+func (c *VisionConn) Read(p []byte) (int, error) {
+	for {
+		if len(c.readRemain) > 0 {
+			n := copy(p, c.readRemain)
+			c.readRemain = c.readRemain[n:]
+			return n, nil
+		}
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if c.readDirect.Load() {
+			return c.raw.Read(p)
+		}
+		if !c.withinPadding {
+			n, err := c.Conn.Read(p)
+			if n > 0 {
+				c.filter.filter(p[:n])
+			}
+			return n, err
+		}
+
+		c.readRemain, c.readErr = c.readPadded()
+	}
+}
+
+// 读取 一段 数据 并 去除 填充. 对应 xray 的 VisionReader.
+func (c *VisionConn) readPadded() ([]byte, error) {
+	if c.readBuf == nil {
+		c.readBuf = make([]byte, utils.MaxPacketLen)
+	}
+	n, err := c.Conn.Read(c.readBuf)
+	if n == 0 {
+		return nil, err
+	}
+	b := c.readBuf[:n]
+
+	if c.remainingCommand == -1 && c.remainingContent == -1 && c.remainingPadding == -1 {
+		//初始状态 下 需要 读够 uuid 与 块头, 才能 判断 是否 为 填充块
+		for len(b) < visionHeaderLen && err == nil {
+			n, err = c.Conn.Read(c.readBuf[len(b):])
+			b = c.readBuf[:len(b)+n]
+		}
+	}
+
+	content := c.unpad(b)
+
+	if c.remainingContent > 0 || c.remainingPadding > 0 || c.currentCommand == int(visionCommandContinue) {
+		c.withinPadding = true
+	} else {
+		c.withinPadding = false
+		if c.currentCommand == int(visionCommandDirect) {
+			//tls连接 中 已读取 但 未被 读出 的 数据 要 先 取出, 之后 才能 直接 读 底层连接
+			input, rawInput := c.tlsConn.GetInputBuffers()
+			if input.Len() > 0 {
+				bs := make([]byte, input.Len())
+				input.Read(bs)
+				content = append(content, bs...)
+			}
+			if rawInput.Len() > 0 {
+				content = append(content, rawInput.Bytes()...)
+			}
+			*input = bytes.Reader{}
+			*rawInput = bytes.Buffer{}
+
+			c.readDirect.Store(true)
+		}
+	}
+
+	if len(content) > 0 {
+		c.filter.filter(content)
+	}
+	return content, err
+}
+
+// 对应 xray 的 XtlsUnpadding; 返回的 切片 是 新分配的.
+func (c *VisionConn) unpad(b []byte) []byte {
+	if c.remainingCommand == -1 && c.remainingContent == -1 && c.remainingPadding == -1 {
+		if len(b) >= visionHeaderLen && bytes.Equal(c.V2rayUser[:], b[:16]) {
+			b = b[16:]
+			c.remainingCommand = 5
+		} else {
+			return append([]byte(nil), b...)
+		}
+	}
+
+	var content []byte
+	for len(b) > 0 {
+		if c.remainingCommand > 0 {
+			data := int(b[0])
+			b = b[1:]
+			switch c.remainingCommand {
+			case 5:
+				c.currentCommand = data
+			case 4:
+				c.remainingContent = data << 8
+			case 3:
+				c.remainingContent |= data
+			case 2:
+				c.remainingPadding = data << 8
+			case 1:
+				c.remainingPadding |= data
+			}
+			c.remainingCommand--
+		} else if c.remainingContent > 0 {
+			l := c.remainingContent
+			if l > len(b) {
+				l = len(b)
+			}
+			content = append(content, b[:l]...)
+			b = b[l:]
+			c.remainingContent -= l
+		} else {
+			l := c.remainingPadding
+			if l > len(b) {
+				l = len(b)
+			}
+			b = b[l:]
+			c.remainingPadding -= l
+		}
+
+		if c.remainingCommand <= 0 && c.remainingContent <= 0 && c.remainingPadding <= 0 {
+			if c.currentCommand == int(visionCommandContinue) {
+				c.remainingCommand = 5
+			} else {
+				c.remainingCommand = -1
+				c.remainingContent = -1
+				c.remainingPadding = -1
+				if len(b) > 0 {
+					content = append(content, b...)
+				}
+				break
+			}
+		}
+	}
+	return content
+}
+
+func (c *VisionConn) Write(p []byte) (int, error) {
+	if c.writeDirect.Load() {
+		return c.raw.Write(p)
+	}
+	if !c.isPadding {
+		c.filter.filter(p)
+		return c.Conn.Write(p)
+	}
+
+	buf := utils.GetBuf()
+	direct := c.pad(buf, p)
+	_, err := c.Conn.Write(buf.Bytes())
+	utils.PutBuf(buf)
+	if err != nil {
+		return 0, err
+	}
+	if direct {
+		c.writeDirect.Store(true)
+	}
+	return len(p), nil
+}
+
+// 将 p 填充后 写入 buf, 返回 之后 是否 应 直接 写 底层连接. 对应 xray 的 VisionWriter.
+func (c *VisionConn) pad(buf *bytes.Buffer, p []byte) (switchToDirect bool) {
+	if len(p) == 0 {
+		c.writePadding(buf, nil, visionCommandContinue, true)
+		return
+	}
+	chunks := reshapeVision(p)
+	c.filter.filter(chunks...)
+
+	c.filter.Lock()
+	isTLS, isTLS12orAbove, enableXtls, numberOfPacketToFilter := c.filter.isTLS, c.filter.isTLS12orAbove, c.filter.enableXtls, c.filter.numberOfPacketToFilter
+	c.filter.Unlock()
+
+	endCommand := visionCommandEnd
+	if enableXtls {
+		endCommand = visionCommandDirect
+	}
+
+	longPadding := isTLS
+	last := len(chunks) - 1
+	for i, b := range chunks {
+		if isTLS && bytes.HasPrefix(b, tlsApplicationDataStart) {
+			if enableXtls {
+				switchToDirect = true
+			}
+			cmd := visionCommandContinue
+			if i == last {
+				cmd = endCommand
+			}
+			c.writePadding(buf, b, cmd, true)
+			c.isPadding = false
+			longPadding = false
+			continue
+		} else if !isTLS12orAbove && numberOfPacketToFilter <= 1 {
+			//不是 tls, 或 过滤 已 结束 仍未 发现 tls1.2 以上 的 握手
+			c.isPadding = false
+			c.writePadding(buf, b, visionCommandEnd, longPadding)
+			for _, rest := range chunks[i+1:] {
+				buf.Write(rest)
+			}
+			return
+		}
+
+		cmd := visionCommandContinue
+		if i == last && !c.isPadding {
+			cmd = endCommand
+		}
+		c.writePadding(buf, b, cmd, longPadding)
+	}
+	return
+}
+
+func (c *VisionConn) writePadding(buf *bytes.Buffer, content []byte, cmd byte, longPadding bool) {
+	contentLen := len(content)
+	var paddingLen int
+	if contentLen < 900 && longPadding {
+		paddingLen = rand.Intn(500) + 900 - contentLen
+	} else {
+		paddingLen = rand.Intn(256)
+	}
+	if paddingLen > visionBufSize-visionHeaderLen-contentLen {
+		paddingLen = visionBufSize - visionHeaderLen - contentLen
+	}
+
+	if !c.uuidWritten {
+		c.uuidWritten = true
+		buf.Write(c.V2rayUser[:])
+	}
+	buf.Write([]byte{cmd, byte(contentLen >> 8), byte(contentLen), byte(paddingLen >> 8), byte(paddingLen)})
+	buf.Write(content)
+	buf.Write(make([]byte, paddingLen))
+}
+
+// 将 过长的 数据 在 application data 记录 的 开头处 分开, 使 每块 都能 放进 一个 填充块
+func reshapeVision(p []byte) (chunks [][]byte) {
+	for len(p) >= visionBufSize-visionHeaderLen {
+		n := len(p)
+		if n > visionBufSize {
+			n = visionBufSize
+		}
+		index := bytes.LastIndex(p[:n], tlsApplicationDataStart)
+		if index < visionHeaderLen || index > visionBufSize-visionHeaderLen {
+			index = visionBufSize / 2
+		}
+		chunks = append(chunks, p[:index])
+		p = p[index:]
+	}
+	if len(p) > 0 {
+		chunks = append(chunks, p)
+	}
+	return
+}
+
+// 切换到 直接拷贝 后, 不能 再 通过 tls连接 发送 close_notify, 否则 会 破坏 对端 读取的 数据流
+func (c *VisionConn) Close() error {
+	if c.writeDirect.Load() || c.readDirect.Load() {
+		return c.raw.Close()
+	}
+	return c.Conn.Close()
+}
+
+func (c *VisionConn) EverPossibleToSpliceRead() bool {
+	return netLayer.IsTCP(c.raw) != nil || netLayer.IsUnix(c.raw) != nil
+}
+
+func (c *VisionConn) CanSpliceRead() (bool, *net.TCPConn, *net.UnixConn) {
+	if c.readDirect.Load() && len(c.readRemain) == 0 && c.readErr == nil {
+		return netLayer.ReturnSpliceRead(c.raw)
+	}
+	return false, nil, nil
+}
+
+func (c *VisionConn) EverPossibleToSpliceWrite() bool {
+	return netLayer.IsTCP(c.raw) != nil
+}
+
+func (c *VisionConn) CanSpliceWrite() (bool, *net.TCPConn) {
+	if c.writeDirect.Load() {
+		if tc := netLayer.IsTCP(c.raw); tc != nil {
+			return true, tc
+		}
+	}
+	return false, nil
+}
+
+func (c *VisionConn) ReadFrom(r io.Reader) (int64, error) {
+	return netLayer.TryReadFrom_withSplice(c, c, r, func() bool { return false })
+}
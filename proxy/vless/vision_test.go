@@ -0,0 +1,81 @@
+package vless
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestVisionAddons(t *testing.T) {
+	var buf bytes.Buffer
+	writeAddons(&buf, FlowVision)
+	bs := buf.Bytes()
+	if int(bs[0]) != len(bs)-1 {
+		t.Fatal("addons length not match", bs[0], len(bs)-1)
+	}
+	flow, err := parseAddonsFlow(bs[1:])
+	if err != nil || flow != FlowVision {
+		t.Fatal("parse flow failed", flow, err)
+	}
+
+	//带 Seed 字段
+	flow, err = parseAddonsFlow(append(append([]byte{}, bs[1:]...), 0x12, 2, 1, 2))
+	if err != nil || flow != FlowVision {
+		t.Fatal("parse flow with seed failed", flow, err)
+	}
+
+	if _, err = parseAddonsFlow([]byte{0x0a, 10, 'x'}); err == nil {
+		t.Fatal("short addons should fail")
+	}
+}
+
+func TestVisionPadding(t *testing.T) {
+	user, _ := utils.NewV2rayUser("a684455c-b14f-11ea-bf0d-42010aaa0003")
+
+	w := &VisionConn{V2rayUser: user, isPadding: true}
+	w.filter.numberOfPacketToFilter = visionNumberOfPacketToFilter
+	r := &VisionConn{V2rayUser: user, remainingCommand: -1, remainingContent: -1, remainingPadding: -1}
+
+	big := make([]byte, visionBufSize*2+100)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	payloads := [][]byte{[]byte("hello"), big}
+	//过滤 的 包数 用完 后 仍未 发现 tls, 就 结束 填充
+	for i := 0; i < visionNumberOfPacketToFilter+2; i++ {
+		payloads = append(payloads, []byte("world"))
+	}
+
+	var buf bytes.Buffer
+	var want []byte
+	for _, p := range payloads {
+		if w.isPadding {
+			w.pad(&buf, p)
+		} else {
+			buf.Write(p)
+		}
+		want = append(want, p...)
+	}
+	if w.isPadding {
+		t.Fatal("padding should end for non-tls data")
+	}
+
+	var got []byte
+	bs := buf.Bytes()
+	//分成 小段 去除 填充, 以 测试 跨段 的 状态
+	for len(bs) > 0 {
+		n := 1000
+		if n > len(bs) {
+			n = len(bs)
+		}
+		got = append(got, r.unpad(bs[:n])...)
+		bs = bs[n:]
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("unpadded data not match", len(got), len(want))
+	}
+	if r.currentCommand != int(visionCommandEnd) {
+		t.Fatal("padding not ended", r.currentCommand)
+	}
+}
@@ -76,11 +76,14 @@ func GenerateXrayShareURL(dc *proxy.DialConf) string {
 
 		//}
 	}
+	if dc.Flow != "" {
+		q.Add("flow", dc.Flow)
+	}
 	if dc.AdvancedLayer != "" {
 		q.Add("type", dc.AdvancedLayer)
 
 		switch dc.AdvancedLayer {
-		case "ws":
+		case "ws", "httpupgrade", "splithttp", "h2":
 			if dc.Path != "" {
 				q.Add("path", dc.Path)
 			}
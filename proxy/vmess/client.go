@@ -19,6 +19,7 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -72,7 +73,7 @@ func (ClientCreator) NewClient(dc *proxy.DialConf) (proxy.Client, error) {
 		return nil, err
 	}
 	c := &Client{
-		use_mux: dc.Mux,
+		use_mux: dc.Mux && dc.MuxConf.IsTraditional(),
 	}
 	c.V2rayUser = utils.V2rayUser(uuid)
 	c.opt = OptChunkStream
@@ -105,7 +106,7 @@ func (c *Client) HasInnerMux() (int, string) {
 		return 2, "simplesocks"
 
 	} else {
-		return 0, ""
+		return c.Base.HasInnerMux() //sing-mux, Mux.Cool
 
 	}
 }
@@ -182,6 +183,9 @@ func (c *Client) commonHandshake(underlay net.Conn, firstPayload []byte, target
 		err = conn.handshake(CMDMux_VS, firstPayload)
 		conn.use_mux = true
 
+	} else if innerMux.IsMuxCoolAddr(target) {
+		err = conn.handshake(CmdMuxCool, firstPayload)
+
 	} else {
 		// Request
 		if target.IsUDP() {
@@ -279,14 +283,15 @@ func (c *ClientConn) handshake(cmd byte, firstpayload []byte) error {
 	buf.WriteByte(0) // reserved
 	buf.WriteByte(cmd)
 
-	// target
-	err := binary.Write(buf, binary.BigEndian, c.port)
-	if err != nil {
-		return err
-	}
+	// target, Mux.Cool 不带 地址
+	if cmd != CmdMuxCool {
+		if err := binary.Write(buf, binary.BigEndian, c.port); err != nil {
+			return err
+		}
 
-	buf.WriteByte(c.atyp)
-	buf.Write(c.addr)
+		buf.WriteByte(c.atyp)
+		buf.Write(c.addr)
+	}
 
 	// padding
 	if paddingLen > 0 {
@@ -297,7 +302,7 @@ func (c *ClientConn) handshake(cmd byte, firstpayload []byte) error {
 	}
 
 	fnv1a := fnv.New32a()
-	_, err = fnv1a.Write(buf.Bytes())
+	_, err := fnv1a.Write(buf.Bytes())
 	if err != nil {
 		return err
 	}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/innerMux"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -137,7 +138,11 @@ func (s *Server) Stop() {
 	s.session_antiReplayMachine.stop()
 }
 
+// 不加锁; 已存在的用户 不会被重复添加
 func (s *Server) addUser(u utils.V2rayUser) {
+	if _, has := s.IDMap[u.IdentityStr()]; has {
+		return
+	}
 	s.MultiUserMap.AddUser_nolock(u)
 	b, err := generateCipherByV2rayUser(u)
 	if err != nil {
@@ -150,6 +155,50 @@ func (s *Server) addUser(u utils.V2rayUser) {
 	s.authPairList = append(s.authPairList, p)
 }
 
+// 运行时 添加用户. u 须为 utils.V2rayUser. implements utils.UserBus
+func (s *Server) AddUser(u utils.User) error {
+	vu, ok := u.(utils.V2rayUser)
+	if !ok {
+		return utils.ErrNilOrWrongParameter
+	}
+	s.MultiUserMap.Mutex.Lock()
+	s.addUser(vu)
+	s.MultiUserMap.Mutex.Unlock()
+	return nil
+}
+
+// 运行时 删除用户. 握手 中 正在遍历的 authPairList 不会被修改, 而是 生成一个新的. implements utils.UserBus
+func (s *Server) DelUser(u utils.User) error {
+	vu, ok := u.(utils.V2rayUser)
+	if !ok {
+		return utils.ErrNilOrWrongParameter
+	}
+	s.MultiUserMap.Mutex.Lock()
+	defer s.MultiUserMap.Mutex.Unlock()
+
+	delete(s.IDMap, vu.IdentityStr())
+	delete(s.AuthMap, vu.AuthStr())
+
+	newList := make([]authPair, 0, len(s.authPairList))
+	for _, p := range s.authPairList {
+		if p.V2rayUser != vu {
+			newList = append(newList, p)
+		}
+	}
+	s.authPairList = newList
+	return nil
+}
+
+func (s *Server) NewUserByConf(uc utils.UserConf) (utils.User, error) {
+	return utils.NewV2rayUser(uc.User)
+}
+
+func (s *Server) getAuthPairList() []authPair {
+	s.MultiUserMap.Mutex.RLock()
+	defer s.MultiUserMap.Mutex.RUnlock()
+	return s.authPairList
+}
+
 func (*Server) HasInnerMux() (int, string) {
 	return 1, "simplesocks"
 }
@@ -171,13 +220,17 @@ func (s *Server) Handshake(underlay net.Conn) (tcpConn net.Conn, msgConn netLaye
 		returnErr = utils.NumErr{E: utils.ErrInvalidData, N: 1}
 		return
 	}
-	user, err := authUserByAuthPairList(data[:authid_len], s.authPairList, s.authid_anitReplayMachine)
+	user, err := authUserByAuthPairList(data[:authid_len], s.getAuthPairList(), s.authid_anitReplayMachine)
 	if err != nil {
 
 		returnErr = err
 		return
 
 	}
+	if utils.UserTraffic.ExceedQuota(user.IdentityStr()) {
+		returnErr = utils.ErrInErr{ErrDesc: "Vmess user rejected ", ErrDetail: utils.ErrQuotaExceeded, Data: user.IdentityStr()}
+		return
+	}
 
 	cmdKey := GetKey(user)
 	remainBuf := bytes.NewBuffer(data[authid_len:n])
@@ -249,10 +302,9 @@ func (s *Server) Handshake(underlay net.Conn) (tcpConn net.Conn, msgConn netLaye
 		}
 		targetAddr = ad
 
-		//verysimple 不支持v2ray中的 vmess 的 mux.cool
-
-	case cmd_muxcool_unimplemented:
-		returnErr = utils.ErrInErr{ErrDesc: "Vmess mux.cool is not supported by verysimple ", ErrDetail: utils.ErrInvalidData}
+	case CmdMuxCool:
+		//按 普通tcp连接 返回, 调用者 以 目标地址 识别
+		targetAddr = innerMux.MuxCoolAddr()
 
 	case CMDMux_VS:
 		ismux = true
@@ -306,7 +358,7 @@ func (s *Server) Handshake(underlay net.Conn) (tcpConn net.Conn, msgConn netLaye
 		return sc, nil, targetAddr, nil
 	}
 
-	if sc.cmd == CmdTCP {
+	if sc.cmd == CmdTCP || sc.cmd == CmdMuxCool {
 		tcpConn = sc
 
 	} else {
@@ -0,0 +1,145 @@
+package v2ray_simple
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+// 某个 tag 的上下行字节数统计, 原子更新. 实现 netLayer.TrafficCounter
+type TagTrafficStat struct {
+	Download uint64
+	Upload   uint64
+}
+
+func (ts *TagTrafficStat) AddDownload(n uint64) {
+	utils.AtomicAddUint64(&ts.Download, n)
+}
+
+func (ts *TagTrafficStat) AddUpload(n uint64) {
+	utils.AtomicAddUint64(&ts.Upload, n)
+}
+
+// 以名称为key 的一组计数器. concurrent safe. 零值可直接使用
+type NamedCounters struct {
+	sync.RWMutex
+	m map[string]*uint64
+}
+
+func (nc *NamedCounters) Add(name string, n uint64) {
+	nc.RLock()
+	p := nc.m[name]
+	nc.RUnlock()
+
+	if p == nil {
+		nc.Lock()
+		if nc.m == nil {
+			nc.m = make(map[string]*uint64)
+		}
+		p = nc.m[name]
+		if p == nil {
+			p = new(uint64)
+			nc.m[name] = p
+		}
+		nc.Unlock()
+	}
+	utils.AtomicAddUint64(p, n)
+}
+
+// 返回所有计数器的快照
+func (nc *NamedCounters) Snapshot() map[string]uint64 {
+	nc.RLock()
+	r := make(map[string]uint64, len(nc.m))
+	for k, p := range nc.m {
+		r[k] = atomic.LoadUint64(p)
+	}
+	nc.RUnlock()
+	return r
+}
+
+// 以 tag 为key 的 TagTrafficStat 表. concurrent safe. 零值可直接使用
+type TagTrafficMap struct {
+	sync.RWMutex
+	m map[string]*TagTrafficStat
+}
+
+func (tm *TagTrafficMap) GetOrCreate(tag string) *TagTrafficStat {
+	tm.RLock()
+	ts := tm.m[tag]
+	tm.RUnlock()
+	if ts != nil {
+		return ts
+	}
+
+	tm.Lock()
+	if tm.m == nil {
+		tm.m = make(map[string]*TagTrafficStat)
+	}
+	ts = tm.m[tag]
+	if ts == nil {
+		ts = new(TagTrafficStat)
+		tm.m[tag] = ts
+	}
+	tm.Unlock()
+	return ts
+}
+
+// 返回所有 tag 的统计快照, 按 tag 排序
+func (tm *TagTrafficMap) Snapshot() (tags []string, stats []TagTrafficStat) {
+	tm.RLock()
+	for tag := range tm.m {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		ts := tm.m[tag]
+		stats = append(stats, TagTrafficStat{
+			Download: atomic.LoadUint64(&ts.Download),
+			Upload:   atomic.LoadUint64(&ts.Upload),
+		})
+	}
+	tm.RUnlock()
+	return
+}
+
+// 用于 GlobalInfo 统计 与 路由结果 的标签. 没有tag的 proxy 使用其协议名.
+func statTagOf(p proxy.BaseInterface) string {
+	if t := p.GetTag(); t != "" {
+		return t
+	}
+	return p.Name()
+}
+
+// 未被分流 而使用了默认 outClient 时, 在 RouteCount 中所使用的key
+const DefaultRouteStatKey = "default"
+
+func (gi *GlobalInfo) addInHandshakeFailure(protocol string) {
+	if gi == nil {
+		return
+	}
+	gi.InHandshakeFailures.Add(protocol, 1)
+}
+
+func (gi *GlobalInfo) addOutHandshakeFailure(protocol string) {
+	if gi == nil {
+		return
+	}
+	gi.OutHandshakeFailures.Add(protocol, 1)
+}
+
+func (gi *GlobalInfo) addFallbackHit() {
+	if gi == nil {
+		return
+	}
+	utils.AtomicAddUint64(&gi.FallbackCount, 1)
+}
+
+func (gi *GlobalInfo) addRoute(outtag string) {
+	if gi == nil {
+		return
+	}
+	gi.RouteCount.Add(outtag, 1)
+}
@@ -4,21 +4,26 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
 	"github.com/e1732a364fed/v2ray_simple"
 	"github.com/e1732a364fed/v2ray_simple/netLayer"
 	"github.com/e1732a364fed/v2ray_simple/proxy"
+	"github.com/e1732a364fed/v2ray_simple/proxy/socks5"
 	"github.com/e1732a364fed/v2ray_simple/utils"
 
 	_ "github.com/e1732a364fed/v2ray_simple/advLayer/grpcSimple"
 	_ "github.com/e1732a364fed/v2ray_simple/advLayer/ws"
 
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/dokodemo"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/muxcool"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/shadowsocks"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/simplesocks"
+	_ "github.com/e1732a364fed/v2ray_simple/proxy/singmux"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/socks5http"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/trojan"
 	_ "github.com/e1732a364fed/v2ray_simple/proxy/vless"
@@ -26,19 +31,27 @@ import (
 )
 
 func TestTCP_vless(t *testing.T) {
-	testTCP(t, "vless", 0, "tcp", false)
+	testTCP(t, "vless", 0, "tcp", "")
 }
 
 func TestTCP_trojan(t *testing.T) {
-	testTCP(t, "trojan", 0, "tcp", false)
+	testTCP(t, "trojan", 0, "tcp", "")
 }
 
 func TestTCP_trojan_mux(t *testing.T) {
-	testTCP(t, "trojan", 0, "tcp", true)
+	testTCP(t, "trojan", 0, "tcp", "use_mux = true")
 }
 
-// tcp测试我们直接使用http请求来测试
-func testTCP(t *testing.T, protocol string, version int, network string, innermux bool) {
+func TestTCP_vless_singmux_yamux(t *testing.T) {
+	testTCP(t, "vless", 0, "tcp", "mux = true\nmux_conf = { protocol = \"yamux\", max_streams = 1, idle_timeout = 5 }")
+}
+
+func TestTCP_trojan_singmux_h2mux_padding(t *testing.T) {
+	testTCP(t, "trojan", 0, "tcp", "mux = true\nmux_conf = { protocol = \"h2mux\", padding = true }")
+}
+
+// tcp测试我们直接使用http请求来测试. muxConf 不为空 时 会被 加到 客户端 dial 配置 的 末尾
+func testTCP(t *testing.T, protocol string, version int, network string, muxConf string) {
 	utils.LogLevel = utils.Log_debug
 	utils.InitLog("")
 
@@ -59,9 +72,7 @@ network = "%s"
 
 `
 
-	if innermux {
-		testClientConfFormatStr += "use_mux = true"
-	}
+	testClientConfFormatStr += muxConf
 
 	const testServerConfFormatStr = `
 [[listen]]
@@ -185,3 +196,374 @@ func tryGetHttp(t *testing.T, client *http.Client, path string) {
 	}
 
 }
+
+// http -> trojan (通过 socks5 拨号) -> socks5 服务端 -> trojan 服务端 -> 本地 http 服务器, 不需要 外网
+func TestTCP_via(t *testing.T) {
+	utils.LogLevel = utils.Log_debug
+	utils.InitLog("")
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "via ok")
+	}))
+	defer hs.Close()
+
+	clientListenPort := netLayer.RandPortStr(true, false)
+	socks5Port := netLayer.RandPortStr(true, false)
+	trojanPort := netLayer.RandPortStr(true, false)
+
+	clientConf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(`
+[[listen]]
+protocol = "http"
+host = "127.0.0.1"
+port = %s
+
+[[dial]]
+protocol = "trojan"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+via = "s5"
+
+[[dial]]
+tag = "s5"
+protocol = "socks5"
+host = "127.0.0.1"
+port = %s
+`, clientListenPort, trojanPort, socks5Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(`
+[[listen]]
+protocol = "socks5"
+host = "127.0.0.1"
+port = %s
+
+[[listen]]
+protocol = "trojan"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+
+[[dial]]
+protocol = "direct"
+`, socks5Port, trojanPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &proxy.RoutingEnv{ClientsTagMap: make(map[string]proxy.Client)}
+	var clients []proxy.Client
+	for _, dc := range clientConf.Dial {
+		c, err := proxy.NewClient(dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.SetClient(c.GetTag(), c)
+		clients = append(clients, c)
+	}
+	directClient, _ := proxy.NewClient(serverConf.Dial[0])
+
+	clientEndInServer, err := proxy.NewServer(clientConf.Listen[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := v2ray_simple.ListenSer(clientEndInServer, clients[0], env, nil); c != nil {
+		defer c.Close()
+	}
+	for _, lc := range serverConf.Listen {
+		s, err := proxy.NewServer(lc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := v2ray_simple.ListenSer(s, directClient, nil, nil); c != nil {
+			defer c.Close()
+		}
+	}
+
+	url_proxy, _ := url.Parse("http://127.0.0.1:" + clientListenPort)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(url_proxy)},
+	}
+	resp, err := client.Get(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(bs) != "via ok" {
+		t.Fatal("got wrong response", string(bs))
+	}
+}
+
+// http -> vmess/vless v0 (mux.cool) -> 本地 http 服务器, 不需要 外网
+func TestTCP_muxcool(t *testing.T) {
+	utils.LogLevel = utils.Log_debug
+	utils.InitLog("")
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "muxcool ok")
+	}))
+	defer hs.Close()
+
+	for _, protocol := range []string{"vmess", "vless"} {
+		t.Run(protocol, func(t *testing.T) {
+			clientListenPort := netLayer.RandPortStr(true, false)
+			serverPort := netLayer.RandPortStr(true, false)
+
+			clientConf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(`
+[[listen]]
+protocol = "http"
+host = "127.0.0.1"
+port = %s
+
+[[dial]]
+protocol = "%s"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+mux = true
+mux_conf = { protocol = "muxcool" }
+`, clientListenPort, protocol, serverPort))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serverConf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(`
+[[listen]]
+protocol = "%s"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+
+[[dial]]
+protocol = "direct"
+`, protocol, serverPort))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			outClient, err := proxy.NewClient(clientConf.Dial[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			inServer, err := proxy.NewServer(clientConf.Listen[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverEndInServer, err := proxy.NewServer(serverConf.Listen[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			directClient, _ := proxy.NewClient(serverConf.Dial[0])
+
+			if c := v2ray_simple.ListenSer(inServer, outClient, nil, nil); c != nil {
+				defer c.Close()
+			}
+			if c := v2ray_simple.ListenSer(serverEndInServer, directClient, nil, nil); c != nil {
+				defer c.Close()
+			}
+			defer outClient.CloseInnerMuxSession()
+
+			url_proxy, _ := url.Parse("http://127.0.0.1:" + clientListenPort)
+			client := &http.Client{
+				Transport: &http.Transport{Proxy: http.ProxyURL(url_proxy), DisableKeepAlives: true},
+			}
+			//多次请求, 后面的 请求 复用 同一个 mux连接
+			for i := 0; i < 3; i++ {
+				resp, err := client.Get(hs.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				bs, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(bs) != "muxcool ok" {
+					t.Fatal("got wrong response", string(bs))
+				}
+			}
+			if !outClient.InnerMuxEstablished() {
+				t.Fatal("mux.cool session not established")
+			}
+		})
+	}
+}
+
+// http -> vless+tls (xtls-rprx-vision) -> 本地 http/https 服务器, 不需要 外网.
+// 访问 https 时 内层 为 tls1.3, 双方 会 切换到 直接拷贝.
+func TestTCP_vision(t *testing.T) {
+	utils.LogLevel = utils.Log_debug
+	utils.InitLog("")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "vision ok")
+	})
+	hs := httptest.NewServer(handler)
+	defer hs.Close()
+	hss := httptest.NewTLSServer(handler)
+	defer hss.Close()
+
+	clientListenPort := netLayer.RandPortStr(true, false)
+	serverPort := netLayer.RandPortStr(true, false)
+
+	clientConf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(`
+[[listen]]
+protocol = "http"
+host = "127.0.0.1"
+port = %s
+
+[[dial]]
+protocol = "vlesss"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+insecure = true
+flow = "xtls-rprx-vision"
+`, clientListenPort, serverPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(`
+[[listen]]
+protocol = "vlesss"
+uuid = "a684455c-b14f-11ea-bf0d-42010aaa0003"
+host = "127.0.0.1"
+port = %s
+cert = "cert.pem"
+key = "cert.key"
+flow = "xtls-rprx-vision"
+
+[[dial]]
+protocol = "direct"
+`, serverPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outClient, err := proxy.NewClient(clientConf.Dial[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	inServer, err := proxy.NewServer(clientConf.Listen[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverEndInServer, err := proxy.NewServer(serverConf.Listen[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	directClient, _ := proxy.NewClient(serverConf.Dial[0])
+
+	if c := v2ray_simple.ListenSer(inServer, outClient, nil, nil); c != nil {
+		defer c.Close()
+	}
+	if c := v2ray_simple.ListenSer(serverEndInServer, directClient, nil, nil); c != nil {
+		defer c.Close()
+	}
+
+	url_proxy, _ := url.Parse("http://127.0.0.1:" + clientListenPort)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(url_proxy),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+	for _, u := range []string{hs.URL, hss.URL, hss.URL} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(bs) != "vision ok" {
+			t.Fatal("got wrong response", u, string(bs))
+		}
+	}
+}
+
+// socks5 BIND -> socks5 -> socks5 BIND -> direct, 目标主机 连入 上游 所监听的端口
+func TestTCP_socks5_bind_chain(t *testing.T) {
+	utils.LogLevel = utils.Log_debug
+	utils.InitLog("")
+
+	frontPort := netLayer.RandPortStr(true, false)
+	upstreamPort := netLayer.RandPortStr(true, false)
+
+	frontConf, err := proxy.LoadStandardConfFromTomlStr(fmt.Sprintf(`
+[[listen]]
+protocol = "socks5"
+host = "127.0.0.1"
+port = %s
+extra = { bind = true }
+
+[[dial]]
+protocol = "socks5"
+host = "127.0.0.1"
+port = %s
+
+[[listen]]
+protocol = "socks5"
+host = "127.0.0.1"
+port = %s
+extra = { bind = true }
+
+[[dial]]
+protocol = "direct"
+`, frontPort, upstreamPort, upstreamPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, lc := range frontConf.Listen {
+		s, err := proxy.NewServer(lc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := proxy.NewClient(frontConf.Dial[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lis := v2ray_simple.ListenSer(s, c, nil, nil); lis != nil {
+			defer lis.Close()
+		}
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+frontPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := &socks5.Client{}
+	bindAddr, err := c.Bind(conn, netLayer.Addr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.Dial("tcp", bindAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	peerAddr, err := socks5.ReadBindReply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peerAddr.String() != peer.LocalAddr().String() {
+		t.Fatal("peer addr wrong", peerAddr.String(), peer.LocalAddr().String())
+	}
+
+	peer.Write([]byte("hello"))
+	var bs [5]byte
+	if _, err = io.ReadFull(conn, bs[:]); err != nil || string(bs[:]) != "hello" {
+		t.Fatal("read from peer wrong", err, bs)
+	}
+
+	conn.Write([]byte("world"))
+	if _, err = io.ReadFull(peer, bs[:]); err != nil || string(bs[:]) != "world" {
+		t.Fatal("read from client wrong", err, bs)
+	}
+}
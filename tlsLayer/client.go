@@ -2,6 +2,7 @@ package tlsLayer
 
 import (
 	"crypto/tls"
+	"errors"
 	"net"
 	"strings"
 	"unsafe"
@@ -23,6 +24,11 @@ type Client struct {
 
 	shadowTlsPassword string
 	utlsFingerprint   utls.ClientHelloID
+	utlsSpec          utlsSpecFactory //自定义指纹, 优先于 utlsFingerprint
+
+	reality *realityClient
+	ech     *echClient
+	echErr  error //配置了 ECH 但 无法使用, 此时 每次 握手 都 失败, 以免 暴露 真实的 sni
 }
 
 func NewClient(conf Conf) *Client {
@@ -34,6 +40,17 @@ func NewClient(conf Conf) *Client {
 	c.alpnList = conf.AlpnList
 
 	switch conf.Tls_type {
+	case Reality_t:
+		rc, err := newRealityClient(conf)
+		if err != nil {
+			if ce := utils.CanLogErr("Failed in init reality client"); ce != nil {
+				ce.Write(zap.Error(err))
+			}
+		}
+		c.reality = rc
+		c.uTlsConfig = GetUTlsConfig(conf)
+		c.utlsFingerprint = getUtlsFingerprintFromExtra(conf.Extra)
+		c.utlsSpec = getUtlsSpecFromExtra(conf.Extra)
 	case ShadowTls2_t:
 		fallthrough
 	case ShadowTls_t:
@@ -44,43 +61,8 @@ func NewClient(conf Conf) *Client {
 	case UTls_t:
 		c.uTlsConfig = GetUTlsConfig(conf)
 
-		if len(conf.Extra) > 0 {
-			if thing := conf.Extra["utls_fingerprint"]; thing != nil {
-				if str, ok := thing.(string); ok {
-					str = strings.ToLower(str)
-					switch str {
-					case "chrome":
-						fallthrough
-					default:
-						c.utlsFingerprint = utls.HelloChrome_Auto
-					case "firefox":
-						c.utlsFingerprint = utls.HelloFirefox_Auto
-
-					case "ios":
-						c.utlsFingerprint = utls.HelloIOS_Auto
-
-					case "safari":
-						c.utlsFingerprint = utls.HelloSafari_Auto
-
-					case "golang":
-						c.utlsFingerprint = utls.HelloGolang
-
-					case "android":
-						c.utlsFingerprint = utls.HelloAndroid_11_OkHttp
-
-					case "360":
-						c.utlsFingerprint = utls.Hello360_Auto
-
-					case "edge":
-						c.utlsFingerprint = utls.HelloEdge_Auto
-
-					case "random":
-						c.utlsFingerprint = utls.HelloRandomized
-
-					}
-				}
-			}
-		}
+		c.utlsFingerprint = getUtlsFingerprintFromExtra(conf.Extra)
+		c.utlsSpec = getUtlsSpecFromExtra(conf.Extra)
 
 		if ce := utils.CanLogInfo("Using uTls and Chrome fingerprint for"); ce != nil {
 			ce.Write(zap.String("host", conf.Host))
@@ -90,22 +72,45 @@ func NewClient(conf Conf) *Client {
 
 	}
 
+	ec, err := newECHClient(conf)
+	if err == nil && ec != nil && conf.Tls_type != Tls_t {
+		err = utils.ErrInErr{ErrDesc: "ech is only supported when tls_type is tls", ErrDetail: utils.ErrUnImplemented, Data: TypeToStr(conf.Tls_type)}
+	}
+	if err != nil {
+		if ce := utils.CanLogErr("Failed in init ech client, all handshakes will fail"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		c.echErr = err
+	} else {
+		c.ech = ec
+	}
+
 	return c
 }
 
-// utls和tls时返回tlsLayer.Conn, shadowTls1时返回underlay, shadowTls2时返回 普通 net.Conn
+// 设置 ech_config 为 dns 时 用于 查询 HTTPS 记录
+func (c *Client) SetECHQuerier(q ECHQuerier) {
+	if c.ech != nil {
+		c.ech.querier = q
+	}
+}
+
+// utls,tls和reality时返回tlsLayer.Conn, shadowTls1时返回underlay, shadowTls2时返回 普通 net.Conn
 func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
+	if c.echErr != nil {
+		return nil, c.echErr
+	}
 
 	switch c.tlsType {
 	case UTls_t:
 		configCopy := c.uTlsConfig //发现uTlsConfig竟然没法使用指针，握手一次后配置文件就会被污染，只能拷贝
 		//否则的话接下来的握手客户端会报错： tls: CurvePreferences includes unsupported curve
 
-		if (c.utlsFingerprint == utls.ClientHelloID{}) {
-			c.utlsFingerprint = utls.HelloChrome_Auto
+		var utlsConn *utls.UConn
+		utlsConn, err = newUConn(underlay, &configCopy, c.utlsFingerprint, c.utlsSpec)
+		if err != nil {
+			return
 		}
-
-		utlsConn := utls.UClient(underlay, &configCopy, c.utlsFingerprint)
 		err = utlsConn.Handshake()
 		if err != nil {
 			return
@@ -115,10 +120,30 @@ func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
 			ptr:     unsafe.Pointer(utlsConn.Conn),
 			tlsType: UTls_t,
 		}
+	case Reality_t:
+		if c.reality == nil {
+			return nil, errors.New("reality client not properly configured")
+		}
+		return c.reality.handshake(underlay, &c.uTlsConfig, c.utlsFingerprint, c.utlsSpec)
 	case Tls_t:
-		officialConn := tls.Client(underlay, c.tlsConfig)
+		tConf := c.tlsConfig
+		if c.ech != nil {
+			var list []byte
+			list, err = c.ech.currentConfigList()
+			if err != nil {
+				return
+			}
+			if list != nil {
+				tConf = applyECHClient(tConf, list, c.ech.insecure)
+			}
+		}
+
+		officialConn := tls.Client(underlay, tConf)
 		err = officialConn.Handshake()
 		if err != nil {
+			if c.ech != nil {
+				c.ech.handleErr(err)
+			}
 			return
 		}
 
@@ -161,3 +186,44 @@ func (c *Client) Handshake(underlay net.Conn) (result net.Conn, err error) {
 
 	return
 }
+
+func getUtlsFingerprintFromExtra(extra map[string]any) (fp utls.ClientHelloID) {
+	if len(extra) > 0 {
+		if thing := extra["utls_fingerprint"]; thing != nil {
+			if str, ok := thing.(string); ok {
+				str = strings.ToLower(str)
+				switch str {
+				case "chrome":
+					fallthrough
+				default:
+					fp = utls.HelloChrome_Auto
+				case "firefox":
+					fp = utls.HelloFirefox_Auto
+
+				case "ios":
+					fp = utls.HelloIOS_Auto
+
+				case "safari":
+					fp = utls.HelloSafari_Auto
+
+				case "golang":
+					fp = utls.HelloGolang
+
+				case "android":
+					fp = utls.HelloAndroid_11_OkHttp
+
+				case "360":
+					fp = utls.Hello360_Auto
+
+				case "edge":
+					fp = utls.HelloEdge_Auto
+
+				case "random":
+					fp = utls.HelloRandomized
+
+				}
+			}
+		}
+	}
+	return
+}
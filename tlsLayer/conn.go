@@ -1,8 +1,10 @@
 package tlsLayer
 
 import (
+	"bytes"
 	"crypto/tls"
 	"net"
+	"reflect"
 	"unsafe"
 
 	utls "github.com/refraction-networking/utls"
@@ -23,6 +25,28 @@ type Conn interface {
 	GetTeeConn() *TeeConn
 	GetAlpn() string
 	GetSni() string
+
+	//返回 tls连接 的 底层连接, 以及 tls连接 内部 已从 底层连接 读取 但 尚未 被读出 的 数据: input 为 已解密的, rawInput 为 尚未解密的.
+	//用于 xtls vision 在 切换到 直接读写 底层连接 时 取出 这些数据.
+	GetRawConn() net.Conn
+	GetInputBuffers() (input *bytes.Reader, rawInput *bytes.Buffer)
+}
+
+// tls.Conn 与 utls.Conn 中 input 与 rawInput 的 偏移
+var tlsInputOffset, tlsRawInputOffset, utlsInputOffset, utlsRawInputOffset uintptr
+
+func init() {
+	tlsInputOffset, tlsRawInputOffset = getInputOffsets(reflect.TypeOf((*tls.Conn)(nil)).Elem())
+	utlsInputOffset, utlsRawInputOffset = getInputOffsets(reflect.TypeOf((*utls.Conn)(nil)).Elem())
+}
+
+func getInputOffsets(t reflect.Type) (input, rawInput uintptr) {
+	i, ok1 := t.FieldByName("input")
+	r, ok2 := t.FieldByName("rawInput")
+	if !ok1 || !ok2 || i.Type != reflect.TypeOf(bytes.Reader{}) || r.Type != reflect.TypeOf(bytes.Buffer{}) {
+		panic("tlsLayer: can't find input and rawInput in " + t.String())
+	}
+	return i.Offset, r.Offset
 }
 
 type conn struct {
@@ -51,6 +75,22 @@ func (c *conn) GetRaw(tls_lazy_encrypt bool) *net.TCPConn {
 	return nil
 }
 
+func (c *conn) GetRawConn() net.Conn {
+	return (*faketlsconn)(c.ptr).conn
+}
+
+func (c *conn) GetInputBuffers() (input *bytes.Reader, rawInput *bytes.Buffer) {
+	switch c.tlsType {
+	case UTls_t:
+		input = (*bytes.Reader)(unsafe.Add(c.ptr, utlsInputOffset))
+		rawInput = (*bytes.Buffer)(unsafe.Add(c.ptr, utlsRawInputOffset))
+	default:
+		input = (*bytes.Reader)(unsafe.Add(c.ptr, tlsInputOffset))
+		rawInput = (*bytes.Buffer)(unsafe.Add(c.ptr, tlsRawInputOffset))
+	}
+	return
+}
+
 // 直接获取TeeConn，仅用于已经确定肯定能获取到的情况
 func (c *conn) GetTeeConn() *TeeConn {
 	rc := (*faketlsconn)(c.ptr)
@@ -0,0 +1,288 @@
+package tlsLayer
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+)
+
+/*
+ECH (Encrypted Client Hello, draft-ietf-tls-esni) 将 真实的 ClientHello (包含 真实的 sni) 用 服务端 公布的 公钥 加密,
+外层 ClientHello 只包含 ECHConfig 中的 public_name, 审查者 无法 得知 真实的 sni.
+
+ECH 依赖 go1.24 及以上 的 crypto/tls, 所以 只支持 tls_type 为 tls 的情况, 用更低版本 编译时 配置 ECH 会报错.
+
+服务端 Extra: ech_config (base64 的 ECHConfigList), ech_key (base64 的 x25519 私钥).
+可用 verysimple -gech 公开域名 生成; ech_config 也就是 要发布在 dns 的 HTTPS 记录 中的 ech 参数.
+
+客户端 Extra:
+
+	ech_config: base64 的 ECHConfigList; 或者为 "dns", 表示 通过 DNSMachine 查询 host 的 HTTPS 记录;
+	或者为 "dns:域名", 表示 查询 指定域名的 HTTPS 记录.
+
+	ech_force: 默认为 true, 得不到 ECHConfig 或 服务端 关闭了 ECH 时 握手失败, 以免 暴露 真实的 sni;
+	为 false 时 回退到 不使用 ECH 的 tls.
+
+ech_config 无法解析, 或 当前编译版本 不支持 ECH, 或 tls_type 不为 tls 时, 客户端 的 每次握手 都会 失败, 而不会 暴露 真实的 sni.
+
+服务端 拒绝 ECH 后 得到的 状态 (retry_configs 或 服务端 关闭了 ECH) 只 保持 echStateTimeout, 之后 重新 使用 配置 或 重新 查询 dns.
+insecure 时 无法 验证 拒绝 是否 真的 来自 服务端, 所以 不会 因为 拒绝 而 关闭 ECH.
+*/
+
+const (
+	echVersion = 0xfe0d
+
+	hpkeKemX25519HkdfSha256 = 0x0020
+	hpkeKdfHkdfSha256       = 0x0001
+	hpkeAeadAes128Gcm       = 0x0001
+	hpkeAeadChaCha20Poly    = 0x0003
+
+	echStateTimeout = 10 * time.Minute
+)
+
+// 默认编译 所用的 quic-go 不支持 go1.20 及以上, 所以 要使用 ECH, 须 用 go1.24 及以上 并 带 noquic 标签 编译.
+var ErrECHUnsupported = errors.New("ech requires go1.24 or later, and must be built with the noquic tag")
+
+// GenerateECHKey 生成 一个 使用 x25519 的 ECHConfigList 以及 对应的私钥, 以 base64 StdEncoding 编码,
+// 分别用于 ech_config 和 ech_key. publicName 是 外层 ClientHello 使用的 sni, 服务端 需要有 该域名的 证书 以便 回退.
+func GenerateECHKey(publicName string) (configList, privateKey string, err error) {
+	if publicName == "" || len(publicName) > 255 {
+		return "", "", utils.ErrInErr{ErrDesc: "ech public name invalid", Data: publicName}
+	}
+	priv := make([]byte, 32)
+	if _, err = rand.Read(priv); err != nil {
+		return
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	var id [1]byte
+	rand.Read(id[:])
+
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(marshalECHConfig(id[0], pub, publicName))
+	})
+	list, err := b.Bytes()
+	if err != nil {
+		return
+	}
+	return base64.StdEncoding.EncodeToString(list), base64.StdEncoding.EncodeToString(priv), nil
+}
+
+func marshalECHConfig(id uint8, pub []byte, publicName string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(echVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(id)
+		b.AddUint16(hpkeKemX25519HkdfSha256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(pub)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, aead := range []uint16{hpkeAeadAes128Gcm, hpkeAeadChaCha20Poly} {
+				b.AddUint16(hpkeKdfHkdfSha256)
+				b.AddUint16(aead)
+			}
+		})
+		b.AddUint8(0) //maximum_name_length, 0 表示 由客户端 自行填充
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) //extensions
+	})
+	return b.BytesOrPanic()
+}
+
+// 将 ECHConfigList 拆分为 各个 ECHConfig (包含 version 和 length)
+func splitECHConfigList(list []byte) (configs [][]byte, err error) {
+	s := cryptobyte.String(list)
+	var inner cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&inner) || !s.Empty() {
+		return nil, errors.New("ech config list malformed")
+	}
+	for !inner.Empty() {
+		var version uint16
+		var contents cryptobyte.String
+		start := inner
+		if !inner.ReadUint16(&version) || !inner.ReadUint16LengthPrefixed(&contents) {
+			return nil, errors.New("ech config malformed")
+		}
+		configs = append(configs, start[:len(start)-len(inner)])
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("ech config list empty")
+	}
+	return
+}
+
+func decodeECHBase64(extra map[string]any, key string) ([]byte, error) {
+	str := getStrFromExtra(extra, key)
+	if str == "" {
+		return nil, nil
+	}
+	bs, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "ech base64 decode failed", ErrDetail: err, Data: key}
+	}
+	return bs, nil
+}
+
+// 服务端 的 ECH 配置, 没有配置 时 返回 nil
+func setupECHServer(tConf *tls.Config, conf Conf) error {
+	list, err := decodeECHBase64(conf.Extra, "ech_config")
+	if err != nil {
+		return err
+	}
+	key, err := decodeECHBase64(conf.Extra, "ech_key")
+	if err != nil {
+		return err
+	}
+	if list == nil && key == nil {
+		return nil
+	}
+	if list == nil || len(key) != 32 {
+		return errors.New("ech server needs both ech_config and a 32 bytes ech_key")
+	}
+	configs, err := splitECHConfigList(list)
+	if err != nil {
+		return err
+	}
+	return applyECHServerKeys(tConf, configs, key)
+}
+
+// ECHQuerier 查询 domain 的 HTTPS 记录 中的 ECHConfigList
+type ECHQuerier func(domain string) ([]byte, error)
+
+type echClient struct {
+	configList  []byte
+	queryDomain string //不为空时 通过 querier 获取 ECHConfigList
+	force       bool
+	insecure    bool
+
+	querier ECHQuerier
+
+	mutex     sync.Mutex
+	retry     []byte    //服务端 拒绝时 发来的 retry_configs, 优先使用
+	disabled  bool      //服务端 关闭了 ECH
+	stateTime time.Time //retry 或 disabled 的 设置时间, 超过 echStateTimeout 后 失效
+}
+
+// 没有配置 ech_config 时 返回 nil, nil
+func newECHClient(conf Conf) (*echClient, error) {
+	str := getStrFromExtra(conf.Extra, "ech_config")
+	if str == "" {
+		return nil, nil
+	}
+	if !echSupported {
+		return nil, ErrECHUnsupported
+	}
+	ec := &echClient{insecure: conf.Insecure, force: true}
+	if v, ok := utils.AnyToBool(conf.Extra["ech_force"]); ok {
+		ec.force = v
+	}
+
+	if str == "dns" || strings.HasPrefix(str, "dns:") {
+		ec.queryDomain = strings.TrimPrefix(strings.TrimPrefix(str, "dns"), ":")
+		if ec.queryDomain == "" {
+			ec.queryDomain = conf.Host
+		}
+		if ec.queryDomain == "" {
+			return nil, errors.New("ech dns query needs a domain")
+		}
+		return ec, nil
+	}
+
+	var err error
+	ec.configList, err = decodeECHBase64(conf.Extra, "ech_config")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = splitECHConfigList(ec.configList); err != nil {
+		return nil, err
+	}
+	return ec, nil
+}
+
+// 返回 本次握手 要使用的 ECHConfigList, 为 nil 时 不使用 ECH
+func (ec *echClient) currentConfigList() ([]byte, error) {
+	ec.mutex.Lock()
+	if !ec.stateTime.IsZero() && time.Since(ec.stateTime) > echStateTimeout {
+		ec.retry, ec.disabled, ec.stateTime = nil, false, time.Time{}
+	}
+	retry, disabled := ec.retry, ec.disabled
+	ec.mutex.Unlock()
+
+	switch {
+	case retry != nil:
+		return retry, nil
+	case disabled:
+		if ec.force {
+			return nil, errors.New("ech disabled by server")
+		}
+		return nil, nil
+	case ec.queryDomain == "":
+		return ec.configList, nil
+	}
+
+	var list []byte
+	var err error
+	if ec.querier == nil {
+		err = errors.New("no dns machine to query ech config")
+	} else {
+		list, err = ec.querier(ec.queryDomain)
+		if err == nil && list == nil {
+			err = errors.New("no ech config in HTTPS record")
+		}
+	}
+	if err != nil {
+		if ec.force {
+			return nil, utils.ErrInErr{ErrDesc: "Failed in getting ech config", ErrDetail: err, Data: ec.queryDomain}
+		}
+		if ce := utils.CanLogWarn("Failed in getting ech config, fallback to tls without ech"); ce != nil {
+			ce.Write(zap.String("domain", ec.queryDomain), zap.Error(err))
+		}
+		return nil, nil
+	}
+	return list, nil
+}
+
+// 根据 握手错误 更新 状态: 服务端 给出 retry_configs 时 之后的连接 使用它, 没给出 表示 服务端 关闭了 ECH.
+// 当前连接 无法重试, 由 上层 重新拨号.
+func (ec *echClient) handleErr(err error) {
+	retry, rejected := echRejection(err)
+	if !rejected {
+		return
+	}
+	if len(retry) == 0 && ec.insecure {
+		//没有 验证 证书, 拒绝 可能 是 中间人 伪造的, 不能 因此 关闭 ECH
+		if ce := utils.CanLogWarn("ech rejected without retry configs, ignored because insecure is set"); ce != nil {
+			ce.Write(zap.Error(err))
+		}
+		return
+	}
+
+	ec.mutex.Lock()
+	if len(retry) > 0 {
+		ec.retry = retry
+	} else {
+		ec.retry = nil
+		ec.disabled = true
+	}
+	ec.stateTime = time.Now()
+	ec.mutex.Unlock()
+
+	if ce := utils.CanLogWarn("ech rejected by server"); ce != nil {
+		ce.Write(zap.Bool("got_retry_configs", len(retry) > 0), zap.Duration("keep", echStateTimeout))
+	}
+}
@@ -0,0 +1,43 @@
+//go:build go1.24
+
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+const echSupported = true
+
+func applyECHServerKeys(tConf *tls.Config, configs [][]byte, key []byte) error {
+	for _, c := range configs {
+		tConf.EncryptedClientHelloKeys = append(tConf.EncryptedClientHelloKeys, tls.EncryptedClientHelloKey{
+			Config:      c,
+			PrivateKey:  key,
+			SendAsRetry: true,
+		})
+	}
+	//ECH 只能用于 tls1.3
+	tConf.MinVersion = tls.VersionTLS13
+	return nil
+}
+
+// 返回的 config 为 拷贝
+func applyECHClient(tConf *tls.Config, list []byte, insecure bool) *tls.Config {
+	tConf = tConf.Clone()
+	tConf.EncryptedClientHelloConfigList = list
+	tConf.MinVersion = tls.VersionTLS13
+	if insecure {
+		//被拒绝时 go 会用 public_name 验证证书 且 忽略 InsecureSkipVerify
+		tConf.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error { return nil }
+	}
+	return tConf
+}
+
+func echRejection(err error) (retry []byte, rejected bool) {
+	var re *tls.ECHRejectionError
+	if errors.As(err, &re) {
+		return re.RetryConfigList, true
+	}
+	return nil, false
+}
@@ -0,0 +1,19 @@
+//go:build !go1.24
+
+package tlsLayer
+
+import "crypto/tls"
+
+const echSupported = false
+
+func applyECHServerKeys(tConf *tls.Config, configs [][]byte, key []byte) error {
+	return ErrECHUnsupported
+}
+
+func applyECHClient(tConf *tls.Config, list []byte, insecure bool) *tls.Config {
+	return tConf
+}
+
+func echRejection(err error) (retry []byte, rejected bool) {
+	return nil, false
+}
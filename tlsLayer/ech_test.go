@@ -0,0 +1,157 @@
+//go:build go1.24
+
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 在 net.Pipe 上 进行一次握手, 返回 服务端 看到的 连接状态
+func echHandshake(t *testing.T, server *Server, client *Client) (tls.ConnectionState, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	type result struct {
+		state tls.ConnectionState
+		err   error
+	}
+	serverResult := make(chan result, 1)
+	go func() {
+		sc, err := server.Handshake(c2)
+		if err != nil {
+			c2.Close()
+			serverResult <- result{err: err}
+			return
+		}
+		serverResult <- result{state: sc.(*conn).Conn.(*tls.Conn).ConnectionState()}
+
+		//net.Pipe 是同步的, 要读取 客户端 可能发来的 alert
+		io.Copy(io.Discard, c2)
+	}()
+
+	_, err := client.Handshake(c1)
+	c1.Close()
+	r := <-serverResult
+	if err != nil {
+		return r.state, err
+	}
+	return r.state, r.err
+}
+
+func TestECH(t *testing.T) {
+	configList, key, err := GenerateECHKey("public.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(Conf{
+		Host:  "secret.example.com",
+		Extra: map[string]any{"ech_config": configList, "ech_key": key},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newClient := func(extra map[string]any) *Client {
+		return NewClient(Conf{Host: "secret.example.com", Insecure: true, Minver: tls.VersionTLS13, Extra: extra})
+	}
+
+	state, err := echHandshake(t, server, newClient(map[string]any{"ech_config": configList}))
+	if err != nil {
+		t.Fatal("ech handshake failed", err)
+	}
+	if !state.ECHAccepted || state.ServerName != "secret.example.com" {
+		t.Fatal("ech should be accepted with inner sni", state.ECHAccepted, state.ServerName)
+	}
+
+	//通过 dns 获取 ECHConfigList
+	client := newClient(map[string]any{"ech_config": "dns"})
+	var queried string
+	client.SetECHQuerier(func(domain string) ([]byte, error) {
+		queried = domain
+		return decodeTestECHList(t, configList), nil
+	})
+	if state, err = echHandshake(t, server, client); err != nil || !state.ECHAccepted || queried != "secret.example.com" {
+		t.Fatal("ech by dns failed", err, queried)
+	}
+
+	//查询失败时 默认 失败, ech_force 为 false 则 回退到 普通tls
+	client = newClient(map[string]any{"ech_config": "dns"})
+	client.SetECHQuerier(func(string) ([]byte, error) { return nil, errors.New("no record") })
+	if _, err = echHandshake(t, server, client); err == nil {
+		t.Fatal("ech should be forced by default")
+	}
+	client = newClient(map[string]any{"ech_config": "dns", "ech_force": false})
+	client.SetECHQuerier(func(string) ([]byte, error) { return nil, errors.New("no record") })
+	if state, err = echHandshake(t, server, client); err != nil || state.ECHAccepted {
+		t.Fatal("should fallback to tls without ech", err)
+	}
+
+	//密钥 过期 时 服务端 拒绝, 并 发来 retry_configs, 下一次 使用 它 成功
+	oldList, _, _ := GenerateECHKey("public.example.com")
+	client = newClient(map[string]any{"ech_config": oldList})
+	if _, err = echHandshake(t, server, client); err == nil {
+		t.Fatal("ech with wrong key should be rejected")
+	}
+	if state, err = echHandshake(t, server, client); err != nil || !state.ECHAccepted {
+		t.Fatal("retry configs should be used", err)
+	}
+}
+
+// 配置了 ECH 但 无法使用 时 不能 回退到 普通tls, 否则 会 暴露 真实的 sni
+func TestECHUnusable(t *testing.T) {
+	for _, conf := range []Conf{
+		{Host: "secret.example.com", Extra: map[string]any{"ech_config": "not base64!"}},
+		{Host: "secret.example.com", Extra: map[string]any{"ech_config": "AAAA"}},
+		{Host: "secret.example.com", Tls_type: UTls_t, Extra: map[string]any{"ech_config": "dns"}},
+	} {
+		c1, c2 := net.Pipe()
+		go io.Copy(io.Discard, c2)
+		_, err := NewClient(conf).Handshake(c1)
+		c1.Close()
+		c2.Close()
+		if err == nil {
+			t.Fatal("handshake should fail", conf.Extra, conf.Tls_type)
+		}
+	}
+}
+
+func TestECHRejectionState(t *testing.T) {
+	configList, _, err := GenerateECHKey("public.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := decodeTestECHList(t, configList)
+	rejection := &tls.ECHRejectionError{}
+
+	//insecure 时 拒绝 可能 是 伪造的, 不关闭 ECH
+	ec := &echClient{configList: list, insecure: true}
+	ec.handleErr(rejection)
+	if got, _ := ec.currentConfigList(); got == nil {
+		t.Fatal("insecure client should not disable ech")
+	}
+
+	//服务端 关闭 ECH 的 状态 会 过期
+	ec = &echClient{configList: list}
+	ec.handleErr(rejection)
+	if got, _ := ec.currentConfigList(); got != nil {
+		t.Fatal("ech should be disabled after rejection")
+	}
+	ec.stateTime = ec.stateTime.Add(-echStateTimeout - time.Second)
+	if got, _ := ec.currentConfigList(); got == nil {
+		t.Fatal("disabled state should expire")
+	}
+}
+
+func decodeTestECHList(t *testing.T, b64 string) []byte {
+	list, err := decodeECHBase64(map[string]any{"k": b64}, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
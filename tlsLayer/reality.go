@@ -0,0 +1,556 @@
+package tlsLayer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	utls "github.com/refraction-networking/utls"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+reality 参考了 xtls/REALITY 的思路, 但 不与其 互通.
+
+服务端 不需要 自己的 域名 和 证书, 而是 "借用" 一个 真实网站(dest) 的 握手:
+
+客户端 用 utls 发送 ClientHello, sni 为 dest 的 域名, 并把 32字节的 session id 换成 认证信息:
+用 ClientHello 中 x25519 key_share 的 私钥 与 服务端 公钥 做 ecdh, 经 hkdf 得到 authKey;
+再用 authKey 做 AES-GCM, 加密 [4字节 保留, 4字节 unix时间, 8字节 short id],
+nonce 为 Random[20:], 附加数据 为 session id 置零后的 ClientHello.
+
+服务端 读取 ClientHello 后 进行 同样的 计算, 认证失败(包括 sni 不在 server_names 中) 时,
+将 已读取的数据 与 之后的 所有数据 原样 转发给 dest, 所以 探测者 看到的 就是 dest 本身;
+
+认证成功时 用 tls1.3 完成 握手, 证书 为 每个连接 临时签发的, 其 SubjectKeyId 为 hmac(authKey, 公钥),
+客户端 据此 确认 对方 是 真正的 reality 服务端. tls1.3 的 证书 是 加密传输的, 审查者 看不到.
+
+配置 通过 Extra 给出:
+
+	服务端: reality_private_key, reality_short_ids, reality_dest (默认为 host:443), reality_server_names (默认为 host),
+	reality_max_time_diff (秒, 默认为0, 即不检查)
+
+	客户端: reality_public_key, reality_short_id, host 即为 发送的 sni. 可用 utls_fingerprint 或 utls_fingerprint_file 指定指纹.
+
+密钥对 可用 GenerateRealityKeyPair 生成, 命令行 为 verysimple -grk
+*/
+
+const (
+	realityKeyLen     = 32
+	realitySidLen     = 32
+	realityShortIdLen = 8
+
+	//Raw 中 session id 的 起始位置: 4字节 握手头, 2字节 版本, 32字节 Random, 1字节 session id 长度
+	realitySidOffset = 4 + 2 + 32 + 1
+)
+
+var realityHkdfInfo = []byte("REALITY")
+
+// GenerateRealityKeyPair 生成 一对 x25519 密钥, 以 base64 RawURLEncoding 编码,
+// 私钥 用于 服务端 的 reality_private_key, 公钥 用于 客户端 的 reality_public_key
+func GenerateRealityKeyPair() (privateKey, publicKey string, err error) {
+	priv := make([]byte, realityKeyLen)
+	if _, err = rand.Read(priv); err != nil {
+		return
+	}
+	//clamp, 见 rfc7748
+	priv[0] &= 248
+	priv[31] &= 127
+	priv[31] |= 64
+
+	var pub []byte
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	return base64.RawURLEncoding.EncodeToString(priv), base64.RawURLEncoding.EncodeToString(pub), nil
+}
+
+func decodeRealityKey(str string) ([]byte, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(str, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) != realityKeyLen {
+		return nil, utils.ErrInErr{ErrDesc: "reality key length wrong", Data: len(bs)}
+	}
+	return bs, nil
+}
+
+// 不足8字节的 short id 在右侧 补0
+func parseRealityShortId(str string) (sid [realityShortIdLen]byte, err error) {
+	if len(str) > realityShortIdLen*2 {
+		err = utils.ErrInErr{ErrDesc: "reality short id too long", Data: str}
+		return
+	}
+	if len(str)%2 == 1 {
+		str += "0"
+	}
+	_, err = hex.Decode(sid[:], []byte(str))
+	return
+}
+
+func getStrFromExtra(extra map[string]any, key string) string {
+	if len(extra) > 0 {
+		if str, ok := extra[key].(string); ok {
+			return str
+		}
+	}
+	return ""
+}
+
+func getStrsFromExtra(extra map[string]any, key string) (result []string) {
+	if len(extra) == 0 {
+		return
+	}
+	switch v := extra[key].(type) {
+	case string:
+		result = []string{v}
+	case []string:
+		result = v
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				result = append(result, s)
+			}
+		}
+	}
+	return
+}
+
+type realityServer struct {
+	privateKey  []byte
+	shortIds    map[[realityShortIdLen]byte]bool
+	dest        string
+	serverNames map[string]bool
+	maxTimeDiff time.Duration
+
+	certKey *ecdsa.PrivateKey
+}
+
+func newRealityServer(conf Conf) (*realityServer, error) {
+	rs := &realityServer{
+		shortIds:    make(map[[realityShortIdLen]byte]bool),
+		serverNames: make(map[string]bool),
+	}
+	var err error
+	rs.privateKey, err = decodeRealityKey(getStrFromExtra(conf.Extra, "reality_private_key"))
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "reality_private_key invalid", ErrDetail: err}
+	}
+
+	sids := getStrsFromExtra(conf.Extra, "reality_short_ids")
+	if len(sids) == 0 {
+		sids = []string{""}
+	}
+	for _, s := range sids {
+		sid, err := parseRealityShortId(s)
+		if err != nil {
+			return nil, err
+		}
+		rs.shortIds[sid] = true
+	}
+
+	names := getStrsFromExtra(conf.Extra, "reality_server_names")
+	if len(names) == 0 && conf.Host != "" {
+		names = []string{conf.Host}
+	}
+	if len(names) == 0 {
+		return nil, errors.New("reality server needs host or reality_server_names")
+	}
+	for _, n := range names {
+		rs.serverNames[strings.ToLower(n)] = true
+	}
+
+	rs.dest = getStrFromExtra(conf.Extra, "reality_dest")
+	if rs.dest == "" {
+		rs.dest = names[0] + ":443"
+	}
+
+	if v, ok := utils.AnyToInt64(conf.Extra["reality_max_time_diff"]); ok && v > 0 {
+		rs.maxTimeDiff = time.Duration(v) * time.Second
+	}
+
+	rs.certKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// ClientHello 中 reality 需要的 部分
+type realityHello struct {
+	raw       []byte //握手消息, 不含 record 头
+	random    []byte
+	sessionId []byte
+	sni       string
+	x25519Key []byte
+}
+
+// 解析 握手消息; 格式 见 rfc8446 4.1.2, 只有 格式错误 时 返回 false
+func parseRealityHello(msg []byte) (h realityHello, ok bool) {
+	if len(msg) < 4 || msg[0] != 1 {
+		return
+	}
+	h.raw = msg
+	p := msg[4:]
+	if len(p) < 2+32+1 {
+		return
+	}
+	h.random = p[2:34]
+	sidLen := int(p[34])
+	p = p[35:]
+	if len(p) < sidLen {
+		return
+	}
+	h.sessionId = p[:sidLen]
+	p = p[sidLen:]
+
+	//cipher suites, compression methods
+	if len(p) < 2 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(p))
+	if len(p) < 2+n+1 {
+		return
+	}
+	p = p[2+n:]
+	n = int(p[0])
+	if len(p) < 1+n+2 {
+		return
+	}
+	p = p[1+n:]
+
+	n = int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) < n {
+		return
+	}
+	p = p[:n]
+
+	for len(p) >= 4 {
+		extType := binary.BigEndian.Uint16(p)
+		extLen := int(binary.BigEndian.Uint16(p[2:]))
+		if len(p) < 4+extLen {
+			return
+		}
+		ext := p[4 : 4+extLen]
+		p = p[4+extLen:]
+
+		switch extType {
+		case 0: //server_name
+			if len(ext) < 5 || ext[2] != 0 {
+				continue
+			}
+			nameLen := int(binary.BigEndian.Uint16(ext[3:]))
+			if len(ext) < 5+nameLen {
+				continue
+			}
+			h.sni = strings.ToLower(string(ext[5 : 5+nameLen]))
+		case 51: //key_share
+			if len(ext) < 2 {
+				continue
+			}
+			ks := ext[2:]
+			for len(ks) >= 4 {
+				group := binary.BigEndian.Uint16(ks)
+				keyLen := int(binary.BigEndian.Uint16(ks[2:]))
+				if len(ks) < 4+keyLen {
+					break
+				}
+				if group == uint16(tls.X25519) && keyLen == realityKeyLen {
+					h.x25519Key = ks[4 : 4+keyLen]
+				}
+				ks = ks[4+keyLen:]
+			}
+		}
+	}
+	ok = true
+	return
+}
+
+func realityAuthKey(shared, random []byte) ([]byte, error) {
+	authKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, random[:20], realityHkdfInfo), authKey); err != nil {
+		return nil, err
+	}
+	return authKey, nil
+}
+
+func realityCertMac(authKey, pubKeyInfo []byte) []byte {
+	h := hmac.New(sha256.New, authKey)
+	h.Write(pubKeyInfo)
+	return h.Sum(nil)
+}
+
+// 认证成功时 返回 authKey
+func (rs *realityServer) auth(h *realityHello) ([]byte, error) {
+	if !rs.serverNames[h.sni] {
+		return nil, utils.ErrInErr{ErrDesc: "reality sni not allowed", Data: h.sni}
+	}
+	if len(h.sessionId) != realitySidLen || h.x25519Key == nil {
+		return nil, errors.New("reality no session id or x25519 key share")
+	}
+
+	shared, err := curve25519.X25519(rs.privateKey, h.x25519Key)
+	if err != nil {
+		return nil, err
+	}
+	authKey, err := realityAuthKey(shared, h.random)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := aes.NewCipher(authKey)
+	aead, _ := cipher.NewGCM(block)
+
+	aad := append([]byte(nil), h.raw...)
+	copy(aad[realitySidOffset:realitySidOffset+realitySidLen], make([]byte, realitySidLen))
+
+	plain, err := aead.Open(nil, h.random[20:], h.sessionId, aad)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "reality decrypt session id failed", ErrDetail: err}
+	}
+
+	var shortId [realityShortIdLen]byte
+	copy(shortId[:], plain[8:16])
+	if !rs.shortIds[shortId] {
+		return nil, utils.ErrInErr{ErrDesc: "reality short id unknown", Data: hex.EncodeToString(shortId[:])}
+	}
+
+	if rs.maxTimeDiff > 0 {
+		diff := time.Since(time.Unix(int64(binary.BigEndian.Uint32(plain[4:8])), 0))
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > rs.maxTimeDiff {
+			return nil, utils.ErrInErr{ErrDesc: "reality time diff too large", Data: diff}
+		}
+	}
+	return authKey, nil
+}
+
+// 为 认证成功的 连接 签发 临时证书
+func (rs *realityServer) makeCert(authKey []byte, serverName string) (tls.Certificate, error) {
+	pubKeyInfo, err := x509.MarshalPKIXPublicKey(&rs.certKey.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		SubjectKeyId: realityCertMac(authKey, pubKeyInfo),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &rs.certKey.PublicKey, rs.certKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: rs.certKey}, nil
+}
+
+// 将 客户端 已发来的 first 以及 之后的数据 转发给 dest
+func (rs *realityServer) forward(clientConn net.Conn, first []byte, reason error) error {
+	if ce := utils.CanLogWarn("reality auth failed, forward to dest"); ce != nil {
+		ce.Write(zap.String("dest", rs.dest), zap.Error(reason))
+	}
+
+	destConn, err := net.DialTimeout("tcp", rs.dest, netLayer.DialTimeout)
+	if err != nil {
+		return utils.ErrInErr{ErrDesc: "Failed reality server dial dest", ErrDetail: err, Data: rs.dest}
+	}
+	if _, err = destConn.Write(first); err != nil {
+		destConn.Close()
+		return utils.ErrInErr{ErrDesc: "Failed reality server write to dest", ErrDetail: err}
+	}
+
+	go func() {
+		io.Copy(destConn, clientConn)
+		destConn.Close()
+	}()
+	go func() {
+		io.Copy(clientConn, destConn)
+		clientConn.Close()
+	}()
+
+	return utils.ErrInErr{ErrDetail: netLayer.ErrDoNotClose, ErrDesc: "not real reality client, forwarded", Data: reason.Error()}
+}
+
+func (rs *realityServer) handshake(clientConn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	var first []byte
+
+	netLayer.SetCommonReadTimeout(clientConn)
+
+	var header [5]byte
+	n, err := io.ReadFull(clientConn, header[:])
+	first = append(first, header[:n]...)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "reality read record header failed", ErrDetail: err}
+	}
+
+	if header[0] != 22 {
+		clientConn.SetReadDeadline(time.Time{})
+		return nil, rs.forward(clientConn, first, errors.New("not tls handshake record"))
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	n, err = io.ReadFull(clientConn, body)
+	first = append(first, body[:n]...)
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "reality read client hello failed", ErrDetail: err}
+	}
+	clientConn.SetReadDeadline(time.Time{})
+
+	var authKey []byte
+	var hello realityHello
+	if len(body) >= 4 && len(body) < 4+int(uint32(body[1])<<16|uint32(body[2])<<8|uint32(body[3])) {
+		err = errors.New("client hello spans multiple records")
+	} else if h, ok := parseRealityHello(body); !ok {
+		err = errors.New("client hello malformed")
+	} else {
+		hello = h
+		authKey, err = rs.auth(&hello)
+	}
+	if err != nil {
+		return nil, rs.forward(clientConn, first, err)
+	}
+
+	cert, err := rs.makeCert(authKey, hello.sni)
+	if err != nil {
+		return nil, err
+	}
+	config := tlsConfig.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	config.GetCertificate = nil
+	config.MinVersion = tls.VersionTLS13
+	config.MaxVersion = tls.VersionTLS13
+	config.SessionTicketsDisabled = true
+
+	rawTlsConn := tls.Server(&netLayer.ReadWrapper{
+		Conn:              clientConn,
+		OptionalReader:    io.MultiReader(bytes.NewReader(first), clientConn),
+		RemainFirstBufLen: len(first),
+	}, config)
+
+	if err = rawTlsConn.Handshake(); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "Failed in reality handshake", ErrDetail: err}
+	}
+
+	return &conn{
+		Conn:    rawTlsConn,
+		ptr:     unsafe.Pointer(rawTlsConn),
+		tlsType: Tls_t, //conn 的 tlsType 表示 ptr 的 实际类型
+	}, nil
+}
+
+type realityClient struct {
+	publicKey []byte
+	shortId   [realityShortIdLen]byte
+}
+
+func newRealityClient(conf Conf) (*realityClient, error) {
+	rc := &realityClient{}
+	var err error
+	rc.publicKey, err = decodeRealityKey(getStrFromExtra(conf.Extra, "reality_public_key"))
+	if err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "reality_public_key invalid", ErrDetail: err}
+	}
+	rc.shortId, err = parseRealityShortId(getStrFromExtra(conf.Extra, "reality_short_id"))
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (rc *realityClient) handshake(underlay net.Conn, baseConfig *utls.Config, fingerprint utls.ClientHelloID, spec utlsSpecFactory) (net.Conn, error) {
+	var authKey []byte
+
+	uConfig := baseConfig.Clone()
+
+	uConfig.SessionTicketsDisabled = true
+	uConfig.ClientSessionCache = nil
+	uConfig.InsecureSkipVerify = true
+	uConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("reality server sent no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if authKey == nil || !hmac.Equal(leaf.SubjectKeyId, realityCertMac(authKey, leaf.RawSubjectPublicKeyInfo)) {
+			return errors.New("reality server verification failed, maybe it's the real dest")
+		}
+		return nil
+	}
+
+	utlsConn, err := newUConn(underlay, uConfig, fingerprint, spec)
+	if err != nil {
+		return nil, err
+	}
+	if err = utlsConn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+
+	hello := utlsConn.HandshakeState.Hello
+	ecdhe := utlsConn.HandshakeState.State13.EcdheParams
+	if ecdhe == nil || ecdhe.CurveID() != utls.X25519 || len(hello.SessionId) != realitySidLen || len(hello.Raw) < realitySidOffset+realitySidLen {
+		return nil, errors.New("reality fingerprint must use x25519 key share and 32 bytes session id")
+	}
+
+	shared := ecdhe.SharedKey(rc.publicKey)
+	if shared == nil {
+		return nil, errors.New("reality ecdh failed")
+	}
+	authKey, err = realityAuthKey(shared, hello.Random)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint32(plain[4:], uint32(time.Now().Unix()))
+	copy(plain[8:], rc.shortId[:])
+
+	copy(hello.Raw[realitySidOffset:realitySidOffset+realitySidLen], make([]byte, realitySidLen))
+
+	block, _ := aes.NewCipher(authKey)
+	aead, _ := cipher.NewGCM(block)
+	hello.SessionId = aead.Seal(hello.SessionId[:0], hello.Random[20:], plain, hello.Raw)
+	copy(hello.Raw[realitySidOffset:], hello.SessionId)
+
+	if err = utlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return &conn{
+		Conn:    utlsConn,
+		ptr:     unsafe.Pointer(utlsConn.Conn),
+		tlsType: UTls_t,
+	}, nil
+}
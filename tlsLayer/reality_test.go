@@ -0,0 +1,164 @@
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/netLayer"
+)
+
+// 一个 简单的 tls echo 服务器, 作为 reality 借用的 dest
+func listenRealityDest(t *testing.T) (net.Listener, *tls.Certificate) {
+	certs, err := GetCertArrayFromFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln, &certs[0]
+}
+
+func TestReality(t *testing.T) {
+	priv, pub, err := GenerateRealityKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, destCert := listenRealityDest(t)
+	defer dest.Close()
+
+	server, err := NewServer(Conf{
+		Host:     "www.example.com",
+		Tls_type: StrToType("reality"),
+		Extra: map[string]any{
+			"reality_private_key":   priv,
+			"reality_short_ids":     []any{"abcd", "0123456789abcdef"},
+			"reality_dest":          dest.Addr().String(),
+			"reality_max_time_diff": int64(60),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	serverErrs := make(chan error, 8)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				tc, err := server.Handshake(c)
+				serverErrs <- err
+				if err != nil {
+					if !errors.Is(err, netLayer.ErrDoNotClose) {
+						c.Close()
+					}
+					return
+				}
+				defer tc.Close()
+				io.Copy(tc, tc)
+			}()
+		}
+	}()
+
+	dial := func(shortId string, pubKey string) (net.Conn, error) {
+		client := NewClient(Conf{
+			Host:     "www.example.com",
+			Tls_type: Reality_t,
+			AlpnList: []string{"h2", "http/1.1"},
+			Extra: map[string]any{
+				"reality_public_key": pubKey,
+				"reality_short_id":   shortId,
+			},
+		})
+		underlay, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.Handshake(underlay)
+		if err != nil {
+			underlay.Close()
+		}
+		return c, err
+	}
+
+	c, err := dial("abcd", pub)
+	if err != nil {
+		t.Fatal("reality handshake failed", err)
+	}
+	if err = <-serverErrs; err != nil {
+		t.Fatal("server handshake failed", err)
+	}
+	if c.(Conn).GetAlpn() == "" {
+		t.Fatal("alpn wrong", c.(Conn).GetAlpn())
+	}
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo failed", err, string(buf))
+	}
+	c.Close()
+
+	//short id 或 公钥 不对 时 被转发到 dest, 客户端 验证 dest 的证书 失败
+	_, otherPub, _ := GenerateRealityKeyPair()
+	for _, bad := range [][2]string{{"beef", pub}, {"abcd", otherPub}} {
+		if _, err = dial(bad[0], bad[1]); err == nil {
+			t.Fatal("should fail", bad)
+		}
+		if err = <-serverErrs; !errors.Is(err, netLayer.ErrDoNotClose) {
+			t.Fatal("server should forward to dest", err)
+		}
+	}
+
+	//普通的 tls 探测 看到的 是 dest 的证书, 且 能与 dest 正常通信
+	probe, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal("probe failed", err)
+	}
+	defer probe.Close()
+	<-serverErrs
+	if string(probe.ConnectionState().PeerCertificates[0].Raw) != string(destCert.Certificate[0]) {
+		t.Fatal("probe should see dest certificate")
+	}
+	probe.Write([]byte("probe"))
+	if _, err = io.ReadFull(probe, buf); err != nil || string(buf) != "probe" {
+		t.Fatal("probe echo failed", err, string(buf))
+	}
+}
+
+func TestParseRealityShortId(t *testing.T) {
+	sid, err := parseRealityShortId("abc")
+	if err != nil || sid != [8]byte{0xab, 0xc0} {
+		t.Fatal("parse wrong", sid, err)
+	}
+	for _, bad := range []string{"0123456789abcdef00", "xyz"} {
+		if _, err = parseRealityShortId(bad); err == nil {
+			t.Fatal("should fail", bad)
+		}
+	}
+}
@@ -17,6 +17,8 @@ type Server struct {
 	//用于shadowTls，使用shadowTls时 我们不使用 tlsConfig
 	serverName string
 	shadowpass string
+
+	reality *realityServer
 }
 
 // 如 certFile, keyFile 有一项没给出，则会自动生成随机证书
@@ -48,15 +50,29 @@ func NewServer(conf Conf) (*Server, error) {
 		if conf.Tls_type == ShadowTls2_t {
 			s.shadowpass = getShadowTlsPasswordFromExtra(conf.Extra)
 		}
+	} else if conf.Tls_type == Reality_t {
+		rs, err := newRealityServer(conf)
+		if err != nil {
+			return nil, err
+		}
+		s.reality = rs
+
+		//reality 的证书 是 每个连接 临时签发的, 不需要 cert 和 key
+		conf.CertConf = nil
+		s.tlsConfig = GetTlsConfig(false, conf)
 	} else {
 		s.tlsConfig = GetTlsConfig(true, conf)
 
+		if err := setupECHServer(s.tlsConfig, conf); err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "Failed in setting up ech", ErrDetail: err}
+		}
 	}
 
 	return s, nil
 }
 
-// tls时返回 tlsLayer.Conn, shadowTls1时返回原 clientConn, shadowTls2时返回 FakeAppDataConn
+// tls和reality时返回 tlsLayer.Conn, shadowTls1时返回原 clientConn, shadowTls2时返回 FakeAppDataConn.
+// reality 认证失败时 会将连接 转发给 dest, 并返回 包含 netLayer.ErrDoNotClose 的错误
 func (s *Server) Handshake(clientConn net.Conn) (result net.Conn, err error) {
 
 	switch s.tlstype {
@@ -65,6 +81,8 @@ func (s *Server) Handshake(clientConn net.Conn) (result net.Conn, err error) {
 		return clientConn, shadowTls1(s.serverName, clientConn)
 	case ShadowTls2_t:
 		return shadowTls2(s.serverName, clientConn, s.shadowpass)
+	case Reality_t:
+		return s.reality.handshake(clientConn, s.tlsConfig)
 
 	}
 
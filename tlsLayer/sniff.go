@@ -12,6 +12,9 @@ import (
 	"github.com/e1732a364fed/v2ray_simple/utils"
 )
 
+// 从 QUIC 的 Initial 包 中 嗅探 sni, 不会修改 传入的数据; 在 advLayer/quic 包 被引用时 才会被设置.
+var SniffQUIC func(b []byte) (sni string)
+
 var PDD bool //print tls detect detail
 var OnlyTest bool
 
@@ -1,5 +1,5 @@
 /*
-Package tlsLayer provides facilities for tls, including uTls,shadowTls, sniffing and random certificate.
+Package tlsLayer provides facilities for tls, including uTls,shadowTls, reality, sniffing and random certificate.
 
 Sniffing can be a part of Tls Lazy Encrypt tech.
 */
@@ -21,6 +21,7 @@ const (
 	UTls_t
 	ShadowTls_t
 	ShadowTls2_t
+	Reality_t
 )
 
 func StrToType(str string) int {
@@ -36,6 +37,8 @@ func StrToType(str string) int {
 		return ShadowTls_t
 	case "shadow2", "shadowtls2", "shadowtlsv2", "shadowtls_v2", "shadowtls v2":
 		return ShadowTls2_t
+	case "reality":
+		return Reality_t
 	}
 }
 
@@ -51,6 +54,8 @@ func TypeToStr(t int) string {
 		return "shadowtls_v1"
 	case ShadowTls2_t:
 		return "shadowtls_v2"
+	case Reality_t:
+		return "reality"
 	}
 }
 
@@ -67,7 +72,7 @@ type Conf struct {
 	RejectUnknownSni bool //only server
 	CipherSuites     []uint16
 
-	Extra map[string]any //用于shadowTls
+	Extra map[string]any //用于shadowTls 和 reality
 }
 
 func (tConf Conf) IsShadowTls() bool {
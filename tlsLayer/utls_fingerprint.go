@@ -0,0 +1,318 @@
+package tlsLayer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+	utls "github.com/refraction-networking/utls"
+	"go.uber.org/zap"
+)
+
+/*
+自定义 utls 指纹, 用 extra.utls_fingerprint_file 给出 文件路径, 优先于 utls_fingerprint.
+
+文件内容 可以是:
+
+ 1. 抓包得到的 ClientHello 的 原始字节 (可以带 tls record 头, 也可以只有 握手消息), 比如 用 wireshark 导出的 分组字节;
+ 2. 上述字节 的 hex 字符串, 可以包含 空白 和 冒号;
+ 3. json 格式的 ClientHelloSpec, 见 utlsSpecJSON.
+
+前两种 会完整复制 其 扩展顺序, 加密套件, GREASE 和 padding, 不认识的扩展 也会 原样发送.
+key_share 中 utls 无法生成的 组 (如 后量子的 混合组) 会被 去掉, 以免 握手失败.
+
+ClientHelloSpec 中的 扩展 在握手时 会被修改, 不能复用, 所以 每次握手 都重新生成.
+*/
+
+// 每次调用 返回 一个 新的 ClientHelloSpec
+type utlsSpecFactory func() (*utls.ClientHelloSpec, error)
+
+// json 格式 的 ClientHelloSpec. 数值 都可以 写成 "GREASE", 表示 随机的 GREASE 值.
+//
+//	{
+//		"tls_vers_min": 771, "tls_vers_max": 772,
+//		"cipher_suites": ["GREASE", 4865, 4866, 4867, 49195],
+//		"compression_methods": [0],
+//		"extensions": [
+//			{"name": "GREASE"},
+//			{"name": "server_name"},
+//			{"name": "supported_groups", "values": ["GREASE", 29, 23, 24]},
+//			{"name": "alpn", "protocols": ["h2", "http/1.1"]},
+//			{"name": "key_share", "values": ["GREASE", 29]},
+//			{"name": "supported_versions", "values": ["GREASE", 772, 771]},
+//			{"name": "generic", "id": 17513, "data": "0003026832"},
+//			{"name": "padding"}
+//		]
+//	}
+//
+// 支持的 name 见 utlsExtJSON.toExtension
+type utlsSpecJSON struct {
+	TLSVersMin         uint16        `json:"tls_vers_min"`
+	TLSVersMax         uint16        `json:"tls_vers_max"`
+	CipherSuites       []jsonUint16  `json:"cipher_suites"`
+	CompressionMethods []uint8       `json:"compression_methods"`
+	Extensions         []utlsExtJSON `json:"extensions"`
+}
+
+type utlsExtJSON struct {
+	Name      string       `json:"name"`
+	Values    []jsonUint16 `json:"values"`
+	Protocols []string     `json:"protocols"`
+
+	//用于 generic
+	ID   uint16 `json:"id"`
+	Data string `json:"data"`
+}
+
+// 可以是 数字 或者 "GREASE"
+type jsonUint16 uint16
+
+func (v *jsonUint16) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		if strings.EqualFold(s, "grease") {
+			*v = utls.GREASE_PLACEHOLDER
+			return nil
+		}
+		return utils.ErrInErr{ErrDesc: "utls spec value not a number or GREASE", Data: s}
+	}
+	var n uint16
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*v = jsonUint16(n)
+	return nil
+}
+
+func uint16sOf(vs []jsonUint16) []uint16 {
+	r := make([]uint16, len(vs))
+	for i, v := range vs {
+		r[i] = uint16(v)
+	}
+	return r
+}
+
+func (e *utlsExtJSON) toExtension() (utls.TLSExtension, error) {
+	vs := uint16sOf(e.Values)
+
+	switch strings.ToLower(e.Name) {
+	case "grease":
+		return &utls.UtlsGREASEExtension{}, nil
+	case "server_name", "sni":
+		return &utls.SNIExtension{}, nil
+	case "extended_master_secret":
+		return &utls.UtlsExtendedMasterSecretExtension{}, nil
+	case "renegotiation_info":
+		return &utls.RenegotiationInfoExtension{Renegotiation: utls.RenegotiateOnceAsClient}, nil
+	case "supported_groups":
+		curves := make([]utls.CurveID, len(vs))
+		for i, v := range vs {
+			curves[i] = utls.CurveID(v)
+		}
+		return &utls.SupportedCurvesExtension{Curves: curves}, nil
+	case "ec_point_formats":
+		return &utls.SupportedPointsExtension{SupportedPoints: uint8sOf(vs, []uint8{0})}, nil
+	case "session_ticket":
+		return &utls.SessionTicketExtension{}, nil
+	case "alpn":
+		return &utls.ALPNExtension{AlpnProtocols: e.Protocols}, nil
+	case "application_settings":
+		return &utls.ApplicationSettingsExtension{SupportedProtocols: e.Protocols}, nil
+	case "status_request":
+		return &utls.StatusRequestExtension{}, nil
+	case "signature_algorithms":
+		algs := make([]utls.SignatureScheme, len(vs))
+		for i, v := range vs {
+			algs[i] = utls.SignatureScheme(v)
+		}
+		return &utls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: algs}, nil
+	case "signed_certificate_timestamp":
+		return &utls.SCTExtension{}, nil
+	case "key_share":
+		shares := make([]utls.KeyShare, len(vs))
+		for i, v := range vs {
+			shares[i].Group = utls.CurveID(v)
+			if v == utls.GREASE_PLACEHOLDER {
+				shares[i].Data = []byte{0}
+			}
+		}
+		return &utls.KeyShareExtension{KeyShares: shares}, nil
+	case "psk_key_exchange_modes":
+		return &utls.PSKKeyExchangeModesExtension{Modes: uint8sOf(vs, []uint8{utls.PskModeDHE})}, nil
+	case "supported_versions":
+		return &utls.SupportedVersionsExtension{Versions: vs}, nil
+	case "compress_certificate":
+		algs := make([]utls.CertCompressionAlgo, len(vs))
+		for i, v := range vs {
+			algs[i] = utls.CertCompressionAlgo(v)
+		}
+		return &utls.UtlsCompressCertExtension{Algorithms: algs}, nil
+	case "record_size_limit":
+		if len(vs) != 1 {
+			return nil, errors.New("record_size_limit needs one value")
+		}
+		return &utls.FakeRecordSizeLimitExtension{Limit: vs[0]}, nil
+	case "padding":
+		return &utls.UtlsPaddingExtension{GetPaddingLen: utls.BoringPaddingStyle}, nil
+	case "generic":
+		data, err := hex.DecodeString(e.Data)
+		if err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "utls spec generic extension data not hex", ErrDetail: err}
+		}
+		return &utls.GenericExtension{Id: e.ID, Data: data}, nil
+	}
+	return nil, utils.ErrInErr{ErrDesc: "utls spec extension name unknown", Data: e.Name}
+}
+
+func uint8sOf(vs []uint16, defaultValue []uint8) []uint8 {
+	if len(vs) == 0 {
+		return defaultValue
+	}
+	r := make([]uint8, len(vs))
+	for i, v := range vs {
+		r[i] = uint8(v)
+	}
+	return r
+}
+
+func (sj *utlsSpecJSON) toSpec() (*utls.ClientHelloSpec, error) {
+	spec := &utls.ClientHelloSpec{
+		TLSVersMin:         sj.TLSVersMin,
+		TLSVersMax:         sj.TLSVersMax,
+		CipherSuites:       uint16sOf(sj.CipherSuites),
+		CompressionMethods: sj.CompressionMethods,
+	}
+	if len(spec.CipherSuites) == 0 {
+		return nil, errors.New("utls spec has no cipher suites")
+	}
+	if len(spec.CompressionMethods) == 0 {
+		spec.CompressionMethods = []uint8{0}
+	}
+	for i := range sj.Extensions {
+		ext, err := sj.Extensions[i].toExtension()
+		if err != nil {
+			return nil, err
+		}
+		spec.Extensions = append(spec.Extensions, ext)
+	}
+	return spec, nil
+}
+
+// utls 可以 生成 key_share 的 组
+func utlsCanGenerateKeyShare(group utls.CurveID) bool {
+	switch group {
+	case utls.X25519, utls.CurveP256, utls.CurveP384, utls.CurveP521, utls.GREASE_PLACEHOLDER:
+		return true
+	}
+	return false
+}
+
+func fingerprintClientHello(record []byte) (*utls.ClientHelloSpec, error) {
+	spec, err := (&utls.Fingerprinter{AllowBluntMimicry: true}).FingerprintClientHello(record)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range spec.Extensions {
+		ks, ok := ext.(*utls.KeyShareExtension)
+		if !ok {
+			continue
+		}
+		var shares []utls.KeyShare
+		for _, s := range ks.KeyShares {
+			if utlsCanGenerateKeyShare(s.Group) {
+				shares = append(shares, s)
+			}
+		}
+		ks.KeyShares = shares
+	}
+	return spec, nil
+}
+
+// 解析 ClientHello 字节 或者 json, 见 本文件 开头的说明
+func parseUtlsSpec(content []byte) (utlsSpecFactory, error) {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 {
+		return nil, errors.New("utls spec empty")
+	}
+
+	if trimmed[0] == '{' {
+		var sj utlsSpecJSON
+		if err := json.Unmarshal(trimmed, &sj); err != nil {
+			return nil, utils.ErrInErr{ErrDesc: "utls spec json invalid", ErrDetail: err}
+		}
+		if _, err := sj.toSpec(); err != nil {
+			return nil, err
+		}
+		return sj.toSpec, nil
+	}
+
+	raw := content
+	hexStr := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', ':':
+			return -1
+		}
+		return r
+	}, string(trimmed))
+	if bs, err := hex.DecodeString(hexStr); err == nil {
+		raw = bs
+	}
+
+	//只有 握手消息 时, 加上 record 头
+	if len(raw) > 0 && raw[0] == 1 {
+		record := []byte{22, 3, 1, byte(len(raw) >> 8), byte(len(raw))}
+		raw = append(record, raw...)
+	}
+	if _, err := fingerprintClientHello(raw); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "utls spec not a valid ClientHello", ErrDetail: err}
+	}
+	return func() (*utls.ClientHelloSpec, error) {
+		return fingerprintClientHello(raw)
+	}, nil
+}
+
+func getUtlsSpecFromExtra(extra map[string]any) utlsSpecFactory {
+	fn := getStrFromExtra(extra, "utls_fingerprint_file")
+	if fn == "" {
+		return nil
+	}
+	content, err := os.ReadFile(utils.GetFilePath(fn))
+	if err == nil {
+		var f utlsSpecFactory
+		f, err = parseUtlsSpec(content)
+		if err == nil {
+			if ce := utils.CanLogInfo("Using custom uTls fingerprint"); ce != nil {
+				ce.Write(zap.String("file", fn))
+			}
+			return f
+		}
+	}
+	if ce := utils.CanLogErr("Failed in loading utls_fingerprint_file, use utls_fingerprint instead"); ce != nil {
+		ce.Write(zap.String("file", fn), zap.Error(err))
+	}
+	return nil
+}
+
+// 使用 自定义指纹 或者 预设指纹 创建 UConn
+func newUConn(underlay net.Conn, config *utls.Config, fp utls.ClientHelloID, specF utlsSpecFactory) (*utls.UConn, error) {
+	if specF == nil {
+		if (fp == utls.ClientHelloID{}) {
+			fp = utls.HelloChrome_Auto
+		}
+		return utls.UClient(underlay, config, fp), nil
+	}
+	spec, err := specF()
+	if err != nil {
+		return nil, err
+	}
+	uc := utls.UClient(underlay, config, utls.HelloCustom)
+	if err = uc.ApplyPreset(spec); err != nil {
+		return nil, utils.ErrInErr{ErrDesc: "Failed in applying custom utls fingerprint", ErrDetail: err}
+	}
+	return uc, nil
+}
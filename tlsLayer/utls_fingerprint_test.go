@@ -0,0 +1,152 @@
+package tlsLayer
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// 运行 hello, 返回 其发出的 第一个 tls record
+func captureClientHello(t *testing.T, hello func(net.Conn)) []byte {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go hello(c1)
+
+	c2.SetReadDeadline(time.Now().Add(time.Second * 3))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c2, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(c2, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+// 扩展类型 的 顺序, GREASE 值 统一为 GREASE_PLACEHOLDER
+func helloExtOrder(t *testing.T, record []byte) (order []uint16) {
+	s := cryptobyte.String(record[5+4+2+32:])
+	var sid, suites, compressions, exts cryptobyte.String
+	if !s.ReadUint8LengthPrefixed(&sid) || !s.ReadUint16LengthPrefixed(&suites) ||
+		!s.ReadUint8LengthPrefixed(&compressions) || !s.ReadUint16LengthPrefixed(&exts) {
+		t.Fatal("client hello malformed")
+	}
+	for !exts.Empty() {
+		var id uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&id) || !exts.ReadUint16LengthPrefixed(&data) {
+			t.Fatal("extension malformed")
+		}
+		if id&0x0f0f == 0x0a0a {
+			id = utls.GREASE_PLACEHOLDER
+		}
+		order = append(order, id)
+	}
+	return
+}
+
+func testCustomFingerprint(t *testing.T, content []byte, check func(record []byte)) {
+	fn := filepath.Join(t.TempDir(), "hello")
+	if err := os.WriteFile(fn, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(Conf{
+		Host:     "www.example.com",
+		Insecure: true,
+		Tls_type: UTls_t,
+		Extra:    map[string]any{"utls_fingerprint_file": fn},
+	})
+	if client.utlsSpec == nil {
+		t.Fatal("custom fingerprint not loaded")
+	}
+
+	check(captureClientHello(t, func(c net.Conn) { client.Handshake(c) }))
+
+	//与 标准库的 服务端 握手 并通信
+	certs, _ := GetCertArrayFromFile("", "")
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		sc := tls.Server(c2, &tls.Config{Certificates: certs})
+		defer sc.Close()
+		io.Copy(sc, sc)
+	}()
+	cc, err := client.Handshake(c1)
+	if err != nil {
+		t.Fatal("handshake with custom fingerprint failed", err)
+	}
+	cc.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(cc, buf); err != nil || string(buf) != "hi" {
+		t.Fatal("echo failed", err)
+	}
+}
+
+func TestUtlsFingerprintFile(t *testing.T) {
+	original := captureClientHello(t, func(c net.Conn) {
+		utls.UClient(c, &utls.Config{ServerName: "captured.com"}, utls.HelloChrome_102).Handshake()
+	})
+	wantOrder := helloExtOrder(t, original)
+
+	for name, content := range map[string][]byte{
+		"raw":            original,
+		"handshake only": original[5:],
+		"hex":            []byte(hex.EncodeToString(original) + "\n"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			testCustomFingerprint(t, content, func(record []byte) {
+				got := helloExtOrder(t, record)
+				if len(got) != len(wantOrder) {
+					t.Fatal("extension count differs", got, wantOrder)
+				}
+				for i := range got {
+					if got[i] != wantOrder[i] {
+						t.Fatal("extension order differs", got, wantOrder)
+					}
+				}
+			})
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		spec := `{
+			"cipher_suites": ["GREASE", 4865, 4866, 4867, 49195, 49199],
+			"extensions": [
+				{"name": "GREASE"},
+				{"name": "server_name"},
+				{"name": "supported_groups", "values": ["GREASE", 29, 23]},
+				{"name": "signature_algorithms", "values": [1027, 2052, 1025]},
+				{"name": "key_share", "values": ["GREASE", 29]},
+				{"name": "psk_key_exchange_modes"},
+				{"name": "supported_versions", "values": ["GREASE", 772, 771]},
+				{"name": "generic", "id": 17513, "data": "0003026832"},
+				{"name": "GREASE"},
+				{"name": "padding"}
+			]
+		}`
+		testCustomFingerprint(t, []byte(spec), func(record []byte) {
+			order := helloExtOrder(t, record)
+			if order[0] != utls.GREASE_PLACEHOLDER || order[1] != 0 || order[7] != 17513 || order[8] != utls.GREASE_PLACEHOLDER {
+				t.Fatal("json spec order wrong", order)
+			}
+		})
+	})
+
+	for _, bad := range []string{"", "{\"extensions\":[{\"name\":\"nope\"}]}", "16030100"} {
+		if _, err := parseUtlsSpec([]byte(bad)); err == nil {
+			t.Fatal("should fail", bad)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/time/rate"
+)
+
+// 全局的 用户限速表, 以 User.IdentityStr() 作为key. 同一用户的所有连接 共享同一组 令牌桶.
+var UserRateLimits = NewRateLimitMap()
+
+// 限速配置, 单位为 每秒字节数, 格式如 "1MB", "512KiB"; 不给出或为空 则表示不限速.
+//
+// Up 为 从客户端 发往 目标 的方向, Down 为 从目标 发往 客户端的方向.
+type RateLimitConf struct {
+	Up   string `toml:"up"`
+	Down string `toml:"down"`
+}
+
+// 令牌桶限速器, 以字节为单位. 实现 netLayer.RateLimiter
+type RateLimiter struct {
+	l *rate.Limiter
+}
+
+// bytesPerSecond 必须大于0.
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	//桶容量取一秒的流量, 但至少能容纳一个 MaxPacketLen 大小的包, 以免大包被切得太碎
+	burst := bytesPerSecond
+	if burst < MaxPacketLen {
+		burst = MaxPacketLen
+	}
+	return &RateLimiter{
+		l: rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst)),
+	}
+}
+
+// 阻塞, 直到 可以传输 n 字节.
+func (rl *RateLimiter) Wait(n int) {
+	b := rl.l.Burst()
+	for n > 0 {
+		thisN := n
+		if thisN > b {
+			thisN = b
+		}
+		rl.l.WaitN(context.Background(), thisN)
+		n -= thisN
+	}
+}
+
+// 依次在 每一个非nil 的 RateLimiter 上等待, 即 同时受多个限速的约束. 实现 netLayer.RateLimiter
+type MultiRateLimiter []*RateLimiter
+
+func (m MultiRateLimiter) Wait(n int) {
+	for _, rl := range m {
+		if rl != nil {
+			rl.Wait(n)
+		}
+	}
+}
+
+// 上下行 两个方向的限速器, 均可为nil.
+type RateLimitPair struct {
+	Up, Down *RateLimiter
+}
+
+// 若 conf 为nil 或者 没有任何限速, 返回 nil, nil
+func NewRateLimitPair(conf *RateLimitConf) (*RateLimitPair, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	var rp RateLimitPair
+	if conf.Up != "" {
+		n, err := humanize.ParseBytes(conf.Up)
+		if err != nil {
+			return nil, ErrInErr{ErrDesc: "parse up rate limit failed", ErrDetail: err, Data: conf.Up}
+		}
+		if n > 0 {
+			rp.Up = NewRateLimiter(n)
+		}
+	}
+	if conf.Down != "" {
+		n, err := humanize.ParseBytes(conf.Down)
+		if err != nil {
+			return nil, ErrInErr{ErrDesc: "parse down rate limit failed", ErrDetail: err, Data: conf.Down}
+		}
+		if n > 0 {
+			rp.Down = NewRateLimiter(n)
+		}
+	}
+	if rp.Up == nil && rp.Down == nil {
+		return nil, nil
+	}
+	return &rp, nil
+}
+
+// concurrent safe.
+type RateLimitMap struct {
+	sync.RWMutex
+	m map[string]*RateLimitPair
+}
+
+func NewRateLimitMap() *RateLimitMap {
+	return &RateLimitMap{
+		m: make(map[string]*RateLimitPair),
+	}
+}
+
+// 若不存在, 返回nil
+func (rlm *RateLimitMap) Get(id string) *RateLimitPair {
+	rlm.RLock()
+	rp := rlm.m[id]
+	rlm.RUnlock()
+	return rp
+}
+
+// 若 rp 为nil, 则删除 id 的限速
+func (rlm *RateLimitMap) Set(id string, rp *RateLimitPair) {
+	rlm.Lock()
+	if rp == nil {
+		delete(rlm.m, id)
+	} else {
+		rlm.m[id] = rp
+	}
+	rlm.Unlock()
+}
+
+// 按 UserConf 中给出的 rate_limit 设置限速. 没给出限速的 UserConf 会被跳过.
+func (rlm *RateLimitMap) LoadUserConfs(ucs []UserConf) error {
+	for _, uc := range ucs {
+		if uc.RateLimit == nil {
+			continue
+		}
+		rp, err := NewRateLimitPair(uc.RateLimit)
+		if err != nil {
+			return err
+		}
+		rlm.Set(uc.IdentityStr(), rp)
+	}
+	return nil
+}
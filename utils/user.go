@@ -3,6 +3,7 @@ package utils
 import (
 	"bytes"
 	"net/url"
+	"sort"
 	"sync"
 )
 
@@ -44,7 +45,7 @@ type UserContainer interface {
 // 可以控制 User 登入和登出 的接口
 type UserBus interface {
 	AddUser(User) error
-	DelUser(User)
+	DelUser(User) error
 }
 
 type UserAssigner interface {
@@ -54,6 +55,11 @@ type UserAssigner interface {
 type UserConf struct {
 	User string `toml:"user"`
 	Pass string `toml:"pass"`
+
+	DailyQuota   string `toml:"daily_quota"`   //可选, 每日流量配额(上传+下载), 如 "10GB"; 用量达到后, 该用户新的握手会被拒绝
+	MonthlyQuota string `toml:"monthly_quota"` //可选, 每月流量配额, 格式同上
+
+	RateLimit *RateLimitConf `toml:"rate_limit"` //可选, 该用户的限速, 其所有连接共享; 如 rate_limit = { up = "1MB", down = "5MB" }
 }
 
 func InitV2rayUsers(uc []UserConf) (us []User) {
@@ -247,18 +253,18 @@ func (mu *MultiUserMap) AddUser_nolock(u User) {
 	}
 }
 
+// 若 IDMap 中 同一id 已被 另一个 认证信息不同的 User 替换, 则只删除 u 的 认证信息; 这样 先添加新用户 再删除旧用户 即可 更换同一id的密码.
 func (mu *MultiUserMap) DelUser(u User) error {
 	mu.Mutex.Lock()
 
+	idKey, authKey := string(u.IdentityBytes()), string(u.AuthBytes())
 	if mu.StoreKeyByStr {
-		delete(mu.IDMap, u.AuthStr())
-		delete(mu.AuthMap, u.IdentityStr())
-
-	} else {
-		delete(mu.IDMap, string(u.AuthBytes()))
-		delete(mu.AuthMap, string(u.IdentityBytes()))
-
+		idKey, authKey = u.IdentityStr(), u.AuthStr()
+	}
+	if existing := mu.IDMap[idKey]; existing != nil && existing.AuthStr() == u.AuthStr() {
+		delete(mu.IDMap, idKey)
 	}
+	delete(mu.AuthMap, authKey)
 
 	mu.Mutex.Unlock()
 
@@ -274,6 +280,21 @@ func (mu *MultiUserMap) LoadUsers(us []User) {
 	}
 }
 
+// 返回所有用户, 按 IdentityStr 排序
+func (mu *MultiUserMap) AllUsers() []User {
+	mu.Mutex.RLock()
+	us := make([]User, 0, len(mu.IDMap))
+	for _, u := range mu.IDMap {
+		us = append(us, u)
+	}
+	mu.Mutex.RUnlock()
+
+	sort.Slice(us, func(i, j int) bool {
+		return us[i].IdentityStr() < us[j].IdentityStr()
+	})
+	return us
+}
+
 // 通过ID查找
 func (mu *MultiUserMap) HasUserByStr(str string) bool {
 	mu.Mutex.RLock()
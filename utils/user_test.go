@@ -0,0 +1,41 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestMultiUserMap(t *testing.T) {
+	mu := utils.NewMultiUserMap()
+	mu.StoreKeyByStr = true
+
+	a := utils.NewUserPass(utils.UserConf{User: "a", Pass: "1"})
+	b := utils.NewUserPass(utils.UserConf{User: "b", Pass: "2"})
+	mu.AddUser(b)
+	mu.AddUser(a)
+
+	if us := mu.AllUsers(); len(us) != 2 || us[0].IdentityStr() != "a" {
+		t.Fatal("AllUsers wrong", us)
+	}
+
+	mu.DelUser(b)
+	if mu.HasUserByStr("b") || mu.AuthUserByStr(b.AuthStr()) != nil {
+		t.Fatal("b not deleted")
+	}
+
+	//同一id 换密码: 先加新的 再删旧的
+	a2 := utils.NewUserPass(utils.UserConf{User: "a", Pass: "new"})
+	mu.AddUser(a2)
+	mu.DelUser(a)
+
+	if mu.HasUserByBytes([]byte("a")) != a2 {
+		t.Fatal("new user should remain")
+	}
+	if mu.AuthUserByStr(a.AuthStr()) != nil {
+		t.Fatal("old password should not work")
+	}
+	if mu.AuthUserByStr(a2.AuthStr()) != a2 {
+		t.Fatal("new password should work")
+	}
+}
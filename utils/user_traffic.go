@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// 用户的流量用量 达到配额后, 各 inServer 拒绝其新握手时 所使用的 ErrDetail
+var ErrQuotaExceeded = errors.New("user traffic quota exceeded")
+
+// 全局的 用户流量统计表. 以 User.IdentityStr() 作为key, 在所有 inServer 之间共享。
+var UserTraffic = NewUserTrafficMap()
+
+// 用户的流量配额, 单位为字节, 上传与下载合并计算。0 表示不限制。
+type UserQuota struct {
+	Daily   uint64 `json:"daily,omitempty"`
+	Monthly uint64 `json:"monthly,omitempty"`
+}
+
+func (q UserQuota) IsZero() bool {
+	return q.Daily == 0 && q.Monthly == 0
+}
+
+// 从 UserConf 中 读取配额, 格式如 "10GB", "500MiB". 若没给出, 返回零值.
+func (uc UserConf) GetQuota() (q UserQuota, err error) {
+	if uc.DailyQuota != "" {
+		q.Daily, err = humanize.ParseBytes(uc.DailyQuota)
+		if err != nil {
+			err = ErrInErr{ErrDesc: "parse daily_quota failed", ErrDetail: err, Data: uc.DailyQuota}
+			return
+		}
+	}
+	if uc.MonthlyQuota != "" {
+		q.Monthly, err = humanize.ParseBytes(uc.MonthlyQuota)
+		if err != nil {
+			err = ErrInErr{ErrDesc: "parse monthly_quota failed", ErrDetail: err, Data: uc.MonthlyQuota}
+			return
+		}
+	}
+	return
+}
+
+// 返回该 UserConf 所对应的 User 的 IdentityStr. 若 User 项是 uuid, 则会被转换为 标准的uuid字符串形式.
+func (uc UserConf) IdentityStr() string {
+	if uuid, err := StrToUUID(uc.User); err == nil {
+		return UUIDToStr(uuid[:])
+	}
+	return uc.User
+}
+
+// 单个用户的流量统计. 计数 均为 原子更新, 转发时 不会 加锁; quota 由 mutex 保护,
+// 跨日/跨月 时 周期计数 的清零 也在 mutex 中 进行.
+//
+// 实现 netLayer.TrafficCounter 和 netLayer.RealtimeTrafficCounter.
+type UserTrafficStat struct {
+	Download              uint64 //自统计开始以来的 总下载字节数
+	Upload                uint64 //自统计开始以来的 总上传字节数
+	TotalConnectionCount  uint64
+	dailyBytes            uint64 //当日 上传+下载 的字节数
+	monthlyBytes          uint64 //当月 上传+下载 的字节数
+	ActiveConnectionCount int32
+	day                   int32 //dailyBytes 所属的日期, 如 20221018
+	month                 int32 //monthlyBytes 所属的月份, 如 202210
+
+	mutex sync.Mutex
+
+	quota UserQuota
+}
+
+func dayAndMonthOf(t time.Time) (day, month int32) {
+	y, m, d := t.Date()
+	month = int32(y*100 + int(m))
+	day = month*100 + int32(d)
+	return
+}
+
+// 若 当前日期/月份 与 记录的不同, 则清零对应的周期计数. 调用前须持有mutex
+func (us *UserTrafficStat) rollover_nolock(now time.Time) {
+	day, month := dayAndMonthOf(now)
+	if atomic.LoadInt32(&us.day) != day {
+		atomic.StoreUint64(&us.dailyBytes, 0)
+		atomic.StoreInt32(&us.day, day)
+	}
+	if atomic.LoadInt32(&us.month) != month {
+		atomic.StoreUint64(&us.monthlyBytes, 0)
+		atomic.StoreInt32(&us.month, month)
+	}
+}
+
+// 每次写入后 都会调用, 只在 跨日/跨月 时 加锁
+func (us *UserTrafficStat) addPeriodBytes(n uint64) {
+	now := time.Now()
+	day, month := dayAndMonthOf(now)
+	if atomic.LoadInt32(&us.day) != day || atomic.LoadInt32(&us.month) != month {
+		us.mutex.Lock()
+		us.rollover_nolock(now)
+		us.mutex.Unlock()
+	}
+	AtomicAddUint64(&us.dailyBytes, n)
+	AtomicAddUint64(&us.monthlyBytes, n)
+}
+
+func (us *UserTrafficStat) AddDownload(n uint64) {
+	AtomicAddUint64(&us.Download, n)
+	us.addPeriodBytes(n)
+}
+
+func (us *UserTrafficStat) AddUpload(n uint64) {
+	AtomicAddUint64(&us.Upload, n)
+	us.addPeriodBytes(n)
+}
+
+// 在一个新连接开始转发时调用. 返回的函数须在连接结束时调用.
+func (us *UserTrafficStat) StartConnection() (end func()) {
+	atomic.AddInt32(&us.ActiveConnectionCount, 1)
+	AtomicAddUint64(&us.TotalConnectionCount, 1)
+	return func() {
+		atomic.AddInt32(&us.ActiveConnectionCount, -1)
+	}
+}
+
+func (us *UserTrafficStat) SetQuota(q UserQuota) {
+	us.mutex.Lock()
+	us.quota = q
+	us.mutex.Unlock()
+}
+
+// 有配额时 返回 true, 此时 流量 需要在 转发过程中 及时计入. 实现 netLayer.RealtimeTrafficCounter
+func (us *UserTrafficStat) NeedRealtime() bool {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+	return !us.quota.IsZero()
+}
+
+// 返回 当日 与 当月 已使用的字节数
+func (us *UserTrafficStat) PeriodBytes() (daily, monthly uint64) {
+	us.mutex.Lock()
+	us.rollover_nolock(time.Now())
+	us.mutex.Unlock()
+	return atomic.LoadUint64(&us.dailyBytes), atomic.LoadUint64(&us.monthlyBytes)
+}
+
+// 当日或当月的用量 达到配额时 返回true.
+//
+// 有配额的用户 的流量 是在转发过程中 每次写入后 计入的, 长连接 与 mux 连接 的流量 也会 及时计入, 见 NeedRealtime;
+// 不过 已经建立的连接 不会因为超额而被中断, 只有新的握手会被拒绝。
+func (us *UserTrafficStat) ExceedQuota() bool {
+	us.mutex.Lock()
+	defer us.mutex.Unlock()
+
+	if us.quota.IsZero() {
+		return false
+	}
+	us.rollover_nolock(time.Now())
+
+	if q := us.quota.Daily; q > 0 && atomic.LoadUint64(&us.dailyBytes) >= q {
+		return true
+	}
+	if q := us.quota.Monthly; q > 0 && atomic.LoadUint64(&us.monthlyBytes) >= q {
+		return true
+	}
+	return false
+}
+
+// 用于 导出/持久化 的 UserTrafficStat 快照
+type UserTrafficRecord struct {
+	ID                    string    `json:"id"`
+	Download              uint64    `json:"download"`
+	Upload                uint64    `json:"upload"`
+	ActiveConnectionCount int32     `json:"active_connections"`
+	TotalConnectionCount  uint64    `json:"total_connections"`
+	DailyBytes            uint64    `json:"daily_bytes"`
+	MonthlyBytes          uint64    `json:"monthly_bytes"`
+	Day                   int       `json:"day"`
+	Month                 int       `json:"month"`
+	Quota                 UserQuota `json:"quota"`
+}
+
+func (us *UserTrafficStat) Record(id string) (r UserTrafficRecord) {
+	r.ID = id
+	r.Download = atomic.LoadUint64(&us.Download)
+	r.Upload = atomic.LoadUint64(&us.Upload)
+	r.ActiveConnectionCount = atomic.LoadInt32(&us.ActiveConnectionCount)
+	r.TotalConnectionCount = atomic.LoadUint64(&us.TotalConnectionCount)
+
+	us.mutex.Lock()
+	us.rollover_nolock(time.Now())
+	r.DailyBytes = atomic.LoadUint64(&us.dailyBytes)
+	r.MonthlyBytes = atomic.LoadUint64(&us.monthlyBytes)
+	r.Day = int(atomic.LoadInt32(&us.day))
+	r.Month = int(atomic.LoadInt32(&us.month))
+	r.Quota = us.quota
+	us.mutex.Unlock()
+	return
+}
+
+// 从持久化的记录中恢复. 配额不会被恢复, 因为配额总是以配置文件为准.
+func (us *UserTrafficStat) restore(r UserTrafficRecord) {
+	atomic.StoreUint64(&us.Download, r.Download)
+	atomic.StoreUint64(&us.Upload, r.Upload)
+	atomic.StoreUint64(&us.TotalConnectionCount, r.TotalConnectionCount)
+
+	us.mutex.Lock()
+	atomic.StoreUint64(&us.dailyBytes, r.DailyBytes)
+	atomic.StoreUint64(&us.monthlyBytes, r.MonthlyBytes)
+	atomic.StoreInt32(&us.day, int32(r.Day))
+	atomic.StoreInt32(&us.month, int32(r.Month))
+	us.rollover_nolock(time.Now())
+	us.mutex.Unlock()
+}
+
+// concurrent safe.
+type UserTrafficMap struct {
+	sync.RWMutex
+	m map[string]*UserTrafficStat
+}
+
+func NewUserTrafficMap() *UserTrafficMap {
+	return &UserTrafficMap{
+		m: make(map[string]*UserTrafficStat),
+	}
+}
+
+// 若不存在, 返回nil
+func (utm *UserTrafficMap) Get(id string) *UserTrafficStat {
+	utm.RLock()
+	us := utm.m[id]
+	utm.RUnlock()
+	return us
+}
+
+func (utm *UserTrafficMap) GetOrCreate(id string) *UserTrafficStat {
+	if us := utm.Get(id); us != nil {
+		return us
+	}
+	utm.Lock()
+	us := utm.m[id]
+	if us == nil {
+		us = new(UserTrafficStat)
+		utm.m[id] = us
+	}
+	utm.Unlock()
+	return us
+}
+
+func (utm *UserTrafficMap) Delete(id string) {
+	utm.Lock()
+	delete(utm.m, id)
+	utm.Unlock()
+}
+
+func (utm *UserTrafficMap) SetQuota(id string, q UserQuota) {
+	utm.GetOrCreate(id).SetQuota(q)
+}
+
+// 按 UserConf 中给出的 daily_quota 和 monthly_quota 设置配额. 没给出配额的 UserConf 会 清除 该用户 之前的配额,
+// 这样 重新加载 配置后, 配置中 被删掉的 配额 不会 继续生效.
+func (utm *UserTrafficMap) LoadQuotas(ucs []UserConf) error {
+	for _, uc := range ucs {
+		q, err := uc.GetQuota()
+		if err != nil {
+			return err
+		}
+		id := uc.IdentityStr()
+		if q.IsZero() {
+			if us := utm.Get(id); us != nil {
+				us.SetQuota(q)
+			}
+			continue
+		}
+		utm.SetQuota(id, q)
+	}
+	return nil
+}
+
+// 若用户不存在, 或者没有超额, 返回false
+func (utm *UserTrafficMap) ExceedQuota(id string) bool {
+	us := utm.Get(id)
+	if us == nil {
+		return false
+	}
+	return us.ExceedQuota()
+}
+
+// 返回所有用户的统计快照, 按id排序
+func (utm *UserTrafficMap) Records() []UserTrafficRecord {
+	utm.RLock()
+	rs := make([]UserTrafficRecord, 0, len(utm.m))
+	for id, us := range utm.m {
+		rs = append(rs, us.Record(id))
+	}
+	utm.RUnlock()
+
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].ID < rs[j].ID
+	})
+	return rs
+}
+
+// 将所有用户的统计数据 以json格式 写入文件
+func (utm *UserTrafficMap) SaveFile(fn string) error {
+	bs, err := json.MarshalIndent(utm.Records(), "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	if err = os.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// 从 SaveFile 所写入的文件 恢复统计数据. 若文件不存在, 不会返回错误.
+func (utm *UserTrafficMap) LoadFile(fn string) error {
+	bs, err := os.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var rs []UserTrafficRecord
+	if err = json.Unmarshal(bs, &rs); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		utm.GetOrCreate(r.ID).restore(r)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package utils_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/e1732a364fed/v2ray_simple/utils"
+)
+
+func TestUserTrafficQuota(t *testing.T) {
+	utm := utils.NewUserTrafficMap()
+
+	uc := utils.UserConf{User: "A684455C-B14F-11EA-BF0D-42010AAA0003", DailyQuota: "1KB"}
+	if err := utm.LoadQuotas([]utils.UserConf{uc}); err != nil {
+		t.Fatal(err)
+	}
+	id := uc.IdentityStr()
+	if id != "a684455c-b14f-11ea-bf0d-42010aaa0003" {
+		t.Fatal("uuid not normalized", id)
+	}
+
+	us := utm.Get(id)
+	if us == nil {
+		t.Fatal("quota not set")
+	}
+	us.AddDownload(600)
+	if utm.ExceedQuota(id) {
+		t.Fatal("should not exceed")
+	}
+	us.AddUpload(400)
+	if !utm.ExceedQuota(id) {
+		t.Fatal("should exceed")
+	}
+
+	if utm.ExceedQuota("nobody") {
+		t.Fatal("unknown user should not exceed")
+	}
+
+	fn := filepath.Join(t.TempDir(), "ut.json")
+	if err := utm.SaveFile(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	utm2 := utils.NewUserTrafficMap()
+	if err := utm2.LoadFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	r := utm2.Get(id).Record(id)
+	if r.Download != 600 || r.Upload != 400 || r.DailyBytes != 1000 {
+		t.Fatal("restore failed", r)
+	}
+	if !r.Quota.IsZero() {
+		t.Fatal("quota should not be restored from file", r.Quota)
+	}
+}
+
+// 重新加载 配置 时, 被删掉的 配额 不再生效
+func TestUserTrafficQuotaRemoved(t *testing.T) {
+	utm := utils.NewUserTrafficMap()
+
+	uc := utils.UserConf{User: "user", DailyQuota: "1KB"}
+	if err := utm.LoadQuotas([]utils.UserConf{uc}); err != nil {
+		t.Fatal(err)
+	}
+	utm.Get("user").AddDownload(2000)
+	if !utm.ExceedQuota("user") {
+		t.Fatal("should exceed")
+	}
+
+	uc.DailyQuota = ""
+	if err := utm.LoadQuotas([]utils.UserConf{uc}); err != nil {
+		t.Fatal(err)
+	}
+	if utm.ExceedQuota("user") || utm.Get("user").NeedRealtime() {
+		t.Fatal("removed quota should be cleared")
+	}
+
+	if utm.LoadQuotas([]utils.UserConf{{User: "other"}}); utm.Get("other") != nil {
+		t.Fatal("user without quota should not be created")
+	}
+}